@@ -0,0 +1,90 @@
+// Package backfill finds the source URLs of books without url identifiers in
+// their EPUB files, so that the books can be checked for updates.
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/epub"
+	"github.com/mook/fanficupdates/model"
+)
+
+// Proposal is a url identifier found for a book.
+type Proposal struct {
+	Book  model.CalibreBook
+	URL   string
+	Found string // Where the URL was found, such as epub.FromSource
+}
+
+// Finder finds and applies url identifiers.
+type Finder struct {
+	Library calibre.Library
+}
+
+// Find returns proposed url identifiers for the books that have none, in the
+// order of the books.  Books without an EPUB, or whose EPUB has no source URL,
+// are skipped.
+func (f *Finder) Find(ctx context.Context, books []model.CalibreBook) []Proposal {
+	var result []Proposal
+	for _, book := range books {
+		if ctx.Err() != nil {
+			break
+		}
+		if _, ok := book.Identifiers["url"]; ok {
+			continue
+		}
+		source, found, err := f.source(ctx, book)
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, epub.ErrNoSource) {
+			logrus.Debugf("No source URL for %s: %v", book.Title, err)
+			continue
+		} else if err != nil {
+			logrus.Warnf("Could not read source URL of %s: %v", book.Title, err)
+			continue
+		}
+		result = append(result, Proposal{Book: book, URL: source, Found: found})
+	}
+	return result
+}
+
+// source returns the source URL in the EPUB of the book.
+func (f *Finder) source(ctx context.Context, book model.CalibreBook) (string, string, error) {
+	reader, err := f.Library.OpenFormat(ctx, book, "epub")
+	if err != nil {
+		return "", "", err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", "", fmt.Errorf("could not read EPUB: %w", err)
+	}
+	return epub.SourceURL(bytes.NewReader(data), int64(len(data)))
+}
+
+// Apply sets the url identifier of the book to the proposed URL, keeping its
+// other identifiers.
+func (f *Finder) Apply(ctx context.Context, proposal Proposal) error {
+	identifiers := map[string]string{"url": proposal.URL}
+	for key, value := range proposal.Book.Identifiers {
+		if key != "url" {
+			identifiers[key] = value
+		}
+	}
+	serialized, err := calibre.SerializeIdentifiers(identifiers)
+	if err != nil {
+		return fmt.Errorf("could not set URL of %s to %s: %w", proposal.Book.Title, proposal.URL, err)
+	}
+	meta := calibre.UpdateMeta{Fields: map[string]string{"identifiers": serialized}}
+	if err := f.Library.UpdateMetadata(ctx, proposal.Book.Id, meta); err != nil {
+		return fmt.Errorf("could not set URL of %s: %w", proposal.Book.Title, err)
+	}
+	logrus.Infof("Set URL of %s to %s (from %s)", proposal.Book.Title, proposal.URL, proposal.Found)
+	return nil
+}
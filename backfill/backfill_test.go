@@ -0,0 +1,52 @@
+package backfill
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mook/fanficupdates/calibre/memory"
+	"github.com/mook/fanficupdates/epub"
+	"github.com/mook/fanficupdates/epub/epubtest"
+	"github.com/mook/fanficupdates/model"
+)
+
+// makeEpub returns an EPUB whose metadata has the given dc:source.
+func makeEpub(t *testing.T, source string) []byte {
+	return epubtest.Make(t, map[string]string{"content.opf": epubtest.OPF("<dc:source>" + source + "</dc:source>")})
+}
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+	library := memory.NewLibrary(
+		model.CalibreBook{Id: 1, Title: "Missing", Identifiers: map[string]string{"isbn": "123"}},
+		model.CalibreBook{Id: 2, Title: "Has URL", Identifiers: map[string]string{"url": "https://example.com/2"}},
+		model.CalibreBook{Id: 3, Title: "No EPUB"},
+		model.CalibreBook{Id: 4, Title: "No source"},
+		model.CalibreBook{Id: 5, Title: "Broken"},
+	)
+	require.NoError(t, library.SetFile(1, "epub", makeEpub(t, "https://example.com/1")))
+	require.NoError(t, library.SetFile(2, "epub", makeEpub(t, "https://example.com/other")))
+	require.NoError(t, library.SetFile(4, "epub", makeEpub(t, "")))
+	require.NoError(t, library.SetFile(5, "epub", []byte("not an epub")))
+	books, err := library.GetBooks(ctx)
+	require.NoError(t, err)
+
+	subject := &Finder{Library: library}
+	proposals := subject.Find(ctx, books)
+	require.Len(t, proposals, 1)
+	assert.Equal(t, 1, proposals[0].Book.Id)
+	assert.Equal(t, "https://example.com/1", proposals[0].URL)
+	assert.Equal(t, epub.FromSource, proposals[0].Found)
+
+	require.NoError(t, subject.Apply(ctx, proposals[0]))
+	books, err = library.GetBooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"url": "https://example.com/1", "isbn": "123"}, books[0].Identifiers)
+	assert.Empty(t, subject.Find(ctx, books[:1]), "books with URLs should not be proposed again")
+
+	err = subject.Apply(ctx, Proposal{Book: books[2], URL: "https://example.com/a,b"})
+	assert.ErrorContains(t, err, "comma")
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -13,7 +14,10 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/mook/fanficupdates/model"
@@ -25,6 +29,22 @@ type Calibre struct {
 	Library  string // Path to the Calibre library
 	Settings string // Path to the settings directory
 
+	// Server, if set, is the content server to use instead of accessing the
+	// library directly; Library is then ignored.
+	Server *ContentServer
+
+	// Columns holds the custom column definitions for the library; see
+	// LoadCustomColumns().  If unset, custom column types are inferred.
+	Columns map[string]model.CustomColumn
+
+	// WatchInterval is how often Watch() checks for changes; if unset,
+	// DefaultWatchInterval is used.
+	WatchInterval time.Duration
+
+	// skipDatabase is set once the metadata database turns out to be
+	// unreadable, so that calibredb is used from then on.
+	skipDatabase atomic.Bool
+
 	// RunShim is used to mock running actual executables.  This should not be
 	// used normally.
 	RunShim func(cmd *exec.Cmd) ([]byte, error)
@@ -46,7 +66,7 @@ func (c *Calibre) FindPaths(ctx context.Context) error {
 		}
 		c.Settings = filepath.Clean(strings.TrimSpace(output))
 	}
-	if c.Library == "" {
+	if c.Library == "" && c.Server == nil {
 		script := "import calibre.library; print(calibre.library.current_library_path())"
 		output, err := c.Run(ctx, "calibre-debug", "--command", script)
 		if err != nil {
@@ -63,11 +83,14 @@ func (c *Calibre) FindPaths(ctx context.Context) error {
 	return nil
 }
 
-// Run the given command with arguments, capturing stdout.
+// Run the given command with arguments, capturing stdout.  If the command
+// fails, any output it produced is returned along with the error, followed by
+// what it wrote to stderr (which is also passed through).
 func (c *Calibre) Run(ctx context.Context, command string, args ...string) (string, error) {
 	cmd := exec.CommandContext(ctx, command)
 	cmd.Args = append(cmd.Args, args...)
-	cmd.Stderr = os.Stderr
+	var stderr bytes.Buffer
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
 	if c.Settings != "" {
 		cmd.Env = append(os.Environ(), fmt.Sprintf("CALIBRE_CONFIG_DIRECTORY=%s", c.Settings))
 	}
@@ -79,14 +102,21 @@ func (c *Calibre) Run(ctx context.Context, command string, args ...string) (stri
 		buf, err = cmd.Output()
 	}
 	if err != nil {
-		return "", err
+		buf = append(buf, stderr.Bytes()...)
 	}
-	return string(buf), nil
+	return string(buf), err
 }
 
 // Run calibredb with the given arguments, returning stdout.
 func (c *Calibre) runDBCommand(ctx context.Context, args ...string) (string, error) {
-	if c.Library != "" {
+	if c.Server != nil {
+		serverArgs, cleanup, err := c.Server.dbArgs()
+		if err != nil {
+			return "", err
+		}
+		defer cleanup()
+		args = append(serverArgs, args...)
+	} else if c.Library != "" {
 		args = append([]string{fmt.Sprintf("--library-path=%s", c.Library)}, args...)
 	}
 	return c.Run(ctx, "calibredb", args...)
@@ -116,8 +146,50 @@ func findFile(targetPath string, baseDir string) string {
 	return ""
 }
 
+// GetBooks returns all the books in the library.  For local libraries, the
+// metadata database is read directly if possible, as calibredb is much slower;
+// otherwise (or if the database schema is unknown), calibredb is used.
 func (c *Calibre) GetBooks(ctx context.Context) ([]model.CalibreBook, error) {
-	data, err := c.runDBCommand(ctx, "list", "--for-machine", "--fields=all")
+	return c.getBooks(ctx)
+}
+
+// GetBook returns the book with the given ID.  Unless the database is read
+// directly, only that book is listed by calibredb.
+func (c *Calibre) GetBook(ctx context.Context, id int) (model.CalibreBook, error) {
+	books, err := c.getBooks(ctx, fmt.Sprintf("--search=id:%d", id))
+	if err != nil {
+		return model.CalibreBook{}, err
+	}
+	if book := util.Find(books, func(b model.CalibreBook) bool { return b.Id == id }); book != nil {
+		return *book, nil
+	}
+	return model.CalibreBook{}, fmt.Errorf("could not find book #%d: %w", id, os.ErrNotExist)
+}
+
+// getBooks returns the books in the library, as GetBooks does; if calibredb is
+// used, the extra arguments (such as a search) are passed to it.
+func (c *Calibre) getBooks(ctx context.Context, extraArgs ...string) ([]model.CalibreBook, error) {
+	if c.Server == nil && c.Library != "" && !c.skipDatabase.Load() {
+		books, err := c.readDatabase(ctx)
+		if err == nil {
+			return books, nil
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			logrus.Debugf("could not find %s in %s, using calibredb", DatabaseName, c.Library)
+		} else {
+			logrus.Warnf("Could not read %s, using calibredb instead: %v", filepath.Join(c.Library, DatabaseName), err)
+		}
+		if errors.Is(err, ErrUnknownSchema) {
+			c.skipDatabase.Store(true)
+		}
+	}
+	return c.listBooks(ctx, extraArgs...)
+}
+
+// listBooks returns the books in the library using calibredb, passing it the
+// extra arguments.
+func (c *Calibre) listBooks(ctx context.Context, extraArgs ...string) ([]model.CalibreBook, error) {
+	data, err := c.runDBCommand(ctx, append([]string{"list", "--for-machine", "--fields=all"}, extraArgs...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -131,10 +203,22 @@ func (c *Calibre) GetBooks(ctx context.Context) ([]model.CalibreBook, error) {
 	}
 	var result []model.CalibreBook
 	for decoder.More() {
+		var rawBook json.RawMessage
+		if err = decoder.Decode(&rawBook); err != nil {
+			return nil, err
+		}
 		var next decodingBook
-		if err = decoder.Decode(&next); err != nil {
+		if err = json.Unmarshal(rawBook, &next); err != nil {
+			return nil, err
+		}
+		var rawFields map[string]json.RawMessage
+		if err = json.Unmarshal(rawBook, &rawFields); err != nil {
 			return nil, err
 		}
+		next.CalibreBook.CustomColumns, err = c.decodeCustomColumns(rawFields)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", next.CalibreBook.Title, err)
+		}
 
 		// Fix up the authors field:
 		// "authors" can either be an array of string, or a bare string.  This
@@ -161,7 +245,12 @@ func (c *Calibre) GetBooks(ctx context.Context) ([]model.CalibreBook, error) {
 		// Fix up file paths:
 		// The path stored in the database might have a different representation
 		// for the library path (because we expect to run this in a docker
-		// container).
+		// container).  Paths from a content server are on the server, and are
+		// kept as they are; see OpenFormat().
+		if c.Server != nil {
+			result = append(result, *next.CalibreBook)
+			continue
+		}
 		next.CalibreBook.Formats = util.Filter(
 			util.Map(next.CalibreBook.Formats, func(path string) string {
 				return findFile(path, c.Library)
@@ -175,12 +264,48 @@ func (c *Calibre) GetBooks(ctx context.Context) ([]model.CalibreBook, error) {
 }
 
 type UpdateMeta struct {
-	Authors   []string  `calibre:"authors"`
-	Comments  string    `calibre:"comments"`
-	Published time.Time `calibre:"pubdate"`
-	Publisher string    `calibre:"publisher"`
-	Series    string    `calibre:"series"`
-	Timestamp time.Time `calibre:"timestamp"`
+	Authors     []string  `calibre:"authors" separator:"&"`
+	Comments    string    `calibre:"comments"`
+	Published   time.Time `calibre:"pubdate"`
+	Publisher   string    `calibre:"publisher"`
+	Series      string    `calibre:"series"`
+	SeriesIndex *float64  `calibre:"series_index"`
+	Timestamp   time.Time `calibre:"timestamp"`
+
+	// Fields holds additional values to set, keyed by the Calibre field name
+	// (which may be a custom column, such as "#status").  These are applied
+	// after the fields above.
+	Fields map[string]string
+}
+
+// SetCustom sets the value of the custom column with the given lookup name
+// (with or without the leading "#").
+func (m *UpdateMeta) SetCustom(label string, value model.CustomValue) {
+	if m.Fields == nil {
+		m.Fields = make(map[string]string)
+	}
+	m.Fields["#"+strings.TrimPrefix(label, "#")] = value.String()
+}
+
+// serializeSeparatedList serializes a list of strings where items are separated
+// by the given separator character, which is escaped by doubling it; this is
+// used for authors, where Calibre allows commas within names.
+func serializeSeparatedList(value reflect.Value, separator string) (string, error) {
+	if value.Kind() != reflect.Array && value.Kind() != reflect.Slice {
+		return "", fmt.Errorf("don't know how to serialize %s as a list", value.Kind())
+	}
+	var result []string
+	for i := 0; i < value.Len(); i++ {
+		next, err := serializeMetadata(value.Index(i))
+		if err != nil {
+			return "", err
+		}
+		next = strings.TrimSpace(strings.ReplaceAll(next, separator, separator+separator))
+		if next != "" {
+			result = append(result, next)
+		}
+	}
+	return strings.Join(result, " "+separator+" "), nil
 }
 
 func serializeMetadata(value reflect.Value) (string, error) {
@@ -201,7 +326,12 @@ func serializeMetadata(value reflect.Value) (string, error) {
 		return fmt.Sprintf("%d", value.Int()), nil
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		return fmt.Sprintf("%d", value.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(value.Float(), 'f', -1, 64), nil
 	case reflect.Interface, reflect.Pointer:
+		if value.IsNil() {
+			return "", nil
+		}
 		return serializeMetadata(value.Elem())
 	case reflect.Struct:
 		time3339 := reflect.TypeOf(model.Time3339{})
@@ -225,29 +355,100 @@ func serializeMetadata(value reflect.Value) (string, error) {
 	return "", fmt.Errorf("don't know how to serialize %s", value.Kind())
 }
 
-func (c *Calibre) UpdateBook(ctx context.Context, id int, meta UpdateMeta, bookPath string) error {
-	args := []string{"set_metadata"}
-	val := reflect.ValueOf(meta)
+// SerializeIdentifiers returns the identifiers in the form accepted by the
+// calibredb set_metadata identifiers field, sorted by key.  Identifiers are
+// separated by commas, which can't be escaped; if a value contains one, an
+// error naming the identifier is returned instead.
+func SerializeIdentifiers(identifiers map[string]string) (string, error) {
+	keys := make([]string, 0, len(identifiers))
+	for key := range identifiers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if strings.Contains(identifiers[key], ",") {
+			return "", fmt.Errorf("identifier %s:%s contains a comma", key, identifiers[key])
+		}
+		parts = append(parts, key+":"+identifiers[key])
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// MetaField is a single metadata field to set, as given to calibredb.
+type MetaField struct {
+	Name  string // The Calibre field name, such as "authors" or "#status"
+	Value string
+}
+
+// Serialize returns the fields to set, in the order they are given to
+// calibredb.  Fields with empty values are left unchanged, and are omitted.
+func (m UpdateMeta) Serialize() ([]MetaField, error) {
+	var result []MetaField
+	val := reflect.ValueOf(m)
 	for i := 0; i < val.Type().NumField(); i++ {
 		tag := val.Type().Field(i).Tag.Get("calibre")
-		value, err := serializeMetadata(val.Field(i))
+		if tag == "" {
+			continue
+		}
+		var value string
+		var err error
+		if separator := val.Type().Field(i).Tag.Get("separator"); separator != "" {
+			value, err = serializeSeparatedList(val.Field(i), separator)
+		} else {
+			value, err = serializeMetadata(val.Field(i))
+		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if value != "" {
-			args = append(args, fmt.Sprintf("--field=%s:%s", tag, value))
+			result = append(result, MetaField{Name: tag, Value: value})
 		}
 	}
-	args = append(args, fmt.Sprintf("%d", id))
-	_, err := c.runDBCommand(ctx, args...)
+	fieldNames := make([]string, 0, len(m.Fields))
+	for name := range m.Fields {
+		fieldNames = append(fieldNames, name)
+	}
+	sort.Strings(fieldNames)
+	for _, name := range fieldNames {
+		if value := m.Fields[name]; value != "" {
+			result = append(result, MetaField{Name: name, Value: value})
+		}
+	}
+	return result, nil
+}
+
+// UpdateMetadata changes the metadata of the book with the given ID.
+func (c *Calibre) UpdateMetadata(ctx context.Context, id int, meta UpdateMeta) error {
+	fields, err := meta.Serialize()
 	if err != nil {
+		return err
+	}
+	args := []string{"set_metadata"}
+	for _, field := range fields {
+		args = append(args, fmt.Sprintf("--field=%s:%s", field.Name, field.Value))
+	}
+	args = append(args, fmt.Sprintf("%d", id))
+	if _, err = c.runDBCommand(ctx, args...); err != nil {
 		return fmt.Errorf("could not update database for book #%d: %w", id, err)
 	}
+	return nil
+}
 
-	_, err = c.runDBCommand(ctx, "add_format", fmt.Sprintf("%d", id), bookPath)
-	if err != nil {
+// AddFormat adds the file at the given path to the book with the given ID,
+// replacing any existing file of the same format.
+func (c *Calibre) AddFormat(ctx context.Context, id int, bookPath string) error {
+	if _, err := c.runDBCommand(ctx, "add_format", fmt.Sprintf("%d", id), bookPath); err != nil {
 		return fmt.Errorf("could not update file for book #%d: %w", id, err)
 	}
-
 	return nil
 }
+
+// UpdateBook changes the metadata of the book with the given ID, and then
+// replaces its file with the one at the given path.
+func (c *Calibre) UpdateBook(ctx context.Context, id int, meta UpdateMeta, bookPath string) error {
+	if err := c.UpdateMetadata(ctx, id, meta); err != nil {
+		return err
+	}
+	return c.AddFormat(ctx, id, bookPath)
+}
@@ -215,6 +215,20 @@ func TestGetBooksSingleAuthor(t *testing.T) {
 	require.Equal(t, []string{"Single Author"}, book.Authors)
 }
 
+func TestSerializeIdentifiers(t *testing.T) {
+	serialized, err := SerializeIdentifiers(map[string]string{
+		"url":  "https://example.com/1",
+		"isbn": "123",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "isbn:123,url:https://example.com/1", serialized)
+	serialized, err = SerializeIdentifiers(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", serialized)
+	_, err = SerializeIdentifiers(map[string]string{"isbn": "123", "bad": "a,b"})
+	assert.ErrorContains(t, err, "bad:a,b")
+}
+
 func TestUpdateBook(t *testing.T) {
 	type testCase struct {
 		name string
@@ -238,7 +252,7 @@ func TestUpdateBook(t *testing.T) {
 				{
 					"calibredb",
 					"set_metadata",
-					"--field=authors:foo,bar",
+					"--field=authors:foo & bar",
 					"--field=comments:some comment",
 					"--field=pubdate:2006-01-02T15:04:05Z",
 					"--field=publisher:hydraulic press",
@@ -254,6 +268,45 @@ func TestUpdateBook(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "authors",
+			UpdateMeta: UpdateMeta{
+				Authors: []string{"Last, First", "Salt & Pepper", " "},
+			},
+			args: [][]string{
+				{
+					"calibredb",
+					"set_metadata",
+					"--field=authors:Last, First & Salt && Pepper",
+					"12345",
+				},
+				{"calibredb", "add_format", "12345", "<bookpath>"},
+			},
+		},
+		{
+			name: "extra fields",
+			UpdateMeta: UpdateMeta{
+				Series:      "112358",
+				SeriesIndex: func() *float64 { v := 2.5; return &v }(),
+				Fields: map[string]string{
+					"#words":  "1234",
+					"#status": "Completed",
+					"#empty":  "",
+				},
+			},
+			args: [][]string{
+				{
+					"calibredb",
+					"set_metadata",
+					"--field=series:112358",
+					"--field=series_index:2.5",
+					"--field=#status:Completed",
+					"--field=#words:1234",
+					"12345",
+				},
+				{"calibredb", "add_format", "12345", "<bookpath>"},
+			},
+		},
 		{
 			name: "empty",
 			args: [][]string{
@@ -0,0 +1,104 @@
+package calibre
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+)
+
+// Changes returns the names of the fields that applying the update would
+// change for the given book, in the order they are applied.  Empty values in
+// the update are not applied, and so are never changes.
+func (m UpdateMeta) Changes(book model.CalibreBook) []string {
+	var result []string
+	add := func(name string, changed bool) {
+		if changed {
+			result = append(result, name)
+		}
+	}
+	changedTime := func(next time.Time, current model.Time3339) bool {
+		return !next.IsZero() && !next.Equal(current.Time)
+	}
+	add("authors", len(m.Authors) > 0 && !sameList(m.Authors, book.Authors, false))
+	add("comments", m.Comments != "" && m.Comments != book.Comments)
+	add("pubdate", changedTime(m.Published, book.PubDate))
+	add("publisher", m.Publisher != "" && m.Publisher != book.Publisher)
+	add("series", m.Series != "" && m.Series != book.Series)
+	add("series_index", m.SeriesIndex != nil && (book.SeriesIndex == nil || *m.SeriesIndex != *book.SeriesIndex))
+	add("timestamp", changedTime(m.Timestamp, book.Timestamp))
+
+	names := make([]string, 0, len(m.Fields))
+	for name := range m.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if value := m.Fields[name]; value != "" {
+			add(name, fieldChanged(book, name, value))
+		}
+	}
+	return result
+}
+
+// fieldChanged returns whether setting the named field of the book to the
+// given value (as passed to calibredb set_metadata) would change it.  Unknown
+// fields are assumed to change.
+func fieldChanged(book model.CalibreBook, name, value string) bool {
+	switch name {
+	case "tags":
+		return !sameList(model.SplitList(value), book.Tags, true)
+	case "languages":
+		return !sameList(model.SplitList(value), book.Languages, true)
+	case "identifiers":
+		for _, part := range model.SplitList(value) {
+			key, id, _ := strings.Cut(part, ":")
+			if book.Identifiers[key] != id {
+				return true
+			}
+		}
+		return false
+	}
+	if !strings.HasPrefix(name, "#") {
+		return true
+	}
+	current, ok := book.Custom(name)
+	if !ok {
+		return true
+	}
+	if current.IsMultiple {
+		return !sameList(model.SplitList(value), current.Values(), true)
+	}
+	switch current.Value.(type) {
+	case int64, float64:
+		next, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return true
+		}
+		existing, _ := strconv.ParseFloat(current.String(), 64)
+		return next != existing
+	}
+	return value != current.String()
+}
+
+// sameList returns whether the two lists have the same items; if unordered is
+// set, the order of the items is ignored.
+func sameList(a, b []string, unordered bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	if unordered {
+		a = append([]string(nil), a...)
+		b = append([]string(nil), b...)
+		sort.Strings(a)
+		sort.Strings(b)
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package calibre
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChanges(t *testing.T) {
+	index := 2.0
+	book := model.CalibreBook{
+		Authors:     []string{"Someone"},
+		Comments:    "Summary",
+		Series:      "Saga",
+		SeriesIndex: &index,
+		Timestamp:   *model.NewTime3339(time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)),
+		Tags:        []string{"one", "two"},
+		Identifiers: map[string]string{"url": "http://example.com/1"},
+		CustomColumns: map[string]model.CustomValue{
+			"words":  {Type: model.CustomInt, Value: int64(1234)},
+			"status": {Type: model.CustomText, Value: "In-Progress"},
+		},
+	}
+	unchanged := UpdateMeta{
+		Authors:     []string{"Someone"},
+		Comments:    "Summary",
+		Series:      "Saga",
+		SeriesIndex: &index,
+		Timestamp:   time.Date(2022, 1, 2, 0, 0, 0, 0, time.FixedZone("", 3600)).Add(time.Hour),
+		Fields: map[string]string{
+			"tags":        "two, one",
+			"identifiers": "url:http://example.com/1",
+			"#words":      "1234",
+			"#status":     "In-Progress",
+		},
+	}
+	assert.Empty(t, unchanged.Changes(book))
+
+	nextIndex := 3.0
+	changed := UpdateMeta{
+		Comments:    "New summary",
+		SeriesIndex: &nextIndex,
+		Timestamp:   time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC),
+		Fields: map[string]string{
+			"tags":    "one, two, three",
+			"#words":  "2000",
+			"#status": "Completed",
+			"#rating": "5",
+		},
+	}
+	assert.Equal(t, []string{"comments", "series_index", "timestamp", "#rating", "#status", "#words", "tags"}, changed.Changes(book))
+}
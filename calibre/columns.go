@@ -0,0 +1,207 @@
+package calibre
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mook/fanficupdates/model"
+)
+
+// columnStringMatcher matches a Python string literal.
+var columnStringMatcher = regexp.MustCompile(`^(?:'((?:[^'\\]|\\.)*)'|"((?:[^"\\]|\\.)*)")$`)
+
+// topLevelEntries returns the top-level entries of a pretty-printed Python
+// dictionary, mapping each key to the source text of its value.
+func topLevelEntries(text string) map[string]string {
+	result := make(map[string]string)
+	depth := 0
+	var quote rune
+	escaped := false
+	var key string
+	var current strings.Builder
+	for _, ch := range text {
+		if depth == 1 && quote == 0 && !escaped {
+			switch ch {
+			case ':':
+				if key == "" {
+					key = strings.TrimSpace(current.String())
+					current.Reset()
+					continue
+				}
+			case ',':
+				if key != "" {
+					result[key] = strings.TrimSpace(current.String())
+				}
+				key = ""
+				current.Reset()
+				continue
+			}
+		}
+		switch {
+		case escaped:
+			escaped = false
+		case ch == '\\':
+			escaped = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '{' || ch == '[' || ch == '(':
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case ch == '}' || ch == ']' || ch == ')':
+			depth--
+			if depth == 0 {
+				if key != "" {
+					result[key] = strings.TrimSpace(current.String())
+				}
+				key = ""
+				current.Reset()
+				continue
+			}
+		}
+		if depth >= 1 {
+			current.WriteRune(ch)
+		}
+	}
+	entries := make(map[string]string, len(result))
+	for key, value := range result {
+		if literal := columnStringMatcher.FindStringSubmatch(key); literal != nil {
+			entries[literal[1]+literal[2]] = value
+		}
+	}
+	return entries
+}
+
+// parseCustomColumns parses the output of `calibredb custom_columns --details`.
+// For each column, the output consists of the lookup name on a line by itself,
+// followed by a pretty-printed Python dictionary describing the column.
+func parseCustomColumns(output string) (map[string]model.CustomColumn, error) {
+	result := make(map[string]model.CustomColumn)
+	var label string
+	var details []string
+	finish := func() error {
+		if label == "" {
+			return nil
+		}
+		if len(details) == 0 {
+			return fmt.Errorf("missing details for custom column %s", label)
+		}
+		column := model.CustomColumn{Label: label, IsMultiple: true}
+		for key, value := range topLevelEntries(strings.Join(details, "\n")) {
+			switch key {
+			case "name":
+				if literal := columnStringMatcher.FindStringSubmatch(value); literal != nil {
+					column.Name = literal[1] + literal[2]
+				}
+			case "datatype":
+				if literal := columnStringMatcher.FindStringSubmatch(value); literal != nil {
+					column.Datatype = model.CustomColumnType(literal[1] + literal[2])
+				}
+			case "is_multiple":
+				column.IsMultiple = !strings.HasPrefix(value, "{}")
+			}
+		}
+		if column.Datatype == "" {
+			return fmt.Errorf("could not determine type of custom column %s", label)
+		}
+		result[label] = column
+		label = ""
+		details = nil
+		return nil
+	}
+	depth := 0
+	for _, line := range strings.Split(strings.ReplaceAll(output, "\r", ""), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if depth > 0 || strings.HasPrefix(line, "{") {
+			details = append(details, line)
+			depth += braceDepth(line)
+			continue
+		}
+		if trimmed == "" {
+			continue
+		}
+		if err := finish(); err != nil {
+			return nil, err
+		}
+		label = trimmed
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// braceDepth returns the change in nesting depth of braces in the given line of
+// Python source, ignoring any braces in string literals.
+func braceDepth(line string) int {
+	depth := 0
+	var quote rune
+	escaped := false
+	for _, ch := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case ch == '\\':
+			escaped = true
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '{':
+			depth++
+		case ch == '}':
+			depth--
+		}
+	}
+	return depth
+}
+
+// LoadCustomColumns discovers the custom columns defined in the library, so
+// that their values can be read with the correct types.
+func (c *Calibre) LoadCustomColumns(ctx context.Context) error {
+	output, err := c.runDBCommand(ctx, "custom_columns", "--details")
+	if err != nil {
+		return fmt.Errorf("could not list custom columns: %w", err)
+	}
+	columns, err := parseCustomColumns(output)
+	if err != nil {
+		return fmt.Errorf("could not read custom columns: %w", err)
+	}
+	c.Columns = columns
+	return nil
+}
+
+// decodeCustomColumns extracts the custom column values (keys starting with
+// "*") from a single book in the calibredb list output.
+func (c *Calibre) decodeCustomColumns(raw map[string]json.RawMessage) (map[string]model.CustomValue, error) {
+	var result map[string]model.CustomValue
+	for key, value := range raw {
+		if !strings.HasPrefix(key, "*") {
+			continue
+		}
+		label := strings.TrimPrefix(key, "*")
+		if result == nil {
+			result = make(map[string]model.CustomValue)
+		}
+		if column, ok := c.Columns[label]; ok {
+			parsed, err := model.ParseCustomValue(column, value)
+			if err != nil {
+				return nil, err
+			}
+			result[label] = parsed
+		} else {
+			result[label] = model.InferCustomValue(value)
+		}
+	}
+	return result, nil
+}
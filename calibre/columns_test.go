@@ -0,0 +1,103 @@
+package calibre
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sampleCustomColumns = `status
+
+{'colnum': 1,
+ 'column': 'value',
+ 'datatype': 'enumeration',
+ 'display': {'description': 'Story {status}',
+             'enum_values': ['In-Progress', 'Completed']},
+ 'is_multiple': {},
+ 'kind': 'field',
+ 'label': 'status',
+ 'name': "Story's Status",
+ 'table': 'custom_column_1'}
+
+
+characters
+
+{'colnum': 2,
+ 'datatype': 'text',
+ 'display': {},
+ 'is_multiple': {'cache_to_list': ',',
+                 'list_to_ui': ', ',
+                 'ui_to_list': ','},
+ 'label': 'characters',
+ 'name': 'Characters',
+ 'table': 'custom_column_2'}
+
+
+words
+
+{'colnum': 3, 'datatype': 'int', 'is_multiple': {}, 'label': 'words', 'name': 'Words'}
+
+
+`
+
+func TestParseCustomColumns(t *testing.T) {
+	columns, err := parseCustomColumns(sampleCustomColumns)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]model.CustomColumn{
+		"status": {
+			Label:    "status",
+			Name:     "Story's Status",
+			Datatype: model.CustomEnumeration,
+		},
+		"characters": {
+			Label:      "characters",
+			Name:       "Characters",
+			Datatype:   model.CustomText,
+			IsMultiple: true,
+		},
+		"words": {
+			Label:    "words",
+			Name:     "Words",
+			Datatype: model.CustomInt,
+		},
+	}, columns)
+
+	_, err = parseCustomColumns("orphan\n")
+	assert.ErrorContains(t, err, "missing details")
+}
+
+func TestGetBooksCustomColumns(t *testing.T) {
+	input := `[{
+		"id": 5,
+		"authors": "Single Author",
+		"*status": "Completed",
+		"*characters": ["Alice", "Bob"],
+		"*words": 1234,
+		"*unknown": 1.5
+	}]`
+	runCount := 0
+	subject := &Calibre{
+		RunShim: func(cmd *exec.Cmd) ([]byte, error) {
+			runCount++
+			if runCount == 1 {
+				assert.Equal(t, []string{"calibredb", "custom_columns", "--details"}, cmd.Args)
+				return []byte(sampleCustomColumns), nil
+			}
+			return []byte(input), nil
+		},
+	}
+	require.NoError(t, subject.LoadCustomColumns(context.Background()))
+	books, err := subject.GetBooks(context.Background())
+	require.NoError(t, err)
+	require.Len(t, books, 1)
+	assert.Equal(t, map[string]model.CustomValue{
+		"status":     {Type: model.CustomEnumeration, Value: "Completed"},
+		"characters": {Type: model.CustomText, IsMultiple: true, Value: []string{"Alice", "Bob"}},
+		"words":      {Type: model.CustomInt, Value: int64(1234)},
+		"unknown":    {Type: model.CustomFloat, Value: 1.5},
+	}, books[0].CustomColumns)
+}
@@ -0,0 +1,352 @@
+package calibre
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+
+	_ "modernc.org/sqlite" // Register the sqlite driver
+)
+
+// DatabaseName is the name of the Calibre metadata database, in the library
+// directory.
+const DatabaseName = "metadata.db"
+
+// The range of database schema versions (PRAGMA user_version) that the
+// database is known to be readable with.
+const (
+	minSchemaVersion = 20
+	maxSchemaVersion = 27
+)
+
+// ErrUnknownSchema is returned when reading a database with a schema version
+// that is not known to be compatible.
+var ErrUnknownSchema = errors.New("unknown database schema version")
+
+// dbTimeFormats are the formats Calibre uses to store times in the database.
+var dbTimeFormats = []string{
+	"2006-01-02 15:04:05.999999-07:00",
+	"2006-01-02T15:04:05.999999-07:00",
+	"2006-01-02 15:04:05-07:00",
+	"2006-01-02 15:04:05",
+}
+
+// parseDBTime converts a time read from the database; depending on the column
+// type, the driver may have already parsed it.  Calibre stores times in UTC.
+func parseDBTime(value any) model.Time3339 {
+	switch v := value.(type) {
+	case time.Time:
+		return model.Time3339{Time: v.UTC()}
+	case []byte:
+		return parseDBTime(string(v))
+	case string:
+		for _, format := range dbTimeFormats {
+			if result, err := time.Parse(format, v); err == nil {
+				return model.Time3339{Time: result.UTC()}
+			}
+		}
+	}
+	return model.Time3339{}
+}
+
+// dbString converts a text value read from the database.
+func dbString(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// dbFloat converts a numeric value read from the database.
+func dbFloat(value any) (float64, error) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return strconv.ParseFloat(dbString(value), 64)
+}
+
+// queryRows runs the query, calling the function with each row.
+func queryRows(ctx context.Context, db *sql.DB, query string, fn func(rows *sql.Rows) error) error {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// readDatabase reads the books directly from the metadata database of the
+// library, which is much faster than listing them with calibredb.  The
+// database is opened read-only; changes must still be made with calibredb.
+func (c *Calibre) readDatabase(ctx context.Context) ([]model.CalibreBook, error) {
+	dbPath := filepath.Join(c.Library, DatabaseName)
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, err
+	}
+	dsn := (&url.URL{Scheme: "file", Path: filepath.ToSlash(dbPath), RawQuery: "mode=ro"}).String()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var version int
+	if err = db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return nil, fmt.Errorf("could not read schema version: %w", err)
+	}
+	if version < minSchemaVersion || version > maxSchemaVersion {
+		return nil, fmt.Errorf("%w %d", ErrUnknownSchema, version)
+	}
+
+	books := make(map[int]*model.CalibreBook)
+	bookDirs := make(map[int]string) // The directory containing the files of each book
+	var ids []int
+	err = queryRows(ctx, db, `
+		SELECT id, title, timestamp, pubdate, series_index, author_sort, path,
+		       uuid, has_cover, last_modified
+		FROM books`,
+		func(rows *sql.Rows) error {
+			var book model.CalibreBook
+			var timestamp, pubdate, lastModified any
+			var seriesIndex float64
+			var title, authorSort, bookPath, uuid sql.NullString
+			var hasCover sql.NullBool
+			err := rows.Scan(&book.Id, &title, &timestamp, &pubdate, &seriesIndex,
+				&authorSort, &bookPath, &uuid, &hasCover, &lastModified)
+			if err != nil {
+				return err
+			}
+			book.Title = title.String
+			book.AuthorSort = authorSort.String
+			book.Uuid = uuid.String
+			book.Timestamp = parseDBTime(timestamp)
+			book.PubDate = parseDBTime(pubdate)
+			book.LastModified = parseDBTime(lastModified)
+			book.SeriesIndex = &seriesIndex
+			dir := filepath.Join(c.Library, filepath.FromSlash(bookPath.String))
+			if hasCover.Bool {
+				book.Cover = filepath.Join(dir, "cover.jpg")
+			}
+			bookDirs[book.Id] = dir
+			books[book.Id] = &book
+			ids = append(ids, book.Id)
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("could not read books: %w", err)
+	}
+
+	// readValues reads (book, value) pairs from the query.
+	readValues := func(name, query string, fn func(book *model.CalibreBook, value string)) error {
+		err := queryRows(ctx, db, query, func(rows *sql.Rows) error {
+			var id int
+			var value any
+			if err := rows.Scan(&id, &value); err != nil {
+				return err
+			}
+			if book, ok := books[id]; ok {
+				fn(book, dbString(value))
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", name, err)
+		}
+		return nil
+	}
+	lists := []struct {
+		name  string
+		query string
+		fn    func(book *model.CalibreBook, value string)
+	}{
+		{"authors", `
+			SELECT l.book, a.name FROM books_authors_link l
+			JOIN authors a ON a.id = l.author ORDER BY l.id`,
+			func(book *model.CalibreBook, value string) { book.Authors = append(book.Authors, value) }},
+		{"tags", `
+			SELECT l.book, t.name FROM books_tags_link l
+			JOIN tags t ON t.id = l.tag ORDER BY t.name`,
+			func(book *model.CalibreBook, value string) { book.Tags = append(book.Tags, value) }},
+		{"series", `
+			SELECT l.book, s.name FROM books_series_link l
+			JOIN series s ON s.id = l.series`,
+			func(book *model.CalibreBook, value string) { book.Series = value }},
+		{"publishers", `
+			SELECT l.book, p.name FROM books_publishers_link l
+			JOIN publishers p ON p.id = l.publisher`,
+			func(book *model.CalibreBook, value string) { book.Publisher = value }},
+		{"languages", `
+			SELECT l.book, g.lang_code FROM books_languages_link l
+			JOIN languages g ON g.id = l.lang_code ORDER BY l.item_order`,
+			func(book *model.CalibreBook, value string) { book.Languages = append(book.Languages, value) }},
+		{"comments", `SELECT book, text FROM comments`,
+			func(book *model.CalibreBook, value string) { book.Comments = value }},
+	}
+	for _, list := range lists {
+		if err = readValues(list.name, list.query, list.fn); err != nil {
+			return nil, err
+		}
+	}
+
+	err = queryRows(ctx, db, `SELECT book, type, val FROM identifiers`, func(rows *sql.Rows) error {
+		var id int
+		var kind, value string
+		if err := rows.Scan(&id, &kind, &value); err != nil {
+			return err
+		}
+		if book, ok := books[id]; ok {
+			if book.Identifiers == nil {
+				book.Identifiers = make(map[string]string)
+			}
+			book.Identifiers[kind] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read identifiers: %w", err)
+	}
+
+	err = queryRows(ctx, db, `SELECT book, format, uncompressed_size, name FROM data ORDER BY id`, func(rows *sql.Rows) error {
+		var id, size int
+		var format, name string
+		if err := rows.Scan(&id, &format, &size, &name); err != nil {
+			return err
+		}
+		if book, ok := books[id]; ok {
+			book.Formats = append(book.Formats, filepath.Join(bookDirs[id], name+"."+strings.ToLower(format)))
+			if size > book.Size {
+				book.Size = size
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read formats: %w", err)
+	}
+
+	if err = c.readCustomColumns(ctx, db, books); err != nil {
+		return nil, err
+	}
+
+	sort.Ints(ids)
+	result := make([]model.CalibreBook, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, *books[id])
+	}
+	return result, nil
+}
+
+// readCustomColumns reads the values of the custom columns from the database
+// into the books.  The column definitions are also read from the database, as
+// they determine where the values are stored.
+func (c *Calibre) readCustomColumns(ctx context.Context, db *sql.DB, books map[int]*model.CalibreBook) error {
+	type dbColumn struct {
+		model.CustomColumn
+		id         int
+		normalized bool
+	}
+	var columns []dbColumn
+	err := queryRows(ctx, db, `
+		SELECT id, label, name, datatype, is_multiple, normalized
+		FROM custom_columns WHERE NOT mark_for_delete`,
+		func(rows *sql.Rows) error {
+			var column dbColumn
+			var datatype string
+			err := rows.Scan(&column.id, &column.Label, &column.Name, &datatype, &column.IsMultiple, &column.normalized)
+			column.Datatype = model.CustomColumnType(datatype)
+			columns = append(columns, column)
+			return err
+		})
+	if err != nil {
+		return fmt.Errorf("could not read custom columns: %w", err)
+	}
+	for _, column := range columns {
+		if column.Datatype == model.CustomComposite {
+			// Composite columns are computed, and not stored.
+			continue
+		}
+		query := fmt.Sprintf(`SELECT book, value FROM custom_column_%d`, column.id)
+		if column.normalized {
+			query = fmt.Sprintf(`
+				SELECT l.book, v.value FROM books_custom_column_%[1]d_link l
+				JOIN custom_column_%[1]d v ON v.id = l.value ORDER BY v.value`,
+				column.id)
+		}
+		err = queryRows(ctx, db, query, func(rows *sql.Rows) error {
+			var id int
+			var raw any
+			if err := rows.Scan(&id, &raw); err != nil {
+				return err
+			}
+			book, ok := books[id]
+			if !ok || raw == nil {
+				return nil
+			}
+			if book.CustomColumns == nil {
+				book.CustomColumns = make(map[string]model.CustomValue)
+			}
+			value := book.CustomColumns[column.Label]
+			value.Type = column.Datatype
+			value.IsMultiple = column.IsMultiple
+			if column.IsMultiple {
+				values, _ := value.Value.([]string)
+				value.Value = append(values, dbString(raw))
+				book.CustomColumns[column.Label] = value
+				return nil
+			}
+			switch column.Datatype {
+			case model.CustomInt:
+				number, err := dbFloat(raw)
+				if err != nil {
+					return err
+				}
+				value.Value = int64(number)
+			case model.CustomFloat, model.CustomRating:
+				number, err := dbFloat(raw)
+				if err != nil {
+					return err
+				}
+				value.Value = number
+			case model.CustomBool:
+				number, err := dbFloat(raw)
+				if err != nil {
+					return err
+				}
+				value.Value = number != 0
+			case model.CustomDatetime:
+				value.Value = parseDBTime(raw)
+			default:
+				value.Value = dbString(raw)
+			}
+			book.CustomColumns[column.Label] = value
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not read custom column #%s: %w", column.Label, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package calibre
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sampleDatabase is a cut-down version of the Calibre database schema, with
+// some books.
+const sampleDatabase = `
+CREATE TABLE books (
+	id INTEGER PRIMARY KEY AUTOINCREMENT, title TEXT NOT NULL DEFAULT 'Unknown',
+	sort TEXT, timestamp TIMESTAMP, pubdate TIMESTAMP, series_index REAL NOT NULL DEFAULT 1.0,
+	author_sort TEXT, path TEXT NOT NULL DEFAULT '', uuid TEXT,
+	has_cover BOOL DEFAULT 0, last_modified TIMESTAMP);
+CREATE TABLE authors (id INTEGER PRIMARY KEY, name TEXT NOT NULL, sort TEXT);
+CREATE TABLE books_authors_link (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, author INTEGER NOT NULL);
+CREATE TABLE tags (id INTEGER PRIMARY KEY, name TEXT NOT NULL);
+CREATE TABLE books_tags_link (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, tag INTEGER NOT NULL);
+CREATE TABLE series (id INTEGER PRIMARY KEY, name TEXT NOT NULL, sort TEXT);
+CREATE TABLE books_series_link (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, series INTEGER NOT NULL);
+CREATE TABLE publishers (id INTEGER PRIMARY KEY, name TEXT NOT NULL, sort TEXT);
+CREATE TABLE books_publishers_link (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, publisher INTEGER NOT NULL);
+CREATE TABLE languages (id INTEGER PRIMARY KEY, lang_code TEXT NOT NULL);
+CREATE TABLE books_languages_link (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, lang_code INTEGER NOT NULL, item_order INTEGER NOT NULL DEFAULT 0);
+CREATE TABLE comments (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, text TEXT NOT NULL);
+CREATE TABLE identifiers (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, type TEXT NOT NULL DEFAULT 'isbn', val TEXT NOT NULL);
+CREATE TABLE data (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, format TEXT NOT NULL, uncompressed_size INTEGER NOT NULL, name TEXT NOT NULL);
+CREATE TABLE custom_columns (
+	id INTEGER PRIMARY KEY AUTOINCREMENT, label TEXT NOT NULL, name TEXT NOT NULL,
+	datatype TEXT NOT NULL, mark_for_delete BOOL DEFAULT 0 NOT NULL,
+	editable BOOL DEFAULT 1 NOT NULL, display TEXT DEFAULT '{}' NOT NULL,
+	is_multiple BOOL DEFAULT 0 NOT NULL, normalized BOOL NOT NULL);
+CREATE TABLE custom_column_1 (id INTEGER PRIMARY KEY, value TEXT NOT NULL);
+CREATE TABLE books_custom_column_1_link (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, value INTEGER NOT NULL);
+CREATE TABLE custom_column_2 (id INTEGER PRIMARY KEY, value TEXT NOT NULL);
+CREATE TABLE books_custom_column_2_link (id INTEGER PRIMARY KEY, book INTEGER NOT NULL, value INTEGER NOT NULL);
+CREATE TABLE custom_column_3 (id INTEGER PRIMARY KEY, book INTEGER, value INT);
+CREATE TABLE custom_column_4 (id INTEGER PRIMARY KEY, book INTEGER, value BOOL);
+CREATE TABLE custom_column_5 (id INTEGER PRIMARY KEY, book INTEGER, value TIMESTAMP);
+
+INSERT INTO books (id, title, timestamp, pubdate, series_index, author_sort, path, uuid, has_cover, last_modified) VALUES
+	(1, 'First Story', '2022-01-02 03:04:05+00:00', '2021-12-31 00:00:00+00:00', 2.0, 'Author, Alice', 'Alice Author/First Story (1)', 'uuid-1', 1, '2022-06-01 12:00:00.123456+00:00'),
+	(2, 'Second Story', '2022-02-03 04:05:06+00:00', '0101-01-01 00:00:00+00:00', 1.0, 'Author, Bob', 'Bob Author/Second Story (2)', 'uuid-2', 0, '2022-06-02 12:00:00+00:00');
+INSERT INTO authors VALUES (1, 'Alice Author', 'Author, Alice'), (2, 'Bob Author', 'Author, Bob');
+INSERT INTO books_authors_link VALUES (1, 1, 2), (2, 1, 1), (3, 2, 2);
+INSERT INTO tags VALUES (1, 'Fluff'), (2, 'Angst');
+INSERT INTO books_tags_link VALUES (1, 1, 1), (2, 1, 2);
+INSERT INTO series VALUES (1, 'Saga', 'Saga');
+INSERT INTO books_series_link VALUES (1, 1, 1);
+INSERT INTO publishers VALUES (1, 'archiveofourown.org', 'archiveofourown.org');
+INSERT INTO books_publishers_link VALUES (1, 1, 1);
+INSERT INTO languages VALUES (1, 'eng'), (2, 'fra');
+INSERT INTO books_languages_link VALUES (1, 1, 2, 1), (2, 1, 1, 0);
+INSERT INTO comments VALUES (1, 1, '<p>A story</p>');
+INSERT INTO identifiers VALUES (1, 1, 'url', 'https://archiveofourown.org/works/1'), (2, 1, 'isbn', '1234');
+INSERT INTO data VALUES (1, 1, 'EPUB', 1000, 'First Story - Alice Author'), (2, 1, 'PDF', 3000, 'First Story - Alice Author');
+INSERT INTO custom_columns (id, label, name, datatype, is_multiple, normalized) VALUES
+	(1, 'status', 'Status', 'enumeration', 0, 1),
+	(2, 'characters', 'Characters', 'text', 1, 1),
+	(3, 'words', 'Words', 'int', 0, 0),
+	(4, 'read', 'Read', 'bool', 0, 0),
+	(5, 'checked', 'Checked', 'datetime', 0, 0),
+	(6, 'summary', 'Summary', 'composite', 0, 0);
+INSERT INTO custom_column_1 VALUES (1, 'Completed');
+INSERT INTO books_custom_column_1_link VALUES (1, 1, 1);
+INSERT INTO custom_column_2 VALUES (1, 'Bob'), (2, 'Alice');
+INSERT INTO books_custom_column_2_link VALUES (1, 1, 1), (2, 1, 2);
+INSERT INTO custom_column_3 VALUES (1, 1, 12345);
+INSERT INTO custom_column_4 VALUES (1, 1, 1), (2, 2, 0);
+INSERT INTO custom_column_5 VALUES (1, 1, '2022-05-06 07:08:09+00:00');
+`
+
+// makeDatabase creates a sample metadata database with the given schema
+// version in a new library directory, returning the library path.
+func makeDatabase(t *testing.T, version int) string {
+	library := t.TempDir()
+	db, err := sql.Open("sqlite", filepath.Join(library, DatabaseName))
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec(sampleDatabase)
+	require.NoError(t, err)
+	_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	require.NoError(t, err)
+	return library
+}
+
+func TestReadDatabase(t *testing.T) {
+	library := makeDatabase(t, 26)
+	subject := &Calibre{
+		Library: library,
+		RunShim: func(cmd *exec.Cmd) ([]byte, error) {
+			t.Errorf("unexpected command %v", cmd.Args)
+			return nil, fmt.Errorf("unexpected command")
+		},
+	}
+	books, err := subject.GetBooks(context.Background())
+	require.NoError(t, err)
+	require.Len(t, books, 2)
+
+	first, second := books[0], books[1]
+	bookDir := filepath.Join(library, "Alice Author", "First Story (1)")
+	seriesIndex := 2.0
+	assert.Equal(t, model.CalibreBook{
+		Id:           1,
+		Uuid:         "uuid-1",
+		Publisher:    "archiveofourown.org",
+		Size:         3000,
+		Identifiers:  map[string]string{"url": "https://archiveofourown.org/works/1", "isbn": "1234"},
+		Formats:      []string{filepath.Join(bookDir, "First Story - Alice Author.epub"), filepath.Join(bookDir, "First Story - Alice Author.pdf")},
+		Title:        "First Story",
+		Authors:      []string{"Bob Author", "Alice Author"},
+		AuthorSort:   "Author, Alice",
+		Tags:         []string{"Angst", "Fluff"},
+		Comments:     "<p>A story</p>",
+		Languages:    []string{"eng", "fra"},
+		Cover:        filepath.Join(bookDir, "cover.jpg"),
+		Series:       "Saga",
+		SeriesIndex:  &seriesIndex,
+		Timestamp:    first.Timestamp,
+		PubDate:      first.PubDate,
+		LastModified: first.LastModified,
+		CustomColumns: map[string]model.CustomValue{
+			"status":     {Type: model.CustomEnumeration, Value: "Completed"},
+			"characters": {Type: model.CustomText, IsMultiple: true, Value: []string{"Alice", "Bob"}},
+			"words":      {Type: model.CustomInt, Value: int64(12345)},
+			"read":       {Type: model.CustomBool, Value: true},
+			"checked":    {Type: model.CustomDatetime, Value: model.Time3339{Time: time.Date(2022, 5, 6, 7, 8, 9, 0, time.UTC)}},
+		},
+	}, first)
+	assert.True(t, first.Timestamp.Equal(time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)), "timestamp %s", first.Timestamp)
+	assert.True(t, first.PubDate.Equal(time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC)), "pubdate %s", first.PubDate)
+	assert.True(t, first.LastModified.Equal(time.Date(2022, 6, 1, 12, 0, 0, 123456000, time.UTC)), "last modified %s", first.LastModified)
+
+	assert.Equal(t, 2, second.Id)
+	assert.Equal(t, []string{"Bob Author"}, second.Authors)
+	assert.Empty(t, second.Cover)
+	assert.Empty(t, second.Formats)
+	assert.Nil(t, second.Url())
+	assert.Equal(t, map[string]model.CustomValue{"read": {Type: model.CustomBool, Value: false}}, second.CustomColumns)
+}
+
+func TestReadDatabaseFallback(t *testing.T) {
+	for name, library := range map[string]string{
+		"unknown schema": makeDatabase(t, 1000),
+		"missing":        t.TempDir(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			runCount := 0
+			subject := &Calibre{
+				Library: library,
+				RunShim: func(cmd *exec.Cmd) ([]byte, error) {
+					runCount++
+					assert.Equal(t, []string{
+						"calibredb", "--library-path=" + library,
+						"list", "--for-machine", "--fields=all",
+					}, cmd.Args)
+					return []byte(`[{"id":5,"authors":"Single Author"}]`), nil
+				},
+			}
+			for i := 0; i < 2; i++ {
+				books, err := subject.GetBooks(context.Background())
+				require.NoError(t, err)
+				require.Len(t, books, 1)
+				assert.Equal(t, 5, books[0].Id)
+			}
+			assert.Equal(t, 2, runCount)
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package calibre
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+)
+
+// Library is a Calibre library that books are listed from and updated in.  It
+// is implemented by *Calibre for real libraries, and by memory.Library for
+// tests and demonstrations without Calibre installed.
+type Library interface {
+	// GetBooks returns all the books in the library.
+	GetBooks(ctx context.Context) ([]model.CalibreBook, error)
+	// GetBook returns the book with the given ID; if there is none, the
+	// error wraps os.ErrNotExist.
+	GetBook(ctx context.Context, id int) (model.CalibreBook, error)
+	// UpdateMetadata changes the metadata of the book with the given ID.
+	UpdateMetadata(ctx context.Context, id int, meta UpdateMeta) error
+	// AddFormat adds the file at the given path to the book with the given
+	// ID, replacing any existing file of the same format (as determined by
+	// the file extension).
+	AddFormat(ctx context.Context, id int, path string) error
+	// AddBook adds the file at the given path as a new book, returning its ID.
+	AddBook(ctx context.Context, path string) (int, error)
+	// RemoveBooks removes the books with the given IDs, including their files.
+	RemoveBooks(ctx context.Context, ids ...int) error
+	// OpenFormat opens the file of the given format (such as "epub") for the
+	// book; if there is none, the error wraps os.ErrNotExist.
+	OpenFormat(ctx context.Context, book model.CalibreBook, format string) (io.ReadCloser, error)
+	// OpenCover opens the cover image for the book; if there is none, the
+	// error wraps os.ErrNotExist.
+	OpenCover(ctx context.Context, book model.CalibreBook) (io.ReadCloser, error)
+	// CustomColumns returns the custom column definitions, keyed by lookup
+	// name without the leading "#", or nil if they are unknown.
+	CustomColumns() map[string]model.CustomColumn
+	// Watch returns a channel that receives a value whenever the library may
+	// have changed; it is closed when the context is cancelled.
+	Watch(ctx context.Context) (<-chan struct{}, error)
+}
+
+var _ Library = &Calibre{}
+
+// DefaultWatchInterval is how often Watch checks for changes if the interval
+// is not set.
+const DefaultWatchInterval = 30 * time.Second
+
+// addedMatcher matches the calibredb add output listing the new book.
+var addedMatcher = regexp.MustCompile(`(?m)^Added book ids: (\d+)`)
+
+// AddBook adds the file at the given path as a new book, returning its ID.
+// Books that appear to be duplicates of existing books are not added.
+func (c *Calibre) AddBook(ctx context.Context, bookPath string) (int, error) {
+	output, err := c.runDBCommand(ctx, "add", bookPath)
+	if err != nil {
+		return 0, fmt.Errorf("could not add %s: %w", bookPath, err)
+	}
+	match := addedMatcher.FindStringSubmatch(output)
+	if match == nil {
+		return 0, fmt.Errorf("could not add %s: it may be a duplicate", bookPath)
+	}
+	return strconv.Atoi(match[1])
+}
+
+// RemoveBooks removes the books with the given IDs.  Calibre versions with a
+// trash keep the books there for a while.
+func (c *Calibre) RemoveBooks(ctx context.Context, ids ...int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, strconv.Itoa(id))
+	}
+	if _, err := c.runDBCommand(ctx, "remove", strings.Join(parts, ",")); err != nil {
+		return fmt.Errorf("could not remove books %s: %w", strings.Join(parts, ", "), err)
+	}
+	return nil
+}
+
+// CustomColumns returns the custom column definitions loaded by
+// LoadCustomColumns().
+func (c *Calibre) CustomColumns() map[string]model.CustomColumn {
+	return c.Columns
+}
+
+// Watch checks the modification time of the metadata database every
+// WatchInterval, sending a value on the returned channel when it changes.
+// Content servers cannot be watched.
+func (c *Calibre) Watch(ctx context.Context) (<-chan struct{}, error) {
+	if c.Server != nil {
+		return nil, errors.New("cannot watch a content server for changes")
+	}
+	dbPath := filepath.Join(c.Library, DatabaseName)
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not watch library: %w", err)
+	}
+	interval := c.WatchInterval
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	result := make(chan struct{}, 1)
+	go func() {
+		defer close(result)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		modified := info.ModTime()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			info, err := os.Stat(dbPath)
+			if err != nil || info.ModTime().Equal(modified) {
+				continue
+			}
+			modified = info.ModTime()
+			select {
+			case result <- struct{}{}:
+			default:
+				// A change is already pending
+			}
+		}
+	}()
+	return result, nil
+}
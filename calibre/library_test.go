@@ -0,0 +1,69 @@
+package calibre
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddBook(t *testing.T) {
+	output := "Added book ids: 42\n"
+	subject := &Calibre{
+		Library: "/library",
+		RunShim: func(cmd *exec.Cmd) ([]byte, error) {
+			assert.Equal(t, []string{"calibredb", "--library-path=/library", "add", "/tmp/book.epub"}, cmd.Args)
+			return []byte(output), nil
+		},
+	}
+	id, err := subject.AddBook(context.Background(), "/tmp/book.epub")
+	require.NoError(t, err)
+	assert.Equal(t, 42, id)
+
+	output = "The following books were not added as they already exist in the database\n"
+	_, err = subject.AddBook(context.Background(), "/tmp/book.epub")
+	assert.ErrorContains(t, err, "duplicate")
+}
+
+func TestRemoveBooks(t *testing.T) {
+	var calls [][]string
+	subject := &Calibre{
+		Library: "/library",
+		RunShim: func(cmd *exec.Cmd) ([]byte, error) {
+			calls = append(calls, cmd.Args)
+			return nil, nil
+		},
+	}
+	require.NoError(t, subject.RemoveBooks(context.Background()))
+	require.NoError(t, subject.RemoveBooks(context.Background(), 3, 5))
+	assert.Equal(t, [][]string{{"calibredb", "--library-path=/library", "remove", "3,5"}}, calls)
+}
+
+func TestWatch(t *testing.T) {
+	library := makeDatabase(t, 26)
+	subject := &Calibre{Library: library, WatchInterval: 10 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := subject.Watch(ctx)
+	require.NoError(t, err)
+
+	modified := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(filepath.Join(library, DatabaseName), modified, modified))
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "expected a change")
+	}
+	cancel()
+	for range changes {
+		// Wait for the channel to be closed
+	}
+
+	_, err = (&Calibre{Server: &ContentServer{URL: "http://localhost/"}}).Watch(ctx)
+	assert.Error(t, err)
+}
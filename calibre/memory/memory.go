@@ -0,0 +1,451 @@
+// Package memory provides a Calibre library that is kept in memory, so that
+// the rest of the program can be tested (or demonstrated) without Calibre.
+package memory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/model"
+)
+
+// Library is an in-memory Calibre library.  The file paths of its books are
+// made up, and the files can only be read with OpenFormat() and OpenCover().
+type Library struct {
+	lock     sync.Mutex
+	books    map[int]*model.CalibreBook
+	files    map[int]map[string][]byte // Keyed by book ID, then format
+	covers   map[int][]byte
+	columns  map[string]model.CustomColumn
+	nextID   int
+	watchers map[chan struct{}]struct{}
+	now      func() time.Time // For testing
+}
+
+var _ calibre.Library = &Library{}
+
+// NewLibrary returns a library containing the given books; books without an
+// ID are assigned one.  Any formats and covers of the books are ignored; use
+// SetFile() and SetCover() to add them.
+func NewLibrary(books ...model.CalibreBook) *Library {
+	result := &Library{
+		books:    make(map[int]*model.CalibreBook),
+		files:    make(map[int]map[string][]byte),
+		covers:   make(map[int][]byte),
+		nextID:   1,
+		watchers: make(map[chan struct{}]struct{}),
+	}
+	for _, book := range books {
+		if book.Id >= result.nextID {
+			result.nextID = book.Id + 1
+		}
+	}
+	for _, book := range books {
+		book := book
+		if book.Id == 0 {
+			book.Id = result.nextID
+			result.nextID++
+		}
+		book.Formats = nil
+		book.Cover = ""
+		result.books[book.Id] = &book
+	}
+	return result
+}
+
+func (l *Library) currentTime() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// changed notifies watchers that the library has changed; the lock must be
+// held.
+func (l *Library) changed() {
+	for watcher := range l.watchers {
+		select {
+		case watcher <- struct{}{}:
+		default:
+			// A change is already pending
+		}
+	}
+}
+
+// SetCustomColumns sets the definitions of the custom columns; values for
+// columns not defined here cannot be set.  If never called, any custom column
+// may be set, and values are stored as text.
+func (l *Library) SetCustomColumns(columns map[string]model.CustomColumn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.columns = columns
+}
+
+// SetFile sets the contents of the file of the given format for a book.
+func (l *Library) SetFile(id int, format string, contents []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.setFile(id, format, contents)
+}
+
+func (l *Library) setFile(id int, format string, contents []byte) error {
+	book, ok := l.books[id]
+	if !ok {
+		return fmt.Errorf("no book #%d: %w", id, os.ErrNotExist)
+	}
+	format = strings.ToLower(strings.TrimPrefix(format, "."))
+	if l.files[id] == nil {
+		l.files[id] = make(map[string][]byte)
+	}
+	l.files[id][format] = append([]byte(nil), contents...)
+	book.LastModified = model.Time3339{Time: l.currentTime()}
+	l.changed()
+	return nil
+}
+
+// File returns the contents of the file of the given format for a book.
+func (l *Library) File(id int, format string) ([]byte, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	contents, ok := l.files[id][strings.ToLower(format)]
+	return contents, ok
+}
+
+// SetCover sets the cover image of a book.
+func (l *Library) SetCover(id int, contents []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	book, ok := l.books[id]
+	if !ok {
+		return fmt.Errorf("no book #%d: %w", id, os.ErrNotExist)
+	}
+	l.covers[id] = append([]byte(nil), contents...)
+	book.LastModified = model.Time3339{Time: l.currentTime()}
+	l.changed()
+	return nil
+}
+
+// GetBooks returns copies of all the books, sorted by ID.
+func (l *Library) GetBooks(ctx context.Context) ([]model.CalibreBook, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	result := make([]model.CalibreBook, 0, len(l.books))
+	for id := range l.books {
+		result = append(result, l.copyBook(id))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result, nil
+}
+
+// GetBook returns a copy of the book with the given ID.
+func (l *Library) GetBook(ctx context.Context, id int) (model.CalibreBook, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.books[id]; !ok {
+		return model.CalibreBook{}, fmt.Errorf("could not find book #%d: %w", id, os.ErrNotExist)
+	}
+	return l.copyBook(id), nil
+}
+
+// copyBook returns a copy of the book with the given ID, with its formats and
+// cover; the lock must be held.
+func (l *Library) copyBook(id int) model.CalibreBook {
+	book := l.books[id]
+	copied := *book
+	copied.Authors = append([]string(nil), book.Authors...)
+	copied.Tags = append([]string(nil), book.Tags...)
+	copied.Languages = append([]string(nil), book.Languages...)
+	if book.Identifiers != nil {
+		copied.Identifiers = make(map[string]string, len(book.Identifiers))
+		for key, value := range book.Identifiers {
+			copied.Identifiers[key] = value
+		}
+	}
+	if book.CustomColumns != nil {
+		copied.CustomColumns = make(map[string]model.CustomValue, len(book.CustomColumns))
+		for key, value := range book.CustomColumns {
+			copied.CustomColumns[key] = value
+		}
+	}
+	copied.Size = 0
+	formats := make([]string, 0, len(l.files[id]))
+	for format, contents := range l.files[id] {
+		formats = append(formats, format)
+		if len(contents) > copied.Size {
+			copied.Size = len(contents)
+		}
+	}
+	sort.Strings(formats)
+	for _, format := range formats {
+		copied.Formats = append(copied.Formats, fmt.Sprintf("/memory/%d/book.%s", id, format))
+	}
+	if _, ok := l.covers[id]; ok {
+		copied.Cover = fmt.Sprintf("/memory/%d/cover.jpg", id)
+	}
+	return copied
+}
+
+// splitAuthors splits a list of authors separated by "&", where a doubled
+// "&&" is a literal ampersand.
+func splitAuthors(value string) []string {
+	const placeholder = "\x00"
+	var result []string
+	for _, part := range strings.Split(strings.ReplaceAll(value, "&&", placeholder), "&") {
+		if part = strings.TrimSpace(strings.ReplaceAll(part, placeholder, "&")); part != "" {
+			result = append(result, part)
+		}
+	}
+	return result
+}
+
+// parseCustom converts the value of a custom column, as given to calibredb.
+func parseCustom(column model.CustomColumn, value string) (model.CustomValue, error) {
+	result := model.CustomValue{Type: column.Datatype, IsMultiple: column.IsMultiple}
+	var err error
+	if column.IsMultiple {
+		result.Value = model.SplitList(value)
+		return result, nil
+	}
+	switch column.Datatype {
+	case model.CustomInt:
+		result.Value, err = strconv.ParseInt(value, 10, 64)
+	case model.CustomFloat, model.CustomRating:
+		result.Value, err = strconv.ParseFloat(value, 64)
+	case model.CustomBool:
+		switch strings.ToLower(value) {
+		case "yes", "true", "1":
+			result.Value = true
+		case "no", "false", "0":
+			result.Value = false
+		default:
+			err = fmt.Errorf("invalid boolean %q", value)
+		}
+	case model.CustomDatetime:
+		var parsed time.Time
+		parsed, err = time.Parse(time.RFC3339, value)
+		result.Value = model.Time3339{Time: parsed}
+	default:
+		result.Value = value
+	}
+	if err != nil {
+		return result, fmt.Errorf("could not parse #%s: %w", column.Label, err)
+	}
+	return result, nil
+}
+
+// applyField sets a single metadata field on a book; the lock must be held.
+func (l *Library) applyField(book *model.CalibreBook, field calibre.MetaField) error {
+	parseTime := func() (model.Time3339, error) {
+		parsed, err := time.Parse(time.RFC3339, field.Value)
+		return model.Time3339{Time: parsed}, err
+	}
+	var err error
+	switch field.Name {
+	case "authors":
+		book.Authors = splitAuthors(field.Value)
+	case "comments":
+		book.Comments = field.Value
+	case "identifiers":
+		book.Identifiers = make(map[string]string)
+		for _, item := range model.SplitList(field.Value) {
+			kind, value, ok := strings.Cut(item, ":")
+			if !ok {
+				return fmt.Errorf("invalid identifier %q", item)
+			}
+			book.Identifiers[kind] = value
+		}
+	case "languages":
+		book.Languages = model.SplitList(field.Value)
+	case "pubdate":
+		book.PubDate, err = parseTime()
+	case "publisher":
+		book.Publisher = field.Value
+	case "series":
+		book.Series = field.Value
+	case "series_index":
+		var index float64
+		index, err = strconv.ParseFloat(field.Value, 64)
+		book.SeriesIndex = &index
+	case "tags":
+		book.Tags = model.SplitList(field.Value)
+	case "timestamp":
+		book.Timestamp, err = parseTime()
+	case "title":
+		book.Title = field.Value
+	default:
+		if !strings.HasPrefix(field.Name, "#") {
+			return fmt.Errorf("unknown field %s", field.Name)
+		}
+		label := strings.TrimPrefix(field.Name, "#")
+		column, ok := l.columns[label]
+		if l.columns == nil {
+			column = model.CustomColumn{Label: label, Datatype: model.CustomText}
+		} else if !ok {
+			return fmt.Errorf("no such custom column %s", field.Name)
+		}
+		var value model.CustomValue
+		if value, err = parseCustom(column, field.Value); err != nil {
+			return err
+		}
+		if book.CustomColumns == nil {
+			book.CustomColumns = make(map[string]model.CustomValue)
+		}
+		book.CustomColumns[label] = value
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", field.Name, err)
+	}
+	return nil
+}
+
+// UpdateMetadata changes the metadata of the book with the given ID, in the
+// same way as calibredb set_metadata.  If any field is invalid, the book is
+// not changed.
+func (l *Library) UpdateMetadata(ctx context.Context, id int, meta calibre.UpdateMeta) error {
+	fields, err := meta.Serialize()
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	book, ok := l.books[id]
+	if !ok {
+		return fmt.Errorf("could not update database for book #%d: %w", id, os.ErrNotExist)
+	}
+	updated := *book
+	if book.CustomColumns != nil {
+		updated.CustomColumns = make(map[string]model.CustomValue, len(book.CustomColumns))
+		for key, value := range book.CustomColumns {
+			updated.CustomColumns[key] = value
+		}
+	}
+	for _, field := range fields {
+		if err = l.applyField(&updated, field); err != nil {
+			return fmt.Errorf("could not update database for book #%d: %w", id, err)
+		}
+	}
+	updated.LastModified = model.Time3339{Time: l.currentTime()}
+	*book = updated
+	l.changed()
+	return nil
+}
+
+// AddFormat reads the file at the given path into the book with the given ID.
+func (l *Library) AddFormat(ctx context.Context, id int, path string) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not update file for book #%d: %w", id, err)
+	}
+	format := strings.TrimPrefix(filepath.Ext(path), ".")
+	if format == "" {
+		return fmt.Errorf("could not update file for book #%d: %s has no extension", id, path)
+	}
+	if err = l.SetFile(id, format, contents); err != nil {
+		return fmt.Errorf("could not update file for book #%d: %w", id, err)
+	}
+	return nil
+}
+
+// AddBook reads the file at the given path as a new book, titled after the
+// file name.
+func (l *Library) AddBook(ctx context.Context, path string) (int, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("could not add %s: %w", path, err)
+	}
+	format := filepath.Ext(path)
+	if format == "" {
+		return 0, fmt.Errorf("could not add %s: no file extension", path)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := model.Time3339{Time: l.currentTime()}
+	book := &model.CalibreBook{
+		Id:           l.nextID,
+		Uuid:         fmt.Sprintf("memory-%d", l.nextID),
+		Title:        strings.TrimSuffix(filepath.Base(path), format),
+		Authors:      []string{"Unknown"},
+		Timestamp:    now,
+		LastModified: now,
+	}
+	l.nextID++
+	l.books[book.Id] = book
+	if err = l.setFile(book.Id, format, contents); err != nil {
+		return 0, err
+	}
+	return book.Id, nil
+}
+
+// RemoveBooks removes the books with the given IDs, and their files.  If any
+// of the books does not exist, none are removed.
+func (l *Library) RemoveBooks(ctx context.Context, ids ...int) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, id := range ids {
+		if _, ok := l.books[id]; !ok {
+			return fmt.Errorf("could not remove book #%d: %w", id, os.ErrNotExist)
+		}
+	}
+	for _, id := range ids {
+		delete(l.books, id)
+		delete(l.files, id)
+		delete(l.covers, id)
+	}
+	if len(ids) > 0 {
+		l.changed()
+	}
+	return nil
+}
+
+// OpenFormat returns the contents of the file of the given format.
+func (l *Library) OpenFormat(ctx context.Context, book model.CalibreBook, format string) (io.ReadCloser, error) {
+	contents, ok := l.File(book.Id, strings.TrimPrefix(format, "."))
+	if !ok {
+		return nil, fmt.Errorf("book #%d has no %s: %w", book.Id, format, os.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(contents)), nil
+}
+
+// OpenCover returns the cover image of the book.
+func (l *Library) OpenCover(ctx context.Context, book model.CalibreBook) (io.ReadCloser, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	contents, ok := l.covers[book.Id]
+	if !ok {
+		return nil, fmt.Errorf("book #%d has no cover: %w", book.Id, os.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(contents)), nil
+}
+
+// CustomColumns returns the definitions set with SetCustomColumns().
+func (l *Library) CustomColumns() map[string]model.CustomColumn {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.columns
+}
+
+// Watch returns a channel that receives a value after each change.
+func (l *Library) Watch(ctx context.Context) (<-chan struct{}, error) {
+	result := make(chan struct{}, 1)
+	l.lock.Lock()
+	l.watchers[result] = struct{}{}
+	l.lock.Unlock()
+	go func() {
+		<-ctx.Done()
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		delete(l.watchers, result)
+		close(result)
+	}()
+	return result, nil
+}
@@ -0,0 +1,160 @@
+package memory
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLibrary(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	subject := NewLibrary(
+		model.CalibreBook{Id: 3, Title: "Existing", Authors: []string{"Someone"}},
+		model.CalibreBook{Title: "No ID"},
+	)
+	subject.now = func() time.Time { return now }
+
+	books, err := subject.GetBooks(ctx)
+	require.NoError(t, err)
+	require.Len(t, books, 2)
+	assert.Equal(t, 3, books[0].Id)
+	assert.Equal(t, 4, books[1].Id, "books without IDs should be assigned one")
+	assert.Empty(t, books[0].Formats)
+
+	t.Run("files", func(t *testing.T) {
+		require.NoError(t, subject.SetFile(3, "EPUB", []byte("contents")))
+		require.NoError(t, subject.SetCover(3, []byte("cover")))
+		books, err := subject.GetBooks(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/memory/3/book.epub"}, books[0].Formats)
+		assert.Equal(t, "/memory/3/book.epub", books[0].FilePath())
+		assert.Equal(t, "/memory/3/cover.jpg", books[0].Cover)
+		book, err := subject.GetBook(ctx, 3)
+		require.NoError(t, err)
+		assert.Equal(t, books[0], book)
+		_, err = subject.GetBook(ctx, 100)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.Equal(t, len("contents"), books[0].Size)
+
+		reader, err := subject.OpenFormat(ctx, books[0], "epub")
+		require.NoError(t, err)
+		contents, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, "contents", string(contents))
+		_, err = subject.OpenFormat(ctx, books[0], "mobi")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, err = subject.OpenCover(ctx, books[1])
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("metadata", func(t *testing.T) {
+		subject.SetCustomColumns(map[string]model.CustomColumn{
+			"words":      {Label: "words", Datatype: model.CustomInt},
+			"characters": {Label: "characters", Datatype: model.CustomText, IsMultiple: true},
+		})
+		index := 2.5
+		err := subject.UpdateMetadata(ctx, 3, calibre.UpdateMeta{
+			Authors:     []string{"Salt & Pepper", "Other"},
+			Series:      "Saga",
+			SeriesIndex: &index,
+			Timestamp:   time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+			Fields: map[string]string{
+				"tags":        "one, two",
+				"#words":      "1234",
+				"#characters": "Alice,Bob",
+			},
+		})
+		require.NoError(t, err)
+		books, err := subject.GetBooks(ctx)
+		require.NoError(t, err)
+		book := books[0]
+		assert.Equal(t, []string{"Salt & Pepper", "Other"}, book.Authors)
+		assert.Equal(t, "Saga", book.Series)
+		assert.Equal(t, 2.5, *book.SeriesIndex)
+		assert.True(t, book.Timestamp.Equal(time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)))
+		assert.True(t, book.LastModified.Equal(now))
+		assert.Equal(t, []string{"one", "two"}, book.Tags)
+		assert.Equal(t, map[string]model.CustomValue{
+			"words":      {Type: model.CustomInt, Value: int64(1234)},
+			"characters": {Type: model.CustomText, IsMultiple: true, Value: []string{"Alice", "Bob"}},
+		}, book.CustomColumns)
+
+		err = subject.UpdateMetadata(ctx, 3, calibre.UpdateMeta{
+			Series: "Changed",
+			Fields: map[string]string{"#missing": "value"},
+		})
+		assert.ErrorContains(t, err, "no such custom column #missing")
+		books, err = subject.GetBooks(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "Saga", books[0].Series, "failed updates should not change the book")
+
+		err = subject.UpdateMetadata(ctx, 100, calibre.UpdateMeta{Series: "Nothing"})
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("add", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "New Story.epub")
+		require.NoError(t, os.WriteFile(path, []byte("new book"), 0o644))
+		id, err := subject.AddBook(ctx, path)
+		require.NoError(t, err)
+		assert.Equal(t, 5, id)
+		contents, ok := subject.File(id, "epub")
+		assert.True(t, ok)
+		assert.Equal(t, "new book", string(contents))
+
+		require.NoError(t, os.WriteFile(path, []byte("replaced"), 0o644))
+		require.NoError(t, subject.AddFormat(ctx, id, path))
+		contents, _ = subject.File(id, "epub")
+		assert.Equal(t, "replaced", string(contents))
+
+		books, err := subject.GetBooks(ctx)
+		require.NoError(t, err)
+		require.Len(t, books, 3)
+		assert.Equal(t, "New Story", books[2].Title)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		err := subject.RemoveBooks(ctx, 5, 100)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, ok := subject.File(5, "epub")
+		assert.True(t, ok, "failed removals should not remove any books")
+
+		require.NoError(t, subject.RemoveBooks(ctx, 5))
+		books, err := subject.GetBooks(ctx)
+		require.NoError(t, err)
+		assert.Len(t, books, 2)
+		_, ok = subject.File(5, "epub")
+		assert.False(t, ok)
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		changes, err := subject.Watch(ctx)
+		require.NoError(t, err)
+		select {
+		case <-changes:
+			assert.Fail(t, "unexpected change")
+		default:
+		}
+		require.NoError(t, subject.UpdateMetadata(ctx, 4, calibre.UpdateMeta{Comments: "one"}))
+		require.NoError(t, subject.UpdateMetadata(ctx, 4, calibre.UpdateMeta{Comments: "two"}))
+		select {
+		case <-changes:
+		case <-time.After(time.Second):
+			assert.Fail(t, "expected a change")
+		}
+		cancel()
+		for range changes {
+			// Wait for the channel to be closed
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package calibre
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/mook/fanficupdates/model"
+)
+
+// FieldPolicy determines whether a metadata field may be overwritten when
+// updating a book.
+type FieldPolicy string
+
+const (
+	PolicyOverwrite = FieldPolicy("overwrite")  // Always write the new value
+	PolicyFillEmpty = FieldPolicy("fill-empty") // Only write if currently empty
+	PolicyNever     = FieldPolicy("never")      // Never write the field
+)
+
+// PolicyTagPrefix is the prefix for tags (and values of the PolicyColumn
+// custom column) that override the field policy for a single book, such as
+// "fanficupdates:lock-comments".
+const PolicyTagPrefix = "fanficupdates:"
+
+// PolicyColumn is the lookup name of the optional custom column whose values
+// override the field policy for a single book, such as "lock-comments".
+const PolicyColumn = "fanficupdates"
+
+// policyActions maps the action in a policy tag to the resulting policy.
+var policyActions = map[string]FieldPolicy{
+	"lock":      PolicyNever,
+	"fill":      PolicyFillEmpty,
+	"overwrite": PolicyOverwrite,
+}
+
+// ParseFieldPolicy converts a string into a FieldPolicy.
+func ParseFieldPolicy(input string) (FieldPolicy, error) {
+	switch policy := FieldPolicy(strings.ToLower(strings.TrimSpace(input))); policy {
+	case PolicyOverwrite, PolicyFillEmpty, PolicyNever:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid field policy %q (expected %s, %s, or %s)",
+		input, PolicyOverwrite, PolicyFillEmpty, PolicyNever)
+}
+
+// FieldPolicies maps Calibre field names (such as "comments" or "#status") to
+// the policy for that field.  Fields not listed are always overwritten.
+type FieldPolicies map[string]FieldPolicy
+
+// ParseFieldPolicies converts a map of field names to policy names.
+func ParseFieldPolicies(input map[string]string) (FieldPolicies, error) {
+	result := make(FieldPolicies, len(input))
+	for field, value := range input {
+		policy, err := ParseFieldPolicy(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", field, err)
+		}
+		result[field] = policy
+	}
+	return result, nil
+}
+
+// Get returns the policy for the given field.  The series index follows the
+// series unless it has been given a policy explicitly.
+func (p FieldPolicies) Get(field string) FieldPolicy {
+	if policy, ok := p[field]; ok {
+		return policy
+	}
+	if field == "series_index" {
+		return p.Get("series")
+	}
+	return PolicyOverwrite
+}
+
+// ForBook returns the policies applicable to the given book, taking into
+// account any overrides from its tags or the PolicyColumn custom column.
+func (p FieldPolicies) ForBook(book model.CalibreBook) FieldPolicies {
+	result := make(FieldPolicies, len(p))
+	for field, policy := range p {
+		result[field] = policy
+	}
+	overrides := make([]string, 0)
+	for _, tag := range book.Tags {
+		if strings.HasPrefix(tag, PolicyTagPrefix) {
+			overrides = append(overrides, strings.TrimPrefix(tag, PolicyTagPrefix))
+		}
+	}
+	if value, ok := book.Custom(PolicyColumn); ok {
+		overrides = append(overrides, value.Values()...)
+	}
+	for _, override := range overrides {
+		action, field, ok := strings.Cut(strings.TrimSpace(override), "-")
+		if policy, known := policyActions[action]; ok && known && field != "" {
+			result[field] = policy
+		}
+	}
+	return result
+}
+
+// isEmptyField returns whether the given Calibre field is currently empty for
+// the book.  Unknown fields are treated as empty.
+func isEmptyField(book model.CalibreBook, field string) bool {
+	isEmptyTime := func(t model.Time3339) bool {
+		// Calibre uses 0101-01-01 for undefined dates.
+		return t.IsZero() || t.Year() <= 101
+	}
+	switch field {
+	case "authors":
+		return len(book.Authors) == 0 || (len(book.Authors) == 1 && book.Authors[0] == "Unknown")
+	case "comments":
+		return strings.TrimSpace(book.Comments) == ""
+	case "pubdate":
+		return isEmptyTime(book.PubDate)
+	case "publisher":
+		return book.Publisher == ""
+	case "series", "series_index":
+		// The series index is only meaningful with a series.
+		return book.Series == ""
+	case "timestamp":
+		return isEmptyTime(book.Timestamp)
+	case "tags":
+		return len(book.Tags) == 0
+	case "languages":
+		return len(book.Languages) == 0
+	case "identifiers":
+		return len(book.Identifiers) == 0
+	}
+	if strings.HasPrefix(field, "#") {
+		_, ok := book.Custom(field)
+		return !ok
+	}
+	return true
+}
+
+// allowed returns whether the given field may be written for the book.
+func (p FieldPolicies) allowed(book model.CalibreBook, field string) bool {
+	switch p.Get(field) {
+	case PolicyNever:
+		return false
+	case PolicyFillEmpty:
+		return isEmptyField(book, field)
+	}
+	return true
+}
+
+// Apply removes any fields from the update that are not permitted by the
+// policies, given the current metadata of the book.  The policies should
+// already include any per-book overrides; see ForBook().
+func (p FieldPolicies) Apply(meta *UpdateMeta, book model.CalibreBook) {
+	val := reflect.ValueOf(meta).Elem()
+	for i := 0; i < val.Type().NumField(); i++ {
+		field := val.Type().Field(i).Tag.Get("calibre")
+		if field != "" && !p.allowed(book, field) {
+			val.Field(i).Set(reflect.Zero(val.Field(i).Type()))
+		}
+	}
+	for field := range meta.Fields {
+		if !p.allowed(book, field) {
+			delete(meta.Fields, field)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package calibre
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFieldPolicies(t *testing.T) {
+	policies, err := ParseFieldPolicies(map[string]string{
+		"comments": "fill-empty",
+		"series":   " Never ",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, FieldPolicies{"comments": PolicyFillEmpty, "series": PolicyNever}, policies)
+	assert.Equal(t, PolicyNever, policies.Get("series_index"))
+	assert.Equal(t, PolicyOverwrite, policies.Get("publisher"))
+
+	_, err = ParseFieldPolicies(map[string]string{"comments": "sometimes"})
+	assert.ErrorContains(t, err, "field comments: invalid field policy")
+}
+
+func TestFieldPoliciesForBook(t *testing.T) {
+	global := FieldPolicies{"comments": PolicyFillEmpty, "series": PolicyNever}
+	book := model.CalibreBook{
+		Tags: []string{"Fluff", "fanficupdates:lock-comments", "fanficupdates:bogus"},
+		CustomColumns: map[string]model.CustomValue{
+			PolicyColumn: {Type: model.CustomText, IsMultiple: true, Value: []string{"overwrite-series", "fill-#status"}},
+		},
+	}
+	assert.Equal(t, FieldPolicies{
+		"comments": PolicyNever,
+		"series":   PolicyOverwrite,
+		"#status":  PolicyFillEmpty,
+	}, global.ForBook(book))
+	assert.Equal(t, FieldPolicies{"comments": PolicyFillEmpty, "series": PolicyNever}, global, "modified global policies")
+}
+
+func TestFieldPoliciesApply(t *testing.T) {
+	index := 3.0
+	newMeta := func() UpdateMeta {
+		return UpdateMeta{
+			Authors:     []string{"Someone"},
+			Comments:    "new comments",
+			Published:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			Publisher:   "new publisher",
+			Series:      "new series",
+			SeriesIndex: &index,
+			Timestamp:   time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+			Fields:      map[string]string{"#status": "Completed", "#words": "1234"},
+		}
+	}
+	book := model.CalibreBook{
+		Authors:  []string{"Unknown"},
+		Comments: "hand-written comments",
+		PubDate:  model.Time3339{Time: time.Date(101, 1, 1, 0, 0, 0, 0, time.UTC)},
+		Series:   "Curated Series",
+		CustomColumns: map[string]model.CustomValue{
+			"status": {Type: model.CustomText, Value: "In-Progress"},
+		},
+	}
+
+	t.Run("no policies", func(t *testing.T) {
+		meta := newMeta()
+		FieldPolicies{}.Apply(&meta, book)
+		assert.Equal(t, newMeta(), meta)
+	})
+	t.Run("fill empty", func(t *testing.T) {
+		meta := newMeta()
+		policies := FieldPolicies{}
+		for _, field := range []string{"authors", "comments", "pubdate", "series", "#status", "#words"} {
+			policies[field] = PolicyFillEmpty
+		}
+		policies.Apply(&meta, book)
+		expected := newMeta()
+		expected.Comments = ""
+		expected.Series = ""
+		expected.SeriesIndex = nil
+		delete(expected.Fields, "#status")
+		assert.Equal(t, expected, meta)
+	})
+	t.Run("never", func(t *testing.T) {
+		meta := newMeta()
+		FieldPolicies{"publisher": PolicyNever, "#words": PolicyNever}.Apply(&meta, book)
+		expected := newMeta()
+		expected.Publisher = ""
+		delete(expected.Fields, "#words")
+		assert.Equal(t, expected, meta)
+	})
+}
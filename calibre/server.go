@@ -0,0 +1,143 @@
+package calibre
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/util"
+)
+
+// ContentServer is a Calibre Content Server that is used instead of accessing
+// the library on the local filesystem, so that the library can stay open in
+// the Calibre GUI or live on another machine.  Metadata is read and written by
+// running calibredb against the server, and files are downloaded over HTTP.
+type ContentServer struct {
+	// URL is the address of the server, with the library ID as the fragment
+	// (e.g. http://localhost:8080/#Calibre_Library).  If there is no
+	// fragment, the default library of the server is used.
+	URL string
+
+	// Username and Password are used if the server requires authentication.
+	// Downloads use HTTP basic authentication, so the server must be started
+	// with --auth-mode=basic.
+	Username string
+	Password string
+
+	// Client is used to download files; if nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// dbArgs returns the arguments for calibredb to use the server.  The password
+// is passed in a temporary file rather than on the command line, where other
+// local users could read it; the returned function removes the file.
+func (s *ContentServer) dbArgs() ([]string, func(), error) {
+	args := []string{"--with-library=" + s.URL}
+	if s.Username == "" {
+		return args, func() {}, nil
+	}
+	file, err := os.CreateTemp("", "fanficupdates-password-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create password file: %w", err)
+	}
+	cleanup := func() { os.Remove(file.Name()) }
+	if _, err = file.WriteString(s.Password); err != nil {
+		file.Close()
+		cleanup()
+		return nil, nil, fmt.Errorf("could not write password file: %w", err)
+	}
+	if err = file.Close(); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("could not write password file: %w", err)
+	}
+	args = append(args, "--username="+s.Username, fmt.Sprintf("--password=<f:%s>", file.Name()))
+	return args, cleanup, nil
+}
+
+// fileURL returns the URL to download the given kind of file ("cover", or a
+// format such as "epub") for a book.
+func (s *ContentServer) fileURL(kind string, id int) (string, error) {
+	base, err := url.Parse(s.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid content server URL: %w", err)
+	}
+	libraryID := base.Fragment
+	base.Fragment = ""
+	base.RawFragment = ""
+	elements := []string{"/", base.Path, "get", kind, fmt.Sprintf("%d", id)}
+	if libraryID != "" {
+		elements = append(elements, libraryID)
+	}
+	base.Path = path.Join(elements...)
+	base.RawPath = ""
+	return base.String(), nil
+}
+
+// open downloads the given kind of file for a book.  If the server does not
+// have the file, the error wraps os.ErrNotExist.
+func (s *ContentServer) open(ctx context.Context, kind string, id int) (io.ReadCloser, error) {
+	target, err := s.fileURL(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.Username != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not download %s for book #%d: %w", kind, id, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		if res.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("could not download %s for book #%d: %w", kind, id, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("could not download %s for book #%d: %s", kind, id, res.Status)
+	}
+	return res.Body, nil
+}
+
+// OpenFormat opens the file of the given format (such as "epub") for the book,
+// either from the local library or by downloading it from the content server.
+// If the book does not have the format, the error wraps os.ErrNotExist.
+func (c *Calibre) OpenFormat(ctx context.Context, book model.CalibreBook, format string) (io.ReadCloser, error) {
+	format = strings.ToLower(strings.TrimPrefix(format, "."))
+	file := util.Find(book.Formats, func(f string) bool {
+		return strings.ToLower(filepath.Ext(f)) == "."+format
+	})
+	if file == nil {
+		return nil, fmt.Errorf("book #%d has no %s: %w", book.Id, format, os.ErrNotExist)
+	}
+	if c.Server != nil {
+		return c.Server.open(ctx, format, book.Id)
+	}
+	return os.Open(*file)
+}
+
+// OpenCover opens the cover image for the book, either from the local library
+// or by downloading it from the content server.  If the book does not have a
+// cover, the error wraps os.ErrNotExist.
+func (c *Calibre) OpenCover(ctx context.Context, book model.CalibreBook) (io.ReadCloser, error) {
+	if book.Cover == "" {
+		return nil, fmt.Errorf("book #%d has no cover: %w", book.Id, os.ErrNotExist)
+	}
+	if c.Server != nil {
+		return c.Server.open(ctx, "cover", book.Id)
+	}
+	return os.Open(book.Cover)
+}
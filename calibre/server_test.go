@@ -0,0 +1,151 @@
+package calibre
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentServerDBCommand(t *testing.T) {
+	input := `[{
+		"id": 5,
+		"authors": "Single Author",
+		"formats": ["/srv/library/Author/Book (5)/Book - Author.epub"],
+		"cover": "/srv/library/Author/Book (5)/cover.jpg"
+	}]`
+	subject := &Calibre{
+		Library: "/ignored",
+		Server: &ContentServer{
+			URL:      "http://localhost:8080/#Books",
+			Username: "reader",
+			Password: "secret",
+		},
+		RunShim: func(cmd *exec.Cmd) ([]byte, error) {
+			require.Len(t, cmd.Args, 7)
+			assert.Equal(t, []string{
+				"calibredb",
+				"--with-library=http://localhost:8080/#Books",
+				"--username=reader",
+			}, cmd.Args[:3])
+			assert.Equal(t, []string{"list", "--for-machine", "--fields=all"}, cmd.Args[4:])
+			// The password must not be on the command line.
+			require.Regexp(t, `^--password=<f:.+>$`, cmd.Args[3])
+			passwordFile := strings.TrimSuffix(strings.TrimPrefix(cmd.Args[3], "--password=<f:"), ">")
+			password, err := os.ReadFile(passwordFile)
+			require.NoError(t, err)
+			assert.Equal(t, "secret", string(password))
+			return []byte(input), nil
+		},
+	}
+	books, err := subject.GetBooks(context.Background())
+	require.NoError(t, err)
+	require.Len(t, books, 1)
+	matches, err := filepath.Glob(filepath.Join(os.TempDir(), "fanficupdates-password-*"))
+	require.NoError(t, err)
+	assert.Empty(t, matches, "the password file should be removed")
+	// Paths on the server are kept, even though they don't exist locally.
+	assert.Equal(t, []string{"/srv/library/Author/Book (5)/Book - Author.epub"}, books[0].Formats)
+	assert.Equal(t, "/srv/library/Author/Book (5)/cover.jpg", books[0].Cover)
+}
+
+func TestContentServerGetBook(t *testing.T) {
+	output := `[{"id": 5, "authors": "Single Author"}]`
+	subject := &Calibre{
+		Server: &ContentServer{URL: "http://localhost:8080/"},
+		RunShim: func(cmd *exec.Cmd) ([]byte, error) {
+			require.GreaterOrEqual(t, len(cmd.Args), 4)
+			assert.Equal(t, []string{"list", "--for-machine", "--fields=all"}, cmd.Args[len(cmd.Args)-4:len(cmd.Args)-1])
+			if cmd.Args[len(cmd.Args)-1] != "--search=id:5" {
+				return []byte("[]"), nil
+			}
+			return []byte(output), nil
+		},
+	}
+	book, err := subject.GetBook(context.Background(), 5)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Single Author"}, book.Authors)
+	_, err = subject.GetBook(context.Background(), 6)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestContentServerFiles(t *testing.T) {
+	handler := http.NewServeMux()
+	handler.HandleFunc("/calibre/get/epub/5/My Books", func(w http.ResponseWriter, req *http.Request) {
+		username, password, ok := req.BasicAuth()
+		if !ok || username != "reader" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("epub contents"))
+	})
+	handler.HandleFunc("/calibre/get/cover/5/My Books", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("cover contents"))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	subject := &Calibre{Server: &ContentServer{
+		URL:      server.URL + "/calibre/#My Books",
+		Username: "reader",
+		Password: "secret",
+		Client:   server.Client(),
+	}}
+	book := model.CalibreBook{
+		Id:      5,
+		Formats: []string{"/srv/library/book.EPUB"},
+		Cover:   "/srv/library/cover.jpg",
+	}
+	readAll := func(t *testing.T, reader io.ReadCloser) string {
+		defer reader.Close()
+		buf, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		return string(buf)
+	}
+
+	t.Run("format", func(t *testing.T) {
+		reader, err := subject.OpenFormat(context.Background(), book, "epub")
+		require.NoError(t, err)
+		assert.Equal(t, "epub contents", readAll(t, reader))
+	})
+	t.Run("cover", func(t *testing.T) {
+		reader, err := subject.OpenCover(context.Background(), book)
+		require.NoError(t, err)
+		assert.Equal(t, "cover contents", readAll(t, reader))
+	})
+	t.Run("missing format", func(t *testing.T) {
+		_, err := subject.OpenFormat(context.Background(), book, "mobi")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+	t.Run("missing on server", func(t *testing.T) {
+		missing := book
+		missing.Id = 6
+		_, err := subject.OpenFormat(context.Background(), missing, "epub")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+	t.Run("unauthorized", func(t *testing.T) {
+		unauthorized := &Calibre{Server: &ContentServer{URL: subject.Server.URL, Client: server.Client()}}
+		_, err := unauthorized.OpenFormat(context.Background(), book, "epub")
+		assert.ErrorContains(t, err, "401")
+		assert.NotErrorIs(t, err, os.ErrNotExist)
+	})
+	t.Run("local", func(t *testing.T) {
+		local := &Calibre{}
+		path := filepath.Join(t.TempDir(), "book.epub")
+		require.NoError(t, os.WriteFile(path, []byte("local contents"), 0o644))
+		reader, err := local.OpenFormat(context.Background(), model.CalibreBook{Formats: []string{path}}, "epub")
+		require.NoError(t, err)
+		assert.Equal(t, "local contents", readAll(t, reader))
+		_, err = local.OpenCover(context.Background(), model.CalibreBook{})
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
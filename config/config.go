@@ -0,0 +1,582 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/query"
+	"github.com/mook/fanficupdates/rules"
+	"github.com/mook/fanficupdates/schedule"
+	"github.com/mook/fanficupdates/util"
+)
+
+// EnvPrefix is the prefix of environment variables that override settings in
+// the configuration file, such as FANFICUPDATES_SERVER_ADDR.
+const EnvPrefix = "FANFICUPDATES_"
+
+// Duration is a time.Duration that is written in configuration files as a
+// string such as "8h" or "30d".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	var text string
+	if err := node.Decode(&text); err != nil {
+		return err
+	}
+	result, err := rules.ParseInterval(text)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*d = Duration(result)
+	return nil
+}
+
+// Server configures the OPDS server.
+type Server struct {
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"` // If set, require HTTP basic authentication
+	Password string `yaml:"password"`
+}
+
+// ContentServer configures a Calibre Content Server to use instead of a
+// library directory; see calibre.ContentServer.
+type ContentServer struct {
+	URL      string `yaml:"url"` // e.g. http://localhost:8080/#Calibre_Library
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Runners for FanFicFare.
+const (
+	RunnerPlugin = "plugin" // The Calibre plugin, via calibre-debug
+	RunnerCLI    = "cli"    // The standalone fanficfare command, from pip
+)
+
+// FanFicFare configures how FanFicFare is run.
+type FanFicFare struct {
+	Runner  string   `yaml:"runner"`  // RunnerPlugin (default) or RunnerCLI
+	Command string   `yaml:"command"` // For RunnerCLI; default fanficfare from the PATH
+	Args    []string `yaml:"args"`    // Extra arguments, e.g. --config=personal.ini
+}
+
+// SiteLimit restricts how often books from a single site are checked.
+type SiteLimit struct {
+	Delay     Duration `yaml:"delay"`       // Minimum time between books
+	MaxPerRun int      `yaml:"max_per_run"` // Maximum books per update run
+}
+
+// RetryPolicy configures how books are retried after a class of failure; see
+// updater.RetryPolicy.
+type RetryPolicy struct {
+	Backoff    Duration `yaml:"backoff"`     // Delay after the first failure
+	MaxBackoff Duration `yaml:"max_backoff"` // Maximum delay; 0 for no limit
+	Quarantine int      `yaml:"quarantine"`  // Failures before quarantining; 0 to never
+}
+
+// Regression configures when updates that lose content are held for review;
+// see fanficfare.FanFicFare.MaxChapterLoss and MaxWordLoss.
+type Regression struct {
+	MaxChapterLoss int     `yaml:"max_chapter_loss"` // Chapters that may be lost; negative to never hold
+	MaxWordLoss    float64 `yaml:"max_word_loss"`    // Fraction of words that may be lost; default 0.2, negative to never hold
+}
+
+// History configures the archive of replaced EPUBs; see history.Archive.
+type History struct {
+	Dir    string `yaml:"dir"`    // Default fanficupdates-history next to the state file
+	Keep   int    `yaml:"keep"`   // Most recent versions kept per book; default 5, negative to not archive
+	Months int    `yaml:"months"` // Recent months with one version kept per book; 0 for all, negative for none
+}
+
+// NotifyTarget is a webhook that receives story updates.
+type NotifyTarget struct {
+	URL     string            `yaml:"url"`
+	Select  string            `yaml:"select"` // Only notify for matching books
+	Headers map[string]string `yaml:"headers"`
+}
+
+// Schedule configures when updates run.
+type Schedule struct {
+	Select     string   `yaml:"select"`      // For additional schedules, the books to use it for
+	Cron       string   `yaml:"cron"`        // See schedule.Parse
+	QuietHours []string `yaml:"quiet_hours"` // Windows such as "22:00-07:00"
+	Jitter     Duration `yaml:"jitter"`      // Maximum random delay
+
+	// MetadataOnly, for additional schedules, only refreshes the metadata
+	// of the selected books, which are still fully updated on their own
+	// schedule.
+	MetadataOnly bool `yaml:"metadata_only"`
+}
+
+// Library configures one of several Calibre libraries.  Unset values are
+// taken from the top-level configuration.
+type Library struct {
+	Name          string        `yaml:"name"` // The library is served at /opds/{name}
+	Path          string        `yaml:"path"`
+	ContentServer ContentServer `yaml:"content_server"` // Used instead of the path
+	Settings      string        `yaml:"settings"`       // Calibre settings directory, for FanFicFare
+	State         string        `yaml:"state"`          // Default fanficupdates-{name}.json in the settings directory
+	History       string        `yaml:"history"`        // Directory of replaced EPUBs; default next to the state file
+	Select        string        `yaml:"select"`
+	Rules         []string      `yaml:"rules"`
+}
+
+// libraryNameMatcher matches valid library names.
+var libraryNameMatcher = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Config is the complete configuration of the program.
+type Config struct {
+	Settings           string                 `yaml:"settings"`       // Calibre settings directory
+	Library            string                 `yaml:"library"`        // Calibre library directory
+	ContentServer      ContentServer          `yaml:"content_server"` // If set, Library is ignored
+	FanFicFare         FanFicFare             `yaml:"fanficfare"`     // How FanFicFare is run
+	State              string                 `yaml:"state"`          // State file
+	Server             Server                 `yaml:"server"`
+	UpdateInterval     Duration               `yaml:"update_interval"` // Used if there is no schedule
+	Timezone           string                 `yaml:"timezone"`        // For schedules; default local
+	Schedule           Schedule               `yaml:"schedule"`
+	Schedules          []Schedule             `yaml:"schedules"` // Schedules for specific books
+	BatchSize          int                    `yaml:"batch_size"`
+	SkipFirst          bool                   `yaml:"skip_first"`
+	Select             string                 `yaml:"select"`
+	PreserveAuthors    bool                   `yaml:"preserve_authors"`
+	KeepOldURL         bool                   `yaml:"keep_old_url"` // Keep the previous URL as an identifier when it changes
+	FieldMap           map[string]string      `yaml:"field_map"`
+	FieldPolicies      map[string]string      `yaml:"field_policies"`
+	Rules              []string               `yaml:"rules"`
+	Sites              map[string]SiteLimit   `yaml:"sites"`                // Keyed by host name
+	Retry              map[string]RetryPolicy `yaml:"retry"`                // Keyed by error class, replacing the default policy
+	SourceRemovedAfter int                    `yaml:"source_removed_after"` // Not-found checks before marking removed; default 3
+	Regression         Regression             `yaml:"regression"`
+	History            History                `yaml:"history"`
+	Notify             []NotifyTarget         `yaml:"notify"`
+	Libraries          []Library              `yaml:"libraries"` // If set, Library is ignored
+}
+
+// Default returns the configuration used when nothing is configured.
+func Default() *Config {
+	return &Config{
+		Server:         Server{Addr: ":8080"},
+		UpdateInterval: Duration(8 * time.Hour),
+		Rules:          append([]string(nil), rules.DefaultRules...),
+	}
+}
+
+// Read reads YAML configuration from the reader over the existing values.
+// Unknown keys are rejected to catch typos.
+func (c *Config) Read(reader io.Reader) error {
+	decoder := yaml.NewDecoder(reader)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// Load returns the configuration from the file at the given path, applied over
+// the defaults.  If the path is empty, the defaults are returned.
+func Load(path string) (*Config, error) {
+	result := Default()
+	if path == "" {
+		return result, nil
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read configuration: %w", err)
+	}
+	if err := result.Read(bytes.NewReader(buf)); err != nil {
+		return nil, fmt.Errorf("could not parse configuration %s: %w", path, err)
+	}
+	return result, nil
+}
+
+// envSetters maps environment variable names (without EnvPrefix) to functions
+// that apply their value.
+var envSetters = map[string]func(c *Config, value string) error{
+	"SETTINGS":                func(c *Config, value string) error { c.Settings = value; return nil },
+	"LIBRARY":                 func(c *Config, value string) error { c.Library = value; return nil },
+	"CONTENT_SERVER_URL":      func(c *Config, value string) error { c.ContentServer.URL = value; return nil },
+	"CONTENT_SERVER_USERNAME": func(c *Config, value string) error { c.ContentServer.Username = value; return nil },
+	"CONTENT_SERVER_PASSWORD": func(c *Config, value string) error { c.ContentServer.Password = value; return nil },
+	"FANFICFARE_RUNNER":       func(c *Config, value string) error { c.FanFicFare.Runner = value; return nil },
+	"FANFICFARE_COMMAND":      func(c *Config, value string) error { c.FanFicFare.Command = value; return nil },
+	"STATE":                   func(c *Config, value string) error { c.State = value; return nil },
+	"HISTORY_DIR":             func(c *Config, value string) error { c.History.Dir = value; return nil },
+	"SERVER_ADDR":             func(c *Config, value string) error { c.Server.Addr = value; return nil },
+	"SERVER_USERNAME":         func(c *Config, value string) error { c.Server.Username = value; return nil },
+	"SERVER_PASSWORD":         func(c *Config, value string) error { c.Server.Password = value; return nil },
+	"SELECT":                  func(c *Config, value string) error { c.Select = value; return nil },
+	"SCHEDULE":                func(c *Config, value string) error { c.Schedule.Cron = value; return nil },
+	"TIMEZONE":                func(c *Config, value string) error { c.Timezone = value; return nil },
+	"UPDATE_INTERVAL": func(c *Config, value string) error {
+		interval, err := rules.ParseInterval(value)
+		c.UpdateInterval = Duration(interval)
+		return err
+	},
+	"BATCH_SIZE": func(c *Config, value string) (err error) {
+		c.BatchSize, err = strconv.Atoi(value)
+		return
+	},
+	"SKIP_FIRST": func(c *Config, value string) (err error) {
+		c.SkipFirst, err = strconv.ParseBool(value)
+		return
+	},
+	"PRESERVE_AUTHORS": func(c *Config, value string) (err error) {
+		c.PreserveAuthors, err = strconv.ParseBool(value)
+		return
+	},
+	"KEEP_OLD_URL": func(c *Config, value string) (err error) {
+		c.KeepOldURL, err = strconv.ParseBool(value)
+		return
+	},
+	"RULES": func(c *Config, value string) error {
+		// Rules are separated by newlines, as they contain spaces.
+		c.Rules = nil
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				c.Rules = append(c.Rules, line)
+			}
+		}
+		return nil
+	},
+}
+
+// EnvNames returns the names of the environment variables that are recognized,
+// sorted.
+func EnvNames() []string {
+	result := make([]string, 0, len(envSetters))
+	for name := range envSetters {
+		result = append(result, EnvPrefix+name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// ApplyEnv overrides the configuration with any environment variables set;
+// lookup is normally os.LookupEnv.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	for _, name := range EnvNames() {
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := envSetters[strings.TrimPrefix(name, EnvPrefix)](c, value); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ValidationError lists all the problems found in a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Validate checks the configuration for errors, returning a *ValidationError
+// describing all of them.
+func (c *Config) Validate() error {
+	var problems []string
+	addProblem := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	checkDirectory := func(name, path string) {
+		if path == "" {
+			return
+		}
+		if info, err := os.Stat(path); err != nil {
+			addProblem("%s: %v", name, err)
+		} else if !info.IsDir() {
+			addProblem("%s: %s is not a directory", name, path)
+		}
+	}
+	checkContentServer := func(name string, server ContentServer) {
+		if server.URL == "" {
+			if server.Username != "" || server.Password != "" {
+				addProblem("%s.url: must be set to use a username or password", name)
+			}
+			return
+		}
+		if u, err := url.Parse(server.URL); err != nil {
+			addProblem("%s.url: %v", name, err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			addProblem("%s.url: %q is not an http or https URL", name, server.URL)
+		}
+		if (server.Username == "") != (server.Password == "") {
+			addProblem("%s: username and password must be set together", name)
+		}
+	}
+	checkDirectory("settings", c.Settings)
+	if c.ContentServer.URL == "" {
+		checkDirectory("library", c.Library)
+	}
+	checkContentServer("content_server", c.ContentServer)
+	switch c.FanFicFare.Runner {
+	case "", RunnerPlugin, RunnerCLI:
+	default:
+		addProblem("fanficfare.runner: %q must be %q or %q", c.FanFicFare.Runner, RunnerPlugin, RunnerCLI)
+	}
+	if c.FanFicFare.Command != "" && c.FanFicFare.Runner != RunnerCLI {
+		addProblem("fanficfare.command: only allowed with runner %q", RunnerCLI)
+	}
+	libraryNames := make(map[string]bool)
+	for i, library := range c.Libraries {
+		prefix := fmt.Sprintf("libraries[%d]", i)
+		if !libraryNameMatcher.MatchString(library.Name) {
+			addProblem("%s.name: %q must only contain letters, numbers, '.', '_' and '-'", prefix, library.Name)
+		} else if libraryNames[library.Name] {
+			addProblem("%s.name: duplicate library %q", prefix, library.Name)
+		}
+		libraryNames[library.Name] = true
+		if library.Path == "" && library.ContentServer.URL == "" {
+			addProblem("%s.path: must not be empty", prefix)
+		} else if library.Path != "" && library.ContentServer.URL != "" {
+			addProblem("%s.path: must not be set with content_server.url", prefix)
+		}
+		checkDirectory(prefix+".path", library.Path)
+		checkContentServer(prefix+".content_server", library.ContentServer)
+		checkDirectory(prefix+".settings", library.Settings)
+		if _, err := query.Parse(library.Select); err != nil {
+			addProblem("%s.select: %v", prefix, err)
+		}
+		for j, rule := range library.Rules {
+			if _, err := rules.ParseRule(rule); err != nil {
+				addProblem("%s.rules[%d]: %v", prefix, j, err)
+			}
+		}
+	}
+	if c.Server.Addr == "" {
+		addProblem("server.addr: must not be empty")
+	}
+	if (c.Server.Username == "") != (c.Server.Password == "") {
+		addProblem("server: username and password must be set together")
+	}
+	if c.UpdateInterval <= 0 {
+		addProblem("update_interval: must be positive")
+	}
+	if _, err := c.Scheduler(time.Now()); err != nil {
+		addProblem("%v", err)
+	}
+	if c.Schedule.Select != "" {
+		addProblem("schedule.select: only allowed in schedules")
+	}
+	if c.Schedule.MetadataOnly {
+		addProblem("schedule.metadata_only: only allowed in schedules")
+	}
+	if c.BatchSize < 0 {
+		addProblem("batch_size: must not be negative")
+	}
+	if _, err := query.Parse(c.Select); err != nil {
+		addProblem("select: %v", err)
+	}
+	for key, value := range c.FieldMap {
+		if value == "" {
+			addProblem("field_map.%s: must not be empty", key)
+		}
+	}
+	if _, err := calibre.ParseFieldPolicies(c.FieldPolicies); err != nil {
+		addProblem("field_policies: %v", err)
+	}
+	for i, rule := range c.Rules {
+		if _, err := rules.ParseRule(rule); err != nil {
+			addProblem("rules[%d]: %v", i, err)
+		}
+	}
+	for site, limit := range c.Sites {
+		if site == "" {
+			addProblem("sites: site name must not be empty")
+		}
+		if limit.Delay < 0 {
+			addProblem("sites.%s.delay: must not be negative", site)
+		}
+		if limit.MaxPerRun < 0 {
+			addProblem("sites.%s.max_per_run: must not be negative", site)
+		}
+	}
+	for class, policy := range c.Retry {
+		if !util.Any(model.ErrorClasses, func(known model.ErrorClass) bool { return string(known) == class }) {
+			addProblem("retry.%s: unknown error class", class)
+		}
+		if policy.Backoff <= 0 {
+			addProblem("retry.%s.backoff: must be positive", class)
+		}
+		if policy.MaxBackoff < 0 {
+			addProblem("retry.%s.max_backoff: must not be negative", class)
+		}
+		if policy.Quarantine < 0 {
+			addProblem("retry.%s.quarantine: must not be negative", class)
+		}
+	}
+	if c.Regression.MaxWordLoss > 1 {
+		addProblem("regression.max_word_loss: must not be more than 1")
+	}
+	for i, target := range c.Notify {
+		if u, err := url.Parse(target.URL); err != nil {
+			addProblem("notify[%d].url: %v", i, err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			addProblem("notify[%d].url: %q is not an http or https URL", i, target.URL)
+		}
+		if _, err := query.Parse(target.Select); err != nil {
+			addProblem("notify[%d].select: %v", i, err)
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// Scheduler returns the scheduler for the configured schedules, starting at
+// the given time.  The main schedule (or, if not set, the update interval)
+// applies to books not selected by any of the additional schedules, which
+// inherit its quiet hours and jitter unless set.
+func (c *Config) Scheduler(now time.Time) (*schedule.Scheduler, error) {
+	location := time.Local
+	if c.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(c.Timezone); err != nil {
+			return nil, fmt.Errorf("timezone: %w", err)
+		}
+	}
+	makeGroup := func(name string, config Schedule) (*schedule.Group, error) {
+		group := &schedule.Group{Name: name, MetadataOnly: config.MetadataOnly, Plan: &schedule.Plan{
+			Jitter:   time.Duration(config.Jitter),
+			Location: location,
+		}}
+		if config.Jitter == 0 {
+			group.Plan.Jitter = time.Duration(c.Schedule.Jitter)
+		}
+		spec := config.Cron
+		if spec == "" {
+			spec = "@every " + time.Duration(c.UpdateInterval).String()
+		}
+		var err error
+		if group.Plan.Schedule, err = schedule.Parse(spec, location); err != nil {
+			return nil, fmt.Errorf("%s.cron: %w", name, err)
+		}
+		quietHours := config.QuietHours
+		if quietHours == nil {
+			quietHours = c.Schedule.QuietHours
+		}
+		for _, input := range quietHours {
+			window, err := schedule.ParseWindow(input)
+			if err != nil {
+				return nil, fmt.Errorf("%s.quiet_hours: %w", name, err)
+			}
+			group.Plan.Quiet = append(group.Plan.Quiet, window)
+		}
+		if config.Select != "" {
+			if group.Filter, err = query.Parse(config.Select); err != nil {
+				return nil, fmt.Errorf("%s.select: %w", name, err)
+			}
+		}
+		return group, nil
+	}
+	var groups []*schedule.Group
+	for i, config := range c.Schedules {
+		name := fmt.Sprintf("schedules[%d]", i)
+		if config.Select == "" {
+			return nil, fmt.Errorf("%s.select: must not be empty", name)
+		}
+		group, err := makeGroup(name, config)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	group, err := makeGroup("schedule", Schedule{Cron: c.Schedule.Cron, QuietHours: c.Schedule.QuietHours, Jitter: c.Schedule.Jitter})
+	if err != nil {
+		return nil, err
+	}
+	groups = append(groups, group)
+	return schedule.NewScheduler(groups, now), nil
+}
+
+// LibraryList returns the libraries to update, with unset values filled in
+// from the top-level configuration.  If no libraries are configured, this is a
+// single library with an empty name, using the top-level library path.
+func (c *Config) LibraryList() []Library {
+	if len(c.Libraries) == 0 {
+		return []Library{{
+			Path:          c.Library,
+			ContentServer: c.ContentServer,
+			Settings:      c.Settings,
+			State:         c.State,
+			History:       c.History.Dir,
+			Select:        c.Select,
+			Rules:         c.Rules,
+		}}
+	}
+	result := make([]Library, 0, len(c.Libraries))
+	for _, library := range c.Libraries {
+		if library.Settings == "" {
+			library.Settings = c.Settings
+		}
+		if library.Select == "" {
+			library.Select = c.Select
+		}
+		if library.Rules == nil {
+			library.Rules = c.Rules
+		}
+		result = append(result, library)
+	}
+	return result
+}
+
+// StatePath returns the path of the state file for the library, given the
+// (possibly auto-detected) settings directory.
+func (l *Library) StatePath(settings string) string {
+	if l.State != "" {
+		return l.State
+	}
+	if l.Name == "" {
+		return filepath.Join(settings, "fanficupdates.json")
+	}
+	return filepath.Join(settings, fmt.Sprintf("fanficupdates-%s.json", l.Name))
+}
+
+// ReviewPath returns the directory holding updates for review for the library,
+// given the (possibly auto-detected) settings directory.  It is next to the
+// state file.
+func (l *Library) ReviewPath(settings string) string {
+	return strings.TrimSuffix(l.StatePath(settings), ".json") + "-review"
+}
+
+// UpdatesPath returns the file holding the recent story updates listed in the
+// updates feed for the library, given the (possibly auto-detected) settings
+// directory.  It is next to the state file.
+func (l *Library) UpdatesPath(settings string) string {
+	return strings.TrimSuffix(l.StatePath(settings), ".json") + "-updates.json"
+}
+
+// HistoryPath returns the directory of replaced EPUBs for the library, given
+// the (possibly auto-detected) settings directory.  By default, it is next to
+// the state file.
+func (l *Library) HistoryPath(settings string) string {
+	if l.History != "" {
+		return l.History
+	}
+	return strings.TrimSuffix(l.StatePath(settings), ".json") + "-history"
+}
+
+// ParsedFieldPolicies returns the parsed field policies.
+func (c *Config) ParsedFieldPolicies() (calibre.FieldPolicies, error) {
+	return calibre.ParseFieldPolicies(c.FieldPolicies)
+}
@@ -0,0 +1,278 @@
+package config_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mook/fanficupdates/config"
+	"github.com/mook/fanficupdates/rules"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sampleConfig = `
+server:
+  addr: ":9090"
+  username: reader
+  password: secret
+update_interval: 12h
+timezone: UTC
+schedule:
+  cron: "0 3 * * *"
+  quiet_hours: ["09:00-17:00"]
+schedules:
+  - select: site:ao3
+    cron: "@every 6h"
+    jitter: 10m
+select: not tag:abandoned
+field_policies:
+  comments: fill-empty
+rules:
+  - tag:noupdate skip
+  - site:ao3 and tag:complete => interval=30d
+sites:
+  archiveofourown.org:
+    delay: 30s
+    max_per_run: 50
+notify:
+  - url: https://example.com/hook
+    select: tag:favourite
+    headers:
+      Authorization: Bearer token
+`
+
+func TestLoad(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		cfg, err := config.Load("")
+		require.NoError(t, err)
+		assert.Equal(t, config.Default(), cfg)
+		assert.Equal(t, rules.DefaultRules, cfg.Rules)
+		assert.NoError(t, cfg.Validate())
+	})
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(sampleConfig), 0o644))
+		cfg, err := config.Load(path)
+		require.NoError(t, err)
+		require.NoError(t, cfg.Validate())
+		assert.Equal(t, config.Server{Addr: ":9090", Username: "reader", Password: "secret"}, cfg.Server)
+		assert.Equal(t, config.Duration(12*time.Hour), cfg.UpdateInterval)
+		assert.Equal(t, "not tag:abandoned", cfg.Select)
+		assert.Equal(t, map[string]string{"comments": "fill-empty"}, cfg.FieldPolicies)
+		assert.Len(t, cfg.Rules, 2)
+		assert.Equal(t, config.SiteLimit{Delay: config.Duration(30 * time.Second), MaxPerRun: 50}, cfg.Sites["archiveofourown.org"])
+		scheduler, err := cfg.Scheduler(time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC))
+		require.NoError(t, err)
+		groups := scheduler.Groups()
+		require.Len(t, groups, 2)
+		assert.Equal(t, "schedules[0]", groups[0].Name)
+		assert.Equal(t, time.Duration(10*time.Minute), groups[0].Plan.Jitter)
+		assert.Len(t, groups[0].Plan.Quiet, 1, "quiet hours should be inherited")
+		assert.Nil(t, groups[1].Filter)
+		require.Len(t, cfg.Notify, 1)
+		assert.Equal(t, "Bearer token", cfg.Notify[0].Headers["Authorization"])
+	})
+	t.Run("unknown key", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte("update_intervl: 1h\n"), 0o644))
+		_, err := config.Load(path)
+		assert.ErrorContains(t, err, "update_intervl")
+	})
+	t.Run("bad duration", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte("\nupdate_interval: often\n"), 0o644))
+		_, err := config.Load(path)
+		assert.ErrorContains(t, err, "line 2")
+	})
+	t.Run("missing file", func(t *testing.T) {
+		_, err := config.Load(filepath.Join(t.TempDir(), "missing.yaml"))
+		assert.Error(t, err)
+	})
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"FANFICUPDATES_SERVER_ADDR":     ":1234",
+		"FANFICUPDATES_UPDATE_INTERVAL": "1d",
+		"FANFICUPDATES_SKIP_FIRST":      "true",
+		"FANFICUPDATES_HISTORY_DIR":     "/history",
+		"FANFICUPDATES_RULES":           "tag:noupdate skip\n\ntag:complete interval=7d\n",
+		"UNRELATED":                     "value",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	cfg := config.Default()
+	require.NoError(t, cfg.ApplyEnv(lookup))
+	assert.Equal(t, ":1234", cfg.Server.Addr)
+	assert.Equal(t, config.Duration(24*time.Hour), cfg.UpdateInterval)
+	assert.True(t, cfg.SkipFirst)
+	assert.Equal(t, "/history", cfg.History.Dir)
+	assert.Equal(t, []string{"tag:noupdate skip", "tag:complete interval=7d"}, cfg.Rules)
+
+	env["FANFICUPDATES_BATCH_SIZE"] = "many"
+	assert.ErrorContains(t, cfg.ApplyEnv(lookup), "FANFICUPDATES_BATCH_SIZE")
+}
+
+func TestScheduler(t *testing.T) {
+	cfg := config.Default()
+	cfg.Timezone = "UTC"
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	scheduler, err := cfg.Scheduler(start)
+	require.NoError(t, err)
+	assert.Equal(t, start.Add(8*time.Hour), scheduler.NextRun(), "should fall back to update interval")
+
+	cfg.Schedules = []config.Schedule{{Cron: "@daily"}}
+	_, err = cfg.Scheduler(start)
+	assert.ErrorContains(t, err, "schedules[0].select")
+
+	cfg.Schedules = []config.Schedule{{Cron: "@hourly", Select: "not tag:complete", MetadataOnly: true}}
+	scheduler, err = cfg.Scheduler(start)
+	require.NoError(t, err)
+	require.Len(t, scheduler.Groups(), 2)
+	assert.True(t, scheduler.Groups()[0].MetadataOnly)
+	assert.False(t, scheduler.Groups()[1].MetadataOnly)
+
+	cfg.Schedules = nil
+	cfg.Timezone = "Nowhere/Special"
+	_, err = cfg.Scheduler(start)
+	assert.ErrorContains(t, err, "timezone")
+}
+
+func TestLibraries(t *testing.T) {
+	cfg := config.Default()
+	cfg.Settings = t.TempDir()
+	cfg.Library = t.TempDir()
+	cfg.Select = "site:ao3"
+	libraries := cfg.LibraryList()
+	require.Len(t, libraries, 1)
+	assert.Equal(t, "", libraries[0].Name)
+	assert.Equal(t, cfg.Library, libraries[0].Path)
+	assert.Equal(t, filepath.Join(cfg.Settings, "fanficupdates.json"), libraries[0].StatePath(cfg.Settings))
+	assert.Equal(t, filepath.Join(cfg.Settings, "fanficupdates-history"), libraries[0].HistoryPath(cfg.Settings))
+	cfg.History.Dir = "/history"
+	assert.Equal(t, "/history", cfg.LibraryList()[0].HistoryPath(cfg.Settings))
+
+	first, second := t.TempDir(), t.TempDir()
+	cfg.Libraries = []config.Library{
+		{Name: "alice", Path: first},
+		{Name: "bob", Path: second, Select: "tag:bob", Rules: []string{}},
+	}
+	require.NoError(t, cfg.Validate())
+	libraries = cfg.LibraryList()
+	require.Len(t, libraries, 2)
+	assert.Equal(t, cfg.Settings, libraries[0].Settings)
+	assert.Equal(t, "site:ao3", libraries[0].Select)
+	assert.Equal(t, rules.DefaultRules, libraries[0].Rules)
+	assert.Equal(t, "tag:bob", libraries[1].Select)
+	assert.Empty(t, libraries[1].Rules)
+	assert.Equal(t, filepath.Join(cfg.Settings, "fanficupdates-bob.json"), libraries[1].StatePath(cfg.Settings))
+	assert.Equal(t, filepath.Join(cfg.Settings, "fanficupdates-bob-review"), libraries[1].ReviewPath(cfg.Settings))
+	assert.Equal(t, filepath.Join(cfg.Settings, "fanficupdates-bob-updates.json"), libraries[1].UpdatesPath(cfg.Settings))
+
+	cfg.Libraries = append(cfg.Libraries,
+		config.Library{Name: "bob", Path: second},
+		config.Library{Name: "no/slash", Path: second},
+		config.Library{Name: "nopath"},
+	)
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `libraries[2].name: duplicate library "bob"`)
+	assert.Contains(t, err.Error(), "libraries[3].name")
+	assert.Contains(t, err.Error(), "libraries[4].path: must not be empty")
+}
+
+func TestContentServer(t *testing.T) {
+	cfg := config.Default()
+	cfg.Library = filepath.Join(t.TempDir(), "missing") // Ignored
+	require.NoError(t, cfg.ApplyEnv(func(name string) (string, bool) {
+		value, ok := map[string]string{
+			"FANFICUPDATES_CONTENT_SERVER_URL":      "http://localhost:8080/#Books",
+			"FANFICUPDATES_CONTENT_SERVER_USERNAME": "reader",
+			"FANFICUPDATES_CONTENT_SERVER_PASSWORD": "secret",
+		}[name]
+		return value, ok
+	}))
+	require.NoError(t, cfg.Validate())
+	libraries := cfg.LibraryList()
+	require.Len(t, libraries, 1)
+	assert.Equal(t, config.ContentServer{URL: "http://localhost:8080/#Books", Username: "reader", Password: "secret"}, libraries[0].ContentServer)
+
+	cfg.ContentServer = config.ContentServer{URL: "ftp://localhost/", Username: "reader"}
+	cfg.Libraries = []config.Library{
+		{Name: "remote", ContentServer: config.ContentServer{URL: "https://example.com/"}},
+		{Name: "both", Path: t.TempDir(), ContentServer: config.ContentServer{URL: "https://example.com/"}},
+	}
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "content_server.url: \"ftp://localhost/\" is not an http or https URL")
+	assert.Contains(t, err.Error(), "content_server: username and password must be set together")
+	assert.Contains(t, err.Error(), "libraries[1].path: must not be set with content_server.url")
+	assert.NotContains(t, err.Error(), "libraries[0]")
+}
+
+func TestFanFicFare(t *testing.T) {
+	cfg := config.Default()
+	require.NoError(t, cfg.ApplyEnv(func(name string) (string, bool) {
+		value, ok := map[string]string{
+			"FANFICUPDATES_FANFICFARE_RUNNER":  "cli",
+			"FANFICUPDATES_FANFICFARE_COMMAND": "/opt/fanficfare",
+		}[name]
+		return value, ok
+	}))
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, config.FanFicFare{Runner: config.RunnerCLI, Command: "/opt/fanficfare"}, cfg.FanFicFare)
+
+	cfg.FanFicFare.Runner = "docker"
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `fanficfare.runner: "docker" must be "plugin" or "cli"`)
+	assert.Contains(t, err.Error(), `fanficfare.command: only allowed with runner "cli"`)
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.Default()
+	cfg.Library = filepath.Join(t.TempDir(), "missing")
+	cfg.Server.Username = "reader"
+	cfg.UpdateInterval = 0
+	cfg.Select = "(oops"
+	cfg.FieldPolicies = map[string]string{"comments": "sometimes"}
+	cfg.Rules = []string{"tag:complete explode"}
+	cfg.Sites = map[string]config.SiteLimit{"example.com": {MaxPerRun: -1}}
+	cfg.Notify = []config.NotifyTarget{{URL: "ftp://example.com"}}
+	cfg.Schedule.MetadataOnly = true
+	cfg.Regression.MaxWordLoss = 1.5
+	cfg.Retry = map[string]config.RetryPolicy{
+		"gremlins":  {Backoff: config.Duration(time.Hour)},
+		"not-found": {Quarantine: 2},
+	}
+
+	err := cfg.Validate()
+	var validationErr *config.ValidationError
+	require.True(t, errors.As(err, &validationErr), "unexpected error %v", err)
+	prefixes := make([]string, 0, len(validationErr.Problems))
+	for _, problem := range validationErr.Problems {
+		prefixes = append(prefixes, strings.SplitN(problem, ":", 2)[0])
+	}
+	assert.Equal(t, []string{
+		"field_policies",
+		"library",
+		"notify[0].url",
+		"regression.max_word_loss",
+		"retry.gremlins",
+		"retry.not-found.backoff",
+		"rules[0]",
+		"schedule.cron",
+		"schedule.metadata_only",
+		"select",
+		"server",
+		"sites.example.com.max_per_run",
+		"update_interval",
+	}, prefixes)
+	assert.Contains(t, err.Error(), "invalid configuration")
+}
@@ -0,0 +1,369 @@
+// Package dedupe finds books in a library that are copies of the same story,
+// such as from importing a story twice, and merges them into one book.
+package dedupe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/storyurl"
+)
+
+// Reason describes why books were grouped as duplicates.
+type Reason string
+
+const (
+	ReasonURL   Reason = "url"   // The books have the same normalized story URL
+	ReasonTitle Reason = "title" // The books have similar titles and a common author
+)
+
+// Group is a set of books that appear to be the same story.
+type Group struct {
+	Reason Reason
+	Key    string              // The story key, or the normalized title
+	Books  []model.CalibreBook // Sorted by ID
+}
+
+// Ids returns the IDs of the books in the group.
+func (g Group) Ids() []int {
+	result := make([]int, 0, len(g.Books))
+	for _, book := range g.Books {
+		result = append(result, book.Id)
+	}
+	return result
+}
+
+// Finder finds and merges duplicate books.
+type Finder struct {
+	// Normalizer is used to find the stories of the books; if nil, only the
+	// built-in rules are used.
+	Normalizer *storyurl.Normalizer
+	// Library is where duplicates are merged.
+	Library calibre.Library
+}
+
+// normalizeTitle returns the title in a form where insignificant differences,
+// such as case and punctuation, are removed.
+func normalizeTitle(title string) string {
+	words := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// shareAuthor returns whether the books have an author in common, ignoring
+// case and surrounding spaces.
+func shareAuthor(a, b model.CalibreBook) bool {
+	for _, first := range a.Authors {
+		for _, second := range b.Authors {
+			if strings.EqualFold(strings.TrimSpace(first), strings.TrimSpace(second)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Find returns the groups of duplicate books.  Books are grouped first by
+// their normalized story URLs; books with the same normalized title and a
+// common author are also grouped, unless they were already grouped by URL.
+func (f *Finder) Find(ctx context.Context, books []model.CalibreBook) []Group {
+	return group(books, func(raw string) (storyurl.Story, bool) {
+		return f.Normalizer.Normalize(ctx, raw)
+	})
+}
+
+// FindKnown returns the groups of duplicate books as Find does, but normalizes
+// story URLs with the built-in rules only, so that no pages are fetched.
+func (f *Finder) FindKnown(books []model.CalibreBook) []Group {
+	return group(books, storyurl.Parse)
+}
+
+// group returns the groups of duplicate books, using the given function to
+// normalize story URLs; see Find.
+func group(books []model.CalibreBook, normalize func(raw string) (storyurl.Story, bool)) []Group {
+	keys := make(map[int]string, len(books))
+	byKey := make(map[string][]model.CalibreBook)
+	byTitle := make(map[string][]model.CalibreBook)
+	for _, book := range books {
+		if raw, ok := book.Identifiers["url"]; ok {
+			if story, ok := normalize(raw); ok {
+				keys[book.Id] = story.Key
+				byKey[story.Key] = append(byKey[story.Key], book)
+			}
+		}
+		if title := normalizeTitle(book.Title); title != "" {
+			byTitle[title] = append(byTitle[title], book)
+		}
+	}
+
+	var result []Group
+	for key, matched := range byKey {
+		if len(matched) > 1 {
+			result = append(result, Group{Reason: ReasonURL, Key: key, Books: matched})
+		}
+	}
+	for title, matched := range byTitle {
+		// Split the books with the same title into sets with common authors.
+		var clusters [][]model.CalibreBook
+		for _, book := range matched {
+			var merged []model.CalibreBook
+			remaining := clusters[:0]
+			for _, cluster := range clusters {
+				if shareAuthorWithAny(book, cluster) {
+					merged = append(merged, cluster...)
+				} else {
+					remaining = append(remaining, cluster)
+				}
+			}
+			clusters = append(remaining, append(merged, book))
+		}
+		for _, cluster := range clusters {
+			if len(cluster) > 1 && !sameKey(cluster, keys) {
+				result = append(result, Group{Reason: ReasonTitle, Key: title, Books: cluster})
+			}
+		}
+	}
+
+	for _, group := range result {
+		sort.Slice(group.Books, func(i, j int) bool { return group.Books[i].Id < group.Books[j].Id })
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Reason != result[j].Reason {
+			return result[i].Reason == ReasonURL
+		}
+		return result[i].Books[0].Id < result[j].Books[0].Id
+	})
+	return result
+}
+
+// shareAuthorWithAny returns whether the book has an author in common with any
+// of the others.
+func shareAuthorWithAny(book model.CalibreBook, others []model.CalibreBook) bool {
+	for _, other := range others {
+		if shareAuthor(book, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameKey returns whether all the books have the same story key, in which case
+// they have already been grouped by URL.
+func sameKey(books []model.CalibreBook, keys map[int]string) bool {
+	key, ok := keys[books[0].Id]
+	if !ok {
+		return false
+	}
+	for _, book := range books[1:] {
+		if keys[book.Id] != key {
+			return false
+		}
+	}
+	return true
+}
+
+// MergeResult describes the outcome of merging duplicate books.
+type MergeResult struct {
+	Kept     int      `json:"kept"`               // The ID of the remaining book
+	EpubFrom int      `json:"epubFrom,omitempty"` // The ID of the book whose EPUB was kept, if any
+	Removed  []int    `json:"removed"`            // The IDs of the books removed
+	Changed  []string `json:"changed,omitempty"`  // The metadata fields changed on the kept book
+}
+
+// richness scores how complete the metadata of the book is.
+func richness(book model.CalibreBook) int {
+	score := len(book.Tags) + len(book.Identifiers) + len(book.Languages)
+	for _, filled := range []bool{
+		book.Comments != "",
+		book.Publisher != "",
+		book.Series != "",
+		!book.PubDate.IsZero(),
+		book.Cover != "",
+	} {
+		if filled {
+			score++
+		}
+	}
+	for label := range book.CustomColumns {
+		if _, ok := book.Custom(label); ok {
+			score++
+		}
+	}
+	return score
+}
+
+// hasEpub returns whether the book has an EPUB file.
+func hasEpub(book model.CalibreBook) bool {
+	for _, format := range book.Formats {
+		if strings.EqualFold(filepath.Ext(format), ".epub") {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge merges the given books into one: the book with the richest metadata
+// is kept, and receives the most recently modified EPUB, any metadata it is
+// missing from the others, all of their tags and identifiers, and the earliest
+// date added.  The other books are then removed.
+func (f *Finder) Merge(ctx context.Context, books []model.CalibreBook) (MergeResult, error) {
+	if len(books) < 2 {
+		return MergeResult{}, errors.New("at least two books are needed to merge")
+	}
+	books = append([]model.CalibreBook(nil), books...)
+	sort.SliceStable(books, func(i, j int) bool {
+		if a, b := richness(books[i]), richness(books[j]); a != b {
+			return a > b
+		}
+		return books[i].Id < books[j].Id
+	})
+	kept := books[0]
+	result := MergeResult{Kept: kept.Id}
+
+	var newest *model.CalibreBook
+	for i, book := range books {
+		if hasEpub(book) && (newest == nil || book.LastModified.After(newest.LastModified.Time)) {
+			newest = &books[i]
+		}
+	}
+	if newest != nil {
+		result.EpubFrom = newest.Id
+		if newest.Id != kept.Id {
+			if err := f.copyEpub(ctx, *newest, kept); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	meta := f.mergedMeta(kept, books[1:])
+	result.Changed = meta.Changes(kept)
+	if len(result.Changed) > 0 {
+		if err := f.Library.UpdateMetadata(ctx, kept.Id, meta); err != nil {
+			return result, fmt.Errorf("could not merge metadata into %s: %w", kept.Title, err)
+		}
+	}
+
+	for _, book := range books[1:] {
+		result.Removed = append(result.Removed, book.Id)
+	}
+	if err := f.Library.RemoveBooks(ctx, result.Removed...); err != nil {
+		return result, err
+	}
+	logrus.Infof("Merged duplicates of %s into #%d, removing %v", kept.Title, kept.Id, result.Removed)
+	return result, nil
+}
+
+// copyEpub replaces the EPUB of the target book with that of the source.
+func (f *Finder) copyEpub(ctx context.Context, source, target model.CalibreBook) error {
+	reader, err := f.Library.OpenFormat(ctx, source, "epub")
+	if err != nil {
+		return fmt.Errorf("could not read EPUB of #%d: %w", source.Id, err)
+	}
+	defer reader.Close()
+	dir, err := os.MkdirTemp("", "fanficupdates-merge-*")
+	if err != nil {
+		return fmt.Errorf("could not create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	workFile := filepath.Join(dir, "book.epub")
+	file, err := os.Create(workFile)
+	if err != nil {
+		return fmt.Errorf("could not create temporary file: %w", err)
+	}
+	if _, err = io.Copy(file, reader); err != nil {
+		file.Close()
+		return fmt.Errorf("could not copy EPUB of #%d: %w", source.Id, err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("could not write temporary file: %w", err)
+	}
+	return f.Library.AddFormat(ctx, target.Id, workFile)
+}
+
+// mergedMeta returns the update that fills in the metadata of the kept book
+// from the others.
+func (f *Finder) mergedMeta(kept model.CalibreBook, others []model.CalibreBook) calibre.UpdateMeta {
+	var meta calibre.UpdateMeta
+	tags := append([]string(nil), kept.Tags...)
+	identifiers := make(map[string]string, len(kept.Identifiers))
+	for key, value := range kept.Identifiers {
+		identifiers[key] = value
+	}
+	for _, other := range others {
+		if kept.Comments == "" && meta.Comments == "" {
+			meta.Comments = other.Comments
+		}
+		if kept.Publisher == "" && meta.Publisher == "" {
+			meta.Publisher = other.Publisher
+		}
+		if kept.Series == "" && meta.Series == "" && other.Series != "" {
+			meta.Series = other.Series
+			meta.SeriesIndex = other.SeriesIndex
+		}
+		if kept.PubDate.IsZero() && meta.Published.IsZero() {
+			meta.Published = other.PubDate.Time
+		}
+		if !other.Timestamp.IsZero() && other.Timestamp.Before(kept.Timestamp.Time) &&
+			(meta.Timestamp.IsZero() || other.Timestamp.Before(meta.Timestamp)) {
+			meta.Timestamp = other.Timestamp.Time
+		}
+		for _, tag := range other.Tags {
+			if !containsFold(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		for key, value := range other.Identifiers {
+			if _, ok := identifiers[key]; !ok {
+				identifiers[key] = value
+			}
+		}
+		for label, value := range other.CustomColumns {
+			_, filled := kept.Custom(label)
+			_, pending := meta.Fields["#"+label]
+			if !filled && !pending && !value.IsEmpty() {
+				meta.SetCustom(label, value)
+			}
+		}
+	}
+	if len(tags) > len(kept.Tags) {
+		setField(&meta, "tags", strings.Join(tags, ","))
+	}
+	if len(identifiers) > len(kept.Identifiers) {
+		if serialized, err := calibre.SerializeIdentifiers(identifiers); err != nil {
+			logrus.Warnf("Not merging identifiers into %s: %v", kept.Title, err)
+		} else {
+			setField(&meta, "identifiers", serialized)
+		}
+	}
+	return meta
+}
+
+// setField sets a field of the update by its Calibre name.
+func setField(meta *calibre.UpdateMeta, name, value string) {
+	if meta.Fields == nil {
+		meta.Fields = make(map[string]string)
+	}
+	meta.Fields[name] = value
+}
+
+// containsFold returns whether the list contains the value, ignoring case.
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
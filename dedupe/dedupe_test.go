@@ -0,0 +1,140 @@
+package dedupe
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/calibre/memory"
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/storyurl"
+	"github.com/mook/fanficupdates/util"
+)
+
+func TestFind(t *testing.T) {
+	ctx := context.Background()
+	book := func(id int, title, author, link string) model.CalibreBook {
+		result := model.CalibreBook{Id: id, Title: title, Authors: []string{author}}
+		if link != "" {
+			result.Identifiers = map[string]string{"url": link}
+		}
+		return result
+	}
+	books := []model.CalibreBook{
+		book(1, "Story", "Writer", "https://archiveofourown.org/works/1"),
+		book(2, "Story (reimport)", "Someone", "http://www.archiveofourown.org/works/1/chapters/5"),
+		book(3, "Another Story!", "Writer", "https://www.fanfiction.net/s/2/1/"),
+		book(4, "another story", "WRITER", ""),
+		book(5, "Another Story", "Different", ""),
+		book(6, "Story", "Writer", "https://archiveofourown.org/works/1"),
+		book(7, "Mirrored", "Writer", "https://mirror.example/story/7"),
+		book(8, "Mirrored copy", "Writer", "https://example.com/works/7"),
+	}
+	subject := &Finder{
+		Normalizer: &storyurl.Normalizer{
+			Resolve: func(ctx context.Context, raw string) (string, error) {
+				return "https://example.com/works/7", nil
+			},
+		},
+	}
+	groups := subject.Find(ctx, books)
+	type summary struct {
+		Reason Reason
+		Key    string
+		Ids    []int
+	}
+	summaries := make([]summary, 0, len(groups))
+	for _, group := range groups {
+		summaries = append(summaries, summary{group.Reason, group.Key, group.Ids()})
+	}
+	assert.Equal(t, []summary{
+		{ReasonURL, "ao3:1", []int{1, 2, 6}},
+		{ReasonURL, "url:example.com/works/7", []int{7, 8}},
+		{ReasonTitle, "another story", []int{3, 4}},
+	}, summaries, "books 1 and 6 should only be reported by URL")
+
+	assert.Empty(t, (&Finder{}).Find(ctx, books[2:3]))
+
+	known := util.Map(subject.FindKnown(books), func(g Group) string { return g.Key })
+	assert.Equal(t, []string{"ao3:1", "another story"}, known, "only the built-in rules should be used")
+}
+
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+	added := model.Time3339{Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	library := memory.NewLibrary(
+		model.CalibreBook{
+			Id:          1,
+			Title:       "Story",
+			Authors:     []string{"Writer"},
+			Timestamp:   model.Time3339{Time: added.AddDate(1, 0, 0)},
+			Tags:        []string{"wip", "romance"},
+			Comments:    "Summary",
+			Identifiers: map[string]string{"url": "https://archiveofourown.org/works/1"},
+		},
+		model.CalibreBook{
+			Id:          2,
+			Title:       "Story",
+			Authors:     []string{"Writer"},
+			Timestamp:   added,
+			Tags:        []string{"Romance", "favourite"},
+			Publisher:   "Archive of Our Own",
+			Identifiers: map[string]string{"url": "https://archiveofourown.org/works/1/chapters/2", "isbn": "123"},
+		},
+	)
+	library.SetCustomColumns(map[string]model.CustomColumn{
+		"status": {Label: "status", Datatype: model.CustomText},
+	})
+	require.NoError(t, library.UpdateMetadata(ctx, 2, calibre.UpdateMeta{Fields: map[string]string{"#status": "In-Progress"}}))
+	require.NoError(t, library.SetFile(1, "epub", []byte("old")))
+	require.NoError(t, library.SetFile(2, "epub", []byte("new")))
+	books, err := library.GetBooks(ctx)
+	require.NoError(t, err)
+	books[0].LastModified = added
+	books[1].LastModified = model.Time3339{Time: added.AddDate(2, 0, 0)}
+
+	subject := &Finder{Library: library}
+	_, err = subject.Merge(ctx, books[:1])
+	assert.Error(t, err)
+
+	result, err := subject.Merge(ctx, books)
+	require.NoError(t, err)
+	assert.Equal(t, MergeResult{
+		Kept:     2,
+		EpubFrom: 2,
+		Removed:  []int{1},
+		Changed:  []string{"comments", "tags"},
+	}, result)
+	books, err = library.GetBooks(ctx)
+	require.NoError(t, err)
+	require.Len(t, books, 1)
+	assert.Equal(t, "Summary", books[0].Comments)
+	assert.Equal(t, []string{"Romance", "favourite", "wip"}, books[0].Tags)
+	assert.True(t, books[0].Timestamp.Equal(added.Time))
+	contents, _ := library.File(2, "epub")
+	assert.Equal(t, "new", string(contents))
+
+	t.Run("newer epub on other book", func(t *testing.T) {
+		library := memory.NewLibrary(
+			model.CalibreBook{Id: 1, Title: "Rich", Comments: "Summary", Tags: []string{"a"}},
+			model.CalibreBook{Id: 2, Title: "Poor"},
+		)
+		require.NoError(t, library.SetFile(1, "epub", []byte("old")))
+		require.NoError(t, library.SetFile(2, "epub", []byte("new")))
+		books, err := library.GetBooks(ctx)
+		require.NoError(t, err)
+		books[1].LastModified = model.Time3339{Time: books[0].LastModified.Add(time.Hour)}
+		result, err := (&Finder{Library: library}).Merge(ctx, books)
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.Kept)
+		assert.Equal(t, 2, result.EpubFrom)
+		contents, _ := library.File(1, "epub")
+		assert.Equal(t, "new", string(contents))
+		_, ok := library.File(2, "epub")
+		assert.False(t, ok)
+	})
+}
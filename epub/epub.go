@@ -0,0 +1,158 @@
+// Package epub reads metadata from EPUB files.
+package epub
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Where the source URL of a book was found.
+const (
+	FromSource     = "dc:source"     // The dc:source element of the OPF metadata
+	FromIdentifier = "dc:identifier" // A URL dc:identifier of the OPF metadata
+	FromTitlePage  = "title page"    // The "Source:" link on the title page
+)
+
+// ErrNoSource is returned when the EPUB does not contain a source URL.
+var ErrNoSource = errors.New("no source URL found")
+
+// container is META-INF/container.xml, which locates the OPF file.
+type container struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+// packageMetadata is the part of the OPF file that may hold the source.
+type packageMetadata struct {
+	Sources     []string `xml:"metadata>source"`
+	Identifiers []struct {
+		Scheme string `xml:"scheme,attr"`
+		Value  string `xml:",chardata"`
+	} `xml:"metadata>identifier"`
+}
+
+// titlePageSource matches the source link on title pages written by
+// FanFicFare, such as <b>Source:</b> <a href="https://...">.
+var titlePageSource = regexp.MustCompile(`(?is)Source:\s*(?:</[a-z]+>\s*)*<a[^>]+href="([^"]+)"`)
+
+// isStoryURL returns whether the value is an absolute http(s) URL.
+func isStoryURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// readFile returns the contents of the named file in the archive.
+func readFile(archive *zip.Reader, name string) ([]byte, error) {
+	file, err := archive.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// SourceURL returns the URL of the story the EPUB was made from, and where it
+// was found (FromSource, FromIdentifier or FromTitlePage).  The OPF metadata
+// is preferred; otherwise, title pages are searched.  If there is no source,
+// the error is ErrNoSource.
+func SourceURL(r io.ReaderAt, size int64) (string, string, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", "", fmt.Errorf("could not open EPUB: %w", err)
+	}
+
+	data, err := readFile(archive, "META-INF/container.xml")
+	if err != nil {
+		return "", "", fmt.Errorf("could not read EPUB container: %w", err)
+	}
+	var rootContainer container
+	if err = xml.Unmarshal(data, &rootContainer); err != nil {
+		return "", "", fmt.Errorf("could not parse EPUB container: %w", err)
+	}
+	for _, rootfile := range rootContainer.Rootfiles {
+		data, err = readFile(archive, rootfile.FullPath)
+		if err != nil {
+			return "", "", fmt.Errorf("could not read %s: %w", rootfile.FullPath, err)
+		}
+		var metadata packageMetadata
+		if err = xml.Unmarshal(data, &metadata); err != nil {
+			return "", "", fmt.Errorf("could not parse %s: %w", rootfile.FullPath, err)
+		}
+		for _, source := range metadata.Sources {
+			if source = strings.TrimSpace(source); isStoryURL(source) {
+				return source, FromSource, nil
+			}
+		}
+		for _, identifier := range metadata.Identifiers {
+			value := strings.TrimSpace(identifier.Value)
+			if strings.EqualFold(identifier.Scheme, "URL") && isStoryURL(value) {
+				return value, FromIdentifier, nil
+			}
+		}
+	}
+
+	var titlePages []string
+	for _, file := range archive.File {
+		name := strings.ToLower(path.Base(file.Name))
+		if strings.Contains(name, "title") && (strings.HasSuffix(name, ".xhtml") || strings.HasSuffix(name, ".html")) {
+			titlePages = append(titlePages, file.Name)
+		}
+	}
+	sort.Strings(titlePages)
+	for _, name := range titlePages {
+		data, err = readFile(archive, name)
+		if err != nil {
+			return "", "", fmt.Errorf("could not read %s: %w", name, err)
+		}
+		if match := titlePageSource.FindSubmatch(data); match != nil {
+			if source := html.UnescapeString(string(match[1])); isStoryURL(source) {
+				return source, FromTitlePage, nil
+			}
+		}
+	}
+	return "", "", ErrNoSource
+}
+
+// tagMatcher matches markup, which is removed before counting words.
+var tagMatcher = regexp.MustCompile(`(?s)<head.*?</head>|<[^>]*>`)
+
+// isFrontMatter returns whether the named file is a title page or table of
+// contents, which are not part of the story text.
+func isFrontMatter(name string) bool {
+	name = strings.ToLower(path.Base(name))
+	return strings.Contains(name, "title") || strings.Contains(name, "toc") || strings.Contains(name, "nav")
+}
+
+// WordCount returns the number of words in the text of the EPUB, excluding
+// title pages and tables of contents.  This is only an estimate, meant for
+// comparing versions of the same book.
+func WordCount(r io.ReaderAt, size int64) (int, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return 0, fmt.Errorf("could not open EPUB: %w", err)
+	}
+	count := 0
+	for _, file := range archive.File {
+		name := strings.ToLower(file.Name)
+		if !strings.HasSuffix(name, ".xhtml") && !strings.HasSuffix(name, ".html") || isFrontMatter(name) {
+			continue
+		}
+		data, err := readFile(archive, file.Name)
+		if err != nil {
+			return 0, fmt.Errorf("could not read %s: %w", file.Name, err)
+		}
+		text := html.UnescapeString(tagMatcher.ReplaceAllString(string(data), " "))
+		count += len(strings.Fields(text))
+	}
+	return count, nil
+}
@@ -0,0 +1,96 @@
+package epub
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mook/fanficupdates/epub/epubtest"
+)
+
+// makeEpub returns an EPUB with the given files, in addition to the container.
+func makeEpub(t *testing.T, files map[string]string) *bytes.Reader {
+	return bytes.NewReader(epubtest.Make(t, files))
+}
+
+func TestSourceURL(t *testing.T) {
+	cases := []struct {
+		name  string
+		files map[string]string
+		url   string
+		found string
+	}{
+		{
+			name: "source",
+			files: map[string]string{"content.opf": epubtest.OPF(`
+				<dc:identifier opf:scheme="URL">https://example.com/identifier</dc:identifier>
+				<dc:source>https://example.com/story/1</dc:source>`)},
+			url:   "https://example.com/story/1",
+			found: FromSource,
+		},
+		{
+			name: "identifier",
+			files: map[string]string{"content.opf": epubtest.OPF(`
+				<dc:identifier opf:scheme="UUID">1234</dc:identifier>
+				<dc:identifier opf:scheme="URL"> https://example.com/story/2 </dc:identifier>
+				<dc:source>not a url</dc:source>`)},
+			url:   "https://example.com/story/2",
+			found: FromIdentifier,
+		},
+		{
+			name: "title page",
+			files: map[string]string{
+				"content.opf": epubtest.OPF(""),
+				"OEBPS/title_page.xhtml": `<html><body>
+					<b>Author:</b> <a href="https://example.com/author">Writer</a><br/>
+					<b>Source:</b> <a href="https://example.com/story?sid=3&amp;chapter=1">Story</a><br/>
+				</body></html>`,
+			},
+			url:   "https://example.com/story?sid=3&chapter=1",
+			found: FromTitlePage,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reader := makeEpub(t, c.files)
+			url, found, err := SourceURL(reader, reader.Size())
+			require.NoError(t, err)
+			assert.Equal(t, c.url, url)
+			assert.Equal(t, c.found, found)
+		})
+	}
+
+	t.Run("no source", func(t *testing.T) {
+		reader := makeEpub(t, map[string]string{
+			"content.opf":      epubtest.OPF(""),
+			"OEBPS/title.html": "<p>No links here</p>",
+		})
+		_, _, err := SourceURL(reader, reader.Size())
+		assert.ErrorIs(t, err, ErrNoSource)
+	})
+	t.Run("not an epub", func(t *testing.T) {
+		reader := bytes.NewReader([]byte("not a zip file"))
+		_, _, err := SourceURL(reader, reader.Size())
+		assert.ErrorContains(t, err, "could not open EPUB")
+	})
+}
+
+func TestWordCount(t *testing.T) {
+	reader := makeEpub(t, map[string]string{
+		"content.opf":            epubtest.OPF(""),
+		"OEBPS/title_page.xhtml": "<p>Title page words are not counted</p>",
+		"OEBPS/toc.xhtml":        "<p>Neither are these</p>",
+		"OEBPS/file0001.xhtml":   "<html><head><title>Chapter One</title></head><body><p>Three little words</p></body></html>",
+		"OEBPS/file0002.xhtml":   "<p>And&nbsp;four <b>more</b>words</p>",
+		"OEBPS/style.css":        "p { margin: 0 }",
+	})
+	count, err := WordCount(reader, reader.Size())
+	require.NoError(t, err)
+	assert.Equal(t, 7, count)
+
+	reader = bytes.NewReader([]byte("not a zip file"))
+	_, err = WordCount(reader, reader.Size())
+	assert.Error(t, err)
+}
@@ -0,0 +1,50 @@
+// Package epubtest builds EPUB files for tests.
+package epubtest
+
+import (
+	"archive/zip"
+	"bytes"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Container is the container document of the EPUBs built by Make, which points
+// to the package document content.opf.
+const Container = `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`
+
+// Make returns an EPUB with the given files, keyed by name, in addition to the
+// container.
+func Make(t require.TestingT, files map[string]string) []byte {
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	if _, ok := files["META-INF/container.xml"]; !ok {
+		file, err := writer.Create("META-INF/container.xml")
+		require.NoError(t, err)
+		_, err = file.Write([]byte(Container))
+		require.NoError(t, err)
+	}
+	for name, contents := range files {
+		file, err := writer.Create(name)
+		require.NoError(t, err)
+		_, err = file.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	return buf.Bytes()
+}
+
+// OPF returns a package document with the given metadata elements, in addition
+// to the title.
+func OPF(metadata string) string {
+	return `<?xml version="1.0"?>
+<package version="2.0" xmlns="http://www.idpf.org/2007/opf">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:title>Story</dc:title>` + metadata + `
+  </metadata>
+</package>`
+}
@@ -0,0 +1,57 @@
+package fanficfare
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/mook/fanficupdates/model"
+)
+
+// Error is a failure to update a book, with the class of the failure.
+type Error struct {
+	Class model.ErrorClass
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorClass returns the class of the given error; errors not created by
+// FanFicFare.Process are model.ErrorUnknown.
+func ErrorClass(err error) model.ErrorClass {
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified.Class
+	}
+	return model.ErrorUnknown
+}
+
+// errorPatterns match FanFicFare output (including the exception messages it
+// prints) to the class of failure; the first match wins.
+var errorPatterns = []struct {
+	class   model.ErrorClass
+	matcher *regexp.Regexp
+}{
+	{model.ErrorCloudflare, regexp.MustCompile(`(?i)cloudflare|cf-ray|just a moment\.\.\.`)},
+	{model.ErrorNotFound, regexp.MustCompile(`(?i)story does not exist|StoryDoesNotExist|HTTP Error( in FFF)?\W+404|has been deleted`)},
+	{model.ErrorLoginRequired, regexp.MustCompile(`(?i)failed to log ?in|FailedToLogin|AccessDenied|requires? (a )?log ?in|registered users only`)},
+	{model.ErrorAdultCheck, regexp.MustCompile(`(?i)confirmation of adult status|AdultCheckRequired|adult check`)},
+	{model.ErrorSiteDown, regexp.MustCompile(`(?i)HTTP Error( in FFF)?\W+5\d\d|connection (refused|reset|aborted)|timed out|temporary failure in name resolution|name or service not known|service unavailable|bad gateway`)},
+	{model.ErrorParse, regexp.MustCompile(`(?i)FailedToDownload|Traceback|(Attribute|Index|Key|Type|Value)Error`)},
+}
+
+// Classify returns the class of failure described by the FanFicFare output,
+// or the fallback if it is not recognized.
+func Classify(output string, fallback model.ErrorClass) model.ErrorClass {
+	for _, pattern := range errorPatterns {
+		if pattern.matcher.MatchString(output) {
+			return pattern.class
+		}
+	}
+	return fallback
+}
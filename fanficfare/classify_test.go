@@ -0,0 +1,78 @@
+package fanficfare
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/mook/fanficupdates/calibre/memory"
+	"github.com/mook/fanficupdates/model"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		output   string
+		expected model.ErrorClass
+	}{
+		{"Story does not exist: (https://archiveofourown.org/works/1)", model.ErrorNotFound},
+		{"HTTP Error in FFF '404 Client Error: Not Found'(https://example.com/s/1)", model.ErrorNotFound},
+		{"Failed to Login for URL: (https://example.com/s/1)", model.ErrorLoginRequired},
+		{"Story requires confirmation of adult status: (https://example.com/s/1)", model.ErrorAdultCheck},
+		{"HTTP Error in FFF '503 Server Error: Service Unavailable'", model.ErrorSiteDown},
+		{"<urlopen error [Errno -3] Temporary failure in name resolution>", model.ErrorSiteDown},
+		{"HTTP Error in FFF '403 Client Error: Forbidden' - Cloudflare", model.ErrorCloudflare},
+		{"Traceback (most recent call last):\nAttributeError: 'NoneType' object has no attribute 'find'", model.ErrorParse},
+		{"Something else entirely", model.ErrorUnknown},
+	}
+	for _, testCase := range cases {
+		assert.Equal(t, testCase.expected, Classify(testCase.output, model.ErrorUnknown), testCase.output)
+	}
+	assert.Equal(t, model.ErrorParse, Classify("", model.ErrorParse))
+	assert.Equal(t, model.ErrorUnknown, ErrorClass(errors.New("plain")))
+}
+
+func TestProcessFailures(t *testing.T) {
+	ctx := context.Background()
+	library := memory.NewLibrary(model.CalibreBook{
+		Id:          1,
+		Title:       "Sample Book",
+		Identifiers: map[string]string{"url": "http://supported.test/1"},
+	})
+	require.NoError(t, library.SetFile(1, "epub", []byte("epub")))
+	runner := &ScriptedRunner{
+		Sites: []string{"http://supported.test"},
+		Responses: []ScriptedResponse{
+			{Output: "Story does not exist: (http://supported.test/1)", Err: errors.New("exit status 1")},
+			{Output: "oops", Err: errors.New("exit status 2")},
+		},
+	}
+	subject, err := New(ctx, library, runner)
+	require.NoError(t, err)
+	subject.logger, _ = test.NewNullLogger()
+	books, err := library.GetBooks(ctx)
+	require.NoError(t, err)
+
+	// Failed run, with the class determined from the output.
+	result, err := subject.Process(ctx, books[0])
+	assert.Error(t, err)
+	assert.Equal(t, model.OutcomeFailed, result.Outcome)
+	assert.Equal(t, model.ErrorNotFound, result.ErrorClass)
+	assert.Equal(t, []string{"Story does not exist: (http://supported.test/1)"}, result.Output)
+
+	// Failed run, with unrecognized output.
+	result, err = subject.Process(ctx, books[0])
+	assert.Error(t, err)
+	assert.Equal(t, model.ErrorUnknown, result.ErrorClass)
+
+	// Successful run, but the output could not be read.
+	subject.Runner = &CLIRunner{RunShim: func(cmd *exec.Cmd) ([]byte, error) {
+		return []byte("no metadata"), nil
+	}}
+	result, err = subject.Process(ctx, books[0])
+	assert.Error(t, err)
+	assert.Equal(t, model.ErrorParse, result.ErrorClass)
+}
@@ -4,24 +4,32 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
 	"golang.org/x/net/publicsuffix"
 
 	"github.com/mook/fanficupdates/calibre"
 	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/review"
+	"github.com/mook/fanficupdates/state"
+	"github.com/mook/fanficupdates/storyurl"
 	"github.com/mook/fanficupdates/util"
 	"github.com/sirupsen/logrus"
 )
 
 type meta struct {
 	Author      string
+	AuthorList  any    `json:"authorlist"`
+	AuthorURL   any    `json:"authorUrl"`
 	FormatName  string `json:"formatname"`
 	Description string `json:"description"`
 	LastUpdate  string `json:"lastupdate"`
@@ -38,18 +46,56 @@ type meta struct {
 }
 
 type chapterInner struct {
-	Date   model.Time3339
+	Date   *model.Time3339
 	KWords string `json:"kwords"`
 	Title  string
 	URL    string `json:"url"`
 	Words  string `json:"words"`
 }
 
+// chapter is a single entry of the "zchapters" output from FanFicFare.  It can
+// either be a two-tuple of chapter number and chapter details, or an object
+// containing the chapter details (with the number being optional).
 type chapter struct {
 	Number int `json:"-"`
 	chapterInner
 }
 
+// wordCount returns the number of words in the chapter, or zero if unknown.
+func (c *chapter) wordCount() int {
+	if words := strings.ReplaceAll(strings.TrimSpace(c.Words), ",", ""); words != "" {
+		if count, err := strconv.Atoi(words); err == nil {
+			return count
+		}
+	}
+	if kwords := strings.TrimSpace(c.KWords); kwords != "" {
+		if count, err := strconv.ParseFloat(kwords, 64); err == nil {
+			return int(count * 1000)
+		}
+	}
+	return 0
+}
+
+// chapters returns the chapters listed in the metadata.  Chapters without a
+// number are numbered by their position.
+func (m *meta) chapters() []model.Chapter {
+	result := make([]model.Chapter, 0, len(m.Chapters))
+	for i, chapter := range m.Chapters {
+		number := chapter.Number
+		if number == 0 {
+			number = i + 1
+		}
+		result = append(result, model.Chapter{
+			Number: number,
+			Title:  chapter.Title,
+			URL:    chapter.URL,
+			Date:   chapter.Date,
+			Words:  chapter.wordCount(),
+		})
+	}
+	return result
+}
+
 func (c *chapter) UnmarshalJSON(data []byte) error {
 	token, err := json.NewDecoder(bytes.NewBuffer(data[:])).Token()
 	if err != nil {
@@ -73,7 +119,21 @@ func (c *chapter) UnmarshalJSON(data []byte) error {
 			return err
 		}
 	} else if delim == '{' {
-
+		var numbered struct {
+			Number *int `json:"number"`
+			Index  *int `json:"index"`
+		}
+		if err = json.Unmarshal(data, &numbered); err != nil {
+			return err
+		}
+		if numbered.Number != nil {
+			c.Number = *numbered.Number
+		} else if numbered.Index != nil {
+			c.Number = *numbered.Index
+		}
+		if err = json.Unmarshal(data, &c.chapterInner); err != nil {
+			return err
+		}
 	} else {
 		return fmt.Errorf("unexpected json delimiter %#v parsing chapters", delim)
 	}
@@ -81,13 +141,72 @@ func (c *chapter) UnmarshalJSON(data []byte) error {
 }
 
 type FanFicFare struct {
-	calibre        *calibre.Calibre
 	supportedSites map[string]struct{}
-	logger         logrus.Logger
+	logger         *logrus.Logger
+
+	// Library is where books are read from and updated.
+	Library calibre.Library
+
+	// Runner runs FanFicFare.
+	Runner Runner
+
+	// OnUpdate, if set, is called after a book has been successfully updated
+	// with new chapters.
+	OnUpdate func(update model.StoryUpdate)
+
+	// Store, if set, is used to remember the chapters of each book between
+	// checks.
+	Store *state.Store
+
+	// FieldMap maps FanFicFare metadata keys to Calibre fields, which may be
+	// custom columns.  If nil, DefaultFieldMap is used.
+	FieldMap map[string]string
+
+	// PreserveAuthors, if set, never modifies the authors (and therefore the
+	// author sort) of existing books.
+	PreserveAuthors bool
+
+	// KeepOldURL, if set, keeps the previous URL of a story as the
+	// OldURLIdentifier identifier when FanFicFare reports a different URL.
+	KeepOldURL bool
+
+	// Policies determines which metadata fields may be overwritten; these can
+	// be overridden per book via tags.  See calibre.FieldPolicies.
+	Policies calibre.FieldPolicies
+
+	// MaxChapterLoss is the number of chapters an update may lose before it
+	// is held for review; zero holds any loss, and a negative value never
+	// holds updates for losing chapters.
+	MaxChapterLoss int
+
+	// MaxWordLoss is the fraction of words an update may lose before it is
+	// held for review; zero means DefaultMaxWordLoss, and a negative value
+	// never holds updates for losing words.
+	MaxWordLoss float64
+
+	// Review, if set, is where updates that lose too much content are held;
+	// if nil, such updates are discarded.
+	Review *review.Queue
 }
 
+// OldURLIdentifier is the Calibre identifier holding the previous URL of a
+// story whose URL changed; see FanFicFare.KeepOldURL.
+const OldURLIdentifier = "url_old"
+
+// updateMatcher matches the FanFicFare output line announcing an update, and
+// captures the chapter counts in the existing epub and at the source.
+var updateMatcher = regexp.MustCompile(`^Do update - epub\((\d+)\) vs url\((\d+)\)`)
+
+// NewFanFicFare creates a FanFicFare that updates books in the given Calibre
+// library, running FanFicFare as a Calibre plugin.
 func NewFanFicFare(ctx context.Context, calibre *calibre.Calibre) (*FanFicFare, error) {
-	result := &FanFicFare{calibre: calibre, logger: *logrus.StandardLogger()}
+	return New(ctx, calibre, &PluginRunner{Calibre: calibre})
+}
+
+// New creates a FanFicFare that updates books in the given library, running
+// FanFicFare with the given runner.
+func New(ctx context.Context, library calibre.Library, runner Runner) (*FanFicFare, error) {
+	result := &FanFicFare{Library: library, Runner: runner, logger: logrus.StandardLogger()}
 	err := result.getSupportedSites(ctx)
 	if err != nil {
 		return nil, err
@@ -95,14 +214,23 @@ func NewFanFicFare(ctx context.Context, calibre *calibre.Calibre) (*FanFicFare,
 	return result, nil
 }
 
-// Run FanFicFare with the given command, returning stdout.
-func (f *FanFicFare) run(ctx context.Context, args ...string) (string, error) {
-	resultArgs := []string{"--run-plugin=FanFicFare", "--", "--non-interactive"}
-	if f.calibre.Library != "" {
-		resultArgs = append(resultArgs, "--library-path="+f.calibre.Library)
+// NewNormalizer returns a story URL normalizer that resolves URLs on sites
+// without built-in rules with NormalizeURL.  Unlike New, it does not run
+// FanFicFare until a URL needs resolving.
+func NewNormalizer(runner Runner) *storyurl.Normalizer {
+	f := &FanFicFare{Runner: runner, logger: logrus.StandardLogger()}
+	return &storyurl.Normalizer{Resolve: f.NormalizeURL}
+}
+
+// splitOutput splits the output of an update into the lines of messages and
+// the JSON metadata that follows them.
+func splitOutput(stdout string) ([]string, []byte, bool) {
+	stdout = strings.ReplaceAll(stdout, "\r", "")
+	message, rawJSON, ok := strings.Cut(stdout, "\n{\n")
+	if !ok {
+		return nil, nil, false
 	}
-	resultArgs = append(resultArgs, args...)
-	return f.calibre.Run(ctx, "calibre-debug", resultArgs...)
+	return strings.Split(message, "\n"), []byte("{\n" + rawJSON), true
 }
 
 func (f *FanFicFare) getSupportedSites(ctx context.Context) error {
@@ -111,7 +239,7 @@ func (f *FanFicFare) getSupportedSites(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	helpText, err := f.run(ctx, "--sites-list")
+	helpText, err := f.Runner.Run(ctx, "--sites-list")
 	if err != nil {
 		return err
 	}
@@ -132,90 +260,422 @@ func (f *FanFicFare) getSupportedSites(ctx context.Context) error {
 	return nil
 }
 
-// Process a single book, returning true if an update was found.
-func (f *FanFicFare) Process(ctx context.Context, book model.CalibreBook) (bool, error) {
+// NormalizeURL asks FanFicFare for the canonical form of the given story URL,
+// using --normalize-list; this fetches the page.  The first URL listed on the
+// same site for the same story ID is used; if the URLs listed are all for other
+// stories, the input is returned unchanged.  This is meant as a
+// storyurl.Normalizer resolver, for sites without built-in rules.
+func (f *FanFicFare) NormalizeURL(ctx context.Context, raw string) (string, error) {
+	input, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("could not parse URL %s: %w", raw, err)
+	}
+	tld, err := publicsuffix.EffectiveTLDPlusOne(input.Hostname())
+	if err != nil {
+		return "", fmt.Errorf("could not get eTLD for %s: %w", raw, err)
+	}
+	story, _ := storyurl.Parse(raw)
+	stdout, err := f.Runner.Run(ctx, "--normalize-list", raw)
+	if err != nil {
+		return "", fmt.Errorf("could not normalize %s: %w", raw, err)
+	}
+	mismatched := false
+	for _, line := range strings.Split(stdout, "\n") {
+		u, err := url.Parse(strings.TrimSpace(line))
+		if err != nil || u.Host == "" {
+			continue
+		}
+		if candidate, err := publicsuffix.EffectiveTLDPlusOne(u.Hostname()); err != nil || candidate != tld {
+			continue
+		}
+		if normalized, ok := storyurl.Parse(u.String()); ok && normalized.ID() != "" && normalized.ID() == story.ID() {
+			return u.String(), nil
+		}
+		mismatched = true
+	}
+	if mismatched {
+		f.logger.Debugf("Not normalizing %s, as FanFicFare only listed other stories", raw)
+		return raw, nil
+	}
+	return "", fmt.Errorf("no normalized URL for %s", raw)
+}
+
+// StateKey returns the key used to store state for the given book: the story
+// key (such as "ao3:123"), so that state follows the story rather than the
+// Calibre entry, or the book UUID if the book has no URL.  Only the built-in
+// rules are used, so that keys are stable between runs.
+func StateKey(book model.CalibreBook) string {
+	if story, ok := storyurl.Book(book); ok {
+		return story.Key
+	}
+	return book.Uuid
+}
+
+// Chapters returns the chapters of the book as of the last check, or nil if
+// the book has not been checked.
+func (f *FanFicFare) Chapters(book model.CalibreBook) []model.Chapter {
+	if f.Store == nil {
+		return nil
+	}
+	return f.Store.Get(StateKey(book)).Chapters
+}
+
+// recordCheck persists the result of checking the given book; chapters are
+// only updated if known.
+func (f *FanFicFare) recordCheck(book model.CalibreBook, chapters []model.Chapter) {
+	if f.Store == nil {
+		return
+	}
+	err := f.Store.Update(StateKey(book), func(state *state.Book) {
+		state.LastChecked = model.NewTime3339(time.Time{})
+		if chapters != nil {
+			state.Chapters = chapters
+		}
+	})
+	if err != nil {
+		f.logger.Errorf("could not save state for %s: %v", book.Title, err)
+	}
+}
+
+// Process a single book, describing what happened.  Any extra arguments are
+// passed to FanFicFare.  If an error is returned, the outcome is
+// model.OutcomeFailed and the result includes the class of the failure.
+func (f *FanFicFare) Process(ctx context.Context, book model.CalibreBook, extraArgs ...string) (model.UpdateResult, error) {
+	start := time.Now()
+	result := model.UpdateResult{BookId: book.Id, Title: book.Title}
+	err := f.process(ctx, book, &result, extraArgs)
+	if err != nil {
+		result.Outcome = model.OutcomeFailed
+		result.ErrorClass = ErrorClass(err)
+	}
+	result.Duration = time.Since(start)
+	return result, err
+}
+
+// checkSource returns the source URL of the book, if it can be checked.  If
+// not, the outcome of the result is set and the URL is nil.
+func (f *FanFicFare) checkSource(book model.CalibreBook, result *model.UpdateResult) (*url.URL, error) {
+	if book.HasTag(model.SourceRemovedTag) {
+		// Never overwrite the EPUB of a story that is gone from its source.
+		f.logger.Infof("Skipping %s, removed from its source", book.Title)
+		result.Outcome = model.OutcomeRemoved
+		return nil, nil
+	}
+
 	url := book.Url()
 	if url == nil {
 		// Books without URL is just skipped without error.
-		f.logger.Infof("Skipping %s, no URL", book.Title)
-		return false, nil
+		f.logger.Infof("Skipping %s, no URL (see --find-urls)", book.Title)
+		result.Outcome = model.OutcomeNoURL
+		return nil, nil
 	}
 
 	tld, err := publicsuffix.EffectiveTLDPlusOne(url.Hostname())
 	if err != nil {
-		return false, fmt.Errorf("could not get eTLD for %s: %w", url, err)
+		return nil, fmt.Errorf("could not get eTLD for %s: %w", url, err)
 	}
+	result.Site = tld
 
 	if _, ok := f.supportedSites[tld]; !ok {
 		f.logger.Infof("Skipping %s, not supported", url.String())
-		return false, nil
+		result.Outcome = model.OutcomeUnsupported
+		return nil, nil
 	}
+	return url, nil
+}
+
+// process checks a single book for updates, filling in the result.
+func (f *FanFicFare) process(ctx context.Context, book model.CalibreBook, result *model.UpdateResult, extraArgs []string) error {
+	url, err := f.checkSource(book, result)
+	if url == nil {
+		return err
+	}
+
+	srcFile, err := f.Library.OpenFormat(ctx, book, "epub")
+	if errors.Is(err, os.ErrNotExist) {
+		f.logger.Infof("Skipping %s, no EPUB", book.Title)
+		result.Outcome = model.OutcomeNoEpub
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not open existing epub %s: %w", book.FilePath(), err)
+	}
+	defer srcFile.Close()
 
 	f.logger.Infof("Updating %s: %s", book.Title, url)
 	workFile, err := os.CreateTemp("", "fanficupdates-*.epub")
 	if err != nil {
-		return false, fmt.Errorf("could not create temporary file: %w", err)
+		return fmt.Errorf("could not create temporary file: %w", err)
 	}
 	defer os.Remove(workFile.Name())
 
-	srcFile, err := os.Open(book.FilePath())
-	if err != nil {
-		return false, fmt.Errorf("could not open existing epub %s: %w", book.FilePath(), err)
-	}
 	if _, err = io.Copy(workFile, srcFile); err != nil {
-		return false, fmt.Errorf("could not write temporary epub file: %w", err)
+		return fmt.Errorf("could not write temporary epub file: %w", err)
 	}
 	if err = srcFile.Close(); err != nil {
-		return false, fmt.Errorf("could not close existing epub file: %w", err)
+		return fmt.Errorf("could not close existing epub file: %w", err)
 	}
 	if err = workFile.Close(); err != nil {
-		return false, fmt.Errorf("could not close temporary epub file: %w", err)
+		return fmt.Errorf("could not close temporary epub file: %w", err)
 	}
 	err = os.Chtimes(workFile.Name(), book.Timestamp.Time, book.Timestamp.Time)
 	if err != nil {
-		return false, err
+		return err
 	}
-	stdout, err := f.run(ctx, "--json-meta", "--update-epub", workFile.Name())
+	oldWords := f.epubWordCount(workFile.Name())
+	args := append([]string{"--json-meta", "--update-epub"}, extraArgs...)
+	stdout, err := f.Runner.Run(ctx, append(args, workFile.Name())...)
 	if err != nil {
-		return false, fmt.Errorf("could not update book: %w", err)
+		if output := strings.TrimSpace(stdout); output != "" {
+			result.Output = strings.Split(output, "\n")
+			f.logger.Errorf("%s", output)
+		}
+		return &Error{
+			Class: Classify(stdout+"\n"+err.Error(), model.ErrorUnknown),
+			Err:   fmt.Errorf("could not update book: %w", err),
+		}
 	}
 
-	stdout = strings.ReplaceAll(stdout, "\r", "")
-	message, rawJSON, ok := strings.Cut(stdout, "\n{\n")
+	lines, rawJSON, ok := splitOutput(stdout)
 	if !ok {
+		result.Output = strings.Split(strings.TrimSpace(stdout), "\n")
 		f.logger.Errorf("%s", stdout)
-		return false, fmt.Errorf("could not read JSON output when updating %s", book.FilePath())
+		return &Error{
+			Class: Classify(stdout, model.ErrorParse),
+			Err:   fmt.Errorf("could not read JSON output when updating %s", book.FilePath()),
+		}
 	}
-	for _, line := range strings.Split(message, "\n") {
+	result.Output = lines
+	for _, line := range lines {
 		f.logger.Infof(">>> %s", strings.TrimRightFunc(line, unicode.IsSpace))
 	}
 
-	doingUpdate := util.Any(strings.Split(message, "\n"), func(line string) bool {
+	doingUpdate := util.Any(lines, func(line string) bool {
 		return strings.HasPrefix(line, "Do update -")
 	})
+	var meta meta
+	metaErr := json.Unmarshal(rawJSON, &meta)
 	if !doingUpdate {
 		// Update was skipped
 		f.logger.Infof("Update of %s was skipped.", book.Title)
-		return false, nil
+		result.Outcome = model.OutcomeUpToDate
+		var chapters []model.Chapter
+		if metaErr == nil {
+			result.NewChapters = meta.chapterCount()
+			result.OldChapters = result.NewChapters
+			if len(meta.Chapters) > 0 {
+				chapters = meta.chapters()
+			}
+			f.followURL(ctx, book, meta.StoryURL, result)
+		}
+		f.recordCheck(book, chapters)
+		return nil
 	}
-	var meta meta
-	if err = json.Unmarshal([]byte("{"+rawJSON), &meta); err != nil {
-		f.logger.Debug("{\n" + rawJSON)
-		return false, fmt.Errorf("could not read output metadata: %w", err)
+	var rawMeta map[string]any
+	if metaErr == nil {
+		metaErr = json.Unmarshal(rawJSON, &rawMeta)
 	}
+	if metaErr != nil {
+		f.logger.Debug(string(rawJSON))
+		return &Error{Class: model.ErrorParse, Err: fmt.Errorf("could not read output metadata: %w", metaErr)}
+	}
+	previous := f.Chapters(book)
+	result.OldChapters = oldChapterCount(lines, previous)
+	result.NewChapters = meta.chapterCount()
 
-	updateMeta := calibre.UpdateMeta{
-		Authors:   []string{meta.Author},
-		Comments:  meta.Description,
-		Published: meta.Published.Time,
-		Publisher: meta.Publisher,
-		Series:    meta.Series,
-		Timestamp: meta.Updated.Time,
+	updateMeta := f.makeUpdateMeta(book, meta, rawMeta)
+	result.Changed = updateMeta.Changes(book)
+	loss := regression{
+		OldChapters: result.OldChapters,
+		NewChapters: result.NewChapters,
+		OldWords:    oldWords,
+		NewWords:    f.epubWordCount(workFile.Name()),
 	}
-	if err = f.calibre.UpdateBook(ctx, book.Id, updateMeta, workFile.Name()); err != nil {
-		return false, fmt.Errorf("could not update book: %w", err)
+	if f.isRegression(loss) {
+		return f.hold(book, result, loss, updateMeta, workFile.Name())
+	}
+	if err = f.Library.UpdateMetadata(ctx, book.Id, updateMeta); err != nil {
+		return &Error{Class: model.ErrorCalibreWrite, Err: fmt.Errorf("could not update book: %w", err)}
+	}
+	result.NewURL = newURL(updateMeta, meta.StoryURL)
+	if err = f.Library.AddFormat(ctx, book.Id, workFile.Name()); err != nil {
+		return &Error{Class: model.ErrorCalibreWrite, Err: fmt.Errorf("could not update book: %w", err)}
 	}
 
 	f.logger.Infof("Completed update of %s.", book.Title)
-	return true, nil
+	result.Outcome = model.OutcomeUpdated
+	f.recordCheck(book, meta.chapters())
+	if f.OnUpdate != nil {
+		f.OnUpdate(makeStoryUpdate(book, lines, meta, previous))
+	}
+	return nil
+}
+
+// makeUpdateMeta returns the metadata to set on the book from the FanFicFare
+// metadata, after applying the field policies.
+func (f *FanFicFare) makeUpdateMeta(book model.CalibreBook, meta meta, rawMeta map[string]any) calibre.UpdateMeta {
+	fieldMap := f.FieldMap
+	if fieldMap == nil {
+		fieldMap = DefaultFieldMap
+	}
+	series, seriesIndex := splitSeries(meta.Series)
+	var authors []string
+	if !f.PreserveAuthors && !sameAuthors(book.Authors, meta.authors()) {
+		authors = meta.authors()
+	}
+	updateMeta := calibre.UpdateMeta{
+		Authors:     authors,
+		Comments:    meta.Description,
+		Published:   meta.Published.Time,
+		Publisher:   meta.Publisher,
+		Series:      series,
+		SeriesIndex: seriesIndex,
+		Timestamp:   meta.Updated.Time,
+		Fields:      mapFields(rawMeta, fieldMap),
+	}
+	if mapped, ok := updateMeta.Fields["tags"]; ok {
+		if tags, changed := mergeTags(book.Tags, mapped); changed {
+			updateMeta.Fields["tags"] = tags
+		} else {
+			delete(updateMeta.Fields, "tags")
+		}
+	}
+	if identifiers := f.changedIdentifiers(book, meta.StoryURL); identifiers != "" {
+		updateMeta.Fields["identifiers"] = identifiers
+	}
+	f.Policies.ForBook(book).Apply(&updateMeta, book)
+	if columns := f.Library.CustomColumns(); columns != nil {
+		for field := range updateMeta.Fields {
+			label := strings.TrimPrefix(field, "#")
+			if _, ok := columns[label]; strings.HasPrefix(field, "#") && !ok {
+				f.logger.Warnf("Not setting %s on %s: no such custom column", field, book.Title)
+				delete(updateMeta.Fields, field)
+			}
+		}
+	}
+	return updateMeta
+}
+
+// changedIdentifiers returns the identifiers of the book, as set by calibredb
+// set_metadata, with the url identifier changed to the given story URL.  If the
+// URL has not changed (or is unknown), the result is empty.
+func (f *FanFicFare) changedIdentifiers(book model.CalibreBook, storyURL string) string {
+	storyURL = strings.TrimSpace(storyURL)
+	previous := book.Identifiers["url"]
+	if storyURL == "" || storyURL == previous {
+		return ""
+	}
+	f.logger.Infof("FanFicFare reports a new URL for %s: %s (was %s)", book.Title, storyURL, previous)
+	identifiers := map[string]string{"url": storyURL}
+	for key, value := range book.Identifiers {
+		if key != "url" && key != OldURLIdentifier {
+			identifiers[key] = value
+		}
+	}
+	if f.KeepOldURL && previous != "" {
+		identifiers[OldURLIdentifier] = previous
+	} else if value, ok := book.Identifiers[OldURLIdentifier]; ok {
+		identifiers[OldURLIdentifier] = value
+	}
+	serialized, err := calibre.SerializeIdentifiers(identifiers)
+	if err != nil {
+		f.logger.Warnf("Not changing URL of %s to %s: %v", book.Title, storyURL, err)
+		return ""
+	}
+	return serialized
+}
+
+// followURL updates the url identifier of a book that was not otherwise
+// updated, if FanFicFare reports a different story URL.  Failures are logged,
+// as the book itself was checked successfully.
+func (f *FanFicFare) followURL(ctx context.Context, book model.CalibreBook, storyURL string, result *model.UpdateResult) {
+	identifiers := f.changedIdentifiers(book, storyURL)
+	if identifiers == "" {
+		return
+	}
+	updateMeta := calibre.UpdateMeta{Fields: map[string]string{"identifiers": identifiers}}
+	f.Policies.ForBook(book).Apply(&updateMeta, book)
+	if len(updateMeta.Fields) == 0 {
+		return
+	}
+	if err := f.Library.UpdateMetadata(ctx, book.Id, updateMeta); err != nil {
+		f.logger.Errorf("could not update URL of %s: %v", book.Title, err)
+		return
+	}
+	result.Changed = updateMeta.Changes(book)
+	result.NewURL = newURL(updateMeta, storyURL)
+}
+
+// newURL returns the story URL if the update changes the url identifier to it,
+// or the empty string otherwise.
+func newURL(updateMeta calibre.UpdateMeta, storyURL string) string {
+	if _, ok := updateMeta.Fields["identifiers"]; !ok {
+		return ""
+	}
+	return strings.TrimSpace(storyURL)
+}
+
+// chapterCount returns the number of chapters at the source, or zero if it is
+// not known.
+func (m *meta) chapterCount() int {
+	if len(m.Chapters) > 0 {
+		return len(m.Chapters)
+	}
+	count, _ := strconv.Atoi(strings.TrimSpace(m.NumChapters))
+	return count
+}
+
+// oldChapterCount returns the number of chapters in the existing epub, from
+// the FanFicFare output or else the previous check; zero if it is unknown.
+func oldChapterCount(lines []string, previous []model.Chapter) int {
+	for _, line := range lines {
+		match := updateMatcher.FindStringSubmatch(strings.TrimSpace(line))
+		if match != nil {
+			count, _ := strconv.Atoi(match[1])
+			return count
+		}
+	}
+	return len(previous)
+}
+
+// makeStoryUpdate describes the chapters that were added to the given book,
+// based on the FanFicFare output.  If the number of chapters in the existing
+// epub could not be determined from the output, the chapters from the previous
+// check are compared instead; if neither is available, no chapters are listed.
+func makeStoryUpdate(book model.CalibreBook, lines []string, meta meta, previous []model.Chapter) model.StoryUpdate {
+	update := model.StoryUpdate{
+		BookId:  book.Id,
+		Uuid:    book.Uuid,
+		Title:   book.Title,
+		Authors: book.Authors,
+		Tags:    book.Tags,
+		Url:     book.Identifiers["url"],
+		Updated: *model.NewTime3339(meta.Updated.Time),
+	}
+	if meta.StoryURL != "" {
+		update.Url = meta.StoryURL
+	}
+	oldCount := -1
+	for _, line := range lines {
+		match := updateMatcher.FindStringSubmatch(strings.TrimSpace(line))
+		if match != nil {
+			oldCount, _ = strconv.Atoi(match[1])
+			break
+		}
+	}
+	if oldCount < 0 {
+		if previous != nil {
+			for _, change := range model.DiffChapters(previous, meta.chapters()) {
+				if change.Kind == model.ChapterAdded {
+					update.Chapters = append(update.Chapters, change.Chapter)
+				}
+			}
+		}
+		return update
+	}
+	for _, chapter := range meta.chapters() {
+		if chapter.Number > oldCount {
+			update.Chapters = append(update.Chapters, chapter)
+		}
+	}
+	return update
 }
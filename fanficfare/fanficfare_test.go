@@ -3,7 +3,10 @@ package fanficfare
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
@@ -11,7 +14,10 @@ import (
 	"testing"
 
 	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/calibre/memory"
 	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/opds"
+	"github.com/mook/fanficupdates/state"
 	"github.com/mook/fanficupdates/util/assertx"
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
@@ -37,6 +43,23 @@ func TestNewFanFicFare(t *testing.T) {
 		_, err := NewFanFicFare(context.Background(), &c)
 		assert.ErrorIs(t, err, expectedError)
 	})
+	t.Run("content server", func(t *testing.T) {
+		expectedError := fmt.Errorf("failed to list sites")
+		c := calibre.Calibre{
+			RunShim: func(cmd *exec.Cmd) ([]byte, error) {
+				assert.Equal(t, []string{
+					"calibre-debug", "--run-plugin=FanFicFare", "--",
+					"--non-interactive", "--sites-list",
+				}, cmd.Args)
+				return nil, expectedError
+			},
+			Library: "somewhere",
+			Server:  &calibre.ContentServer{URL: "http://localhost:8080/"},
+		}
+
+		_, err := NewFanFicFare(context.Background(), &c)
+		assert.ErrorIs(t, err, expectedError)
+	})
 	t.Run("reads site list", func(t *testing.T) {
 		type site struct {
 			name     string
@@ -97,16 +120,18 @@ func TestNewFanFicFare(t *testing.T) {
 }
 
 func TestProcess(t *testing.T) {
-	makeFff := func() (*FanFicFare, *test.Hook) {
+	makeFff := func() (*FanFicFare, *calibre.Calibre, *test.Hook) {
 		logger, hook := test.NewNullLogger()
+		c := &calibre.Calibre{}
 		fff := &FanFicFare{
-			calibre: &calibre.Calibre{},
+			Library: c,
+			Runner:  &PluginRunner{Calibre: c},
 			supportedSites: map[string]struct{}{
 				"supported.test": {},
 			},
-			logger: *logger,
+			logger: logger,
 		}
-		return fff, hook
+		return fff, c, hook
 	}
 	makeBook := func(url string) model.CalibreBook {
 		return model.CalibreBook{
@@ -117,50 +142,77 @@ func TestProcess(t *testing.T) {
 		}
 	}
 	t.Run("no url", func(t *testing.T) {
-		subj, hook := makeFff()
-		ok, err := subj.Process(context.Background(), model.CalibreBook{})
+		subj, _, hook := makeFff()
+		result, err := subj.Process(context.Background(), model.CalibreBook{})
 		assert.NoError(t, err)
-		assert.False(t, ok)
+		assert.Equal(t, model.OutcomeNoURL, result.Outcome)
 		assertx.Any(t, hook.AllEntries(), func(entry *logrus.Entry) bool {
 			return strings.Contains(entry.Message, "no URL")
 		})
 	})
 	t.Run("invalid url", func(t *testing.T) {
-		subj, hook := makeFff()
+		subj, _, hook := makeFff()
 		book := makeBook("http:///path")
-		_, err := subj.Process(context.Background(), book)
+		result, err := subj.Process(context.Background(), book)
 		assert.Error(t, err)
+		assert.Equal(t, model.OutcomeFailed, result.Outcome)
 		assert.Empty(t, hook.AllEntries())
 	})
 	t.Run("unsupported site", func(t *testing.T) {
-		subj, hook := makeFff()
+		subj, _, hook := makeFff()
 		book := makeBook("http://unsupported.test/")
-		ok, err := subj.Process(context.Background(), book)
+		result, err := subj.Process(context.Background(), book)
 		assert.NoError(t, err)
-		assert.False(t, ok)
+		assert.Equal(t, model.OutcomeUnsupported, result.Outcome)
+		assert.Equal(t, "unsupported.test", result.Site)
 		assertx.Any(t, hook.AllEntries(), func(entry *logrus.Entry) bool {
 			return strings.Contains(entry.Message, "not supported")
 		})
 	})
+	t.Run("source removed", func(t *testing.T) {
+		subj, c, _ := makeFff()
+		c.RunShim = func(cmd *exec.Cmd) ([]byte, error) {
+			assert.Fail(t, "unexpected command", "%v", cmd.Args)
+			return nil, fmt.Errorf("should not run")
+		}
+		book := makeBook("http://supported.test")
+		book.Tags = []string{model.SourceRemovedTag}
+		book.Formats = []string{"/library/book.epub"}
+		result, err := subj.Process(context.Background(), book, "--force")
+		assert.NoError(t, err)
+		assert.Equal(t, model.OutcomeRemoved, result.Outcome)
+	})
+	t.Run("no epub", func(t *testing.T) {
+		subj, _, hook := makeFff()
+		book := makeBook("http://supported.test")
+		result, err := subj.Process(context.Background(), book)
+		assert.NoError(t, err)
+		assert.Equal(t, model.OutcomeNoEpub, result.Outcome)
+		assertx.Any(t, hook.AllEntries(), func(entry *logrus.Entry) bool {
+			return strings.Contains(entry.Message, "no EPUB")
+		})
+	})
 	t.Run("no changes required", func(t *testing.T) {
 		file, err := os.Create(path.Join(t.TempDir(), "test.epub"))
 		require.NoError(t, err)
 		file.Close()
-		subj, hook := makeFff()
+		subj, c, hook := makeFff()
 		message := "Not updating Sample Book"
 		book := makeBook("http://supported.test")
 		book.Formats = append(book.Formats, file.Name())
-		subj.calibre.RunShim = func(cmd *exec.Cmd) ([]byte, error) {
+		c.RunShim = func(cmd *exec.Cmd) ([]byte, error) {
 			assert.Contains(t, cmd.Args, "--json-meta")
 			assert.Contains(t, cmd.Args, "--update-epub")
+			assert.Contains(t, cmd.Args, "--force")
 			// Expected message, plus JSON data - should be whole thing, but
 			// we can get away with nothing.
 			output := message + "\n{\n}\n"
 			return []byte(output), nil
 		}
-		ok, err := subj.Process(context.Background(), book)
+		result, err := subj.Process(context.Background(), book, "--force")
 		assert.NoError(t, err)
-		assert.False(t, ok)
+		assert.Equal(t, model.OutcomeUpToDate, result.Outcome)
+		assert.Equal(t, []string{message}, result.Output)
 		assertx.Any(t, hook.AllEntries(), func(entry *logrus.Entry) bool {
 			return strings.Contains(entry.Message, "Updating Sample Book")
 		})
@@ -172,12 +224,12 @@ func TestProcess(t *testing.T) {
 		file, err := os.Create(path.Join(t.TempDir(), "test.epub"))
 		require.NoError(t, err)
 		file.Close()
-		subj, hook := makeFff()
+		subj, c, hook := makeFff()
 		book := makeBook("http://supported.test")
 		message := fmt.Sprintf("Some extra text\nDo update - %s", book.Title)
 		book.Formats = append(book.Formats, file.Name())
 		runCount := 0
-		subj.calibre.RunShim = func(cmd *exec.Cmd) ([]byte, error) {
+		c.RunShim = func(cmd *exec.Cmd) ([]byte, error) {
 			if runCount == 0 {
 				runCount++
 				assert.Contains(t, cmd.Args, "--json-meta")
@@ -201,8 +253,9 @@ func TestProcess(t *testing.T) {
 				"got unexpected run count %d with command %#v", runCount, cmd.Args)
 			return nil, fmt.Errorf("running executables too many times")
 		}
-		_, err = subj.Process(context.Background(), book)
+		result, err := subj.Process(context.Background(), book)
 		assert.Error(t, err)
+		assert.Equal(t, model.OutcomeFailed, result.Outcome)
 		assertx.Any(t, hook.AllEntries(), func(entry *logrus.Entry) bool {
 			return strings.Contains(entry.Message, "Updating Sample Book")
 		})
@@ -216,12 +269,12 @@ func TestProcess(t *testing.T) {
 		file, err := os.Create(path.Join(t.TempDir(), "test.epub"))
 		require.NoError(t, err)
 		file.Close()
-		subj, hook := makeFff()
+		subj, c, hook := makeFff()
 		book := makeBook("http://supported.test")
 		message := fmt.Sprintf("Do update - %s", book.Title)
 		book.Formats = append(book.Formats, file.Name())
 		runCount := 0
-		subj.calibre.RunShim = func(cmd *exec.Cmd) ([]byte, error) {
+		c.RunShim = func(cmd *exec.Cmd) ([]byte, error) {
 			if runCount == 0 {
 				runCount++
 				assert.Contains(t, cmd.Args, "--json-meta")
@@ -263,9 +316,17 @@ func TestProcess(t *testing.T) {
 				"got unexpected run count %d with command %#v", runCount, cmd.Args)
 			return nil, fmt.Errorf("running executables too many times")
 		}
-		ok, err := subj.Process(context.Background(), book)
+		subj.Store, err = state.Open("")
+		require.NoError(t, err)
+		result, err := subj.Process(context.Background(), book)
 		assert.NoError(t, err)
-		assert.True(t, ok)
+		assert.Equal(t, model.OutcomeUpdated, result.Outcome)
+		assert.Equal(t, "supported.test", result.Site)
+		assert.Equal(t, 1, result.NewChapters)
+		assert.Equal(t, []string{"authors"}, result.Changed)
+		if chapters := subj.Chapters(book); assert.Len(t, chapters, 1) {
+			assert.Equal(t, "chap1", chapters[0].Title)
+		}
 		assertx.Any(t, hook.AllEntries(), func(entry *logrus.Entry) bool {
 			return strings.Contains(entry.Message, "Updating Sample Book")
 		})
@@ -276,3 +337,254 @@ func TestProcess(t *testing.T) {
 		}
 	})
 }
+
+func TestProcessLibrary(t *testing.T) {
+	// Update a book in an in-memory library, and serve the result over OPDS.
+	ctx := context.Background()
+	library := memory.NewLibrary(model.CalibreBook{
+		Id:          1,
+		Title:       "Sample Book",
+		Authors:     []string{"someone"},
+		Identifiers: map[string]string{"url": "http://supported.test/1"},
+	})
+	require.NoError(t, library.SetFile(1, "epub", []byte("old epub")))
+	runner := &ScriptedRunner{
+		Sites: []string{"http://supported.test"},
+		Responses: []ScriptedResponse{{
+			Output: "Do update - epub(1) vs url(2)",
+			Meta: map[string]any{
+				"author": "someone",
+				"status": "Completed",
+				"zchapters": []any{
+					[]any{1, map[string]any{"date": "2022-01-01 00:00:00", "title": "one"}},
+					[]any{2, map[string]any{"date": "2022-02-01 00:00:00", "title": "two"}},
+				},
+			},
+			Epub: []byte("new epub"),
+		}},
+	}
+	subject, err := New(ctx, library, runner)
+	require.NoError(t, err)
+	subject.logger, _ = test.NewNullLogger()
+	subject.FieldMap = map[string]string{"status": "#status"}
+	var updates []model.StoryUpdate
+	subject.OnUpdate = func(update model.StoryUpdate) { updates = append(updates, update) }
+	books, err := library.GetBooks(ctx)
+	require.NoError(t, err)
+	result, err := subject.Process(ctx, books[0])
+	require.NoError(t, err)
+	assert.True(t, result.Updated())
+	assert.Equal(t, 1, result.OldChapters)
+	assert.Equal(t, 2, result.NewChapters)
+	assert.Equal(t, []string{"#status"}, result.Changed)
+	require.Len(t, runner.Calls, 2)
+	assert.Equal(t, []string{"--sites-list"}, runner.Calls[0])
+	assert.Equal(t, []string{"--json-meta", "--update-epub"}, runner.Calls[1][:2])
+	require.Len(t, updates, 1)
+	assert.Equal(t, 1, updates[0].BookId)
+
+	books, err = library.GetBooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Completed", books[0].CustomColumns["status"].Value)
+
+	server := opds.NewServer()
+	server.Files = library
+	server.SetBooks(books)
+	recorder := httptest.NewRecorder()
+	server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/get/epub/1", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "new epub", recorder.Body.String())
+}
+
+func TestFollowURL(t *testing.T) {
+	ctx := context.Background()
+	library := memory.NewLibrary(
+		model.CalibreBook{
+			Id:          1,
+			Title:       "Updated",
+			Identifiers: map[string]string{"url": "http://supported.test/old/1", "isbn": "123"},
+		},
+		model.CalibreBook{
+			Id:          2,
+			Title:       "Unchanged",
+			Identifiers: map[string]string{"url": "http://supported.test/old/2"},
+		},
+	)
+	require.NoError(t, library.SetFile(1, "epub", []byte("epub")))
+	require.NoError(t, library.SetFile(2, "epub", []byte("epub")))
+	runner := &ScriptedRunner{
+		Sites: []string{"http://supported.test"},
+		Responses: []ScriptedResponse{
+			{
+				Output: "Do update - epub(1) vs url(2)",
+				Meta:   map[string]any{"storyUrl": "http://supported.test/new/1"},
+			},
+			{
+				Output: "Not updating Unchanged",
+				Meta:   map[string]any{"storyUrl": "http://supported.test/new/2"},
+			},
+		},
+	}
+	subject, err := New(ctx, library, runner)
+	require.NoError(t, err)
+	subject.logger, _ = test.NewNullLogger()
+	subject.KeepOldURL = true
+	books, err := library.GetBooks(ctx)
+	require.NoError(t, err)
+
+	result, err := subject.Process(ctx, books[0])
+	require.NoError(t, err)
+	assert.Equal(t, model.OutcomeUpdated, result.Outcome)
+	assert.Contains(t, result.Changed, "identifiers")
+	assert.Equal(t, "http://supported.test/new/1", result.NewURL)
+
+	subject.KeepOldURL = false
+	result, err = subject.Process(ctx, books[1])
+	require.NoError(t, err)
+	assert.Equal(t, model.OutcomeUpToDate, result.Outcome)
+	assert.Equal(t, []string{"identifiers"}, result.Changed)
+	assert.Equal(t, "http://supported.test/new/2", result.NewURL)
+
+	books, err = library.GetBooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"url":            "http://supported.test/new/1",
+		OldURLIdentifier: "http://supported.test/old/1",
+		"isbn":           "123",
+	}, books[0].Identifiers)
+	assert.Equal(t, map[string]string{"url": "http://supported.test/new/2"}, books[1].Identifiers)
+
+	var hook *test.Hook
+	subject.logger, hook = test.NewNullLogger()
+	assert.Empty(t, subject.changedIdentifiers(books[1], "http://supported.test/a,b"))
+	assertx.Any(t, hook.AllEntries(), func(entry *logrus.Entry) bool {
+		return strings.Contains(entry.Message, "url:http://supported.test/a,b contains a comma")
+	})
+}
+
+func TestNormalizeURL(t *testing.T) {
+	ctx := context.Background()
+	runner := &ScriptedRunner{
+		Normalized: map[string][]string{
+			"https://www.example.com/viewstory.php?sid=1&chapter=2": {
+				"https://other.test/story/1",
+				"https://example.com/story/1",
+			},
+			"https://example.com/chapter/5": {
+				"https://example.com/story/9",
+			},
+		},
+	}
+	subject, err := New(ctx, memory.NewLibrary(), runner)
+	require.NoError(t, err)
+	subject.logger, _ = test.NewNullLogger()
+	normalized, err := subject.NormalizeURL(ctx, "https://www.example.com/viewstory.php?sid=1&chapter=2")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/story/1", normalized)
+	assert.Contains(t, runner.Calls, []string{"--normalize-list", "https://www.example.com/viewstory.php?sid=1&chapter=2"})
+
+	normalized, err = subject.NormalizeURL(ctx, "https://example.com/chapter/5")
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/chapter/5", normalized, "a different story should not be used")
+
+	_, err = subject.NormalizeURL(ctx, "https://example.com/nothing")
+	assert.ErrorContains(t, err, "no normalized URL")
+
+	story, ok := NewNormalizer(runner).Normalize(ctx, "https://example.com/chapter/5")
+	require.True(t, ok)
+	assert.Equal(t, "https://example.com/chapter/5", story.URL, "a different story should not be used")
+
+	assert.Equal(t, "ao3:1", StateKey(model.CalibreBook{Uuid: "uuid", Identifiers: map[string]string{"url": "https://archiveofourown.org/works/1/chapters/2"}}))
+	assert.Equal(t, "uuid", StateKey(model.CalibreBook{Uuid: "uuid"}))
+}
+
+func TestMakeStoryUpdate(t *testing.T) {
+	book := model.CalibreBook{
+		Id:          3,
+		Title:       "Sample Book",
+		Identifiers: map[string]string{"url": "http://supported.test/old"},
+	}
+	var m meta
+	for i := 1; i <= 4; i++ {
+		c := chapter{Number: i}
+		c.Title = fmt.Sprintf("chapter %d", i)
+		c.URL = fmt.Sprintf("http://supported.test/new/%d", i)
+		m.Chapters = append(m.Chapters, c)
+	}
+	m.StoryURL = "http://supported.test/new"
+	t.Run("known chapter count", func(t *testing.T) {
+		lines := []string{"Some text", "Do update - epub(2) vs url(4)"}
+		update := makeStoryUpdate(book, lines, m, nil)
+		assert.Equal(t, 3, update.BookId)
+		assert.Equal(t, "http://supported.test/new", update.Url)
+		if assert.Len(t, update.Chapters, 2) {
+			assert.Equal(t, 3, update.Chapters[0].Number)
+			assert.Equal(t, "http://supported.test/new/4", update.Chapters[1].URL)
+		}
+		assert.Equal(t, "Sample Book: chapters 3–4 added", update.Summary())
+	})
+	t.Run("previous chapters", func(t *testing.T) {
+		lines := []string{"Do update - Sample Book"}
+		previous := []model.Chapter{
+			{Number: 1, Title: "chapter 1", URL: "http://supported.test/new/1"},
+		}
+		update := makeStoryUpdate(book, lines, m, previous)
+		if assert.Len(t, update.Chapters, 3) {
+			assert.Equal(t, 2, update.Chapters[0].Number)
+		}
+	})
+	t.Run("unknown chapter count", func(t *testing.T) {
+		lines := []string{"Do update - Sample Book"}
+		update := makeStoryUpdate(book, lines, m, nil)
+		assert.Empty(t, update.Chapters)
+		assert.Equal(t, "Sample Book: updated", update.Summary())
+	})
+}
+
+func TestChapterUnmarshal(t *testing.T) {
+	t.Run("tuple", func(t *testing.T) {
+		var c chapter
+		input := `[3, {"date": "2020-01-02", "title": "Third", "url": "http://x.test/3", "words": "1,234"}]`
+		require.NoError(t, json.Unmarshal([]byte(input), &c))
+		assert.Equal(t, 3, c.Number)
+		assert.Equal(t, "Third", c.Title)
+		assert.Equal(t, "http://x.test/3", c.URL)
+		if assert.NotNil(t, c.Date) {
+			assert.Equal(t, 2020, c.Date.Year())
+		}
+		assert.Equal(t, 1234, c.wordCount())
+	})
+	t.Run("object", func(t *testing.T) {
+		var c chapter
+		input := `{"number": 4, "title": "Fourth", "url": "http://x.test/4", "kwords": "1.5"}`
+		require.NoError(t, json.Unmarshal([]byte(input), &c))
+		assert.Equal(t, 4, c.Number)
+		assert.Equal(t, "Fourth", c.Title)
+		assert.Nil(t, c.Date)
+		assert.Equal(t, 1500, c.wordCount())
+	})
+	t.Run("object with index", func(t *testing.T) {
+		var c chapter
+		require.NoError(t, json.Unmarshal([]byte(`{"index": 2, "title": "Second"}`), &c))
+		assert.Equal(t, 2, c.Number)
+		assert.Equal(t, 0, c.wordCount())
+	})
+	t.Run("invalid tuple", func(t *testing.T) {
+		var c chapter
+		assert.Error(t, json.Unmarshal([]byte(`[1, {}, 3]`), &c))
+	})
+	t.Run("invalid token", func(t *testing.T) {
+		var c chapter
+		assert.Error(t, json.Unmarshal([]byte(`"chapter"`), &c))
+	})
+	t.Run("numbered by position", func(t *testing.T) {
+		var m meta
+		input := `{"zchapters": [{"title": "one"}, {"title": "two"}]}`
+		require.NoError(t, json.Unmarshal([]byte(input), &m))
+		chapters := m.chapters()
+		if assert.Len(t, chapters, 2) {
+			assert.Equal(t, 1, chapters[0].Number)
+			assert.Equal(t, 2, chapters[1].Number)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package fanficfare
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mook/fanficupdates/util"
+)
+
+// DefaultFieldMap is the mapping from FanFicFare metadata keys to Calibre
+// fields used when none is configured.  Custom columns (such as "#status")
+// that are not defined in the library are skipped, as long as the column
+// definitions have been loaded.
+var DefaultFieldMap = map[string]string{
+	"language": "languages",
+}
+
+var (
+	// seriesMatcher splits a FanFicFare series ("Name [3]") into the name and
+	// the index.
+	seriesMatcher = regexp.MustCompile(`^(.*?)\s*\[([\d.]+)\]$`)
+	// groupedNumberMatcher matches numbers with thousands separators, as
+	// FanFicFare produces for word counts.
+	groupedNumberMatcher = regexp.MustCompile(`^\d{1,3}(,\d{3})+$`)
+)
+
+// splitSeries returns the series name and index from a FanFicFare series
+// string; the index is nil if not present.
+func splitSeries(series string) (string, *float64) {
+	match := seriesMatcher.FindStringSubmatch(strings.TrimSpace(series))
+	if match == nil {
+		return series, nil
+	}
+	index, err := strconv.ParseFloat(match[2], 64)
+	if err != nil {
+		return series, nil
+	}
+	return match[1], &index
+}
+
+// formatFieldValue converts a value from the FanFicFare JSON output into the
+// form expected by calibredb set_metadata.
+func formatFieldValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		v = strings.TrimSpace(v)
+		if groupedNumberMatcher.MatchString(v) {
+			return strings.ReplaceAll(v, ",", "")
+		}
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []any:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			if part := formatFieldValue(item); part != "" {
+				parts = append(parts, part)
+			}
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// mapFields converts the raw FanFicFare metadata into Calibre fields using the
+// given mapping.  Where multiple FanFicFare keys map to the same Calibre field,
+// the values are combined as a comma-separated list.
+func mapFields(raw map[string]any, fieldMap map[string]string) map[string]string {
+	keys := make([]string, 0, len(fieldMap))
+	for key := range fieldMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make(map[string]string)
+	for _, key := range keys {
+		target := fieldMap[key]
+		if target == "" {
+			continue
+		}
+		value := formatFieldValue(raw[key])
+		if value == "" {
+			continue
+		}
+		if existing, ok := result[target]; ok {
+			value = existing + "," + value
+		}
+		result[target] = value
+	}
+	return result
+}
+
+// mergeTags returns the book's tags with the mapped tags (a comma-separated
+// list) added, ignoring case, so that mapping metadata to tags never removes
+// existing tags such as "noupdate".  The second result is false if there are
+// no new tags.
+func mergeTags(existing []string, mapped string) (string, bool) {
+	tags := append([]string(nil), existing...)
+	for _, tag := range strings.Split(mapped, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if !util.Any(tags, func(t string) bool { return strings.EqualFold(t, tag) }) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == len(existing) {
+		return "", false
+	}
+	return strings.Join(tags, ","), true
+}
+
+// stringList converts a JSON value that may be either a list of strings or a
+// single string into a list.  A single string is split on ", " only if that
+// produces the expected number of items (when known); otherwise it is treated
+// as a single item, as names may themselves contain commas.
+func stringList(value any, expected int) []string {
+	switch v := value.(type) {
+	case []any:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			if text := strings.TrimSpace(fmt.Sprintf("%v", item)); text != "" {
+				result = append(result, text)
+			}
+		}
+		return result
+	case string:
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return nil
+		}
+		if parts := strings.Split(v, ", "); expected > 1 && len(parts) == expected {
+			return parts
+		}
+		return []string{v}
+	}
+	return nil
+}
+
+// authors returns the list of authors of the story.  FanFicFare may output the
+// authors either as a list, or as a comma-separated string; in the latter case,
+// the number of author URLs is used to determine how to split the string.
+func (m *meta) authors() []string {
+	urls := stringList(m.AuthorURL, 0)
+	if list, ok := m.AuthorURL.(string); ok {
+		urls = strings.Split(list, ", ")
+	}
+	if authors := stringList(m.AuthorList, len(urls)); len(authors) > 0 {
+		return authors
+	}
+	return stringList(m.Author, len(urls))
+}
+
+// sameAuthors returns whether the two author lists contain the same names,
+// ignoring order.
+func sameAuthors(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int, len(a))
+	for _, name := range a {
+		counts[name]++
+	}
+	for _, name := range b {
+		if counts[name] == 0 {
+			return false
+		}
+		counts[name]--
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package fanficfare
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mook/fanficupdates/calibre/memory"
+	"github.com/mook/fanficupdates/model"
+)
+
+func TestSplitSeries(t *testing.T) {
+	cases := []struct {
+		input string
+		name  string
+		index *float64
+	}{
+		{"", "", nil},
+		{"Some Series", "Some Series", nil},
+		{"Some Series [3]", "Some Series", func() *float64 { v := 3.0; return &v }()},
+		{"Some Series [1.5]", "Some Series", func() *float64 { v := 1.5; return &v }()},
+		{"Some [Bracketed] Series", "Some [Bracketed] Series", nil},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.input, func(t *testing.T) {
+			name, index := splitSeries(testCase.input)
+			assert.Equal(t, testCase.name, name)
+			assert.Equal(t, testCase.index, index)
+		})
+	}
+}
+
+func TestMapFields(t *testing.T) {
+	input := `{
+		"status": "In-Progress",
+		"numWords": "12,345",
+		"numChapters": 7,
+		"category": "Harry Potter",
+		"genre": ["Fluff", "Angst"],
+		"characters": "",
+		"rating": "Teen"
+	}`
+	var raw map[string]any
+	require.NoError(t, json.Unmarshal([]byte(input), &raw))
+	fieldMap := map[string]string{
+		"status":      "#status",
+		"numWords":    "#words",
+		"numChapters": "#chapters",
+		"category":    "tags",
+		"genre":       "tags",
+		"characters":  "#characters",
+		"rating":      "",
+		"language":    "languages",
+	}
+	assert.Equal(t, map[string]string{
+		"#status":   "In-Progress",
+		"#words":    "12345",
+		"#chapters": "7",
+		"tags":      "Harry Potter,Fluff,Angst",
+	}, mapFields(raw, fieldMap))
+}
+
+func TestAuthors(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{"none", `{}`, nil},
+		{"single", `{"author": "Someone"}`, []string{"Someone"}},
+		{"comma in name", `{"author": "Last, First", "authorUrl": "http://x.test/a"}`, []string{"Last, First"}},
+		{
+			"list",
+			`{"author": "A, B", "authorlist": ["A", "B"]}`,
+			[]string{"A", "B"},
+		},
+		{
+			"joined string with urls",
+			`{"author": "A, B", "authorUrl": "http://x.test/a, http://x.test/b"}`,
+			[]string{"A", "B"},
+		},
+		{
+			"joined list with url list",
+			`{"authorlist": "A, B", "authorUrl": ["http://x.test/a", "http://x.test/b"]}`,
+			[]string{"A", "B"},
+		},
+		{
+			"mismatched count",
+			`{"author": "Last, First, Other", "authorUrl": "http://x.test/a, http://x.test/b"}`,
+			[]string{"Last, First, Other"},
+		},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var m meta
+			require.NoError(t, json.Unmarshal([]byte(testCase.input), &m))
+			assert.Equal(t, testCase.expected, m.authors())
+		})
+	}
+}
+
+func TestSameAuthors(t *testing.T) {
+	assert.True(t, sameAuthors(nil, nil))
+	assert.True(t, sameAuthors([]string{"A", "B"}, []string{"B", "A"}))
+	assert.False(t, sameAuthors([]string{"A", "A"}, []string{"A", "B"}))
+	assert.False(t, sameAuthors([]string{"A"}, []string{"A", "B"}))
+}
+
+func TestMergeTags(t *testing.T) {
+	existing := []string{"noupdate", model.SourceRemovedTag, "Fluff"}
+	tags, changed := mergeTags(existing, "fluff, Angst,,noupdate")
+	assert.True(t, changed)
+	assert.Equal(t, "noupdate,"+model.SourceRemovedTag+",Fluff,Angst", tags)
+	_, changed = mergeTags(existing, "FLUFF")
+	assert.False(t, changed)
+
+	subject := &FanFicFare{Library: memory.NewLibrary(), FieldMap: map[string]string{"genre": "tags"}}
+	book := model.CalibreBook{Title: "Story", Tags: existing}
+	updateMeta := subject.makeUpdateMeta(book, meta{}, map[string]any{"genre": []any{"Angst"}})
+	assert.Equal(t, "noupdate,"+model.SourceRemovedTag+",Fluff,Angst", updateMeta.Fields["tags"],
+		"mapped tags should not replace the existing tags")
+	updateMeta = subject.makeUpdateMeta(book, meta{}, map[string]any{"genre": []any{"fluff"}})
+	assert.NotContains(t, updateMeta.Fields, "tags")
+}
@@ -0,0 +1,108 @@
+package fanficfare
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mook/fanficupdates/model"
+)
+
+// MetadataRefresh is a processor (see updater.Processor) that only refreshes
+// the metadata of books, without downloading chapters; see RefreshMetadata.
+type MetadataRefresh struct {
+	*FanFicFare
+}
+
+// Process refreshes the metadata of the book.
+func (r *MetadataRefresh) Process(ctx context.Context, book model.CalibreBook, extraArgs ...string) (model.UpdateResult, error) {
+	return r.RefreshMetadata(ctx, book, extraArgs...)
+}
+
+// RefreshMetadata fetches the current metadata of the story, such as its
+// status, chapter count and summary, and writes it to the book without
+// downloading chapters or replacing the EPUB.  This is much cheaper than a
+// full update.  The outcome is model.OutcomeRefreshed if the metadata changed,
+// and model.OutcomeUpToDate otherwise.  As the EPUB is not checked, the time
+// of the last check is not changed.
+func (f *FanFicFare) RefreshMetadata(ctx context.Context, book model.CalibreBook, extraArgs ...string) (model.UpdateResult, error) {
+	start := time.Now()
+	result := model.UpdateResult{BookId: book.Id, Title: book.Title}
+	err := f.refresh(ctx, book, &result, extraArgs)
+	if err != nil {
+		result.Outcome = model.OutcomeFailed
+		result.ErrorClass = ErrorClass(err)
+	}
+	result.Duration = time.Since(start)
+	return result, err
+}
+
+// refresh refreshes the metadata of a single book, filling in the result.
+func (f *FanFicFare) refresh(ctx context.Context, book model.CalibreBook, result *model.UpdateResult, extraArgs []string) error {
+	url, err := f.checkSource(book, result)
+	if url == nil {
+		return err
+	}
+
+	f.logger.Infof("Refreshing metadata of %s: %s", book.Title, url)
+	args := append([]string{"--meta-only", "--json-meta"}, extraArgs...)
+	stdout, err := f.Runner.Run(ctx, append(args, url.String())...)
+	if err != nil {
+		if output := strings.TrimSpace(stdout); output != "" {
+			result.Output = strings.Split(output, "\n")
+			f.logger.Errorf("%s", output)
+		}
+		return &Error{
+			Class: Classify(stdout+"\n"+err.Error(), model.ErrorUnknown),
+			Err:   fmt.Errorf("could not refresh metadata: %w", err),
+		}
+	}
+
+	// The metadata may not be preceded by any messages.
+	lines, rawJSON, ok := splitOutput("\n" + strings.TrimLeft(stdout, "\r\n"))
+	if !ok {
+		result.Output = strings.Split(strings.TrimSpace(stdout), "\n")
+		f.logger.Errorf("%s", stdout)
+		return &Error{
+			Class: Classify(stdout, model.ErrorParse),
+			Err:   fmt.Errorf("could not read JSON output when refreshing %s", book.Title),
+		}
+	}
+	for _, line := range lines {
+		if line = strings.TrimRightFunc(line, unicode.IsSpace); line != "" {
+			result.Output = append(result.Output, line)
+			f.logger.Infof(">>> %s", line)
+		}
+	}
+
+	var meta meta
+	var rawMeta map[string]any
+	err = json.Unmarshal(rawJSON, &meta)
+	if err == nil {
+		err = json.Unmarshal(rawJSON, &rawMeta)
+	}
+	if err != nil {
+		f.logger.Debug(string(rawJSON))
+		return &Error{Class: model.ErrorParse, Err: fmt.Errorf("could not read output metadata: %w", err)}
+	}
+	result.OldChapters = len(f.Chapters(book))
+	result.NewChapters = meta.chapterCount()
+
+	updateMeta := f.makeUpdateMeta(book, meta, rawMeta)
+	result.Changed = updateMeta.Changes(book)
+	if len(result.Changed) == 0 {
+		f.logger.Infof("Metadata of %s is unchanged.", book.Title)
+		result.Outcome = model.OutcomeUpToDate
+		return nil
+	}
+	if err = f.Library.UpdateMetadata(ctx, book.Id, updateMeta); err != nil {
+		return &Error{Class: model.ErrorCalibreWrite, Err: fmt.Errorf("could not update metadata: %w", err)}
+	}
+	result.NewURL = newURL(updateMeta, meta.StoryURL)
+	f.logger.Infof("Refreshed metadata of %s: %s", book.Title, strings.Join(result.Changed, ", "))
+	result.Outcome = model.OutcomeRefreshed
+	return nil
+}
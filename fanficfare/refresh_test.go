@@ -0,0 +1,77 @@
+package fanficfare
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mook/fanficupdates/calibre/memory"
+	"github.com/mook/fanficupdates/model"
+)
+
+func TestRefreshMetadata(t *testing.T) {
+	ctx := context.Background()
+	library := memory.NewLibrary(
+		model.CalibreBook{
+			Id:          1,
+			Title:       "Story",
+			Authors:     []string{"someone"},
+			Comments:    "Old summary",
+			Identifiers: map[string]string{"url": "http://supported.test/1"},
+		},
+		model.CalibreBook{Id: 2, Title: "No URL"},
+	)
+	require.NoError(t, library.SetFile(1, "epub", []byte("epub")))
+	chapters := []any{
+		map[string]any{"title": "one"},
+		map[string]any{"title": "two"},
+		map[string]any{"title": "three"},
+	}
+	runner := &ScriptedRunner{
+		Sites: []string{"http://supported.test"},
+		Responses: []ScriptedResponse{
+			{Meta: map[string]any{"author": "someone", "description": "New summary", "status": "Completed", "zchapters": chapters}},
+			{Meta: map[string]any{"author": "someone", "description": "New summary", "status": "Completed", "zchapters": chapters}},
+			{Output: "Story does not exist: http://supported.test/1", Err: errors.New("exit status 1")},
+		},
+	}
+	subject, err := New(ctx, library, runner)
+	require.NoError(t, err)
+	subject.logger, _ = test.NewNullLogger()
+	subject.FieldMap = map[string]string{"status": "#status"}
+	refresh := &MetadataRefresh{FanFicFare: subject}
+	books, err := library.GetBooks(ctx)
+	require.NoError(t, err)
+
+	result, err := refresh.Process(ctx, books[0], "--option=x")
+	require.NoError(t, err)
+	assert.Equal(t, model.OutcomeRefreshed, result.Outcome)
+	assert.Equal(t, 3, result.NewChapters)
+	assert.Equal(t, []string{"comments", "#status"}, result.Changed)
+	assert.Equal(t, []string{"--meta-only", "--json-meta", "--option=x", "http://supported.test/1"}, runner.Calls[1])
+	contents, _ := library.File(1, "epub")
+	assert.Equal(t, "epub", string(contents), "the EPUB should not be replaced")
+
+	books, err = library.GetBooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "New summary", books[0].Comments)
+	assert.Equal(t, "Completed", books[0].CustomColumns["status"].Value)
+
+	result, err = refresh.Process(ctx, books[0])
+	require.NoError(t, err)
+	assert.Equal(t, model.OutcomeUpToDate, result.Outcome)
+	assert.Empty(t, result.Changed)
+
+	result, err = refresh.Process(ctx, books[0])
+	assert.Error(t, err)
+	assert.Equal(t, model.OutcomeFailed, result.Outcome)
+	assert.Equal(t, model.ErrorNotFound, result.ErrorClass)
+
+	result, err = refresh.Process(ctx, books[1])
+	require.NoError(t, err)
+	assert.Equal(t, model.OutcomeNoURL, result.Outcome)
+}
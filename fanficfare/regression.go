@@ -0,0 +1,118 @@
+package fanficfare
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/epub"
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/review"
+	"github.com/mook/fanficupdates/state"
+)
+
+// DefaultMaxWordLoss is the fraction of words an update may lose before it is
+// held for review, if FanFicFare.MaxWordLoss is zero.
+const DefaultMaxWordLoss = 0.2
+
+// regression describes an update that would lose content.
+type regression struct {
+	OldChapters, NewChapters int
+	OldWords, NewWords       int
+}
+
+// String describes the loss, such as "5 → 3 chapters".
+func (r regression) String() string {
+	if r.NewChapters < r.OldChapters {
+		return fmt.Sprintf("%d → %d chapters", r.OldChapters, r.NewChapters)
+	}
+	return fmt.Sprintf("%d → %d words", r.OldWords, r.NewWords)
+}
+
+// epubWordCount returns the number of words in the EPUB at the given path, or
+// zero if it could not be read.
+func (f *FanFicFare) epubWordCount(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		f.logger.Debugf("could not open %s to count words: %v", path, err)
+		return 0
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		f.logger.Debugf("could not read %s to count words: %v", path, err)
+		return 0
+	}
+	count, err := epub.WordCount(file, info.Size())
+	if err != nil {
+		f.logger.Debugf("could not count words in %s: %v", path, err)
+		return 0
+	}
+	return count
+}
+
+// isRegression returns whether the update loses more content than allowed by
+// MaxChapterLoss or MaxWordLoss.  Counts that are unknown (zero) are not
+// compared.
+func (f *FanFicFare) isRegression(r regression) bool {
+	if f.MaxChapterLoss >= 0 && r.OldChapters > 0 && r.NewChapters > 0 {
+		if r.OldChapters-r.NewChapters > f.MaxChapterLoss {
+			return true
+		}
+	}
+	maxWordLoss := f.MaxWordLoss
+	if maxWordLoss == 0 {
+		maxWordLoss = DefaultMaxWordLoss
+	}
+	if maxWordLoss >= 0 && r.OldWords > 0 && r.NewWords > 0 {
+		if float64(r.OldWords-r.NewWords) > maxWordLoss*float64(r.OldWords) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordHeld persists that an update of the given book was held at the given
+// time.  This is not recorded as a check, so that the book is checked again
+// when next due.
+func (f *FanFicFare) recordHeld(book model.CalibreBook, held time.Time) {
+	if f.Store == nil {
+		return
+	}
+	err := f.Store.Update(StateKey(book), func(state *state.Book) {
+		state.LastHeld = model.NewTime3339(held)
+	})
+	if err != nil {
+		f.logger.Errorf("could not save state for %s: %v", book.Title, err)
+	}
+}
+
+// hold refuses an update that loses too much content, keeping it in the review
+// queue if there is one.
+func (f *FanFicFare) hold(book model.CalibreBook, result *model.UpdateResult, loss regression, updateMeta calibre.UpdateMeta, epubPath string) error {
+	result.Outcome = model.OutcomeHeld
+	held := time.Now()
+	f.recordHeld(book, held)
+	if f.Review == nil {
+		f.logger.Warnf("Discarded update of %s, which would lose content (%s)", book.Title, loss)
+		return nil
+	}
+	err := f.Review.Hold(review.Entry{
+		BookId:      book.Id,
+		Title:       book.Title,
+		URL:         book.Identifiers["url"],
+		Reason:      loss.String(),
+		OldChapters: loss.OldChapters,
+		NewChapters: loss.NewChapters,
+		OldWords:    loss.OldWords,
+		NewWords:    loss.NewWords,
+		Held:        held,
+		Meta:        updateMeta,
+	}, epubPath)
+	if err != nil {
+		return &Error{Class: model.ErrorUnknown, Err: err}
+	}
+	f.logger.Warnf("Held update of %s for review, as it would lose content (%s)", book.Title, loss)
+	return nil
+}
@@ -0,0 +1,106 @@
+package fanficfare
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mook/fanficupdates/calibre/memory"
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/review"
+	"github.com/mook/fanficupdates/state"
+)
+
+func TestIsRegression(t *testing.T) {
+	cases := []struct {
+		name           string
+		maxChapterLoss int
+		maxWordLoss    float64
+		loss           regression
+		expected       bool
+	}{
+		{"no loss", 0, 0, regression{3, 4, 1000, 1200}, false},
+		{"chapter lost", 0, 0, regression{3, 2, 1000, 1000}, true},
+		{"chapter loss allowed", 1, 0, regression{3, 2, 1000, 1000}, false},
+		{"chapter check disabled", -1, 0, regression{3, 1, 1000, 1000}, false},
+		{"unknown chapters", 0, 0, regression{0, 2, 0, 0}, false},
+		{"small word loss", 0, 0, regression{3, 3, 1000, 850}, false},
+		{"large word loss", 0, 0, regression{3, 3, 1000, 700}, true},
+		{"word loss allowed", 0, 0.5, regression{3, 3, 1000, 700}, false},
+		{"word check disabled", 0, -1, regression{3, 3, 1000, 10}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			subject := &FanFicFare{MaxChapterLoss: c.maxChapterLoss, MaxWordLoss: c.maxWordLoss}
+			assert.Equal(t, c.expected, subject.isRegression(c.loss))
+		})
+	}
+}
+
+func TestProcessRegression(t *testing.T) {
+	ctx := context.Background()
+	library := memory.NewLibrary(model.CalibreBook{
+		Id:          1,
+		Title:       "Story",
+		Authors:     []string{"someone"},
+		Identifiers: map[string]string{"url": "http://supported.test/1"},
+	})
+	require.NoError(t, library.SetFile(1, "epub", []byte("old epub")))
+	runner := &ScriptedRunner{
+		Sites: []string{"http://supported.test"},
+		Responses: []ScriptedResponse{{
+			Output: "Do update - epub(3) vs url(2)",
+			Meta: map[string]any{
+				"author":    "someone",
+				"status":    "Completed",
+				"zchapters": []any{map[string]any{"title": "one"}, map[string]any{"title": "two"}},
+			},
+			Epub: []byte("new epub"),
+		}},
+	}
+	subject, err := New(ctx, library, runner)
+	require.NoError(t, err)
+	subject.logger, _ = test.NewNullLogger()
+	subject.FieldMap = map[string]string{"status": "#status"}
+	subject.Review, err = review.Open(t.TempDir(), library)
+	require.NoError(t, err)
+	subject.Store, err = state.Open("")
+	require.NoError(t, err)
+	var updates []model.StoryUpdate
+	subject.OnUpdate = func(update model.StoryUpdate) { updates = append(updates, update) }
+	books, err := library.GetBooks(ctx)
+	require.NoError(t, err)
+
+	before := time.Now().Add(-time.Second)
+	result, err := subject.Process(ctx, books[0])
+	require.NoError(t, err)
+	after := time.Now().Add(time.Second)
+	assert.Equal(t, model.OutcomeHeld, result.Outcome)
+	assert.Equal(t, "Story: held, 3 → 2 chapters", result.Summary())
+	assert.Empty(t, updates)
+	contents, _ := library.File(1, "epub")
+	assert.Equal(t, "old epub", string(contents), "held update should not replace the EPUB")
+	if held := subject.Store.Get(StateKey(books[0])).LastHeld; assert.NotNil(t, held) {
+		assert.True(t, held.After(before) && held.Before(after), "held at %s, not between %s and %s", held, before, after)
+	}
+	assert.Nil(t, subject.Store.Get(StateKey(books[0])).LastChecked, "held updates should not delay the next check")
+
+	entries, err := subject.Review.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, 1, entries[0].BookId)
+	assert.Equal(t, "3 → 2 chapters", entries[0].Reason)
+	assert.Equal(t, "Completed", entries[0].Meta.Fields["#status"])
+
+	_, err = subject.Review.Accept(ctx, 1)
+	require.NoError(t, err)
+	contents, _ = library.File(1, "epub")
+	assert.Equal(t, "new epub", string(contents))
+	books, err = library.GetBooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Completed", books[0].CustomColumns["status"].Value)
+}
@@ -0,0 +1,163 @@
+package fanficfare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/mook/fanficupdates/calibre"
+)
+
+// Runner runs FanFicFare with the given arguments, returning stdout.  The
+// arguments are those accepted by the FanFicFare command line, such as
+// --sites-list or --json-meta --update-epub file.epub.  If FanFicFare fails,
+// any output it produced (including what it wrote to stderr, where tracebacks
+// and HTTP errors go) is returned along with the error, so that the failure can
+// be classified.
+type Runner interface {
+	Run(ctx context.Context, args ...string) (string, error)
+}
+
+var (
+	_ Runner = &PluginRunner{}
+	_ Runner = &CLIRunner{}
+	_ Runner = &ScriptedRunner{}
+)
+
+// PluginRunner runs FanFicFare as a Calibre plugin via calibre-debug.
+type PluginRunner struct {
+	Calibre *calibre.Calibre
+	// Args are extra arguments passed to FanFicFare before any others.
+	Args []string
+}
+
+func (r *PluginRunner) Run(ctx context.Context, args ...string) (string, error) {
+	resultArgs := []string{"--run-plugin=FanFicFare", "--", "--non-interactive"}
+	if r.Calibre.Library != "" && r.Calibre.Server == nil {
+		resultArgs = append(resultArgs, "--library-path="+r.Calibre.Library)
+	}
+	resultArgs = append(resultArgs, r.Args...)
+	resultArgs = append(resultArgs, args...)
+	return r.Calibre.Run(ctx, "calibre-debug", resultArgs...)
+}
+
+// DefaultCommand is the standalone FanFicFare executable, as installed by pip.
+const DefaultCommand = "fanficfare"
+
+// CLIRunner runs the standalone FanFicFare command line tool, which does not
+// need Calibre to be installed.
+type CLIRunner struct {
+	// Command is the FanFicFare executable; if empty, DefaultCommand is looked
+	// up in the PATH.
+	Command string
+	// Args are extra arguments passed to FanFicFare before any others, such as
+	// --config to use a specific personal.ini.
+	Args []string
+	// RunShim, if set, is used to run commands instead of executing them; this
+	// is for testing.
+	RunShim func(cmd *exec.Cmd) ([]byte, error)
+}
+
+func (r *CLIRunner) Run(ctx context.Context, args ...string) (string, error) {
+	command := r.Command
+	if command == "" {
+		command = DefaultCommand
+	}
+	cmd := exec.CommandContext(ctx, command, "--non-interactive")
+	cmd.Args = append(cmd.Args, r.Args...)
+	cmd.Args = append(cmd.Args, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	var buf []byte
+	var err error
+	if r.RunShim != nil {
+		buf, err = r.RunShim(cmd)
+	} else {
+		buf, err = cmd.Output()
+	}
+	if err != nil {
+		buf = append(buf, stderr.Bytes()...)
+	}
+	return string(buf), err
+}
+
+// ScriptedResponse is the result of one update run by a ScriptedRunner.
+type ScriptedResponse struct {
+	// Output is the text FanFicFare prints before the metadata, such as
+	// "Do update - epub(1) vs url(2)".
+	Output string
+	// Meta is the metadata printed as JSON.
+	Meta map[string]any
+	// Epub, if set, replaces the contents of the epub being updated.
+	Epub []byte
+	// Err, if set, is returned along with Output, without any metadata.
+	Err error
+}
+
+// ScriptedRunner is a Runner for tests; instead of running FanFicFare, it
+// returns prepared responses.
+type ScriptedRunner struct {
+	lock sync.Mutex
+
+	// Sites are the URLs listed as supported by --sites-list.
+	Sites []string
+	// Normalized are the URLs listed by --normalize-list, keyed by its
+	// argument.
+	Normalized map[string][]string
+	// Responses are returned, in order, for each update.
+	Responses []ScriptedResponse
+	// Calls records the arguments of each run.
+	Calls [][]string
+}
+
+func (r *ScriptedRunner) Run(ctx context.Context, args ...string) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Calls = append(r.Calls, append([]string(nil), args...))
+
+	for i, arg := range args {
+		if arg == "--normalize-list" && i+1 < len(args) {
+			return strings.Join(r.Normalized[args[i+1]], "\n") + "\n", nil
+		}
+		if arg == "--sites-list" {
+			var builder strings.Builder
+			for _, site := range r.Sites {
+				fmt.Fprintf(&builder, "  * %s/\n", strings.TrimSuffix(site, "/"))
+			}
+			return builder.String(), nil
+		}
+	}
+
+	if len(r.Responses) == 0 {
+		return "", fmt.Errorf("no scripted response for %v", args)
+	}
+	response := r.Responses[0]
+	r.Responses = r.Responses[1:]
+	if response.Err != nil {
+		return response.Output, response.Err
+	}
+	if response.Epub != nil && len(args) > 0 {
+		if err := os.WriteFile(args[len(args)-1], response.Epub, 0o644); err != nil {
+			return "", err
+		}
+	}
+	meta := response.Meta
+	if meta == nil {
+		meta = map[string]any{}
+	}
+	rawJSON, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if len(meta) == 0 {
+		rawJSON = []byte("{\n}")
+	}
+	output := strings.TrimSuffix(response.Output, "\n")
+	return output + "\n" + string(rawJSON) + "\n", nil
+}
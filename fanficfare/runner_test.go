@@ -0,0 +1,116 @@
+package fanficfare
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunners(t *testing.T) {
+	ctx := context.Background()
+	t.Run("plugin", func(t *testing.T) {
+		subject := &PluginRunner{
+			Calibre: &calibre.Calibre{
+				Library: "/library",
+				RunShim: func(cmd *exec.Cmd) ([]byte, error) {
+					assert.Equal(t, []string{
+						"calibre-debug", "--run-plugin=FanFicFare", "--", "--non-interactive",
+						"--library-path=/library", "--debug", "--sites-list",
+					}, cmd.Args)
+					return []byte("output"), nil
+				},
+			},
+			Args: []string{"--debug"},
+		}
+		output, err := subject.Run(ctx, "--sites-list")
+		require.NoError(t, err)
+		assert.Equal(t, "output", output)
+
+		subject.Calibre.RunShim = func(cmd *exec.Cmd) ([]byte, error) {
+			_, err := io.WriteString(cmd.Stderr, "Traceback (most recent call last):\nHTTPError: HTTP Error 429: Too Many Requests\n")
+			require.NoError(t, err)
+			return nil, errors.New("exit status 1")
+		}
+		output, err = subject.Run(ctx, "--sites-list")
+		assert.EqualError(t, err, "exit status 1")
+		assert.Contains(t, output, "HTTP Error 429", "stderr should be returned on failure")
+	})
+	t.Run("cli", func(t *testing.T) {
+		subject := &CLIRunner{
+			Args: []string{"--config=/config/personal.ini"},
+			RunShim: func(cmd *exec.Cmd) ([]byte, error) {
+				assert.Equal(t, []string{
+					"fanficfare", "--non-interactive", "--config=/config/personal.ini",
+					"--json-meta", "-u", "book.epub",
+				}, cmd.Args)
+				return []byte("output"), nil
+			},
+		}
+		output, err := subject.Run(ctx, "--json-meta", "-u", "book.epub")
+		require.NoError(t, err)
+		assert.Equal(t, "output", output)
+
+		subject.Command = "/opt/fanficfare"
+		subject.RunShim = func(cmd *exec.Cmd) ([]byte, error) {
+			assert.Equal(t, "/opt/fanficfare", cmd.Args[0])
+			return nil, errors.New("failed")
+		}
+		_, err = subject.Run(ctx, "--sites-list")
+		assert.EqualError(t, err, "failed")
+
+		subject.RunShim = func(cmd *exec.Cmd) ([]byte, error) {
+			_, err := io.WriteString(cmd.Stderr, "Story does not exist: https://example.com/s/1\n")
+			require.NoError(t, err)
+			return []byte("Updating book.epub\n"), errors.New("exit status 1")
+		}
+		output, err = subject.Run(ctx, "--json-meta", "-u", "book.epub")
+		assert.EqualError(t, err, "exit status 1")
+		assert.Equal(t, "Updating book.epub\nStory does not exist: https://example.com/s/1\n", output)
+		assert.Equal(t, model.ErrorNotFound, Classify(output, model.ErrorUnknown))
+	})
+	t.Run("scripted", func(t *testing.T) {
+		workFile := filepath.Join(t.TempDir(), "book.epub")
+		subject := &ScriptedRunner{
+			Sites: []string{"https://example.com/"},
+			Responses: []ScriptedResponse{
+				{Output: "Do update - epub(1) vs url(2)\n", Meta: map[string]any{"title": "Title"}, Epub: []byte("new")},
+				{},
+				{Err: errors.New("failed")},
+			},
+		}
+		output, err := subject.Run(ctx, "--sites-list")
+		require.NoError(t, err)
+		assert.Equal(t, "  * https://example.com/\n", output)
+
+		output, err = subject.Run(ctx, "--json-meta", "--update-epub", workFile)
+		require.NoError(t, err)
+		lines, rawJSON, ok := splitOutput(output)
+		require.True(t, ok)
+		assert.Equal(t, []string{"Do update - epub(1) vs url(2)"}, lines)
+		assert.JSONEq(t, `{"title": "Title"}`, string(rawJSON))
+		contents, err := os.ReadFile(workFile)
+		require.NoError(t, err)
+		assert.Equal(t, "new", string(contents))
+
+		output, err = subject.Run(ctx, "--json-meta", "--update-epub", workFile)
+		require.NoError(t, err)
+		_, rawJSON, ok = splitOutput(output)
+		require.True(t, ok)
+		assert.JSONEq(t, `{}`, string(rawJSON))
+
+		_, err = subject.Run(ctx, "--json-meta", "--update-epub", workFile)
+		assert.EqualError(t, err, "failed")
+		_, err = subject.Run(ctx, "--json-meta", "--update-epub", workFile)
+		assert.ErrorContains(t, err, "no scripted response")
+		assert.Len(t, subject.Calls, 5)
+	})
+}
@@ -0,0 +1,270 @@
+// Package history keeps previous versions of the EPUBs of books, so that an
+// update that went wrong can be rolled back.
+package history
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/util"
+)
+
+// DefaultKeep is the number of most recent versions kept for each book, if
+// Archive.Keep is zero.
+const DefaultKeep = 5
+
+// now returns the current time; tests replace it.
+var now = time.Now
+
+// Version is an archived EPUB of a book.
+type Version struct {
+	Hash     string    `json:"hash"` // The SHA-256 of the file, in hex
+	Size     int64     `json:"size"`
+	Archived time.Time `json:"archived"` // When the file was replaced
+}
+
+// Archive stores the versions of the EPUBs of the books in a library.  Files
+// are stored by their content, so that a file is only stored once however many
+// times it is archived; an index lists the versions of each book.  It is safe
+// for concurrent use.
+type Archive struct {
+	Dir     string
+	Library calibre.Library // Where the current EPUBs are read and restored
+	// Keep is the number of most recent versions kept for each book; zero
+	// means DefaultKeep.
+	Keep int
+	// Months is the number of recent months in which the latest version of
+	// each month is also kept; zero keeps one for every month, and a negative
+	// value keeps none.
+	Months int
+
+	lock  sync.Mutex
+	index map[string][]Version // Keyed by book ID, newest first
+}
+
+// Open returns the archive in the given directory, creating it if needed.
+func Open(dir string, library calibre.Library) (*Archive, error) {
+	a := &Archive{Dir: dir, Library: library, index: make(map[string][]Version)}
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0o755); err != nil {
+		return nil, fmt.Errorf("could not create history directory %s: %w", dir, err)
+	}
+	data, err := os.ReadFile(a.indexPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read history index: %w", err)
+	}
+	if err = json.Unmarshal(data, &a.index); err != nil {
+		return nil, fmt.Errorf("could not parse history index %s: %w", a.indexPath(), err)
+	}
+	if a.index == nil {
+		a.index = make(map[string][]Version)
+	}
+	return a, nil
+}
+
+func (a *Archive) indexPath() string {
+	return filepath.Join(a.Dir, "index.json")
+}
+
+// objectPath returns the path of the file with the given hash.
+func (a *Archive) objectPath(hash string) string {
+	return filepath.Join(a.Dir, "objects", hash[:2], hash+".epub")
+}
+
+// Versions returns the archived versions of the book, newest first.
+func (a *Archive) Versions(bookId int) []Version {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]Version(nil), a.index[strconv.Itoa(bookId)]...)
+}
+
+// Open opens the file of the given version of the book.  The version may be
+// abbreviated to a unique prefix of its hash.
+func (a *Archive) Open(bookId int, version string) (io.ReadCloser, Version, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	found, err := a.find(bookId, version)
+	if err != nil {
+		return nil, found, err
+	}
+	file, err := os.Open(a.objectPath(found.Hash))
+	if err != nil {
+		return nil, found, fmt.Errorf("could not open version %s of book #%d: %w", found.Hash, bookId, err)
+	}
+	return file, found, nil
+}
+
+// find returns the version of the book whose hash starts with the given
+// prefix; the lock must be held.  If there is none, the error wraps
+// os.ErrNotExist.
+func (a *Archive) find(bookId int, prefix string) (Version, error) {
+	var found *Version
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	for _, version := range a.index[strconv.Itoa(bookId)] {
+		if prefix == "" || !strings.HasPrefix(version.Hash, prefix) {
+			continue
+		}
+		if found != nil && found.Hash != version.Hash {
+			return Version{}, fmt.Errorf("version %q of book #%d is ambiguous", prefix, bookId)
+		}
+		if found == nil {
+			version := version
+			found = &version
+		}
+	}
+	if found == nil {
+		return Version{}, fmt.Errorf("no version %q of book #%d: %w", prefix, bookId, os.ErrNotExist)
+	}
+	return *found, nil
+}
+
+// Save archives the current EPUB of the book, if it has one, unless it is the
+// same as the latest archived version.  Old versions are then pruned.
+func (a *Archive) Save(ctx context.Context, book model.CalibreBook) error {
+	reader, err := a.Library.OpenFormat(ctx, book, "epub")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read EPUB of %s to archive: %w", book.Title, err)
+	}
+	defer reader.Close()
+	file, err := os.CreateTemp(a.Dir, "incoming-*.epub")
+	if err != nil {
+		return fmt.Errorf("could not create temporary file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hasher), reader)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not archive EPUB of %s: %w", book.Title, err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("could not archive EPUB of %s: %w", book.Title, err)
+	}
+	version := Version{Hash: hex.EncodeToString(hasher.Sum(nil)), Size: size, Archived: now()}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	key := strconv.Itoa(book.Id)
+	versions := a.index[key]
+	if len(versions) > 0 && versions[0].Hash == version.Hash {
+		return nil
+	}
+	objectPath := a.objectPath(version.Hash)
+	if _, err = os.Stat(objectPath); errors.Is(err, os.ErrNotExist) {
+		if err = os.MkdirAll(filepath.Dir(objectPath), 0o755); err != nil {
+			return fmt.Errorf("could not archive EPUB of %s: %w", book.Title, err)
+		}
+		if err = os.Rename(file.Name(), objectPath); err != nil {
+			return fmt.Errorf("could not archive EPUB of %s: %w", book.Title, err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("could not archive EPUB of %s: %w", book.Title, err)
+	}
+	a.index[key] = a.prune(append([]Version{version}, versions...))
+	logrus.Debugf("Archived version %.12s of %s", version.Hash, book.Title)
+	return a.save()
+}
+
+// prune returns the versions that are retained: the Keep most recent, and the
+// latest of each month within the last Months months.
+func (a *Archive) prune(versions []Version) []Version {
+	keep := a.Keep
+	if keep == 0 {
+		keep = DefaultKeep
+	}
+	var oldest time.Time
+	if a.Months > 0 {
+		today := now()
+		oldest = time.Date(today.Year(), today.Month()-time.Month(a.Months-1), 1, 0, 0, 0, 0, today.Location())
+	}
+	months := make(map[string]bool)
+	result := make([]Version, 0, len(versions))
+	for i, version := range versions {
+		month := version.Archived.Format("2006-01")
+		latestOfMonth := !months[month]
+		months[month] = true
+		if i < keep || (a.Months >= 0 && latestOfMonth && !version.Archived.Before(oldest)) {
+			result = append(result, version)
+		}
+	}
+	return result
+}
+
+// save writes the index to disk, and removes files no longer referenced by
+// any version; the lock must be held.
+func (a *Archive) save() error {
+	data, err := json.MarshalIndent(a.index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not serialize history index: %w", err)
+	}
+	if err = util.ReplaceFile(a.indexPath(), data); err != nil {
+		return fmt.Errorf("could not write history index %s: %w", a.indexPath(), err)
+	}
+
+	referenced := make(map[string]bool)
+	for _, versions := range a.index {
+		for _, version := range versions {
+			referenced[version.Hash] = true
+		}
+	}
+	objects, err := filepath.Glob(filepath.Join(a.Dir, "objects", "*", "*.epub"))
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if !referenced[strings.TrimSuffix(filepath.Base(object), ".epub")] {
+			if err = os.Remove(object); err != nil {
+				logrus.Warnf("could not remove old version %s: %v", object, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Rollback replaces the EPUB of the book with the given version, which may be
+// abbreviated to a unique prefix of its hash.  The EPUB being replaced is
+// archived first, so that the rollback can itself be undone.
+func (a *Archive) Rollback(ctx context.Context, book model.CalibreBook, version string) (Version, error) {
+	a.lock.Lock()
+	found, err := a.find(book.Id, version)
+	a.lock.Unlock()
+	if err != nil {
+		return found, err
+	}
+	// Copy the version out first, as archiving the current EPUB may prune it.
+	dir, err := os.MkdirTemp("", "fanficupdates-rollback-*")
+	if err != nil {
+		return found, fmt.Errorf("could not create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	workFile := filepath.Join(dir, "book.epub")
+	if err = util.CopyFile(a.objectPath(found.Hash), workFile); err != nil {
+		return found, fmt.Errorf("could not read version %s of %s: %w", found.Hash, book.Title, err)
+	}
+	if err = a.Save(ctx, book); err != nil {
+		return found, err
+	}
+	if err = a.Library.AddFormat(ctx, book.Id, workFile); err != nil {
+		return found, err
+	}
+	logrus.Infof("Rolled back %s to version %.12s from %s", book.Title, found.Hash, found.Archived.Format(time.RFC1123))
+	return found, nil
+}
@@ -0,0 +1,100 @@
+package history
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mook/fanficupdates/calibre/memory"
+	"github.com/mook/fanficupdates/model"
+)
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	library := memory.NewLibrary(model.CalibreBook{Id: 1, Title: "Story"})
+	dir := t.TempDir()
+	subject, err := Open(dir, library)
+	require.NoError(t, err)
+	subject.Keep = 2
+	current := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+
+	book := model.CalibreBook{Id: 1, Title: "Story"}
+	require.NoError(t, subject.Save(ctx, book), "a book without an EPUB has nothing to archive")
+	assert.Empty(t, subject.Versions(1))
+
+	contents := []string{"march", "april", "may one", "may two", "may two", "may three"}
+	for i, content := range contents {
+		switch i {
+		case 0:
+			current = time.Date(2022, 3, 10, 0, 0, 0, 0, time.UTC)
+		case 1:
+			current = time.Date(2022, 4, 10, 0, 0, 0, 0, time.UTC)
+		default:
+			current = time.Date(2022, 5, i, 0, 0, 0, 0, time.UTC)
+		}
+		require.NoError(t, library.SetFile(1, "epub", []byte(content)))
+		require.NoError(t, subject.Save(ctx, book))
+	}
+	read := func(version Version) string {
+		reader, _, err := subject.Open(1, version.Hash)
+		require.NoError(t, err)
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		return string(data)
+	}
+	versions := subject.Versions(1)
+	require.Len(t, versions, 4)
+	assert.Equal(t, []string{"may three", "may two", "april", "march"},
+		[]string{read(versions[0]), read(versions[1]), read(versions[2]), read(versions[3])},
+		"the last two versions and the latest of each month should be kept")
+	objects, err := filepath.Glob(filepath.Join(dir, "objects", "*", "*.epub"))
+	require.NoError(t, err)
+	assert.Len(t, objects, 4, "pruned versions should be removed")
+
+	reopened, err := Open(dir, library)
+	require.NoError(t, err)
+	assert.Equal(t, versions, reopened.Versions(1))
+
+	t.Run("months", func(t *testing.T) {
+		subject.Months = 2
+		assert.Len(t, subject.prune(versions), 3)
+		subject.Months = -1
+		assert.Len(t, subject.prune(versions), 2)
+		subject.Months = 0
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		_, err := subject.Rollback(ctx, book, "")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, err = subject.Rollback(ctx, book, "not-a-hash")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		require.NoError(t, library.SetFile(1, "epub", []byte("broken")))
+		restored, err := subject.Rollback(ctx, book, versions[2].Hash[:8])
+		require.NoError(t, err)
+		assert.Equal(t, versions[2], restored)
+		data, _ := library.File(1, "epub")
+		assert.Equal(t, "april", string(data))
+		assert.Equal(t, "broken", read(subject.Versions(1)[0]), "the replaced EPUB should be archived")
+	})
+
+	t.Run("library", func(t *testing.T) {
+		wrapped := &Library{Library: library, Archive: subject}
+		file := filepath.Join(t.TempDir(), "new.epub")
+		require.NoError(t, os.WriteFile(file, []byte("new"), 0o644))
+		require.NoError(t, wrapped.AddFormat(ctx, 1, file))
+		data, _ := library.File(1, "epub")
+		assert.Equal(t, "new", string(data))
+		assert.Equal(t, "april", read(subject.Versions(1)[0]))
+		assert.ErrorIs(t, wrapped.AddFormat(ctx, 100, file), os.ErrNotExist, "a missing book can't be archived")
+	})
+}
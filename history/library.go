@@ -0,0 +1,35 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/mook/fanficupdates/calibre"
+)
+
+// Library is a calibre.Library that archives the EPUB of a book before it is
+// replaced.
+type Library struct {
+	calibre.Library
+	Archive *Archive
+}
+
+var _ calibre.Library = &Library{}
+
+// AddFormat archives the existing EPUB of the book, if an EPUB is being added,
+// and then adds the file.  If the existing EPUB could not be archived, it is
+// not replaced.
+func (l *Library) AddFormat(ctx context.Context, id int, path string) error {
+	if strings.EqualFold(filepath.Ext(path), ".epub") {
+		book, err := l.Library.GetBook(ctx, id)
+		if err != nil {
+			return fmt.Errorf("could not find book #%d to archive its EPUB: %w", id, err)
+		}
+		if err = l.Archive.Save(ctx, book); err != nil {
+			return err
+		}
+	}
+	return l.Library.AddFormat(ctx, id, path)
+}
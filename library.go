@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/mook/fanficupdates/backfill"
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/config"
+	"github.com/mook/fanficupdates/dedupe"
+	"github.com/mook/fanficupdates/fanficfare"
+	"github.com/mook/fanficupdates/history"
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/opds"
+	"github.com/mook/fanficupdates/query"
+	"github.com/mook/fanficupdates/review"
+	"github.com/mook/fanficupdates/rules"
+	"github.com/mook/fanficupdates/schedule"
+	"github.com/mook/fanficupdates/state"
+	"github.com/mook/fanficupdates/updater"
+	"github.com/mook/fanficupdates/util"
+)
+
+// librarySettings is the parsed form of the configuration for one library.
+type librarySettings struct {
+	config    config.Library
+	selection query.Expr
+	rules     rules.Rules
+	scheduler *schedule.Scheduler
+}
+
+func newLibrarySettings(cfg *config.Config, library config.Library) (*librarySettings, error) {
+	result := &librarySettings{config: library}
+	var err error
+	if result.selection, err = query.Parse(library.Select); err != nil {
+		return nil, err
+	}
+	if result.rules, err = rules.ParseRules(library.Rules); err != nil {
+		return nil, err
+	}
+	// Each library has its own scheduler, as they track the time of the
+	// last update.
+	if result.scheduler, err = cfg.Scheduler(time.Now()); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// library is a Calibre library being updated.
+type library struct {
+	name    string
+	calibre calibre.Library
+	runner  fanficfare.Runner
+	store   *state.Store
+	servers []*opds.Server // The OPDS servers for the library
+
+	duplicates *dedupe.Finder
+	review     *review.Queue    // Updates held as they would lose content
+	history    *history.Archive // Replaced EPUBs; nil if not archived
+}
+
+// String returns the name of the library for log messages.
+func (l *library) String() string {
+	if l.name == "" {
+		return "library"
+	}
+	return fmt.Sprintf("library %s", l.name)
+}
+
+// target returns the library that updates are written to: the Calibre library,
+// archiving replaced EPUBs if there is a history.
+func (l *library) target() calibre.Library {
+	if l.history == nil {
+		return l.calibre
+	}
+	return &history.Library{Library: l.calibre, Archive: l.history}
+}
+
+// batchBooks repeatedly lists the books in the library and sends them in
+// batches of the given size (or all at once if zero) until the context is
+// cancelled.
+func (l *library) batchBooks(ctx context.Context, batchSize int, bookGroup chan<- []model.CalibreBook) error {
+	defer close(bookGroup)
+	if batchSize == 0 {
+		for ctx.Err() == nil {
+			books, err := l.calibre.GetBooks(ctx)
+			if err != nil {
+				return fmt.Errorf("error getting books for %s: %w", l, err)
+			}
+			bookGroup <- books
+		}
+		return nil
+	}
+	buffer := make([]model.CalibreBook, 0, batchSize*2)
+	for ctx.Err() == nil {
+		if len(buffer) >= batchSize {
+			bookGroup <- buffer[:batchSize]
+			buffer = buffer[batchSize:]
+			continue
+		}
+		books, err := l.calibre.GetBooks(ctx)
+		if err != nil {
+			return fmt.Errorf("error getting books for %s: %w", l, err)
+		}
+		buffer = append(buffer, books...)
+		bookGroup <- buffer[:batchSize]
+		buffer = buffer[batchSize:]
+	}
+	return nil
+}
+
+// watchBooks refreshes the books served whenever the library changes, until
+// the context is cancelled.
+func (l *library) watchBooks(ctx context.Context) error {
+	changes, err := l.calibre.Watch(ctx)
+	if err != nil {
+		logrus.Infof("Not watching %s for changes: %v", l, err)
+		return nil
+	}
+	for range changes {
+		books, err := l.calibre.GetBooks(ctx)
+		if err != nil {
+			logrus.Warnf("Could not refresh books for %s: %v", l, err)
+			continue
+		}
+		logrus.Debugf("Refreshed %d books for %s", len(books), l)
+		for _, server := range l.servers {
+			server.SetBooks(books)
+		}
+	}
+	return nil
+}
+
+// configure applies the settings to FanFicFare.
+func configure(fff *fanficfare.FanFicFare, s *settings) {
+	fff.PreserveAuthors = s.config.PreserveAuthors
+	fff.KeepOldURL = s.config.KeepOldURL
+	fff.Policies = s.policies
+	fff.FieldMap = s.fieldMap
+	fff.MaxChapterLoss = s.config.Regression.MaxChapterLoss
+	fff.MaxWordLoss = s.config.Regression.MaxWordLoss
+}
+
+// newUpdater returns an updater for the library using the given processor,
+// counting the outcomes of the books checked.
+func (l *library) newUpdater(s *settings, processor updater.Processor, limiter *updater.SiteLimiter, outcomes map[model.Outcome]int) *updater.Updater {
+	_, metadataOnly := processor.(*fanficfare.MetadataRefresh)
+	return &updater.Updater{
+		Processor:          processor,
+		Rules:              s.libraries[l.name].rules,
+		Store:              l.store,
+		Limiter:            limiter,
+		StateKey:           fanficfare.StateKey,
+		RetryPolicies:      s.retry,
+		SourceRemovedAfter: s.config.SourceRemovedAfter,
+		MetadataOnly:       metadataOnly,
+		Library:            l.calibre,
+		OnResult: func(result model.UpdateResult) {
+			outcomes[result.Outcome]++
+		},
+	}
+}
+
+// refreshMetadata refreshes the metadata of the selected books once, without
+// downloading chapters.
+func (l *library) refreshMetadata(ctx context.Context, s *settings, limiter *updater.SiteLimiter, books []model.CalibreBook) error {
+	fff, err := fanficfare.New(ctx, l.target(), l.runner)
+	if err != nil {
+		return fmt.Errorf("error readying FanFicFare for %s: %w", l, err)
+	}
+	fff.Store = l.store
+	configure(fff, s)
+	outcomes := make(map[model.Outcome]int)
+	refresh := l.newUpdater(s, &fanficfare.MetadataRefresh{FanFicFare: fff}, limiter, outcomes)
+	refresh.Update(ctx, util.Filter(books, s.libraries[l.name].selection.Match))
+	if len(outcomes) > 0 {
+		logrus.Infof("Finished refreshing %s: %s", l, describeOutcomes(outcomes))
+	}
+	return nil
+}
+
+// runUpdates updates the books in the library according to its schedule,
+// until the context is cancelled.
+func (l *library) runUpdates(ctx context.Context, getCurrent func() *settings, limiter *updater.SiteLimiter, skipFirst bool, bookGroup <-chan []model.CalibreBook) error {
+	fff, err := fanficfare.New(ctx, l.target(), l.runner)
+	if err != nil {
+		return fmt.Errorf("error readying FanFicFare for %s: %w", l, err)
+	}
+	fff.OnUpdate = func(update model.StoryUpdate) {
+		for _, server := range l.servers {
+			server.AddUpdate(update)
+		}
+		getCurrent().notifier.Notify(update)
+	}
+	fff.Store = l.store
+	fff.Review = l.review
+	// Books from earlier batches whose schedule was not yet due.
+	var pending []model.CalibreBook
+	isFirstRun := true
+	for ctx.Err() == nil {
+		// Use the same settings for the whole run, even if the
+		// configuration is reloaded part way through.
+		s := getCurrent()
+		ls := s.libraries[l.name]
+		var due []*schedule.Group
+		if isFirstRun && !skipFirst {
+			due = ls.scheduler.Groups()
+		} else {
+			next := ls.scheduler.NextRun()
+			if next.IsZero() {
+				logrus.Warnf("No more updates are scheduled for %s", l)
+				next = time.Now().Add(24 * time.Hour)
+			}
+			logrus.Infof("Waiting until %s for next update of %s...", next.Format(time.RFC1123), l)
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-ctx.Done():
+			case <-s.replaced:
+			case <-timer.C:
+			}
+			timer.Stop()
+			if ctx.Err() != nil {
+				// Guard against parent context closing
+				break
+			}
+			if s != getCurrent() {
+				// The schedule changed while waiting
+				continue
+			}
+			due = ls.scheduler.Due(time.Now())
+		}
+		isFirstRun = false
+		if len(due) == 0 {
+			continue
+		}
+		configure(fff, s)
+		outcomes := make(map[model.Outcome]int)
+		newUpdater := func(processor updater.Processor) *updater.Updater {
+			return l.newUpdater(s, processor, limiter, outcomes)
+		}
+		var books, refreshBooks []model.CalibreBook
+		candidates := mergePending(pending, <-bookGroup)
+		pending = nil
+		for _, book := range candidates {
+			if !ls.selection.Match(book) {
+				continue
+			}
+			group := ls.scheduler.Assign(book)
+			if util.Any(due, func(g *schedule.Group) bool { return g == group }) {
+				books = append(books, book)
+				continue
+			}
+			// Keep the book until its own schedule is due.
+			pending = append(pending, book)
+			if util.Any(due, func(g *schedule.Group) bool {
+				return g.MetadataOnly && (g.Filter == nil || g.Filter.Match(book))
+			}) {
+				// Books due for a full update don't need a refresh as well.
+				refreshBooks = append(refreshBooks, book)
+			}
+		}
+		newUpdater(fff).Update(ctx, books)
+		newUpdater(&fanficfare.MetadataRefresh{FanFicFare: fff}).Update(ctx, refreshBooks)
+		if len(outcomes) > 0 {
+			logrus.Infof("Finished updating %s: %s", l, describeOutcomes(outcomes))
+		}
+	}
+	for range bookGroup {
+		// Drain the channel until the writer exits
+	}
+	return nil
+}
+
+// mergePending returns the pending books followed by the new batch, where books
+// in the batch replace pending books with the same ID, as they are more recent.
+func mergePending(pending, batch []model.CalibreBook) []model.CalibreBook {
+	inBatch := make(map[int]bool, len(batch))
+	for _, book := range batch {
+		inBatch[book.Id] = true
+	}
+	result := util.Filter(pending, func(b model.CalibreBook) bool { return !inBatch[b.Id] })
+	return append(result, batch...)
+}
+
+// describeOutcomes summarizes the number of books with each outcome, such as
+// "5 up-to-date, 2 updated".
+func describeOutcomes(outcomes map[model.Outcome]int) string {
+	keys := make([]string, 0, len(outcomes))
+	for outcome := range outcomes {
+		keys = append(keys, string(outcome))
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%d %s", outcomes[model.Outcome(key)], key))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// reportDuplicates writes the groups of duplicate books in the library; if
+// merge is set, the books grouped by story URL are merged.  Books grouped only
+// by title and author are never merged automatically, as they may be
+// different stories.
+func (l *library) reportDuplicates(ctx context.Context, w io.Writer, books []model.CalibreBook, merge bool) error {
+	groups := l.duplicates.Find(ctx, books)
+	if len(groups) == 0 {
+		fmt.Fprintf(w, "No duplicates found in %s\n", l)
+		return nil
+	}
+	fmt.Fprintf(w, "Duplicates in %s:\n", l)
+	for _, group := range groups {
+		switch group.Reason {
+		case dedupe.ReasonURL:
+			fmt.Fprintf(w, "  Same story (%s):\n", group.Key)
+		default:
+			fmt.Fprintf(w, "  Same title and author (%s):\n", group.Key)
+		}
+		for _, book := range group.Books {
+			modified := "unknown"
+			if !book.LastModified.IsZero() {
+				modified = book.LastModified.Format("2006-01-02")
+			}
+			fmt.Fprintf(w, "    #%d %s by %s (modified %s) %s\n",
+				book.Id, book.Title, strings.Join(book.Authors, " & "), modified, book.Identifiers["url"])
+		}
+		if !merge || group.Reason != dedupe.ReasonURL {
+			continue
+		}
+		result, err := l.duplicates.Merge(ctx, group.Books)
+		if err != nil {
+			return fmt.Errorf("could not merge %s: %w", group.Key, err)
+		}
+		fmt.Fprintf(w, "    Merged into #%d, removed %v\n", result.Kept, result.Removed)
+	}
+	return nil
+}
+
+// reportBackfill writes the url identifiers found in the EPUBs of the books
+// that have none; if apply is set, the identifiers are also set, so that the
+// books are checked for updates.
+func (l *library) reportBackfill(ctx context.Context, w io.Writer, books []model.CalibreBook, apply bool) error {
+	finder := &backfill.Finder{Library: l.calibre}
+	proposals := finder.Find(ctx, books)
+	if len(proposals) == 0 {
+		fmt.Fprintf(w, "No missing URLs found in %s\n", l)
+		return nil
+	}
+	fmt.Fprintf(w, "URLs found in %s:\n", l)
+	for _, proposal := range proposals {
+		fmt.Fprintf(w, "  #%d %s: %s (from %s)\n", proposal.Book.Id, proposal.Book.Title, proposal.URL, proposal.Found)
+		if apply {
+			if err := finder.Apply(ctx, proposal); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reportReview writes the updates held for review in the library, after
+// accepting or rejecting those given.
+func (l *library) reportReview(ctx context.Context, w io.Writer, accept, reject []int) error {
+	for _, bookId := range accept {
+		entry, err := l.review.Accept(ctx, bookId)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Accepted update of #%d %s (%s)\n", entry.BookId, entry.Title, entry.Reason)
+	}
+	for _, bookId := range reject {
+		entry, err := l.review.Reject(bookId)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Rejected update of #%d %s (%s)\n", entry.BookId, entry.Title, entry.Reason)
+	}
+	entries, err := l.review.List()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Fprintf(w, "No updates held for review in %s\n", l)
+		return nil
+	}
+	fmt.Fprintf(w, "Updates held for review in %s:\n", l)
+	for _, entry := range entries {
+		fmt.Fprintf(w, "  #%d %s: %s, held %s %s\n",
+			entry.BookId, entry.Title, entry.Reason, entry.Held.Format("2006-01-02"), entry.URL)
+	}
+	return nil
+}
+
+// reportHistory writes the archived versions of the given books, after
+// rolling back those given as book ID to version.
+func (l *library) reportHistory(ctx context.Context, w io.Writer, books []model.CalibreBook, bookIds []int, rollbacks map[string]string) error {
+	if l.history == nil {
+		return fmt.Errorf("no history is kept for %s", l)
+	}
+	find := func(value string) *model.CalibreBook {
+		return util.Find(books, func(b model.CalibreBook) bool { return strconv.Itoa(b.Id) == value })
+	}
+	for value, version := range rollbacks {
+		book := find(value)
+		if book == nil {
+			continue
+		}
+		restored, err := l.history.Rollback(ctx, *book, version)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Rolled back #%d %s to %.12s from %s\n",
+			book.Id, book.Title, restored.Hash, restored.Archived.Format(time.RFC1123))
+	}
+	for _, bookId := range bookIds {
+		book := find(strconv.Itoa(bookId))
+		if book == nil {
+			continue
+		}
+		versions := l.history.Versions(book.Id)
+		if len(versions) == 0 {
+			fmt.Fprintf(w, "No previous versions of #%d %s in %s\n", book.Id, book.Title, l)
+			continue
+		}
+		fmt.Fprintf(w, "Previous versions of #%d %s in %s:\n", book.Id, book.Title, l)
+		for _, version := range versions {
+			fmt.Fprintf(w, "  %.12s %s (%d bytes)\n", version.Hash, version.Archived.Format(time.RFC1123), version.Size)
+		}
+	}
+	return nil
+}
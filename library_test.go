@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mook/fanficupdates/calibre/memory"
+	"github.com/mook/fanficupdates/config"
+	"github.com/mook/fanficupdates/fanficfare"
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/state"
+	"github.com/mook/fanficupdates/updater"
+	"github.com/mook/fanficupdates/util"
+)
+
+func TestMergePending(t *testing.T) {
+	pending := []model.CalibreBook{{Id: 1, Title: "old"}, {Id: 2, Title: "kept"}}
+	batch := []model.CalibreBook{{Id: 1, Title: "new"}, {Id: 3, Title: "added"}}
+	merged := mergePending(pending, batch)
+	assert.Equal(t, []string{"kept", "new", "added"}, util.Map(merged, func(b model.CalibreBook) string { return b.Title }))
+	assert.Equal(t, batch, mergePending(nil, batch))
+}
+
+func TestRunUpdates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lib := memory.NewLibrary(model.CalibreBook{
+		Id:          1,
+		Title:       "Sample Book",
+		Identifiers: map[string]string{"url": "http://supported.test/1"},
+	})
+	require.NoError(t, lib.SetFile(1, "epub", []byte("old epub")))
+	runner := &fanficfare.ScriptedRunner{
+		Sites: []string{"http://supported.test"},
+		Responses: []fanficfare.ScriptedResponse{{
+			Output: "Do update - epub(1) vs url(2)",
+			Epub:   []byte("new epub"),
+		}},
+	}
+	store, err := state.Open(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, err)
+	s, err := newSettings(config.Default())
+	require.NoError(t, err)
+	subject := &library{calibre: lib, runner: runner, store: store}
+
+	books, err := lib.GetBooks(ctx)
+	require.NoError(t, err)
+	bookGroup := make(chan []model.CalibreBook)
+	done := make(chan error)
+	go func() {
+		done <- subject.runUpdates(ctx, func() *settings { return s }, updater.NewSiteLimiter(nil), false, bookGroup)
+	}()
+	bookGroup <- books
+	require.Eventually(t, func() bool {
+		data, _ := lib.File(1, "epub")
+		return string(data) == "new epub"
+	}, 5*time.Second, 10*time.Millisecond, "the book should be updated on the first run")
+	cancel()
+	close(bookGroup)
+	require.NoError(t, <-done)
+	assert.Empty(t, runner.Responses)
+}
@@ -8,6 +8,9 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -15,9 +18,18 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/config"
+	"github.com/mook/fanficupdates/dedupe"
 	"github.com/mook/fanficupdates/fanficfare"
+	"github.com/mook/fanficupdates/history"
 	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/notify"
 	"github.com/mook/fanficupdates/opds"
+	"github.com/mook/fanficupdates/query"
+	"github.com/mook/fanficupdates/review"
+	"github.com/mook/fanficupdates/state"
+	"github.com/mook/fanficupdates/updater"
+	"github.com/mook/fanficupdates/util"
 )
 
 type PathValue struct {
@@ -48,102 +60,379 @@ func (p *PathValue) Type() string {
 	return "path"
 }
 
+// settings is the parsed form of the configuration, which is replaced as a
+// whole when the configuration is reloaded.
+type settings struct {
+	config     *config.Config
+	policies   calibre.FieldPolicies
+	fieldMap   map[string]string
+	siteLimits map[string]updater.SiteLimit
+	retry      map[model.ErrorClass]updater.RetryPolicy
+	notifier   *notify.Notifier
+	libraries  map[string]*librarySettings // Keyed by library name
+	replaced   chan struct{}               // Closed when the settings are reloaded
+}
+
+func newSettings(cfg *config.Config) (*settings, error) {
+	result := &settings{
+		config:    cfg,
+		notifier:  &notify.Notifier{},
+		libraries: make(map[string]*librarySettings),
+		replaced:  make(chan struct{}),
+	}
+	var err error
+	for _, library := range cfg.LibraryList() {
+		if result.libraries[library.Name], err = newLibrarySettings(cfg, library); err != nil {
+			return nil, err
+		}
+	}
+	if result.policies, err = cfg.ParsedFieldPolicies(); err != nil {
+		return nil, err
+	}
+	if len(cfg.FieldMap) > 0 {
+		result.fieldMap = make(map[string]string)
+		for key, value := range fanficfare.DefaultFieldMap {
+			result.fieldMap[key] = value
+		}
+		for key, value := range cfg.FieldMap {
+			result.fieldMap[key] = value
+		}
+	}
+	result.siteLimits = make(map[string]updater.SiteLimit, len(cfg.Sites))
+	for site, limit := range cfg.Sites {
+		result.siteLimits[site] = updater.SiteLimit{Delay: time.Duration(limit.Delay), MaxPerRun: limit.MaxPerRun}
+	}
+	result.retry = make(map[model.ErrorClass]updater.RetryPolicy, len(cfg.Retry))
+	for class, policy := range cfg.Retry {
+		result.retry[model.ErrorClass(class)] = updater.RetryPolicy{
+			Backoff:    time.Duration(policy.Backoff),
+			MaxBackoff: time.Duration(policy.MaxBackoff),
+			Quarantine: policy.Quarantine,
+		}
+	}
+	for _, target := range cfg.Notify {
+		filter, err := query.Parse(target.Select)
+		if err != nil {
+			return nil, err
+		}
+		result.notifier.Targets = append(result.notifier.Targets, &notify.Webhook{
+			URL:     target.URL,
+			Headers: target.Headers,
+			Filter:  filter,
+		})
+	}
+	return result, nil
+}
+
+// libraryLocations returns the parts of the library configuration that can
+// only be changed by restarting.
+func libraryLocations(cfg *config.Config) []config.Library {
+	return util.Map(cfg.LibraryList(), func(library config.Library) config.Library {
+		return config.Library{Name: library.Name, Path: library.Path, Settings: library.Settings, State: library.State}
+	})
+}
+
+// newRunner returns the FanFicFare runner for the configuration.
+func newRunner(cfg config.FanFicFare, c *calibre.Calibre) fanficfare.Runner {
+	if cfg.Runner == config.RunnerCLI {
+		return &fanficfare.CLIRunner{Command: cfg.Command, Args: cfg.Args}
+	}
+	return &fanficfare.PluginRunner{Calibre: c, Args: cfg.Args}
+}
+
 func main() {
-	c := &calibre.Calibre{}
+	defaults := config.Default()
 	var settingsDir, libraryDir PathValue
+	configFile := pflag.StringP("config", "c", os.Getenv(config.EnvPrefix+"CONFIG"), "Path to YAML configuration file")
 	pflag.VarP(&settingsDir, "settings", "s", "Path to Calibre settings directory")
 	pflag.VarP(&libraryDir, "library", "l", "Path to Calibre library directory")
+	contentServer := pflag.String("content-server", "", "URL of a Calibre Content Server to use instead of the library directory, e.g. http://localhost:8080/#Calibre_Library")
+	runner := pflag.String("runner", config.RunnerPlugin, "How to run FanFicFare: plugin (via calibre-debug) or cli (the fanficfare command)")
 	verbose := pflag.CountP("verbose", "v", "Produce more detailed messages")
 	quiet := pflag.CountP("quiet", "q", "Produce fewer messages")
-	batchSize := pflag.IntP("batch-size", "b", 0, "Update in chunks with the given chunk size")
-	updateInterval := pflag.DurationP("update-interval", "i", 8*time.Hour, "Interval between successive updates")
-	skipFirstUpdate := pflag.Bool("skip-first", false, "Skip initial update before waiting")
+	batchSize := pflag.IntP("batch-size", "b", defaults.BatchSize, "Update in chunks with the given chunk size")
+	updateInterval := pflag.DurationP("update-interval", "i", time.Duration(defaults.UpdateInterval), "Interval between successive updates, if there is no schedule")
+	scheduleSpec := pflag.String("schedule", defaults.Schedule.Cron, "Cron expression for when to update, e.g. '0 3 * * *' or '@every 6h'")
+	skipFirstUpdate := pflag.Bool("skip-first", defaults.SkipFirst, "Skip initial update before waiting")
+	fieldMap := pflag.StringToString("field-map", nil, "Map FanFicFare metadata keys to Calibre fields, e.g. status=#status,numWords=#words")
+	fieldPolicy := pflag.StringToString("field-policy", nil, "Policy for overwriting Calibre fields (overwrite, fill-empty, never), e.g. comments=fill-empty")
+	preserveAuthors := pflag.Bool("preserve-authors", defaults.PreserveAuthors, "Never change the authors of existing books")
+	keepOldURL := pflag.Bool("keep-old-url", defaults.KeepOldURL, "Keep the previous URL as the url_old identifier when a story URL changes")
+	ruleInputs := pflag.StringArray("rule", defaults.Rules, "Update rule, as <condition> <action>...; may be repeated")
+	selectQuery := pflag.String("select", defaults.Select, "Only update books matching the given query, e.g. 'site:ao3 and not tag:complete'")
+	stateFile := pflag.String("state", defaults.State, "Path to state file (default fanficupdates.json in the settings directory)")
+	addr := pflag.String("addr", defaults.Server.Addr, "Address for the OPDS server to listen on")
+	findDuplicates := pflag.Bool("duplicates", false, "List books that appear to be the same story, then exit")
+	mergeDuplicates := pflag.Bool("merge-duplicates", false, "Merge books with the same story URL, then exit")
+	findURLs := pflag.Bool("find-urls", false, "List source URLs found in the EPUBs of books without URLs, then exit")
+	backfillURLs := pflag.Bool("backfill-urls", false, "Set the URLs of books without them from their EPUBs, then exit")
+	refreshMetadata := pflag.Bool("refresh-metadata", false, "Refresh the metadata of the selected books without downloading chapters, then exit")
+	showReview := pflag.Bool("review", false, "List updates held for review as they would lose content, then exit")
+	acceptUpdates := pflag.IntSlice("accept-update", nil, "Apply the held updates of the books with the given IDs, then exit")
+	rejectUpdates := pflag.IntSlice("reject-update", nil, "Discard the held updates of the books with the given IDs, then exit")
+	showVersions := pflag.IntSlice("versions", nil, "List the previous versions of the EPUBs of the books with the given IDs, then exit")
+	rollbacks := pflag.StringToString("rollback", nil, "Restore previous versions of EPUBs, as book ID=version, then exit")
+	libraryName := pflag.String("library-name", "", "Only use the configured library with the given name")
 	pflag.Parse()
 
 	logrus.SetLevel(logrus.Level(int(logrus.InfoLevel) + *verbose - *quiet))
-	if settingsDir.string != "" {
-		c.Settings = settingsDir.string
+
+	// loadConfig reads the configuration file, then applies environment
+	// variables and finally any flags given on the command line.
+	loadConfig := func() (*settings, error) {
+		cfg, err := config.Load(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+			return nil, err
+		}
+		changed := pflag.CommandLine.Changed
+		if changed("settings") {
+			cfg.Settings = settingsDir.string
+		}
+		if changed("library") {
+			cfg.Library = libraryDir.string
+		}
+		if changed("content-server") {
+			cfg.ContentServer.URL = *contentServer
+		}
+		if changed("runner") {
+			cfg.FanFicFare.Runner = *runner
+		}
+		if changed("batch-size") {
+			cfg.BatchSize = *batchSize
+		}
+		if changed("update-interval") {
+			cfg.UpdateInterval = config.Duration(*updateInterval)
+		}
+		if changed("schedule") {
+			cfg.Schedule.Cron = *scheduleSpec
+		}
+		if changed("skip-first") {
+			cfg.SkipFirst = *skipFirstUpdate
+		}
+		if changed("field-map") {
+			cfg.FieldMap = *fieldMap
+		}
+		if changed("field-policy") {
+			cfg.FieldPolicies = *fieldPolicy
+		}
+		if changed("preserve-authors") {
+			cfg.PreserveAuthors = *preserveAuthors
+		}
+		if changed("keep-old-url") {
+			cfg.KeepOldURL = *keepOldURL
+		}
+		if changed("rule") {
+			cfg.Rules = *ruleInputs
+		}
+		if changed("select") {
+			cfg.Select = *selectQuery
+		}
+		if changed("state") {
+			cfg.State = *stateFile
+		}
+		if changed("addr") {
+			cfg.Server.Addr = *addr
+		}
+		if err := cfg.Validate(); err != nil {
+			return nil, err
+		}
+		return newSettings(cfg)
+	}
+	initial, err := loadConfig()
+	if err != nil {
+		logrus.Fatal(err)
 	}
-	if libraryDir.string != "" {
-		c.Library = libraryDir.string
+	var currentLock sync.Mutex
+	current := initial
+	getCurrent := func() *settings {
+		currentLock.Lock()
+		defer currentLock.Unlock()
+		return current
+	}
+	cfg := initial.config
+
+	// Commands that report on (or fix up) the libraries, then exit.
+	reviewing := *showReview || len(*acceptUpdates) > 0 || len(*rejectUpdates) > 0
+	versioning := len(*showVersions) > 0 || len(*rollbacks) > 0
+	oneShot := *findDuplicates || *mergeDuplicates || *findURLs || *backfillURLs || *refreshMetadata || reviewing || versioning
+
+	libraryList := cfg.LibraryList()
+	if pflag.CommandLine.Changed("library-name") {
+		libraryList = util.Filter(libraryList, func(l config.Library) bool { return l.Name == *libraryName })
+		if len(libraryList) == 0 {
+			logrus.Fatalf("No library named %q is configured", *libraryName)
+		}
+	}
+	// Held updates and versions are identified by Calibre book IDs, which
+	// differ between libraries.
+	if len(libraryList) > 1 && (len(*acceptUpdates) > 0 || len(*rejectUpdates) > 0) {
+		logrus.Fatal("--accept-update and --reject-update need --library-name, as several libraries are configured")
+	}
+	if len(libraryList) > 1 && (len(*showVersions) > 0 || len(*rollbacks) > 0) {
+		logrus.Fatal("--versions and --rollback need --library-name, as several libraries are configured")
 	}
 
 	server := opds.NewServer()
+	server.SetAuth(cfg.Server.Username, cfg.Server.Password)
+	limiter := updater.NewSiteLimiter(initial.siteLimits)
 	ctx, cancel := context.WithCancel(context.Background())
 	grp, ctx := errgroup.WithContext(ctx)
-	if err := c.FindPaths(ctx); err != nil {
-		logrus.Fatalf("Could not auto-detect paths: %v", err)
+	var libraries []*library
+	for i, libraryConfig := range libraryList {
+		cal := &calibre.Calibre{Library: libraryConfig.Path, Settings: libraryConfig.Settings}
+		lib := &library{name: libraryConfig.Name, calibre: cal}
+		if server := libraryConfig.ContentServer; server.URL != "" {
+			cal.Server = &calibre.ContentServer{
+				URL:      server.URL,
+				Username: server.Username,
+				Password: server.Password,
+			}
+		}
+		lib.runner = newRunner(cfg.FanFicFare, cal)
+		if err := cal.FindPaths(ctx); err != nil {
+			logrus.Fatalf("Could not auto-detect paths for %s: %v", lib, err)
+		}
+		if err := cal.LoadCustomColumns(ctx); err != nil {
+			logrus.Warnf("Could not load custom columns for %s, types will be guessed: %v", lib, err)
+		}
+		if lib.store, err = state.Open(libraryConfig.StatePath(cal.Settings)); err != nil {
+			logrus.Fatalf("Could not load state for %s: %v", lib, err)
+		}
+		if cfg.History.Keep >= 0 {
+			if lib.history, err = history.Open(libraryConfig.HistoryPath(cal.Settings), lib.calibre); err != nil {
+				logrus.Fatalf("Could not open history for %s: %v", lib, err)
+			}
+			lib.history.Keep = cfg.History.Keep
+			lib.history.Months = cfg.History.Months
+		}
+		if lib.review, err = review.Open(libraryConfig.ReviewPath(cal.Settings), lib.target()); err != nil {
+			logrus.Fatalf("Could not open review queue for %s: %v", lib, err)
+		}
+		books, err := lib.calibre.GetBooks(ctx)
+		if err != nil {
+			fmt.Printf("error getting books for %s: %v\n", lib, err)
+			os.Exit(1)
+		}
+		lib.duplicates = &dedupe.Finder{
+			Normalizer: fanficfare.NewNormalizer(lib.runner),
+			Library:    lib.target(),
+		}
+		if *findDuplicates || *mergeDuplicates {
+			if err := lib.reportDuplicates(ctx, os.Stdout, books, *mergeDuplicates); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		if *findURLs || *backfillURLs {
+			if err := lib.reportBackfill(ctx, os.Stdout, books, *backfillURLs); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		if *refreshMetadata {
+			if err := lib.refreshMetadata(ctx, initial, limiter, books); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		if reviewing {
+			if err := lib.reportReview(ctx, os.Stdout, *acceptUpdates, *rejectUpdates); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		if versioning {
+			if err := lib.reportHistory(ctx, os.Stdout, books, *showVersions, *rollbacks); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		if oneShot {
+			continue
+		}
+		if i == 0 {
+			// The first library is also served at /opds
+			lib.servers = append(lib.servers, server)
+		}
+		if lib.name != "" {
+			lib.servers = append(lib.servers, server.AddLibrary(lib.name))
+		}
+		for _, libraryServer := range lib.servers {
+			if err := libraryServer.LoadUpdates(libraryConfig.UpdatesPath(cal.Settings)); err != nil {
+				logrus.Fatalf("Could not load updates feed for %s: %v", lib, err)
+			}
+			libraryServer.Library = cal.Library
+			libraryServer.Files = lib.calibre
+			libraryServer.Books = books
+			libraryServer.Duplicates = lib.duplicates
+			libraryServer.Review = lib.review
+			libraryServer.History = lib.history
+		}
+		libraries = append(libraries, lib)
 	}
-	bookGroup := make(chan []model.CalibreBook)
-
-	books, err := c.GetBooks(ctx)
-	if err != nil {
-		fmt.Printf("error getting books: %v\n", err)
-		os.Exit(1)
+	if oneShot {
+		cancel()
+		return
+	}
+	for _, lib := range libraries {
+		lib := lib
+		bookGroup := make(chan []model.CalibreBook)
+		grp.Go(func() error {
+			// Batch books for updates
+			return lib.batchBooks(ctx, cfg.BatchSize, bookGroup)
+		})
+		grp.Go(func() error {
+			// Keep the books served up to date
+			return lib.watchBooks(ctx)
+		})
+		grp.Go(func() error {
+			// Trigger book updates
+			return lib.runUpdates(ctx, getCurrent, limiter, cfg.SkipFirst, bookGroup)
+		})
 	}
 	grp.Go(func() error {
-		// Batch books for updates
-		defer close(bookGroup)
-		if *batchSize == 0 {
-			for ctx.Err() == nil {
-				books, err := c.GetBooks(ctx)
-				if err != nil {
-					return fmt.Errorf("error getting books: %w", err)
-				}
-				bookGroup <- books
+		// Reload the configuration on SIGHUP
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGHUP)
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ch:
 			}
-		} else {
-			buffer := make([]model.CalibreBook, 0, *batchSize*2)
-			for ctx.Err() == nil {
-				if len(buffer) >= *batchSize {
-					bookGroup <- buffer[:*batchSize]
-					buffer = buffer[*batchSize:]
-					continue
-				}
-				books, err := c.GetBooks(ctx)
-				if err != nil {
-					return fmt.Errorf("error getting books: %w", err)
-				}
-				buffer = append(buffer, books...)
-				bookGroup <- buffer[:*batchSize]
-				buffer = buffer[*batchSize:]
+			reloaded, err := loadConfig()
+			if err != nil {
+				logrus.Errorf("Not reloading configuration: %v", err)
+				continue
 			}
-		}
-		return nil
-	})
-	grp.Go(func() error {
-		// Trigger book updates
-		fff, err := fanficfare.NewFanFicFare(ctx, c)
-		if err != nil {
-			return fmt.Errorf("error readying FanFicFare: %w", err)
-		}
-		isFirstRun := true
-		for ctx.Err() == nil {
-			func() {
-				if !isFirstRun || *skipFirstUpdate {
-					timeout, cancel := context.WithTimeout(ctx, *updateInterval)
-					defer cancel()
-					logrus.Infof("Waiting %s for next update...", *updateInterval)
-					<-timeout.Done()
-				} else {
-					isFirstRun = false
-				}
-				if ctx.Err() != nil {
-					// Guard against parent context closing
-					return
-				}
-				for _, book := range <-bookGroup {
-					_, err := fff.Process(ctx, book)
-					if err != nil {
-						logrus.Errorf("error updating %s: %v", book.Title, err)
-					}
+			next := reloaded.config
+			if !reflect.DeepEqual(libraryLocations(next), libraryLocations(cfg)) {
+				// The update loops for the libraries are already running.
+				logrus.Errorf("Not reloading configuration: libraries changed; this requires a restart")
+				continue
+			}
+			restart := map[string]bool{
+				"server.addr": next.Server.Addr != cfg.Server.Addr,
+				"batch_size":  next.BatchSize != cfg.BatchSize,
+				"fanficfare":  !reflect.DeepEqual(next.FanFicFare, cfg.FanFicFare),
+			}
+			for name, changed := range restart {
+				if changed {
+					logrus.Warnf("Configuration %s changed; this requires a restart to take effect", name)
 				}
-			}()
-		}
-		for <-bookGroup != nil {
-			// Drain the channel until the writer exits
+			}
+			previous := getCurrent()
+			// Groups whose schedule did not change keep their next run.
+			for name, ls := range reloaded.libraries {
+				ls.scheduler.Carry(previous.libraries[name].scheduler)
+			}
+			server.SetAuth(next.Server.Username, next.Server.Password)
+			limiter.SetLimits(reloaded.siteLimits)
+			currentLock.Lock()
+			current = reloaded
+			currentLock.Unlock()
+			close(previous.replaced)
+			logrus.Info("Reloaded configuration")
 		}
-		return nil
 	})
 
 	grp.Go(func() error {
@@ -161,8 +450,7 @@ func main() {
 	})
 	grp.Go(func() error {
 		// Start the OPDS server
-		server.Books = books
-		server.Addr = ":8080"
+		server.Addr = cfg.Server.Addr
 		err := server.ListenAndServe()
 		if err == nil || errors.Is(err, http.ErrServerClosed) {
 			return nil
@@ -170,7 +458,10 @@ func main() {
 		return fmt.Errorf("error closing server: %w", err)
 	})
 
-	if err = grp.Wait(); err != nil {
+	err = grp.Wait()
+	// Let notifications of the last updates finish sending.
+	getCurrent().notifier.Wait()
+	if err != nil {
 		logrus.Fatal(err)
 	}
 }
@@ -24,7 +24,32 @@ type CalibreBook struct {
 	Comments     string
 	Languages    []string
 	Cover        string
+	Series       string
 	SeriesIndex  *float64 `json:"series_index"`
+
+	// CustomColumns holds the values of custom columns, keyed by the lookup
+	// name without the leading "#".
+	CustomColumns map[string]CustomValue `json:"-"`
+}
+
+// Custom returns the value of the custom column with the given lookup name
+// (with or without the leading "#"), and whether it was set.
+func (b *CalibreBook) Custom(label string) (CustomValue, bool) {
+	value, ok := b.CustomColumns[strings.TrimPrefix(label, "#")]
+	if !ok || value.IsEmpty() {
+		return value, false
+	}
+	return value, true
+}
+
+// HasTag returns whether the book has the given tag.
+func (b *CalibreBook) HasTag(tag string) bool {
+	for _, t := range b.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
 }
 
 // Url returns the source URL for the book, or nil if unavailable.
@@ -0,0 +1,53 @@
+package model
+
+// Chapter describes a single chapter of a story at its source site.
+type Chapter struct {
+	Number int       `json:"number"`
+	Title  string    `json:"title"`
+	URL    string    `json:"url"`
+	Date   *Time3339 `json:"date,omitempty"`
+	Words  int       `json:"words,omitempty"`
+}
+
+// ChapterChangeKind describes how a chapter differs between two lists.
+type ChapterChangeKind string
+
+const (
+	ChapterAdded   = ChapterChangeKind("added")
+	ChapterRemoved = ChapterChangeKind("removed")
+	ChapterChanged = ChapterChangeKind("changed")
+)
+
+// ChapterChange describes a difference in a single chapter.
+type ChapterChange struct {
+	Kind    ChapterChangeKind
+	Chapter Chapter // The new chapter; for removed chapters, the old one.
+}
+
+// DiffChapters compares two chapter lists by chapter number, returning the
+// changes needed to go from the old list to the new one.  A chapter is
+// considered changed if its title, URL, or word count differ.
+func DiffChapters(old, new []Chapter) []ChapterChange {
+	oldByNumber := make(map[int]Chapter, len(old))
+	for _, chapter := range old {
+		oldByNumber[chapter.Number] = chapter
+	}
+	var changes []ChapterChange
+	for _, chapter := range new {
+		previous, ok := oldByNumber[chapter.Number]
+		if !ok {
+			changes = append(changes, ChapterChange{Kind: ChapterAdded, Chapter: chapter})
+			continue
+		}
+		delete(oldByNumber, chapter.Number)
+		if previous.Title != chapter.Title || previous.URL != chapter.URL || previous.Words != chapter.Words {
+			changes = append(changes, ChapterChange{Kind: ChapterChanged, Chapter: chapter})
+		}
+	}
+	for _, chapter := range old {
+		if _, ok := oldByNumber[chapter.Number]; ok {
+			changes = append(changes, ChapterChange{Kind: ChapterRemoved, Chapter: chapter})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,27 @@
+package model_test
+
+import (
+	"testing"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffChapters(t *testing.T) {
+	old := []model.Chapter{
+		{Number: 1, Title: "one", URL: "http://x.test/1"},
+		{Number: 2, Title: "two", URL: "http://x.test/2"},
+		{Number: 3, Title: "three", URL: "http://x.test/3"},
+	}
+	new := []model.Chapter{
+		{Number: 1, Title: "one", URL: "http://x.test/1"},
+		{Number: 2, Title: "two (revised)", URL: "http://x.test/2"},
+		{Number: 4, Title: "four", URL: "http://x.test/4"},
+	}
+	assert.Equal(t, []model.ChapterChange{
+		{Kind: model.ChapterChanged, Chapter: new[1]},
+		{Kind: model.ChapterAdded, Chapter: new[2]},
+		{Kind: model.ChapterRemoved, Chapter: old[2]},
+	}, model.DiffChapters(old, new))
+	assert.Empty(t, model.DiffChapters(old, old))
+}
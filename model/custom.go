@@ -0,0 +1,182 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CustomColumnType is the data type of a Calibre custom column.
+type CustomColumnType string
+
+const (
+	CustomText        = CustomColumnType("text")
+	CustomComments    = CustomColumnType("comments")
+	CustomSeries      = CustomColumnType("series")
+	CustomEnumeration = CustomColumnType("enumeration")
+	CustomComposite   = CustomColumnType("composite")
+	CustomInt         = CustomColumnType("int")
+	CustomFloat       = CustomColumnType("float")
+	CustomRating      = CustomColumnType("rating")
+	CustomBool        = CustomColumnType("bool")
+	CustomDatetime    = CustomColumnType("datetime")
+)
+
+// CustomColumn describes the definition of a Calibre custom column.
+type CustomColumn struct {
+	Label      string // Lookup name, without the leading "#"
+	Name       string // Display name
+	Datatype   CustomColumnType
+	IsMultiple bool
+}
+
+// CustomValue is the value of a custom column for a book.  Value holds one of
+// string, int64, float64, bool, Time3339 or []string (for multiple-valued
+// columns), depending on Type.
+type CustomValue struct {
+	Type       CustomColumnType
+	IsMultiple bool
+	Value      any
+}
+
+// ParseCustomValue converts the JSON value of a custom column, as output by
+// calibredb, into a typed value.
+func ParseCustomValue(column CustomColumn, raw json.RawMessage) (CustomValue, error) {
+	result := CustomValue{Type: column.Datatype, IsMultiple: column.IsMultiple}
+	if string(raw) == "null" {
+		return result, nil
+	}
+	var err error
+	if column.IsMultiple {
+		var values []string
+		if err = json.Unmarshal(raw, &values); err != nil {
+			// Some versions output multiple values as a single string.
+			var value string
+			if json.Unmarshal(raw, &value) != nil {
+				return result, fmt.Errorf("could not parse #%s: %w", column.Label, err)
+			}
+			values = SplitList(value)
+		}
+		result.Value = values
+		return result, nil
+	}
+	switch column.Datatype {
+	case CustomInt:
+		var value int64
+		err = json.Unmarshal(raw, &value)
+		result.Value = value
+	case CustomFloat, CustomRating:
+		var value float64
+		err = json.Unmarshal(raw, &value)
+		result.Value = value
+	case CustomBool:
+		var value bool
+		err = json.Unmarshal(raw, &value)
+		result.Value = value
+	case CustomDatetime:
+		var value Time3339
+		err = value.UnmarshalJSON(raw)
+		result.Value = value
+	default:
+		var value string
+		err = json.Unmarshal(raw, &value)
+		result.Value = value
+	}
+	if err != nil {
+		return result, fmt.Errorf("could not parse #%s as %s: %w", column.Label, column.Datatype, err)
+	}
+	return result, nil
+}
+
+// InferCustomValue converts the JSON value of a custom column whose definition
+// is unknown, guessing the type from the JSON type.
+func InferCustomValue(raw json.RawMessage) CustomValue {
+	var value any
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return CustomValue{Type: CustomText, Value: string(raw)}
+	}
+	switch v := value.(type) {
+	case bool:
+		return CustomValue{Type: CustomBool, Value: v}
+	case float64:
+		if v == math.Trunc(v) {
+			return CustomValue{Type: CustomInt, Value: int64(v)}
+		}
+		return CustomValue{Type: CustomFloat, Value: v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, fmt.Sprintf("%v", item))
+		}
+		return CustomValue{Type: CustomText, IsMultiple: true, Value: values}
+	case nil:
+		return CustomValue{Type: CustomText}
+	}
+	return CustomValue{Type: CustomText, Value: fmt.Sprintf("%v", value)}
+}
+
+// SplitList splits a comma-separated list of values, such as multiple values
+// of a custom column.
+func SplitList(value string) []string {
+	var result []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			result = append(result, part)
+		}
+	}
+	return result
+}
+
+// IsEmpty returns whether the value is unset.
+func (v CustomValue) IsEmpty() bool {
+	switch value := v.Value.(type) {
+	case nil:
+		return true
+	case string:
+		return value == ""
+	case []string:
+		return len(value) == 0
+	case Time3339:
+		return value.IsZero()
+	}
+	return false
+}
+
+// Values returns the value as a list of strings; single values are returned
+// as a list of one item, and empty values as an empty list.
+func (v CustomValue) Values() []string {
+	if v.IsEmpty() {
+		return nil
+	}
+	if values, ok := v.Value.([]string); ok {
+		return values
+	}
+	return []string{v.String()}
+}
+
+// String returns the value in the form accepted by calibredb set_metadata.
+func (v CustomValue) String() string {
+	switch value := v.Value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case []string:
+		return strings.Join(value, ",")
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case Time3339:
+		if value.IsZero() {
+			return ""
+		}
+		return value.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%v", v.Value)
+}
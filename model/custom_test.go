@@ -0,0 +1,80 @@
+package model_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCustomValue(t *testing.T) {
+	cases := []struct {
+		name     string
+		column   model.CustomColumn
+		input    string
+		expected any
+		str      string
+	}{
+		{"text", model.CustomColumn{Datatype: model.CustomText}, `"hello"`, "hello", "hello"},
+		{"int", model.CustomColumn{Datatype: model.CustomInt}, `42`, int64(42), "42"},
+		{"float", model.CustomColumn{Datatype: model.CustomFloat}, `1.5`, 1.5, "1.5"},
+		{"bool", model.CustomColumn{Datatype: model.CustomBool}, `true`, true, "true"},
+		{"enumeration", model.CustomColumn{Datatype: model.CustomEnumeration}, `"Completed"`, "Completed", "Completed"},
+		{
+			"datetime",
+			model.CustomColumn{Datatype: model.CustomDatetime},
+			`"2020-01-02T03:04:05+00:00"`,
+			model.Time3339{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+			"2020-01-02T03:04:05Z",
+		},
+		{"multiple", model.CustomColumn{Datatype: model.CustomText, IsMultiple: true}, `["a", "b"]`, []string{"a", "b"}, "a,b"},
+		{"multiple string", model.CustomColumn{Datatype: model.CustomText, IsMultiple: true}, `"a, b"`, []string{"a", "b"}, "a,b"},
+		{"null", model.CustomColumn{Datatype: model.CustomInt}, `null`, nil, ""},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			value, err := model.ParseCustomValue(testCase.column, json.RawMessage(testCase.input))
+			require.NoError(t, err)
+			assert.Equal(t, testCase.column.Datatype, value.Type)
+			if expectedTime, ok := testCase.expected.(model.Time3339); ok {
+				assert.True(t, expectedTime.Equal(value.Value.(model.Time3339).Time))
+			} else {
+				assert.Equal(t, testCase.expected, value.Value)
+			}
+			assert.Equal(t, testCase.str, value.String())
+		})
+	}
+	t.Run("invalid", func(t *testing.T) {
+		_, err := model.ParseCustomValue(model.CustomColumn{Label: "words", Datatype: model.CustomInt}, json.RawMessage(`"many"`))
+		assert.ErrorContains(t, err, "could not parse #words")
+	})
+}
+
+func TestInferCustomValue(t *testing.T) {
+	assert.Equal(t, model.CustomValue{Type: model.CustomInt, Value: int64(3)}, model.InferCustomValue(json.RawMessage(`3`)))
+	assert.Equal(t, model.CustomValue{Type: model.CustomFloat, Value: 3.5}, model.InferCustomValue(json.RawMessage(`3.5`)))
+	assert.Equal(t, model.CustomValue{Type: model.CustomBool, Value: false}, model.InferCustomValue(json.RawMessage(`false`)))
+	assert.Equal(t, model.CustomValue{Type: model.CustomText, Value: "x"}, model.InferCustomValue(json.RawMessage(`"x"`)))
+	assert.Equal(t, model.CustomValue{Type: model.CustomText, IsMultiple: true, Value: []string{"x", "y"}}, model.InferCustomValue(json.RawMessage(`["x","y"]`)))
+}
+
+func TestCustom(t *testing.T) {
+	book := model.CalibreBook{
+		CustomColumns: map[string]model.CustomValue{
+			"status": {Type: model.CustomText, Value: "Completed"},
+			"empty":  {Type: model.CustomText, Value: ""},
+		},
+	}
+	value, ok := book.Custom("#status")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"Completed"}, value.Values())
+	_, ok = book.Custom("status")
+	assert.True(t, ok)
+	_, ok = book.Custom("empty")
+	assert.False(t, ok)
+	_, ok = book.Custom("missing")
+	assert.False(t, ok)
+}
@@ -0,0 +1,79 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// Outcome is what happened when a book was checked for updates.
+type Outcome string
+
+const (
+	OutcomeUpdated     Outcome = "updated"     // New content was fetched
+	OutcomeUpToDate    Outcome = "up-to-date"  // There was nothing new
+	OutcomeNoURL       Outcome = "no-url"      // The book has no source URL
+	OutcomeUnsupported Outcome = "unsupported" // FanFicFare does not support the site
+	OutcomeNoEpub      Outcome = "no-epub"     // The book has no EPUB to update
+	OutcomeFailed      Outcome = "failed"      // An error occurred
+	OutcomeSkipped     Outcome = "skipped"     // The rules skipped the book
+	OutcomeRemoved     Outcome = "removed"     // The story was removed from its source
+	OutcomeRefreshed   Outcome = "refreshed"   // Only the metadata was updated
+	OutcomeHeld        Outcome = "held"        // The update would lose content, and was held for review
+)
+
+// SourceRemovedTag is added to books whose story has been removed from its
+// source site; they are not checked for updates while they have the tag.
+const SourceRemovedTag = "fanficupdates:removed"
+
+// ErrorClass is the kind of failure when checking a book for updates, which
+// determines how it is retried.
+type ErrorClass string
+
+const (
+	ErrorNotFound      ErrorClass = "not-found"      // The story was deleted or never existed
+	ErrorLoginRequired ErrorClass = "login-required" // The site requires logging in
+	ErrorAdultCheck    ErrorClass = "adult-check"    // The site requires confirming adult status
+	ErrorSiteDown      ErrorClass = "site-down"      // The site could not be reached, or had an error
+	ErrorCloudflare    ErrorClass = "cloudflare"     // The site is blocked by Cloudflare
+	ErrorParse         ErrorClass = "parse"          // The story or FanFicFare output could not be read
+	ErrorCalibreWrite  ErrorClass = "calibre-write"  // The update could not be saved in the library
+	ErrorUnknown       ErrorClass = "unknown"
+)
+
+// ErrorClasses lists all the error classes.
+var ErrorClasses = []ErrorClass{
+	ErrorNotFound, ErrorLoginRequired, ErrorAdultCheck, ErrorSiteDown,
+	ErrorCloudflare, ErrorParse, ErrorCalibreWrite, ErrorUnknown,
+}
+
+// UpdateResult describes the result of checking a single book for updates.
+type UpdateResult struct {
+	BookId      int
+	Title       string
+	Outcome     Outcome
+	Site        string        // The eTLD+1 of the source, if known
+	OldChapters int           // Chapters in the existing EPUB; 0 if unknown
+	NewChapters int           // Chapters at the source; 0 if unknown
+	Changed     []string      // Calibre fields changed, such as "comments" or "#status"
+	Duration    time.Duration // Time taken to check the book
+	Output      []string      // Messages from FanFicFare, without the metadata
+	ErrorClass  ErrorClass    // For OutcomeFailed, the kind of failure
+	NewURL      string        // The story URL, if it was changed to one reported by FanFicFare
+}
+
+// Updated returns whether the book was updated.
+func (r *UpdateResult) Updated() bool {
+	return r.Outcome == OutcomeUpdated
+}
+
+// Summary returns a short human-readable description of the result, such as
+// "Story X: updated, 3 → 5 chapters".
+func (r *UpdateResult) Summary() string {
+	if r.Outcome == OutcomeUpdated && r.OldChapters > 0 && r.NewChapters > 0 {
+		return fmt.Sprintf("%s: updated, %d → %d chapters", r.Title, r.OldChapters, r.NewChapters)
+	}
+	if r.Outcome == OutcomeHeld && r.OldChapters > 0 && r.NewChapters > 0 {
+		return fmt.Sprintf("%s: held, %d → %d chapters", r.Title, r.OldChapters, r.NewChapters)
+	}
+	return fmt.Sprintf("%s: %s", r.Title, r.Outcome)
+}
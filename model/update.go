@@ -0,0 +1,29 @@
+package model
+
+import "fmt"
+
+// StoryUpdate records that new chapters were fetched for a book.
+type StoryUpdate struct {
+	BookId   int
+	Uuid     string
+	Title    string
+	Authors  []string
+	Tags     []string
+	Url      string
+	Updated  Time3339
+	Chapters []Chapter // The chapters that were added in this update
+}
+
+// Summary returns a short human-readable description of the update, such as
+// "Story X: chapters 4–6 added".
+func (u *StoryUpdate) Summary() string {
+	switch len(u.Chapters) {
+	case 0:
+		return fmt.Sprintf("%s: updated", u.Title)
+	case 1:
+		return fmt.Sprintf("%s: chapter %d added", u.Title, u.Chapters[0].Number)
+	}
+	first := u.Chapters[0].Number
+	last := u.Chapters[len(u.Chapters)-1].Number
+	return fmt.Sprintf("%s: chapters %d–%d added", u.Title, first, last)
+}
@@ -0,0 +1,139 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/query"
+	"github.com/sirupsen/logrus"
+)
+
+// timeout is the maximum time to wait for a webhook to respond.
+const timeout = 30 * time.Second
+
+// payload is the JSON body sent to webhooks.
+type payload struct {
+	Summary  string          `json:"summary"`
+	BookId   int             `json:"book_id"`
+	Uuid     string          `json:"uuid"`
+	Title    string          `json:"title"`
+	Authors  []string        `json:"authors"`
+	Tags     []string        `json:"tags"`
+	Url      string          `json:"url"`
+	Updated  model.Time3339  `json:"updated"`
+	Chapters []model.Chapter `json:"chapters"`
+}
+
+// Webhook posts story updates as JSON to a URL.
+type Webhook struct {
+	URL     string
+	Headers map[string]string
+	Filter  query.Expr // If set, only notify for matching books
+	Client  *http.Client
+}
+
+// book returns the information in the update as a book, for matching against
+// the filter.
+func book(update model.StoryUpdate) model.CalibreBook {
+	result := model.CalibreBook{
+		Id:      update.BookId,
+		Uuid:    update.Uuid,
+		Title:   update.Title,
+		Authors: update.Authors,
+		Tags:    update.Tags,
+	}
+	if update.Url != "" {
+		result.Identifiers = map[string]string{"url": update.Url}
+	}
+	return result
+}
+
+// Match returns whether the webhook should be notified of the update.
+func (w *Webhook) Match(update model.StoryUpdate) bool {
+	return w.Filter == nil || w.Filter.Match(book(update))
+}
+
+// Notify sends the update to the webhook.
+func (w *Webhook) Notify(ctx context.Context, update model.StoryUpdate) error {
+	body, err := json.Marshal(payload{
+		Summary:  update.Summary(),
+		BookId:   update.BookId,
+		Uuid:     update.Uuid,
+		Title:    update.Title,
+		Authors:  update.Authors,
+		Tags:     update.Tags,
+		Url:      update.Url,
+		Updated:  update.Updated,
+		Chapters: update.Chapters,
+	})
+	if err != nil {
+		return fmt.Errorf("could not encode update: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range w.Headers {
+		req.Header.Set(key, value)
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not notify %s: %w", w.URL, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("could not notify %s: %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// Notifier sends story updates to a set of webhooks, logging any errors.
+// Notifications are sent in the background, so that slow webhooks do not delay
+// updates; each is limited by the webhook timeout.
+type Notifier struct {
+	Targets []*Webhook
+	Logger  *logrus.Logger
+
+	pending sync.WaitGroup
+}
+
+// Notify starts sending the update to all matching targets.
+func (n *Notifier) Notify(update model.StoryUpdate) {
+	logger := n.Logger
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	for _, target := range n.Targets {
+		if !target.Match(update) {
+			continue
+		}
+		target := target
+		n.pending.Add(1)
+		go func() {
+			defer n.pending.Done()
+			if err := target.Notify(context.Background(), update); err != nil {
+				logger.Warnf("Failed to send notification for %s: %v", update.Title, err)
+			}
+		}()
+	}
+}
+
+// Wait waits for the notifications that have been started to be sent.
+func (n *Notifier) Wait() {
+	n.pending.Wait()
+}
@@ -0,0 +1,76 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/notify"
+	"github.com/mook/fanficupdates/query"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhook(t *testing.T) {
+	var received []map[string]any
+	var headers []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		var value map[string]any
+		require.NoError(t, json.Unmarshal(body, &value))
+		received = append(received, value)
+		headers = append(headers, req.Header)
+		if value["title"] == "Broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	update := model.StoryUpdate{
+		BookId:   3,
+		Title:    "Fluffy",
+		Tags:     []string{"complete"},
+		Url:      "https://archiveofourown.org/works/1",
+		Updated:  model.Time3339{Time: time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)},
+		Chapters: []model.Chapter{{Number: 4, Title: "Four"}},
+	}
+
+	t.Run("notify", func(t *testing.T) {
+		received, headers = nil, nil
+		webhook := &notify.Webhook{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer x"}}
+		require.NoError(t, webhook.Notify(context.Background(), update))
+		require.Len(t, received, 1)
+		assert.Equal(t, "Fluffy: chapter 4 added", received[0]["summary"])
+		assert.Equal(t, float64(3), received[0]["book_id"])
+		assert.Equal(t, "Bearer x", headers[0].Get("Authorization"))
+		assert.Equal(t, "application/json", headers[0].Get("Content-Type"))
+	})
+	t.Run("error status", func(t *testing.T) {
+		webhook := &notify.Webhook{URL: server.URL}
+		broken := update
+		broken.Title = "Broken"
+		assert.ErrorContains(t, webhook.Notify(context.Background(), broken), "500")
+	})
+	t.Run("filter", func(t *testing.T) {
+		received = nil
+		logger, hook := test.NewNullLogger()
+		notifier := &notify.Notifier{
+			Targets: []*notify.Webhook{
+				{URL: server.URL, Filter: query.MustParse("site:ao3 tag:complete")},
+				{URL: server.URL, Filter: query.MustParse("site:ffnet")},
+			},
+			Logger: logger,
+		}
+		notifier.Notify(update)
+		notifier.Wait()
+		assert.Len(t, received, 1)
+		assert.Empty(t, hook.AllEntries())
+	})
+}
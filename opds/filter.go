@@ -0,0 +1,54 @@
+package opds
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/util"
+)
+
+// BookFilter selects which books are included in a catalog.  Empty fields
+// match everything.
+type BookFilter struct {
+	Tags    []string            // Only include books with any of these tags
+	Authors []string            // Only include books by any of these authors
+	Columns map[string][]string // Only include books where each custom column has any of the values
+}
+
+// NewBookFilter creates a filter from the query parameters "tag", "author",
+// and "custom" (in the form "label:value"); each may be repeated.
+func NewBookFilter(query url.Values) BookFilter {
+	filter := BookFilter{Tags: query["tag"], Authors: query["author"]}
+	for _, custom := range query["custom"] {
+		label, value, _ := strings.Cut(custom, ":")
+		if filter.Columns == nil {
+			filter.Columns = make(map[string][]string)
+		}
+		label = strings.TrimPrefix(label, "#")
+		filter.Columns[label] = append(filter.Columns[label], value)
+	}
+	return filter
+}
+
+// Match returns whether the given book should be included.
+func (f *BookFilter) Match(book model.CalibreBook) bool {
+	containedIn := func(haystack []string) func(string) bool {
+		return func(needle string) bool {
+			return util.Any(haystack, func(s string) bool { return strings.EqualFold(s, needle) })
+		}
+	}
+	if len(f.Tags) > 0 && !util.Any(f.Tags, containedIn(book.Tags)) {
+		return false
+	}
+	if len(f.Authors) > 0 && !util.Any(f.Authors, containedIn(book.Authors)) {
+		return false
+	}
+	for label, wanted := range f.Columns {
+		value, _ := book.Custom(label)
+		if !util.Any(wanted, containedIn(value.Values())) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package opds
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBookFilter(t *testing.T) {
+	book := model.CalibreBook{
+		Tags:    []string{"Fluff"},
+		Authors: []string{"Someone"},
+		CustomColumns: map[string]model.CustomValue{
+			"status":     {Type: model.CustomEnumeration, Value: "Completed"},
+			"characters": {Type: model.CustomText, IsMultiple: true, Value: []string{"Alice", "Bob"}},
+		},
+	}
+	cases := []struct {
+		query    string
+		expected bool
+	}{
+		{"", true},
+		{"tag=fluff", true},
+		{"tag=angst", false},
+		{"author=someone", true},
+		{"author=nobody", false},
+		{"custom=status:completed", true},
+		{"custom=%23status:Completed", true},
+		{"custom=status:In-Progress", false},
+		{"custom=status:In-Progress&custom=status:Completed", true},
+		{"custom=characters:bob", true},
+		{"custom=missing:x", false},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.query, func(t *testing.T) {
+			query, err := url.ParseQuery(testCase.query)
+			if assert.NoError(t, err) {
+				filter := NewBookFilter(query)
+				assert.Equal(t, testCase.expected, filter.Match(book))
+			}
+		})
+	}
+}
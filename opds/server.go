@@ -1,6 +1,9 @@
 package opds
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -12,35 +15,184 @@ import (
 	"log"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/dedupe"
+	"github.com/mook/fanficupdates/history"
 	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/query"
+	"github.com/mook/fanficupdates/review"
 	"github.com/mook/fanficupdates/util"
 	"golang.org/x/image/draw"
 )
 
+// maxUpdates is the number of story updates retained for the updates feed.
+const maxUpdates = 100
+
+// Files opens the files of books, such as from a local library or a Calibre
+// Content Server; see calibre.Calibre.
+type Files interface {
+	OpenFormat(ctx context.Context, book model.CalibreBook, format string) (io.ReadCloser, error)
+	OpenCover(ctx context.Context, book model.CalibreBook) (io.ReadCloser, error)
+}
+
 type Server struct {
 	*http.Server
-	Library string // Path to the library
-	Books   []model.CalibreBook
+	Library string              // Path to the library
+	Books   []model.CalibreBook // Use SetBooks() once the server is running
+	Prefix  string              // Path prefix, for libraries added with AddLibrary
+	Files   Files               // Used to read book files; if nil, the paths are opened directly
+
+	// Duplicates finds and merges duplicate books for the API; if nil, the
+	// duplicates API is not available.
+	Duplicates *dedupe.Finder
+	// Review holds updates that would lose content; if nil, the review API
+	// is not available.
+	Review *review.Queue
+	// History holds previous versions of EPUBs; if nil, the history API is
+	// not available.
+	History *history.Archive
+
+	mux *http.ServeMux
+
+	booksLock sync.RWMutex
+
+	updatesLock sync.Mutex
+	updates     []model.StoryUpdate
+	updatesPath string // Where updates are saved; empty to keep them in memory
+
+	authLock sync.RWMutex
+	username string
+	password string
 }
 
 func NewServer() *Server {
-	mux := http.NewServeMux()
 	server := &Server{
-		Server: &http.Server{Handler: mux},
+		Server: &http.Server{},
+		mux:    http.NewServeMux(),
 	}
-	mux.HandleFunc("/opds", server.HandleCatalog)
-	mux.HandleFunc("/get/epub/", server.HandleDownload)
-	mux.HandleFunc("/get/cover/", server.HandleCover)
-	mux.HandleFunc("/get/thumb/", server.HandleThumb)
+	server.Handler = server.authenticate(server.mux)
+	server.register()
 
 	return server
 }
 
+// AddLibrary returns a server for an additional library, which is served with
+// the path prefix /opds/{name} (e.g. the catalog is at /opds/{name} and books
+// at /opds/{name}/get/epub/:id).  The new library shares the HTTP listener and
+// authentication of this server.
+func (s *Server) AddLibrary(name string) *Server {
+	library := &Server{
+		Server: s.Server,
+		Prefix: "/opds/" + name,
+		mux:    s.mux,
+	}
+	library.register()
+	return library
+}
+
+// catalogPath returns the path of the catalog for the server.
+func (s *Server) catalogPath() string {
+	if s.Prefix == "" {
+		return "/opds"
+	}
+	return s.Prefix
+}
+
+// register adds the handlers for the server to its mux.
+func (s *Server) register() {
+	s.mux.HandleFunc(s.catalogPath(), s.HandleCatalog)
+	s.mux.HandleFunc(s.Prefix+"/get/epub/", s.HandleDownload)
+	s.mux.HandleFunc(s.Prefix+"/get/cover/", s.HandleCover)
+	s.mux.HandleFunc(s.Prefix+"/get/thumb/", s.HandleThumb)
+	s.mux.HandleFunc(s.Prefix+"/feeds/updates", s.HandleUpdates)
+	s.mux.HandleFunc(s.Prefix+"/feeds/removed", s.HandleRemoved)
+	s.mux.HandleFunc(s.Prefix+"/api/removed", s.HandleRemovedAPI)
+	s.mux.HandleFunc(s.Prefix+"/api/duplicates", s.HandleDuplicatesAPI)
+	s.mux.HandleFunc(s.Prefix+"/api/duplicates/merge", s.protect(s.HandleMergeAPI))
+	s.mux.HandleFunc(s.Prefix+"/api/review", s.HandleReviewAPI)
+	s.mux.HandleFunc(s.Prefix+"/api/review/accept", s.protect(s.HandleAcceptAPI))
+	s.mux.HandleFunc(s.Prefix+"/api/review/reject", s.protect(s.HandleRejectAPI))
+	s.mux.HandleFunc(s.Prefix+"/api/history", s.HandleHistoryAPI)
+	s.mux.HandleFunc(s.Prefix+"/api/history/rollback", s.protect(s.HandleRollbackAPI))
+}
+
+// pathParts splits the request path, after removing the prefix, into parts.
+func (s *Server) pathParts(req *http.Request) []string {
+	return strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, s.Prefix), "/"), "/")
+}
+
+// SetAuth sets the credentials required to access the server using HTTP basic
+// authentication; if the username is empty, no authentication is required.
+func (s *Server) SetAuth(username, password string) {
+	s.authLock.Lock()
+	defer s.authLock.Unlock()
+	s.username = username
+	s.password = password
+}
+
+// authenticate wraps the handler to require the credentials set with SetAuth.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.authLock.RLock()
+		username, password := s.username, s.password
+		s.authLock.RUnlock()
+		if username != "" {
+			user, pass, ok := req.BasicAuth()
+			userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+			passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+			if !ok || !userMatch || !passMatch {
+				w.Header().Set("WWW-Authenticate", `Basic realm="fanficupdates", charset="UTF-8"`)
+				writeError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// protect wraps a handler that changes the library.  Requests are refused
+// unless credentials were set with SetAuth, as anyone who can reach the server
+// could otherwise make changes; cross-site requests from browsers are also
+// refused, as they would be sent with the user's stored credentials.
+func (s *Server) protect(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		s.authLock.RLock()
+		username := s.username
+		s.authLock.RUnlock()
+		if username == "" {
+			writeError(w, http.StatusForbidden, "Changes require the server username and password to be set")
+			return
+		}
+		if !sameOrigin(req) {
+			writeError(w, http.StatusForbidden, "Cross-site requests are not allowed")
+			return
+		}
+		next(w, req)
+	}
+}
+
+// sameOrigin returns whether the request may come from a page of this server.
+// Browsers identify the page making the request in the Sec-Fetch-Site and
+// Origin headers; requests without them are from other clients, and allowed.
+func sameOrigin(req *http.Request) bool {
+	if site := req.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
 func writeError(w http.ResponseWriter, statusCode int, msg string) {
 	w.WriteHeader(statusCode)
 	if _, err := io.WriteString(w, msg); err != nil {
@@ -49,8 +201,31 @@ func writeError(w http.ResponseWriter, statusCode int, msg string) {
 }
 
 // HandleCatalog handles requests for path /opds
+// The query parameters "tag", "author" and "custom" filter the books listed;
+// see NewBookFilter().  The query parameter "q" further filters the books using
+// the query language; see query.Parse().
 func (s *Server) HandleCatalog(w http.ResponseWriter, req *http.Request) {
-	buf, err := xml.Marshal(MakeCatalog(s.Books, nil))
+	filter := NewBookFilter(req.URL.Query())
+	search, err := query.Parse(req.URL.Query().Get("q"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	books := util.Filter(s.books(), func(book model.CalibreBook) bool {
+		return filter.Match(book) && search.Match(book)
+	})
+	s.writeCatalog(w, MakeCatalog(books, nil))
+}
+
+// writeCatalog writes the catalog feed, adjusting the links for the prefix.
+func (s *Server) writeCatalog(w http.ResponseWriter, feed *Feed) {
+	feed.Start.Href = s.catalogPath()
+	for _, entry := range feed.Entries {
+		for i := range entry.Links {
+			entry.Links[i].Href = s.Prefix + entry.Links[i].Href
+		}
+	}
+	buf, err := xml.Marshal(feed)
 	if err != nil {
 		log.Printf("Failed to marshal catalog: %v", err)
 		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Error rendering catalog: %v", err))
@@ -60,9 +235,399 @@ func (s *Server) HandleCatalog(w http.ResponseWriter, req *http.Request) {
 	_, _ = w.Write(buf)
 }
 
+// removedBooks returns the books that have been removed from their source.
+func (s *Server) removedBooks() []model.CalibreBook {
+	return util.Filter(s.books(), func(book model.CalibreBook) bool {
+		return book.HasTag(model.SourceRemovedTag)
+	})
+}
+
+// HandleRemoved handles requests for path /feeds/removed, listing the books
+// whose stories have been removed from their source sites.
+func (s *Server) HandleRemoved(w http.ResponseWriter, req *http.Request) {
+	feed := MakeCatalog(s.removedBooks(), nil)
+	feed.Title = "Removed from source"
+	feed.Id = "fanficupdates:removed"
+	s.writeCatalog(w, feed)
+}
+
+// apiBook is a book in the responses of the JSON API.
+type apiBook struct {
+	Id       int             `json:"id"`
+	Uuid     string          `json:"uuid"`
+	Title    string          `json:"title"`
+	Authors  []string        `json:"authors"`
+	Url      string          `json:"url,omitempty"`
+	Modified *model.Time3339 `json:"modified,omitempty"`
+	Download string          `json:"download,omitempty"` // Path of the local EPUB
+}
+
+// apiBook returns the JSON API representation of the book.
+func (s *Server) apiBook(book model.CalibreBook) apiBook {
+	result := apiBook{
+		Id:      book.Id,
+		Uuid:    book.Uuid,
+		Title:   book.Title,
+		Authors: book.Authors,
+		Url:     book.Identifiers["url"],
+	}
+	if !book.LastModified.IsZero() {
+		result.Modified = &book.LastModified
+	}
+	if util.Any(book.Formats, func(f string) bool { return path.Ext(f) == ".epub" }) {
+		result.Download = fmt.Sprintf("%s/get/epub/%d", s.Prefix, book.Id)
+	}
+	return result
+}
+
+// writeJSON writes the value as a JSON response.
+func writeJSON(w http.ResponseWriter, value any) {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Error rendering response: %v", err))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	_, _ = w.Write(buf)
+}
+
+// HandleRemovedAPI handles requests for path /api/removed, listing the books
+// whose stories have been removed from their source sites as JSON.
+func (s *Server) HandleRemovedAPI(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, util.Map(s.removedBooks(), s.apiBook))
+}
+
+// duplicateGroup is an entry in the response of HandleDuplicatesAPI.
+type duplicateGroup struct {
+	Reason dedupe.Reason `json:"reason"`
+	Key    string        `json:"key"`
+	Books  []apiBook     `json:"books"`
+}
+
+// HandleDuplicatesAPI handles requests for path /api/duplicates, listing the
+// groups of books that appear to be the same story as JSON.  Only the built-in
+// rules are used to normalize story URLs, as fetching pages for every request
+// would be too slow; see dedupe.Finder.FindKnown().
+func (s *Server) HandleDuplicatesAPI(w http.ResponseWriter, req *http.Request) {
+	if s.Duplicates == nil {
+		writeError(w, http.StatusNotFound, "Duplicate detection is not available")
+		return
+	}
+	result := make([]duplicateGroup, 0)
+	for _, group := range s.Duplicates.FindKnown(s.books()) {
+		result = append(result, duplicateGroup{
+			Reason: group.Reason,
+			Key:    group.Key,
+			Books:  util.Map(group.Books, s.apiBook),
+		})
+	}
+	writeJSON(w, result)
+}
+
+// HandleMergeAPI handles POST requests for path /api/duplicates/merge, merging
+// the books given by the (repeated) "id" form value; see dedupe.Finder.Merge().
+// The books must be exactly one of the groups listed by HandleDuplicatesAPI.
+func (s *Server) HandleMergeAPI(w http.ResponseWriter, req *http.Request) {
+	if s.Duplicates == nil {
+		writeError(w, http.StatusNotFound, "Duplicate detection is not available")
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "Merging requires POST")
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	books := s.books()
+	var selected []model.CalibreBook
+	for _, value := range req.Form["id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid book ID %s", value))
+			return
+		}
+		book := util.Find(books, func(b model.CalibreBook) bool { return b.Id == id })
+		if book == nil {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("Book %d not found", id))
+			return
+		}
+		selected = append(selected, *book)
+	}
+	if len(selected) < 2 {
+		writeError(w, http.StatusBadRequest, "At least two books are needed to merge")
+		return
+	}
+	if !util.Any(s.Duplicates.FindKnown(books), func(g dedupe.Group) bool { return sameBooks(g.Books, selected) }) {
+		writeError(w, http.StatusConflict, "The books are not a group of duplicates")
+		return
+	}
+	result, err := s.Duplicates.Merge(req.Context(), selected)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Error merging books: %v", err))
+		return
+	}
+	// Stop serving the removed books until the library is next read.
+	s.SetBooks(util.Filter(books, func(b model.CalibreBook) bool {
+		return !util.Any(result.Removed, func(id int) bool { return id == b.Id })
+	}))
+	writeJSON(w, result)
+}
+
+// sameBooks returns whether the lists have books with the same IDs, in any
+// order.
+func sameBooks(a, b []model.CalibreBook) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ids := make(map[int]int, len(a))
+	for _, book := range a {
+		ids[book.Id]++
+	}
+	for _, book := range b {
+		if ids[book.Id] == 0 {
+			return false
+		}
+		ids[book.Id]--
+	}
+	return true
+}
+
+// HandleReviewAPI handles requests for path /api/review, listing the updates
+// held for review as JSON.
+func (s *Server) HandleReviewAPI(w http.ResponseWriter, req *http.Request) {
+	if s.Review == nil {
+		writeError(w, http.StatusNotFound, "Review is not available")
+		return
+	}
+	entries, err := s.Review.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Error listing held updates: %v", err))
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// HandleAcceptAPI handles POST requests for path /api/review/accept, applying
+// the held update of the book given by the "id" form value.
+func (s *Server) HandleAcceptAPI(w http.ResponseWriter, req *http.Request) {
+	s.handleReviewAction(w, req, func(bookId int) (review.Entry, error) {
+		return s.Review.Accept(req.Context(), bookId)
+	})
+}
+
+// HandleRejectAPI handles POST requests for path /api/review/reject,
+// discarding the held update of the book given by the "id" form value.
+func (s *Server) HandleRejectAPI(w http.ResponseWriter, req *http.Request) {
+	s.handleReviewAction(w, req, func(bookId int) (review.Entry, error) {
+		return s.Review.Reject(bookId)
+	})
+}
+
+// handleReviewAction calls the action with the book ID of the request,
+// responding with the affected entry.
+func (s *Server) handleReviewAction(w http.ResponseWriter, req *http.Request, action func(int) (review.Entry, error)) {
+	if s.Review == nil {
+		writeError(w, http.StatusNotFound, "Review is not available")
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "Reviewing requires POST")
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	bookId, err := strconv.Atoi(req.Form.Get("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid book ID %s", req.Form.Get("id")))
+		return
+	}
+	entry, err := action(bookId)
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No held update for book %d", bookId))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Error reviewing update: %v", err))
+		return
+	}
+	writeJSON(w, entry)
+}
+
+// historyBook finds the book given by the "id" form value for the history API,
+// writing an error response if it cannot.
+func (s *Server) historyBook(w http.ResponseWriter, req *http.Request) *model.CalibreBook {
+	if s.History == nil {
+		writeError(w, http.StatusNotFound, "History is not available")
+		return nil
+	}
+	if err := req.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return nil
+	}
+	id, err := strconv.Atoi(req.Form.Get("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid book ID %s", req.Form.Get("id")))
+		return nil
+	}
+	book := util.Find(s.books(), func(b model.CalibreBook) bool { return b.Id == id })
+	if book == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Book %d not found", id))
+	}
+	return book
+}
+
+// HandleHistoryAPI handles requests for path /api/history, listing the
+// previous versions of the EPUB of the book given by the "id" query parameter
+// as JSON, newest first.
+func (s *Server) HandleHistoryAPI(w http.ResponseWriter, req *http.Request) {
+	book := s.historyBook(w, req)
+	if book == nil {
+		return
+	}
+	writeJSON(w, s.History.Versions(book.Id))
+}
+
+// HandleRollbackAPI handles POST requests for path /api/history/rollback,
+// restoring the "version" (a hash, or a unique prefix of one) of the EPUB of
+// the book given by the "id" form value; see history.Archive.Rollback().
+func (s *Server) HandleRollbackAPI(w http.ResponseWriter, req *http.Request) {
+	if s.History != nil && req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "Rolling back requires POST")
+		return
+	}
+	book := s.historyBook(w, req)
+	if book == nil {
+		return
+	}
+	version, err := s.History.Rollback(req.Context(), *book, req.Form.Get("version"))
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No version %s of book %d", req.Form.Get("version"), book.Id))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Error rolling back: %v", err))
+		return
+	}
+	writeJSON(w, version)
+}
+
+// LoadUpdates reads the updates previously saved at the given path, and saves
+// the updates feed there from now on, so that it survives restarts.  A missing
+// file is treated as having no updates.
+func (s *Server) LoadUpdates(path string) error {
+	s.updatesLock.Lock()
+	defer s.updatesLock.Unlock()
+	s.updatesPath = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read updates file: %w", err)
+	}
+	if err = json.Unmarshal(data, &s.updates); err != nil {
+		return fmt.Errorf("could not parse updates file %s: %w", path, err)
+	}
+	return nil
+}
+
+// AddUpdate records a story update to be listed in the updates feed.  Only the
+// most recent updates are retained.
+func (s *Server) AddUpdate(update model.StoryUpdate) {
+	s.updatesLock.Lock()
+	defer s.updatesLock.Unlock()
+	s.updates = append(s.updates, update)
+	if len(s.updates) > maxUpdates {
+		s.updates = s.updates[len(s.updates)-maxUpdates:]
+	}
+	if s.updatesPath == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s.updates, "", "  ")
+	if err == nil {
+		err = util.ReplaceFile(s.updatesPath, data)
+	}
+	if err != nil {
+		log.Printf("Could not save updates to %s: %v", s.updatesPath, err)
+	}
+}
+
+// baseURL returns the absolute URL of the server (including the prefix) as
+// requested by the client, for links that feed readers can't resolve.
+func (s *Server) baseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return (&url.URL{Scheme: scheme, Host: req.Host, Path: s.Prefix}).String()
+}
+
+// HandleUpdates handles requests for path /feeds/updates
+// The query parameters "tag" and "author" (which may be repeated) filter the
+// updates listed; "format=rss" produces an RSS 2.0 feed instead of Atom.
+func (s *Server) HandleUpdates(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	filter := UpdateFilter{Tags: query["tag"], Authors: query["author"]}
+	s.updatesLock.Lock()
+	updates := util.Filter(s.updates, filter.Match)
+	s.updatesLock.Unlock()
+
+	var feed any
+	contentType := "application/atom+xml"
+	switch query.Get("format") {
+	case "", "atom":
+		atom := MakeUpdatesFeed(updates, nil)
+		atom.Self.Href = s.baseURL(req) + atom.Self.Href
+		feed = atom
+	case "rss":
+		rss := MakeUpdatesRSS(updates, nil)
+		rss.Channel.Link = s.baseURL(req) + rss.Channel.Link
+		feed = rss
+		contentType = "application/rss+xml"
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Unknown feed format %s", query.Get("format")))
+		return
+	}
+	buf, err := xml.Marshal(feed)
+	if err != nil {
+		log.Printf("Failed to marshal updates feed: %v", err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Error rendering feed: %v", err))
+		return
+	}
+	w.Header().Add("Content-Type", contentType)
+	_, _ = w.Write(buf)
+}
+
+// SetBooks replaces the books served.
+func (s *Server) SetBooks(books []model.CalibreBook) {
+	s.booksLock.Lock()
+	defer s.booksLock.Unlock()
+	s.Books = books
+}
+
+// books returns the books served.
+func (s *Server) books() []model.CalibreBook {
+	s.booksLock.RLock()
+	defer s.booksLock.RUnlock()
+	return s.Books
+}
+
+// files returns the Files used to read book files.
+func (s *Server) files() Files {
+	if s.Files == nil {
+		// Without a content server, the paths are opened directly.
+		return &calibre.Calibre{}
+	}
+	return s.Files
+}
+
 // HandleDownload handles requests for path /get/epub/:id
 func (s *Server) HandleDownload(w http.ResponseWriter, req *http.Request) {
-	pathParts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	pathParts := s.pathParts(req)
 	if len(pathParts) != 3 || pathParts[0] != "get" || pathParts[1] != "epub" {
 		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid path %s", req.URL.Path))
 		return
@@ -73,7 +638,7 @@ func (s *Server) HandleDownload(w http.ResponseWriter, req *http.Request) {
 		writeError(w, http.StatusBadRequest, fmt.Sprintf("Failed to convert %s to book id", pathParts[2]))
 		return
 	}
-	book := util.Find(s.Books, func(book model.CalibreBook) bool { return book.Id == id })
+	book := util.Find(s.books(), func(book model.CalibreBook) bool { return book.Id == id })
 	if book == nil {
 		writeError(w, http.StatusNotFound, fmt.Sprintf("Could not find book with id %d", id))
 		return
@@ -84,7 +649,7 @@ func (s *Server) HandleDownload(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	file, err := os.Open(*format)
+	file, err := s.files().OpenFormat(req.Context(), *book, "epub")
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			writeError(w, http.StatusNotFound, fmt.Sprintf("Missing epub for book id %d", id))
@@ -101,7 +666,7 @@ func (s *Server) HandleDownload(w http.ResponseWriter, req *http.Request) {
 
 // HandleCover handles requests for /get/cover/:id
 func (s *Server) HandleCover(w http.ResponseWriter, req *http.Request) {
-	pathParts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	pathParts := s.pathParts(req)
 	if len(pathParts) != 3 || pathParts[0] != "get" || pathParts[1] != "cover" {
 		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid path %s", req.URL.Path))
 		return
@@ -112,13 +677,13 @@ func (s *Server) HandleCover(w http.ResponseWriter, req *http.Request) {
 		writeError(w, http.StatusBadRequest, fmt.Sprintf("Failed to convert %s to book id", pathParts[2]))
 		return
 	}
-	book := util.Find(s.Books, func(book model.CalibreBook) bool { return book.Id == id })
+	book := util.Find(s.books(), func(book model.CalibreBook) bool { return book.Id == id })
 	if book == nil {
 		writeError(w, http.StatusNotFound, fmt.Sprintf("Could not find book with id %d", id))
 		return
 	}
 
-	file, err := os.Open(book.Cover)
+	file, err := s.files().OpenCover(req.Context(), *book)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			writeError(w, http.StatusNotFound, fmt.Sprintf("Missing cover for book id %d", id))
@@ -138,7 +703,7 @@ func (s *Server) HandleCover(w http.ResponseWriter, req *http.Request) {
 
 // HandleThumb handles requests for /get/thumb/:id
 func (s *Server) HandleThumb(w http.ResponseWriter, req *http.Request) {
-	pathParts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	pathParts := s.pathParts(req)
 	if len(pathParts) != 3 || pathParts[0] != "get" || pathParts[1] != "thumb" {
 		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid path %s", req.URL.Path))
 		return
@@ -149,13 +714,13 @@ func (s *Server) HandleThumb(w http.ResponseWriter, req *http.Request) {
 		writeError(w, http.StatusBadRequest, fmt.Sprintf("Failed to convert %s to book id", pathParts[2]))
 		return
 	}
-	book := util.Find(s.Books, func(book model.CalibreBook) bool { return book.Id == id })
+	book := util.Find(s.books(), func(book model.CalibreBook) bool { return book.Id == id })
 	if book == nil {
 		writeError(w, http.StatusNotFound, fmt.Sprintf("Could not find book with id %d", id))
 		return
 	}
 
-	file, err := os.Open(book.Cover)
+	file, err := s.files().OpenCover(req.Context(), *book)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			writeError(w, http.StatusNotFound, fmt.Sprintf("Missing cover for book id %d", id))
@@ -1,6 +1,7 @@
 package opds
 
 import (
+	"context"
 	"fmt"
 	"image"
 	"image/color"
@@ -9,11 +10,18 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/mook/fanficupdates/calibre/memory"
+	"github.com/mook/fanficupdates/dedupe"
+	"github.com/mook/fanficupdates/history"
 	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/review"
 	"github.com/mook/fanficupdates/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -34,6 +42,392 @@ func TestCatalog(t *testing.T) {
 	// Actually testing that the catalog is valid is done in catalog_test.go
 	// This just checks that the feed looks reasonable.
 	assert.Contains(t, string(prettyActual), "<feed")
+
+	t.Run("query", func(t *testing.T) {
+		subject.Books = []model.CalibreBook{
+			{Id: 1, Title: "Fluffy", Tags: []string{"complete"}},
+			{Id: 2, Title: "Angsty"},
+		}
+		res, err := http.Get(fmt.Sprintf("%s/opds?q=%s", server.URL, url.QueryEscape("tag:complete")))
+		require.NoError(t, err)
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Contains(t, string(body), "Fluffy")
+		assert.NotContains(t, string(body), "Angsty")
+	})
+	t.Run("invalid query", func(t *testing.T) {
+		res, err := http.Get(fmt.Sprintf("%s/opds?q=%s", server.URL, url.QueryEscape("(tag:complete")))
+		require.NoError(t, err)
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+		assert.Contains(t, string(body), "invalid query")
+	})
+}
+
+func TestAddLibrary(t *testing.T) {
+	subject := NewServer()
+	subject.Books = []model.CalibreBook{{Id: 1, Title: "Default Book"}}
+	other := subject.AddLibrary("other")
+	epub := path.Join(t.TempDir(), "book.epub")
+	require.NoError(t, os.WriteFile(epub, []byte("contents"), 0o644))
+	other.Books = []model.CalibreBook{{Id: 1, Title: "Other Book", Formats: []string{epub}}}
+	other.AddUpdate(model.StoryUpdate{Title: "Other Update"})
+	subject.SetAuth("user", "secret")
+	server := httptest.NewServer(subject.Handler)
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		req.SetBasicAuth("user", "secret")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(body)
+	}
+
+	status, body := get("/opds")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "Default Book")
+	status, body = get("/opds/other")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "Other Book")
+	assert.Contains(t, body, `href="/opds/other/get/epub/1"`)
+	assert.Contains(t, body, `href="/opds/other"`)
+	status, body = get("/opds/other/get/epub/1")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "contents", body)
+	status, body = get("/opds/other/feeds/updates")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "Other Update")
+	assert.Contains(t, body, `href="`+server.URL+`/opds/other/feeds/updates"`, "feed links should be absolute")
+	_, body = get("/feeds/updates")
+	assert.NotContains(t, body, "Other Update")
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/opds/other", nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "authentication should be shared")
+}
+
+func TestAuth(t *testing.T) {
+	subject := NewServer()
+	subject.SetAuth("user", "secret")
+	server := httptest.NewServer(subject.Handler)
+	defer server.Close()
+
+	get := func(username, password string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/opds", server.URL), nil)
+		require.NoError(t, err)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+
+	res := get("", "")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Contains(t, res.Header.Get("WWW-Authenticate"), "Basic")
+	assert.Equal(t, http.StatusUnauthorized, get("user", "wrong").StatusCode)
+	assert.Equal(t, http.StatusOK, get("user", "secret").StatusCode)
+
+	subject.SetAuth("", "")
+	assert.Equal(t, http.StatusOK, get("", "").StatusCode)
+}
+
+func TestUpdates(t *testing.T) {
+	subject := NewServer()
+	updatesPath := path.Join(t.TempDir(), "updates.json")
+	require.NoError(t, subject.LoadUpdates(updatesPath))
+	for i := 0; i < maxUpdates+5; i++ {
+		subject.AddUpdate(makeUpdate(fmt.Sprintf("Fluffy %d", i), []string{"Fluff"}, []string{"Someone"}, i))
+	}
+	subject.AddUpdate(makeUpdate("Tagged", []string{"Angst"}, []string{"Other"}, 1))
+	assert.Len(t, subject.updates, maxUpdates)
+	server := httptest.NewServer(subject.Handler)
+	defer server.Close()
+
+	get := func(t *testing.T, query string) (int, string) {
+		res, err := http.Get(fmt.Sprintf("%s/feeds/updates%s", server.URL, query))
+		require.NoError(t, err)
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(body)
+	}
+
+	t.Run("atom", func(t *testing.T) {
+		status, body := get(t, "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, "<feed")
+		assert.Contains(t, body, "Tagged: chapter 1 added")
+	})
+	t.Run("rss", func(t *testing.T) {
+		status, body := get(t, "?format=rss")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, "<rss")
+		assert.Contains(t, body, "<link>"+server.URL+"/feeds/updates?format=rss</link>")
+	})
+	t.Run("persisted", func(t *testing.T) {
+		restarted := NewServer()
+		require.NoError(t, restarted.LoadUpdates(updatesPath))
+		require.Len(t, restarted.updates, maxUpdates)
+		assert.Equal(t, "Tagged", restarted.updates[maxUpdates-1].Title)
+		assert.Equal(t, subject.updates[0].Updated.Unix(), restarted.updates[0].Updated.Unix())
+	})
+	t.Run("filter by tag", func(t *testing.T) {
+		_, body := get(t, "?tag=angst")
+		assert.Contains(t, body, "Tagged")
+		assert.NotContains(t, body, "Fluffy")
+	})
+	t.Run("filter by author", func(t *testing.T) {
+		_, body := get(t, "?author=Someone")
+		assert.NotContains(t, body, "Tagged")
+		assert.Contains(t, body, "Fluffy")
+	})
+	t.Run("invalid format", func(t *testing.T) {
+		status, body := get(t, "?format=pdf")
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Contains(t, body, "Unknown feed format")
+	})
+}
+
+func TestRemoved(t *testing.T) {
+	subject := NewServer()
+	subject.Books = []model.CalibreBook{
+		{
+			Id:          1,
+			Title:       "Gone",
+			Authors:     []string{"Someone"},
+			Tags:        []string{model.SourceRemovedTag},
+			Formats:     []string{"/library/Gone.epub"},
+			Identifiers: map[string]string{"url": "http://example.com/1"},
+		},
+		{Id: 2, Title: "Still Here"},
+	}
+	other := subject.AddLibrary("other")
+	server := httptest.NewServer(subject.Handler)
+	defer server.Close()
+
+	get := func(path string) string {
+		res, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	body := get("/feeds/removed")
+	assert.Contains(t, body, "Gone")
+	assert.NotContains(t, body, "Still Here")
+	assert.Contains(t, body, "<title>Removed from source</title>")
+
+	assert.JSONEq(t, `[{
+		"id": 1,
+		"uuid": "",
+		"title": "Gone",
+		"authors": ["Someone"],
+		"url": "http://example.com/1",
+		"download": "/get/epub/1"
+	}]`, get("/api/removed"))
+
+	other.Books = []model.CalibreBook{{Id: 3, Title: "Other", Tags: []string{model.SourceRemovedTag}}}
+	assert.JSONEq(t, `[{"id": 3, "uuid": "", "title": "Other", "authors": null}]`, get("/opds/other/api/removed"))
+	other.Books = nil
+	assert.JSONEq(t, `[]`, get("/opds/other/api/removed"))
+}
+
+// send makes a request with the credentials "user" and "secret", returning the
+// status code and body of the response.
+func send(t *testing.T, method, target string, form url.Values, header http.Header) (int, string) {
+	req, err := http.NewRequest(method, target, strings.NewReader(form.Encode()))
+	require.NoError(t, err)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.SetBasicAuth("user", "secret")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res.StatusCode, string(body)
+}
+
+func TestDuplicates(t *testing.T) {
+	ctx := context.Background()
+	library := memory.NewLibrary(
+		model.CalibreBook{Id: 1, Title: "Story", Authors: []string{"Writer"}, Identifiers: map[string]string{"url": "https://archiveofourown.org/works/1"}},
+		model.CalibreBook{Id: 2, Title: "Story", Authors: []string{"Writer"}, Identifiers: map[string]string{"url": "https://archiveofourown.org/works/1/chapters/2"}},
+		model.CalibreBook{Id: 3, Title: "Other"},
+	)
+	books, err := library.GetBooks(ctx)
+	require.NoError(t, err)
+	subject := NewServer()
+	subject.Books = books
+	server := httptest.NewServer(subject.Handler)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/duplicates")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	subject.Duplicates = &dedupe.Finder{Library: library}
+	res, err = http.Get(server.URL + "/api/duplicates")
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{
+		"reason": "url",
+		"key": "ao3:1",
+		"books": [
+			{"id": 1, "uuid": "", "title": "Story", "authors": ["Writer"], "url": "https://archiveofourown.org/works/1"},
+			{"id": 2, "uuid": "", "title": "Story", "authors": ["Writer"], "url": "https://archiveofourown.org/works/1/chapters/2"}
+		]
+	}]`, string(body))
+
+	status, _ := send(t, http.MethodPost, server.URL+"/api/duplicates/merge", url.Values{"id": {"1", "2"}}, nil)
+	assert.Equal(t, http.StatusForbidden, status, "merging should require credentials to be set")
+	subject.SetAuth("user", "secret")
+	status, _ = send(t, http.MethodPost, server.URL+"/api/duplicates/merge", url.Values{"id": {"1", "2"}},
+		http.Header{"Origin": {"https://elsewhere.test"}})
+	assert.Equal(t, http.StatusForbidden, status, "cross-site requests should be refused")
+	status, _ = send(t, http.MethodGet, server.URL+"/api/duplicates/merge?id=1&id=2", nil, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+
+	for _, ids := range [][]string{{"1"}, {"1", "100"}, {"1", "x"}, {"1", "3"}, {"1", "2", "3"}, {"1", "1"}} {
+		status, _ = send(t, http.MethodPost, server.URL+"/api/duplicates/merge", url.Values{"id": ids}, nil)
+		assert.NotEqual(t, http.StatusOK, status, "merging %v should fail", ids)
+	}
+
+	status, merged := send(t, http.MethodPost, server.URL+"/api/duplicates/merge", url.Values{"id": {"2", "1"}},
+		http.Header{"Origin": {server.URL}, "Sec-Fetch-Site": {"same-origin"}})
+	require.Equal(t, http.StatusOK, status, merged)
+	assert.JSONEq(t, `{"kept": 1, "removed": [2]}`, merged)
+	assert.Len(t, subject.books(), 2, "removed books should no longer be served")
+	remaining, err := library.GetBooks(ctx)
+	require.NoError(t, err)
+	assert.Len(t, remaining, 2)
+}
+
+func TestReview(t *testing.T) {
+	library := memory.NewLibrary(model.CalibreBook{Id: 1, Title: "Story"})
+	require.NoError(t, library.SetFile(1, "epub", []byte("old")))
+	subject := NewServer()
+	server := httptest.NewServer(subject.Handler)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/review")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	subject.Review, err = review.Open(t.TempDir(), library)
+	require.NoError(t, err)
+	held := path.Join(t.TempDir(), "held.epub")
+	require.NoError(t, os.WriteFile(held, []byte("new"), 0o644))
+	for i := 0; i < 2; i++ {
+		require.NoError(t, subject.Review.Hold(review.Entry{
+			BookId:      1,
+			Title:       "Story",
+			Reason:      "3 → 1 chapters",
+			OldChapters: 3,
+			NewChapters: 1,
+			Held:        time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		}, held))
+		status, body := send(t, http.MethodGet, server.URL+"/api/review", nil, nil)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Contains(t, body, `"reason":"3 → 1 chapters"`)
+
+		if i == 0 {
+			status, _ = send(t, http.MethodPost, server.URL+"/api/review/reject", url.Values{"id": {"1"}}, nil)
+			assert.Equal(t, http.StatusForbidden, status, "reviewing should require credentials to be set")
+			subject.SetAuth("user", "secret")
+			status, _ = send(t, http.MethodPost, server.URL+"/api/review/reject", url.Values{"id": {"1"}},
+				http.Header{"Sec-Fetch-Site": {"cross-site"}})
+			assert.Equal(t, http.StatusForbidden, status, "cross-site requests should be refused")
+			status, _ = send(t, http.MethodGet, server.URL+"/api/review/reject?id=1", nil, nil)
+			assert.Equal(t, http.StatusMethodNotAllowed, status)
+			status, _ = send(t, http.MethodPost, server.URL+"/api/review/accept", url.Values{"id": {"2"}}, nil)
+			assert.Equal(t, http.StatusNotFound, status)
+			status, _ = send(t, http.MethodPost, server.URL+"/api/review/reject", url.Values{"id": {"1"}}, nil)
+		} else {
+			status, _ = send(t, http.MethodPost, server.URL+"/api/review/accept", url.Values{"id": {"1"}}, nil)
+		}
+		assert.Equal(t, http.StatusOK, status)
+		contents, _ := library.File(1, "epub")
+		assert.Equal(t, []string{"old", "new"}[i], string(contents))
+	}
+
+	entries, err := subject.Review.List()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	library := memory.NewLibrary(model.CalibreBook{Id: 1, Title: "Story"})
+	require.NoError(t, library.SetFile(1, "epub", []byte("old")))
+	books, err := library.GetBooks(ctx)
+	require.NoError(t, err)
+	subject := NewServer()
+	subject.Books = books
+	server := httptest.NewServer(subject.Handler)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/history?id=1")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	subject.History, err = history.Open(t.TempDir(), library)
+	require.NoError(t, err)
+	require.NoError(t, subject.History.Save(ctx, books[0]))
+	require.NoError(t, library.SetFile(1, "epub", []byte("new")))
+	versions := subject.History.Versions(1)
+	require.Len(t, versions, 1)
+
+	res, err = http.Get(server.URL + "/api/history?id=1")
+	require.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	assert.Contains(t, string(body), fmt.Sprintf(`"hash":"%s"`, versions[0].Hash))
+
+	rollback := server.URL + "/api/history/rollback"
+	status, _ := send(t, http.MethodPost, rollback, url.Values{"id": {"1"}, "version": {versions[0].Hash}}, nil)
+	assert.Equal(t, http.StatusForbidden, status, "rolling back should require credentials to be set")
+	subject.SetAuth("user", "secret")
+	status, _ = send(t, http.MethodPost, rollback, url.Values{"id": {"1"}, "version": {versions[0].Hash}},
+		http.Header{"Origin": {"https://elsewhere.test"}})
+	assert.Equal(t, http.StatusForbidden, status, "cross-site requests should be refused")
+	status, _ = send(t, http.MethodGet, rollback+"?id=1&version="+versions[0].Hash, nil, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+	for _, form := range []url.Values{
+		{"id": {"2"}, "version": {versions[0].Hash}},
+		{"id": {"1"}, "version": {"nope"}},
+	} {
+		status, _ = send(t, http.MethodPost, rollback, form, nil)
+		assert.Equal(t, http.StatusNotFound, status, "rolling back %v", form)
+	}
+
+	status, result := send(t, http.MethodPost, rollback, url.Values{"id": {"1"}, "version": {versions[0].Hash[:8]}}, nil)
+	require.Equal(t, http.StatusOK, status, result)
+	contents, _ := library.File(1, "epub")
+	assert.Equal(t, "old", string(contents))
+	assert.Len(t, subject.History.Versions(1), 2, "the replaced EPUB should be archived")
 }
 
 func TestDownload(t *testing.T) {
@@ -132,6 +526,57 @@ func TestDownload(t *testing.T) {
 	})
 }
 
+// stubFiles serves fixed contents for every book.
+type stubFiles struct {
+	epub, cover string
+}
+
+func (f *stubFiles) OpenFormat(ctx context.Context, book model.CalibreBook, format string) (io.ReadCloser, error) {
+	if f.epub == "" {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(strings.NewReader(f.epub)), nil
+}
+
+func (f *stubFiles) OpenCover(ctx context.Context, book model.CalibreBook) (io.ReadCloser, error) {
+	if f.cover == "" {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(strings.NewReader(f.cover)), nil
+}
+
+func TestFiles(t *testing.T) {
+	files := &stubFiles{epub: "remote epub", cover: "remote cover"}
+	subject := NewServer()
+	subject.Files = files
+	book := *makeBook(t)
+	book.Cover = "/srv/library/cover.jpg" // Does not exist locally
+	subject.Books = []model.CalibreBook{book}
+	server := httptest.NewServer(subject.Handler)
+	defer server.Close()
+
+	get := func(t *testing.T, kind string) (int, string) {
+		res, err := http.Get(fmt.Sprintf("%s/get/%s/%d", server.URL, kind, book.Id))
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res.StatusCode, string(body)
+	}
+
+	status, body := get(t, "epub")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "remote epub", body)
+	status, body = get(t, "cover")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "remote cover", body)
+
+	files.epub = ""
+	status, body = get(t, "epub")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Contains(t, body, "Missing epub")
+}
+
 func TestCover(t *testing.T) {
 	subject := NewServer()
 	subject.Books = append(subject.Books, *makeBook(t))
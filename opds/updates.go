@@ -0,0 +1,194 @@
+package opds
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/util"
+)
+
+// UpdateFilter selects which story updates are included in a feed.  Empty
+// fields match everything.
+type UpdateFilter struct {
+	Tags    []string // Only include books with any of these tags
+	Authors []string // Only include books by any of these authors
+}
+
+// Match returns whether the given update should be included.
+func (f *UpdateFilter) Match(update model.StoryUpdate) bool {
+	contains := func(haystack []string) func(string) bool {
+		return func(needle string) bool {
+			return util.Any(haystack, func(s string) bool { return strings.EqualFold(s, needle) })
+		}
+	}
+	if len(f.Tags) > 0 && !util.Any(f.Tags, contains(update.Tags)) {
+		return false
+	}
+	if len(f.Authors) > 0 && !util.Any(f.Authors, contains(update.Authors)) {
+		return false
+	}
+	return true
+}
+
+// updateContent renders the list of new chapters as HTML.
+func updateContent(update model.StoryUpdate) string {
+	if len(update.Chapters) == 0 {
+		return fmt.Sprintf(`<p><a href="%s">%s</a></p>`,
+			html.EscapeString(update.Url), html.EscapeString(update.Title))
+	}
+	var buf strings.Builder
+	buf.WriteString("<ul>")
+	for _, chapter := range update.Chapters {
+		title := chapter.Title
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", chapter.Number)
+		}
+		buf.WriteString(fmt.Sprintf(`<li><a href="%s">%s</a></li>`,
+			html.EscapeString(chapter.URL), html.EscapeString(title)))
+	}
+	buf.WriteString("</ul>")
+	return buf.String()
+}
+
+// updateLink returns the best link for an update: the first new chapter, or
+// the story itself if that is unavailable.
+func updateLink(update model.StoryUpdate) string {
+	if len(update.Chapters) > 0 && update.Chapters[0].URL != "" {
+		return update.Chapters[0].URL
+	}
+	return update.Url
+}
+
+// updateId returns a stable identifier for the update.
+func updateId(update model.StoryUpdate) string {
+	last := 0
+	if len(update.Chapters) > 0 {
+		last = update.Chapters[len(update.Chapters)-1].Number
+	}
+	return fmt.Sprintf("fanficupdates:update:%s:%d:%d", update.Uuid, last, update.Updated.Unix())
+}
+
+type updateEntryLink struct {
+	Rel   string `xml:"rel,attr"`
+	Href  string `xml:"href,attr"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+type UpdateEntry struct {
+	XMLName xml.Name        `xml:"entry"`
+	Title   string          `xml:"title"`
+	Author  []string        `xml:"author>name"`
+	Id      string          `xml:"id"`
+	Updated *model.Time3339 `xml:"updated"`
+	Content struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"content"`
+	Links []updateEntryLink `xml:"link"`
+}
+
+type UpdateFeed struct {
+	XMLName xml.Name
+	Title   string          `xml:"title"`
+	Author  string          `xml:"author>name"`
+	Id      string          `xml:"id"`
+	Updated *model.Time3339 `xml:"updated"`
+	Self    updateEntryLink `xml:"link"`
+	Entries []*UpdateEntry
+}
+
+// MakeUpdatesFeed creates an Atom feed listing the given story updates, most
+// recent first.  If updateTime is nil, the current time is used.
+func MakeUpdatesFeed(updates []model.StoryUpdate, updateTime *model.Time3339) *UpdateFeed {
+	if updateTime == nil {
+		updateTime = model.NewTime3339(time.Time{})
+	}
+	result := &UpdateFeed{
+		XMLName: xml.Name{Space: "http://www.w3.org/2005/Atom", Local: "feed"},
+		Title:   "Story Updates",
+		Author:  "FanFicUpdates",
+		Id:      "fanficupdates:updates",
+		Updated: updateTime,
+		Self:    updateEntryLink{Rel: "self", Href: "/feeds/updates"},
+	}
+	for i := len(updates) - 1; i >= 0; i-- {
+		update := updates[i]
+		entry := &UpdateEntry{
+			Title:   update.Summary(),
+			Author:  update.Authors[:],
+			Id:      updateId(update),
+			Updated: &update.Updated,
+		}
+		entry.Content.Type = "html"
+		entry.Content.Value = updateContent(update)
+		entry.Links = append(entry.Links, updateEntryLink{
+			Rel:  "alternate",
+			Href: updateLink(update),
+		})
+		for _, chapter := range update.Chapters {
+			entry.Links = append(entry.Links, updateEntryLink{
+				Rel:   "related",
+				Href:  chapter.URL,
+				Title: chapter.Title,
+			})
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+	return result
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	Author      string   `xml:"http://purl.org/dc/elements/1.1/ creator,omitempty"`
+	Categories  []string `xml:"category"`
+	Guid        struct {
+		IsPermaLink bool   `xml:"isPermaLink,attr"`
+		Value       string `xml:",chardata"`
+	} `xml:"guid"`
+	PubDate string `xml:"pubDate"`
+}
+
+type RSSFeed struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string   `xml:"version,attr"`
+	Channel struct {
+		Title         string     `xml:"title"`
+		Link          string     `xml:"link"`
+		Description   string     `xml:"description"`
+		LastBuildDate string     `xml:"lastBuildDate"`
+		Items         []*rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+// MakeUpdatesRSS creates an RSS 2.0 feed listing the given story updates, most
+// recent first.  If updateTime is nil, the current time is used.
+func MakeUpdatesRSS(updates []model.StoryUpdate, updateTime *model.Time3339) *RSSFeed {
+	if updateTime == nil {
+		updateTime = model.NewTime3339(time.Time{})
+	}
+	result := &RSSFeed{Version: "2.0"}
+	result.Channel.Title = "Story Updates"
+	result.Channel.Link = "/feeds/updates?format=rss"
+	result.Channel.Description = "New chapters found by FanFicUpdates"
+	result.Channel.LastBuildDate = updateTime.Format(time.RFC1123Z)
+	for i := len(updates) - 1; i >= 0; i-- {
+		update := updates[i]
+		item := &rssItem{
+			Title:       update.Summary(),
+			Link:        updateLink(update),
+			Description: updateContent(update),
+			Author:      strings.Join(update.Authors, " & "),
+			Categories:  update.Tags[:],
+			PubDate:     update.Updated.Format(time.RFC1123Z),
+		}
+		item.Guid.Value = updateId(update)
+		result.Channel.Items = append(result.Channel.Items, item)
+	}
+	return result
+}
@@ -0,0 +1,87 @@
+package opds
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeUpdate(title string, tags []string, authors []string, chapters ...int) model.StoryUpdate {
+	update := model.StoryUpdate{
+		BookId:  len(chapters),
+		Uuid:    "00000000-0000-0000-0000-000000000000",
+		Title:   title,
+		Authors: authors,
+		Tags:    tags,
+		Url:     "http://story.test/1",
+		Updated: *model.NewTime3339(time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)),
+	}
+	for _, number := range chapters {
+		update.Chapters = append(update.Chapters, model.Chapter{
+			Number: number,
+			Title:  "Chapter Title",
+			URL:    "http://story.test/1/chapter",
+		})
+	}
+	return update
+}
+
+func TestUpdateFilter(t *testing.T) {
+	update := makeUpdate("Story", []string{"Fluff", "Angst"}, []string{"Someone"}, 1)
+	cases := []struct {
+		name     string
+		filter   UpdateFilter
+		expected bool
+	}{
+		{"empty", UpdateFilter{}, true},
+		{"tag match", UpdateFilter{Tags: []string{"fluff"}}, true},
+		{"tag miss", UpdateFilter{Tags: []string{"crack"}}, false},
+		{"any tag", UpdateFilter{Tags: []string{"crack", "angst"}}, true},
+		{"author match", UpdateFilter{Authors: []string{"someone"}}, true},
+		{"author miss", UpdateFilter{Authors: []string{"nobody"}}, false},
+		{"both", UpdateFilter{Tags: []string{"fluff"}, Authors: []string{"nobody"}}, false},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, testCase.filter.Match(update))
+		})
+	}
+}
+
+func TestMakeUpdatesFeed(t *testing.T) {
+	updates := []model.StoryUpdate{
+		makeUpdate("Older", nil, []string{"A"}, 3),
+		makeUpdate("Newer", nil, []string{"B"}, 4, 5, 6),
+	}
+	feed := MakeUpdatesFeed(updates, nil)
+	require.Len(t, feed.Entries, 2)
+	assert.Equal(t, "Newer: chapters 4–6 added", feed.Entries[0].Title)
+	assert.Equal(t, "Older: chapter 3 added", feed.Entries[1].Title)
+	assert.Len(t, feed.Entries[0].Links, 4, "expected alternate link plus one per chapter")
+	assert.Contains(t, feed.Entries[0].Content.Value, `href="http://story.test/1/chapter"`)
+
+	_, err := xml.Marshal(feed)
+	assert.NoError(t, err)
+}
+
+func TestMakeUpdatesRSS(t *testing.T) {
+	updates := []model.StoryUpdate{
+		makeUpdate("Story", []string{"Fluff"}, []string{"A", "B"}),
+	}
+	feed := MakeUpdatesRSS(updates, nil)
+	require.Len(t, feed.Channel.Items, 1)
+	item := feed.Channel.Items[0]
+	assert.Equal(t, "Story: updated", item.Title)
+	assert.Equal(t, "http://story.test/1", item.Link)
+	assert.Equal(t, "A & B", item.Author)
+	assert.Equal(t, []string{"Fluff"}, item.Categories)
+	assert.Equal(t, "Sun, 02 Jan 2022 03:04:05 +0000", item.PubDate)
+
+	buf, err := xml.Marshal(feed)
+	require.NoError(t, err)
+	assert.Contains(t, string(buf), `<rss version="2.0">`)
+}
@@ -0,0 +1,172 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// SyntaxError describes a problem parsing a query.
+type SyntaxError struct {
+	Input    string
+	Position int // Byte offset into the input
+	Message  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid query %q at position %d: %s", e.Input, e.Position+1, e.Message)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenOpen
+	tokenClose
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenTerm
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokenEOF:
+		return "end of query"
+	case tokenOpen:
+		return `"("`
+	case tokenClose:
+		return `")"`
+	case tokenAnd:
+		return `"and"`
+	case tokenOr:
+		return `"or"`
+	case tokenNot:
+		return `"not"`
+	}
+	return "search term"
+}
+
+type token struct {
+	kind     tokenKind
+	position int
+	field    string // For terms, the field name (empty to search all)
+	value    string // For terms, the value to search for
+	quoted   bool   // For terms, whether the value was quoted
+}
+
+// lex splits the input into tokens.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+	offsets := make([]int, len(runes)+1)
+	offset := 0
+	for i, r := range runes {
+		offsets[i] = offset
+		offset += len(string(r))
+	}
+	offsets[len(runes)] = offset
+	fail := func(i int, format string, args ...any) error {
+		return &SyntaxError{Input: input, Position: offsets[i], Message: fmt.Sprintf(format, args...)}
+	}
+
+	// readQuoted reads a quoted string starting at position i (which must be
+	// the quote), returning the unquoted string and the position after it.
+	readQuoted := func(i int) (string, int, error) {
+		var buf strings.Builder
+		for j := i + 1; j < len(runes); j++ {
+			switch runes[j] {
+			case '\\':
+				if j+1 < len(runes) {
+					j++
+					buf.WriteRune(runes[j])
+				}
+			case '"':
+				return buf.String(), j + 1, nil
+			default:
+				buf.WriteRune(runes[j])
+			}
+		}
+		return "", 0, fail(i, "unterminated quoted string")
+	}
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenOpen, position: offsets[i]})
+			i++
+			continue
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenClose, position: offsets[i]})
+			i++
+			continue
+		}
+		start := i
+		tok := token{kind: tokenTerm, position: offsets[i]}
+		if r == '"' {
+			value, next, err := readQuoted(i)
+			if err != nil {
+				return nil, err
+			}
+			tok.value, tok.quoted = value, true
+			i = next
+		} else {
+			// Read a bare word, which may be "field:value"
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' && runes[i] != ':' && runes[i] != '"' {
+				i++
+			}
+			word := string(runes[start:i])
+			if i < len(runes) && runes[i] == ':' {
+				tok.field = strings.ToLower(word)
+				if tok.field == "" {
+					return nil, fail(start, "missing field name before \":\"")
+				}
+				i++
+				// Read the value, which may be quoted after an optional
+				// comparison operator.
+				valueStart := i
+				for i < len(runes) && strings.ContainsRune("=<>!", runes[i]) {
+					i++
+				}
+				operator := string(runes[valueStart:i])
+				if i < len(runes) && runes[i] == '"' {
+					value, next, err := readQuoted(i)
+					if err != nil {
+						return nil, err
+					}
+					tok.value, tok.quoted = operator+value, true
+					i = next
+				} else {
+					for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' {
+						i++
+					}
+					tok.value = string(runes[valueStart:i])
+					if tok.value == "" {
+						return nil, fail(valueStart, "missing value for field %q", tok.field)
+					}
+				}
+			} else {
+				switch strings.ToLower(word) {
+				case "and":
+					tok.kind = tokenAnd
+				case "or":
+					tok.kind = tokenOr
+				case "not":
+					tok.kind = tokenNot
+				default:
+					tok.value = word
+				}
+				if i < len(runes) && runes[i] == '"' {
+					return nil, fail(i, "unexpected quote")
+				}
+			}
+		}
+		tokens = append(tokens, tok)
+	}
+	tokens = append(tokens, token{kind: tokenEOF, position: len(input)})
+	return tokens, nil
+}
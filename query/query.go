@@ -0,0 +1,393 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/storyurl"
+	"github.com/mook/fanficupdates/util"
+)
+
+// Expr is a parsed query that can be evaluated against books.
+type Expr interface {
+	// Match returns whether the book satisfies the query.
+	Match(book model.CalibreBook) bool
+	// String returns a normalized representation of the query.
+	String() string
+}
+
+type andExpr struct{ left, right Expr }
+type orExpr struct{ left, right Expr }
+type notExpr struct{ inner Expr }
+type allExpr struct{}
+
+func (e *andExpr) Match(book model.CalibreBook) bool {
+	return e.left.Match(book) && e.right.Match(book)
+}
+
+func (e *andExpr) String() string {
+	return fmt.Sprintf("(%s and %s)", e.left, e.right)
+}
+
+func (e *orExpr) Match(book model.CalibreBook) bool {
+	return e.left.Match(book) || e.right.Match(book)
+}
+
+func (e *orExpr) String() string {
+	return fmt.Sprintf("(%s or %s)", e.left, e.right)
+}
+
+func (e *notExpr) Match(book model.CalibreBook) bool {
+	return !e.inner.Match(book)
+}
+
+func (e *notExpr) String() string {
+	return fmt.Sprintf("not %s", e.inner)
+}
+
+func (allExpr) Match(book model.CalibreBook) bool { return true }
+func (allExpr) String() string                    { return "" }
+
+// comparison is the kind of comparison made by a term.
+type comparison string
+
+const (
+	compareContains = comparison("")
+	compareEqual    = comparison("=")
+	compareNotEqual = comparison("!=")
+	compareLess     = comparison("<")
+	compareLessEq   = comparison("<=")
+	compareMore     = comparison(">")
+	compareMoreEq   = comparison(">=")
+)
+
+// termExpr matches a single field against a value.
+type termExpr struct {
+	field      string // Empty to search the default fields
+	comparison comparison
+	value      string
+	quoted     bool
+	number     float64 // For numeric comparisons
+}
+
+func (e *termExpr) String() string {
+	value := e.value
+	if e.quoted || value == "" || strings.ContainsAny(value, " ()\"") {
+		value = strconv.Quote(value)
+	}
+	if e.field == "" {
+		return value
+	}
+	return fmt.Sprintf("%s:%s%s", e.field, e.comparison, value)
+}
+
+// Parse a query string.  The syntax is similar to the Calibre search syntax:
+//
+//   - `field:value` matches books where the field contains the value (case
+//     insensitive); `field:=value` requires an exact match.
+//   - `field:>5` (also <, <=, >=, !=) compares numerically.
+//   - `field:""` matches books where the field is empty; `field:true` and
+//     `field:false` test whether the field is set.
+//   - A bare `value` searches the title, authors, tags, series and comments.
+//   - Terms can be combined with `and`, `or`, `not` and parentheses; terms
+//     next to each other are implicitly combined with `and`.
+//
+// See Fields for the known fields; custom columns are referred to as `#name`.
+// An empty query matches all books.
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{input: input, tokens: tokens}
+	if p.peek().kind == tokenEOF {
+		return allExpr{}, nil
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.fail(tok, "unexpected %s", tok.kind)
+	}
+	return expr, nil
+}
+
+// MustParse is like Parse, but panics on error.  This is intended for queries
+// that are known to be valid.
+func MustParse(input string) Expr {
+	expr, err := Parse(input)
+	if err != nil {
+		panic(err)
+	}
+	return expr
+}
+
+type parser struct {
+	input  string
+	tokens []token
+	next   int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) advance() token {
+	tok := p.tokens[p.next]
+	if tok.kind != tokenEOF {
+		p.next++
+	}
+	return tok
+}
+
+func (p *parser) fail(tok token, format string, args ...any) error {
+	return &SyntaxError{Input: p.input, Position: tok.position, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenOr {
+		p.advance()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orExpr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().kind {
+		case tokenAnd:
+			p.advance()
+		case tokenNot, tokenOpen, tokenTerm:
+			// Implicit "and"
+		default:
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andExpr{left: left, right: right}
+	}
+}
+
+func (p *parser) parseNot() (Expr, error) {
+	if p.peek().kind == tokenNot {
+		p.advance()
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{inner: inner}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	tok := p.advance()
+	switch tok.kind {
+	case tokenOpen:
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.peek(); closing.kind != tokenClose {
+			return nil, p.fail(closing, "expected \")\" to match \"(\" at position %d, got %s", tok.position+1, closing.kind)
+		}
+		p.advance()
+		return expr, nil
+	case tokenTerm:
+		return p.parseTerm(tok)
+	}
+	return nil, p.fail(tok, "expected a search term, got %s", tok.kind)
+}
+
+func (p *parser) parseTerm(tok token) (Expr, error) {
+	term := &termExpr{field: tok.field, value: tok.value, quoted: tok.quoted}
+	if term.field != "" {
+		if _, ok := fieldAliases[term.field]; ok {
+			term.field = fieldAliases[term.field]
+		}
+		if _, ok := fields[term.field]; !ok && !strings.HasPrefix(term.field, "#") {
+			return nil, p.fail(tok, "unknown field %q (known fields: %s, or #column)", tok.field, strings.Join(Fields(), ", "))
+		}
+		for _, candidate := range []comparison{compareLessEq, compareMoreEq, compareNotEqual, compareEqual, compareLess, compareMore} {
+			if strings.HasPrefix(term.value, string(candidate)) {
+				term.comparison = candidate
+				term.value = strings.TrimPrefix(term.value, string(candidate))
+				break
+			}
+		}
+	}
+	switch term.comparison {
+	case compareLess, compareLessEq, compareMore, compareMoreEq:
+		number, err := strconv.ParseFloat(term.value, 64)
+		if err != nil {
+			return nil, p.fail(tok, "expected a number to compare %s with, got %q", term.field, term.value)
+		}
+		term.number = number
+	}
+	return term, nil
+}
+
+// fieldGetter returns the values of a field for a book.
+type fieldGetter func(book model.CalibreBook) []string
+
+var fields = map[string]fieldGetter{
+	"title":    func(b model.CalibreBook) []string { return []string{b.Title} },
+	"authors":  func(b model.CalibreBook) []string { return b.Authors },
+	"tags":     func(b model.CalibreBook) []string { return b.Tags },
+	"series":   func(b model.CalibreBook) []string { return []string{b.Series} },
+	"comments": func(b model.CalibreBook) []string { return []string{b.Comments} },
+	"publisher": func(b model.CalibreBook) []string {
+		return []string{b.Publisher}
+	},
+	"languages": func(b model.CalibreBook) []string { return b.Languages },
+	"formats": func(b model.CalibreBook) []string {
+		return util.Map(b.Formats, func(path string) string {
+			return path[strings.LastIndex(path, ".")+1:]
+		})
+	},
+	"id":   func(b model.CalibreBook) []string { return []string{strconv.Itoa(b.Id)} },
+	"uuid": func(b model.CalibreBook) []string { return []string{b.Uuid} },
+	"identifiers": func(b model.CalibreBook) []string {
+		result := make([]string, 0, len(b.Identifiers))
+		for kind, value := range b.Identifiers {
+			result = append(result, kind+":"+value)
+		}
+		sort.Strings(result)
+		return result
+	},
+	"url": func(b model.CalibreBook) []string { return []string{b.Identifiers["url"]} },
+	"site": func(b model.CalibreBook) []string {
+		u := b.Url()
+		if u == nil {
+			return nil
+		}
+		return siteNames(u.Hostname())
+	},
+	"series_index": func(b model.CalibreBook) []string {
+		if b.Series == "" || b.SeriesIndex == nil {
+			return nil
+		}
+		return []string{strconv.FormatFloat(*b.SeriesIndex, 'f', -1, 64)}
+	},
+}
+
+var fieldAliases = map[string]string{
+	"author":     "authors",
+	"tag":        "tags",
+	"language":   "languages",
+	"format":     "formats",
+	"identifier": "identifiers",
+	"comment":    "comments",
+}
+
+// defaultFields are searched by terms without a field name.
+var defaultFields = []string{"title", "authors", "tags", "series", "comments"}
+
+// Fields returns the names of the known fields, sorted.
+func Fields() []string {
+	result := make([]string, 0, len(fields))
+	for name := range fields {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// siteNames returns the names a site can be searched by: the host name, plus
+// the short names of known sites; see storyurl.SiteNames.
+func siteNames(host string) []string {
+	return append([]string{strings.ToLower(host)}, storyurl.SiteNames(host)...)
+}
+
+// values returns the values of the term's field for the book, and whether the
+// field is a boolean.
+func (e *termExpr) values(book model.CalibreBook) ([]string, bool) {
+	if strings.HasPrefix(e.field, "#") {
+		value, ok := book.Custom(e.field)
+		if !ok {
+			return nil, value.Type == model.CustomBool
+		}
+		return value.Values(), value.Type == model.CustomBool
+	}
+	return util.Filter(fields[e.field](book), func(s string) bool { return s != "" }), false
+}
+
+func (e *termExpr) Match(book model.CalibreBook) bool {
+	if e.field == "" {
+		return util.Any(defaultFields, func(field string) bool {
+			sub := *e
+			sub.field = field
+			return sub.Match(book)
+		})
+	}
+	values, isBool := e.values(book)
+	if e.comparison == compareContains {
+		if e.quoted && e.value == "" {
+			return len(values) == 0
+		}
+		if !e.quoted && !isBool {
+			switch strings.ToLower(e.value) {
+			case "true":
+				return len(values) > 0
+			case "false":
+				return len(values) == 0
+			}
+		}
+	}
+	needle := strings.ToLower(e.value)
+	if isBool {
+		switch needle {
+		case "yes", "checked":
+			needle = "true"
+		case "no", "unchecked":
+			needle = "false"
+		}
+	}
+	matches := func(value string) bool {
+		haystack := strings.ToLower(value)
+		switch e.comparison {
+		case compareEqual, compareNotEqual:
+			return haystack == needle
+		case compareLess, compareLessEq, compareMore, compareMoreEq:
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return false
+			}
+			switch e.comparison {
+			case compareLess:
+				return number < e.number
+			case compareLessEq:
+				return number <= e.number
+			case compareMore:
+				return number > e.number
+			}
+			return number >= e.number
+		}
+		if isBool {
+			return haystack == needle
+		}
+		return strings.Contains(haystack, needle)
+	}
+	if e.comparison == compareNotEqual {
+		return !util.Any(values, matches)
+	}
+	return util.Any(values, matches)
+}
@@ -0,0 +1,129 @@
+package query_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	cases := map[string]string{
+		"":                                 "",
+		"fluffy":                           "fluffy",
+		"tag:complete":                     "tags:complete",
+		"a b":                              "(a and b)",
+		"a or b c":                         "(a or (b and c))",
+		"(a or b) c":                       "((a or b) and c)",
+		"not tag:complete":                 "not tags:complete",
+		`title:"Some Story"`:               `title:"Some Story"`,
+		`title:=""`:                        `title:=""`,
+		"series_index:>=2":                 "series_index:>=2",
+		"#status:=In-Progress OR site:ao3": "(#status:=In-Progress or site:ao3)",
+	}
+	for input, expected := range cases {
+		t.Run(input, func(t *testing.T) {
+			expr, err := query.Parse(input)
+			require.NoError(t, err)
+			assert.Equal(t, expected, expr.String())
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]struct {
+		input    string
+		position int
+		message  string
+	}{
+		"unterminated":  {`title:"foo`, 6, "unterminated quoted string"},
+		"unknown field": {"a nope:x", 2, `unknown field "nope"`},
+		"missing value": {"tag: x", 4, `missing value for field "tag"`},
+		"missing field": {":x", 0, "missing field name"},
+		"unbalanced":    {"(a or b", 7, `expected ")"`},
+		"extra close":   {"a)", 1, `unexpected ")"`},
+		"dangling or":   {"a or", 4, "expected a search term, got end of query"},
+		"not a number":  {"series_index:>x", 0, "expected a number"},
+	}
+	for name, testCase := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := query.Parse(testCase.input)
+			var syntaxErr *query.SyntaxError
+			require.True(t, errors.As(err, &syntaxErr), "unexpected error %v", err)
+			assert.Equal(t, testCase.position, syntaxErr.Position)
+			assert.Contains(t, syntaxErr.Message, testCase.message)
+			assert.Equal(t, testCase.input, syntaxErr.Input)
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	index := 2.0
+	book := model.CalibreBook{
+		Id:          12,
+		Title:       "A Fluffy Story",
+		Authors:     []string{"Alice", "Bob"},
+		Tags:        []string{"Romance", "Complete"},
+		Series:      "Fluff",
+		SeriesIndex: &index,
+		Publisher:   "archiveofourown.org",
+		Languages:   []string{"eng"},
+		Formats:     []string{"/library/A Fluffy Story.epub"},
+		Identifiers: map[string]string{"url": "https://archiveofourown.org/works/1234"},
+		CustomColumns: map[string]model.CustomValue{
+			"status":   {Type: model.CustomText, Value: "In-Progress"},
+			"reviewed": {Type: model.CustomBool, Value: false},
+			"words":    {Type: model.CustomInt, Value: int64(5000)},
+		},
+	}
+	cases := map[string]bool{
+		"":                            true,
+		"fluffy":                      true,
+		"alice":                       true,
+		"romance":                     true,
+		"dragons":                     false,
+		"title:fluffy":                true,
+		"title:=fluffy":               false,
+		`title:="a fluffy story"`:     true,
+		"author:=bob":                 true,
+		"tag:complete":                true,
+		"not tag:complete":            false,
+		"tag:dragons or alice":        true,
+		"tag:dragons alice":           false,
+		"(tag:dragons or bob) fluffy": true,
+		`comments:""`:                 true,
+		`series:""`:                   false,
+		"comments:false":              true,
+		"series:true":                 true,
+		"series_index:>1":             true,
+		"series_index:<=1":            false,
+		"id:=12":                      true,
+		"format:epub":                 true,
+		"language:eng":                true,
+		"identifier:isbn:":            false,
+		"identifiers:url:https":       true,
+		"url:works/1234":              true,
+		"site:ao3":                    true,
+		"site:ffnet":                  false,
+		"site:archiveofourown":        true,
+		"#status:=in-progress":        true,
+		"#status:!=in-progress":       false,
+		"#reviewed:false":             true,
+		"#reviewed:true":              false,
+		"#reviewed:no":                true,
+		"#words:>1000":                true,
+		"#words:<1000":                false,
+		`#missing:""`:                 true,
+		"#missing:x":                  false,
+	}
+	for input, expected := range cases {
+		t.Run(input, func(t *testing.T) {
+			expr, err := query.Parse(input)
+			require.NoError(t, err)
+			assert.Equal(t, expected, expr.Match(book))
+		})
+	}
+}
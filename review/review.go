@@ -0,0 +1,165 @@
+// Package review holds updates that would destroy content, such as those that
+// lose chapters, until they are accepted or rejected.
+package review
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/util"
+)
+
+// Entry is an update held for review.  There is at most one entry per book;
+// holding another update replaces it.
+type Entry struct {
+	BookId      int                `json:"bookId"`
+	Title       string             `json:"title"`
+	URL         string             `json:"url,omitempty"`
+	Reason      string             `json:"reason"` // Why the update was held, such as "5 → 3 chapters"
+	OldChapters int                `json:"oldChapters"`
+	NewChapters int                `json:"newChapters"`
+	OldWords    int                `json:"oldWords"`
+	NewWords    int                `json:"newWords"`
+	Held        time.Time          `json:"held"`
+	Meta        calibre.UpdateMeta `json:"meta"` // The metadata to set if accepted
+}
+
+// Queue is a review queue stored in a directory, as a JSON file and an EPUB
+// for each entry.  It is safe for concurrent use.
+type Queue struct {
+	Dir     string
+	Library calibre.Library // Where accepted updates are applied
+
+	lock sync.Mutex
+}
+
+// Open returns the queue in the given directory, creating it if needed.
+func Open(dir string, library calibre.Library) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create review directory %s: %w", dir, err)
+	}
+	return &Queue{Dir: dir, Library: library}, nil
+}
+
+// paths returns the paths of the entry and EPUB files for the book.
+func (q *Queue) paths(bookId int) (string, string) {
+	base := filepath.Join(q.Dir, strconv.Itoa(bookId))
+	return base + ".json", base + ".epub"
+}
+
+// Hold adds the update to the queue, copying the EPUB at the given path.
+func (q *Queue) Hold(entry Entry, epubPath string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	entryPath, heldPath := q.paths(entry.BookId)
+	if err := util.CopyFile(epubPath, heldPath); err != nil {
+		return fmt.Errorf("could not hold update of %s: %w", entry.Title, err)
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not serialize held update of %s: %w", entry.Title, err)
+	}
+	if err = os.WriteFile(entryPath, data, 0o644); err != nil {
+		return fmt.Errorf("could not hold update of %s: %w", entry.Title, err)
+	}
+	return nil
+}
+
+// List returns the entries in the queue, sorted by book ID.
+func (q *Queue) List() ([]Entry, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	names, err := filepath.Glob(filepath.Join(q.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Entry, 0, len(names))
+	for _, name := range names {
+		bookId, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			continue
+		}
+		entry, err := q.get(bookId)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].BookId < result[j].BookId })
+	return result, nil
+}
+
+// Get returns the entry for the book; if there is none, the error wraps
+// os.ErrNotExist.
+func (q *Queue) Get(bookId int) (Entry, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.get(bookId)
+}
+
+// get returns the entry for the book; the lock must be held.
+func (q *Queue) get(bookId int) (Entry, error) {
+	entryPath, _ := q.paths(bookId)
+	data, err := os.ReadFile(entryPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return Entry{}, fmt.Errorf("no held update for book #%d: %w", bookId, err)
+	} else if err != nil {
+		return Entry{}, fmt.Errorf("could not read held update for book #%d: %w", bookId, err)
+	}
+	var entry Entry
+	if err = json.Unmarshal(data, &entry); err != nil {
+		return Entry{}, fmt.Errorf("could not parse held update for book #%d: %w", bookId, err)
+	}
+	return entry, nil
+}
+
+// Accept applies the held update of the book, replacing its metadata and
+// EPUB, and removes it from the queue.
+func (q *Queue) Accept(ctx context.Context, bookId int) (Entry, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	entry, err := q.get(bookId)
+	if err != nil {
+		return entry, err
+	}
+	_, heldPath := q.paths(bookId)
+	if err = q.Library.UpdateMetadata(ctx, bookId, entry.Meta); err != nil {
+		return entry, fmt.Errorf("could not accept update of %s: %w", entry.Title, err)
+	}
+	if err = q.Library.AddFormat(ctx, bookId, heldPath); err != nil {
+		return entry, fmt.Errorf("could not accept update of %s: %w", entry.Title, err)
+	}
+	return entry, q.remove(bookId)
+}
+
+// Reject discards the held update of the book.
+func (q *Queue) Reject(bookId int) (Entry, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	entry, err := q.get(bookId)
+	if err != nil {
+		return entry, err
+	}
+	return entry, q.remove(bookId)
+}
+
+// remove deletes the files of the entry for the book; the lock must be held.
+func (q *Queue) remove(bookId int) error {
+	entryPath, heldPath := q.paths(bookId)
+	for _, name := range []string{entryPath, heldPath} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not remove held update for book #%d: %w", bookId, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package review
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/calibre/memory"
+	"github.com/mook/fanficupdates/model"
+)
+
+func TestQueue(t *testing.T) {
+	ctx := context.Background()
+	library := memory.NewLibrary(
+		model.CalibreBook{Id: 1, Title: "One"},
+		model.CalibreBook{Id: 2, Title: "Two"},
+	)
+	require.NoError(t, library.SetFile(1, "epub", []byte("old one")))
+	require.NoError(t, library.SetFile(2, "epub", []byte("old two")))
+	subject, err := Open(filepath.Join(t.TempDir(), "review"), library)
+	require.NoError(t, err)
+
+	hold := func(bookId int, contents string) {
+		source := filepath.Join(t.TempDir(), "book.epub")
+		require.NoError(t, os.WriteFile(source, []byte(contents), 0o644))
+		require.NoError(t, subject.Hold(Entry{
+			BookId:      bookId,
+			Title:       "Book",
+			Reason:      "3 → 2 chapters",
+			OldChapters: 3,
+			NewChapters: 2,
+			Held:        time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+			Meta:        calibre.UpdateMeta{Comments: contents},
+		}, source))
+	}
+	hold(2, "first two")
+	hold(1, "new one")
+	hold(2, "new two")
+
+	entries, err := subject.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, 1, entries[0].BookId)
+	assert.Equal(t, 2, entries[1].BookId)
+	assert.Equal(t, "new two", entries[1].Meta.Comments, "holding again should replace the entry")
+
+	entry, err := subject.Accept(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 3, entry.OldChapters)
+	contents, _ := library.File(1, "epub")
+	assert.Equal(t, "new one", string(contents))
+	books, err := library.GetBooks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "new one", books[0].Comments)
+
+	_, err = subject.Reject(2)
+	require.NoError(t, err)
+	contents, _ = library.File(2, "epub")
+	assert.Equal(t, "old two", string(contents))
+
+	entries, err = subject.List()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	_, err = subject.Get(1)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = subject.Accept(ctx, 2)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = subject.Reject(3)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,194 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/query"
+	"github.com/mook/fanficupdates/util"
+)
+
+// DefaultRules are the rules used when none are configured.
+var DefaultRules = []string{
+	"tag:noupdate skip",
+	"tag:complete interval=30d",
+	"#update_overwrite=yes args=--force",
+}
+
+// Condition selects the books a rule applies to: books with a given tag, books
+// where a custom column has a given value, or books matching a query.
+type Condition struct {
+	Tag    string
+	Column string
+	Value  string
+	Query  query.Expr
+}
+
+// Match returns whether the condition applies to the given book.
+func (c *Condition) Match(book model.CalibreBook) bool {
+	if c.Query != nil {
+		return c.Query.Match(book)
+	}
+	if c.Tag != "" {
+		return util.Any(book.Tags, func(tag string) bool { return strings.EqualFold(tag, c.Tag) })
+	}
+	value, ok := book.Custom(c.Column)
+	if !ok {
+		return c.Value == ""
+	}
+	if value.Type == model.CustomBool {
+		wanted, err := parseBool(c.Value)
+		return err == nil && value.Value == wanted
+	}
+	return util.Any(value.Values(), func(v string) bool { return strings.EqualFold(v, c.Value) })
+}
+
+// Action describes what to do with books matching a rule.
+type Action struct {
+	Skip     bool          // Do not update the book at all
+	Interval time.Duration // Minimum time between checks of the book
+	Args     []string      // Extra arguments to pass to FanFicFare
+}
+
+// Rule is a single update rule, parsed from text in the form
+// "<condition> <action>...", where the condition is "tag:<name>" or
+// "#<column>=<value>", and each action is one of "skip", "interval=<duration>"
+// or "args=<FanFicFare flag>".  Alternatively, the rule may be written as
+// "<query> => <action>...", where the query uses the syntax of query.Parse.
+type Rule struct {
+	Source string
+	Condition
+	Action
+}
+
+// parseBool parses yes/no style boolean values.
+func parseBool(input string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(input)) {
+	case "yes", "y", "true", "1", "checked":
+		return true, nil
+	case "no", "n", "false", "0", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", input)
+}
+
+// ParseInterval parses a duration, additionally accepting a "d" suffix for
+// days.
+func ParseInterval(input string) (time.Duration, error) {
+	if strings.HasSuffix(input, "d") {
+		count, err := strconv.ParseFloat(strings.TrimSuffix(input, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid interval %q", input)
+		}
+		return time.Duration(count * float64(24*time.Hour)), nil
+	}
+	result, err := time.ParseDuration(input)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval %q", input)
+	}
+	return result, nil
+}
+
+// ParseRule parses a single rule; see Rule for the syntax.
+func ParseRule(input string) (Rule, error) {
+	rule := Rule{Source: input}
+	if search, actions, ok := strings.Cut(input, "=>"); ok {
+		expr, err := query.Parse(search)
+		if err != nil {
+			return rule, fmt.Errorf("rule %q: %w", input, err)
+		}
+		rule.Query = expr
+		fields := strings.Fields(actions)
+		if len(fields) < 1 {
+			return rule, fmt.Errorf("rule %q: expected at least one action", input)
+		}
+		return rule, rule.parseActions(fields)
+	}
+	fields := strings.Fields(input)
+	if len(fields) < 2 {
+		return rule, fmt.Errorf("rule %q: expected a condition and at least one action", input)
+	}
+	condition := fields[0]
+	if strings.HasPrefix(condition, "tag:") && len(condition) > len("tag:") {
+		rule.Tag = strings.TrimPrefix(condition, "tag:")
+	} else if column, value, ok := strings.Cut(strings.TrimPrefix(condition, "#"), "="); ok && strings.HasPrefix(condition, "#") && column != "" {
+		rule.Column = column
+		rule.Value = value
+	} else {
+		return rule, fmt.Errorf("rule %q: invalid condition %q (expected tag:<name> or #<column>=<value>)", input, condition)
+	}
+	return rule, rule.parseActions(fields[1:])
+}
+
+// parseActions parses the actions of a rule into the rule.
+func (rule *Rule) parseActions(actions []string) error {
+	input := rule.Source
+	for _, action := range actions {
+		name, value, _ := strings.Cut(action, "=")
+		switch name {
+		case "skip":
+			rule.Skip = true
+		case "interval":
+			interval, err := ParseInterval(value)
+			if err != nil {
+				return fmt.Errorf("rule %q: %w", input, err)
+			}
+			rule.Interval = interval
+		case "args":
+			if !strings.HasPrefix(value, "-") {
+				return fmt.Errorf("rule %q: invalid FanFicFare argument %q", input, value)
+			}
+			rule.Args = append(rule.Args, value)
+		default:
+			return fmt.Errorf("rule %q: unknown action %q", input, action)
+		}
+	}
+	return nil
+}
+
+// Rules is an ordered list of rules.
+type Rules []Rule
+
+// ParseRules parses each of the given rules.
+func ParseRules(inputs []string) (Rules, error) {
+	result := make(Rules, 0, len(inputs))
+	for _, input := range inputs {
+		rule, err := ParseRule(input)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+// Decision is the combined result of evaluating the rules for a book.
+type Decision struct {
+	Action
+	Matched []string // The source of each matching rule
+}
+
+// Evaluate applies all matching rules to the book: the book is skipped if any
+// rule says so, the longest interval wins, and arguments are combined.
+func (r Rules) Evaluate(book model.CalibreBook) Decision {
+	var decision Decision
+	for _, rule := range r {
+		if !rule.Match(book) {
+			continue
+		}
+		decision.Matched = append(decision.Matched, rule.Source)
+		decision.Skip = decision.Skip || rule.Skip
+		if rule.Interval > decision.Interval {
+			decision.Interval = rule.Interval
+		}
+		for _, arg := range rule.Args {
+			if !util.Any(decision.Args, func(existing string) bool { return existing == arg }) {
+				decision.Args = append(decision.Args, arg)
+			}
+		}
+	}
+	return decision
+}
@@ -0,0 +1,105 @@
+package rules_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/rules"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	t.Run("tag", func(t *testing.T) {
+		rule, err := rules.ParseRule("tag:complete interval=30d")
+		require.NoError(t, err)
+		assert.Equal(t, "complete", rule.Tag)
+		assert.Equal(t, 30*24*time.Hour, rule.Interval)
+		assert.False(t, rule.Skip)
+	})
+	t.Run("column", func(t *testing.T) {
+		rule, err := rules.ParseRule("#update_overwrite=yes args=--force args=--update-cover")
+		require.NoError(t, err)
+		assert.Equal(t, "update_overwrite", rule.Column)
+		assert.Equal(t, "yes", rule.Value)
+		assert.Equal(t, []string{"--force", "--update-cover"}, rule.Args)
+	})
+	t.Run("query", func(t *testing.T) {
+		rule, err := rules.ParseRule("site:ao3 and not tag:complete => interval=1d")
+		require.NoError(t, err)
+		assert.NotNil(t, rule.Query)
+		assert.Equal(t, 24*time.Hour, rule.Interval)
+		assert.True(t, rule.Match(model.CalibreBook{
+			Identifiers: map[string]string{"url": "https://archiveofourown.org/works/1"},
+		}))
+		assert.False(t, rule.Match(model.CalibreBook{
+			Identifiers: map[string]string{"url": "https://archiveofourown.org/works/1"},
+			Tags:        []string{"Complete"},
+		}))
+	})
+	errorCases := map[string]string{
+		"bad query":        "title:(x => skip",
+		"query no action":  "tag:complete =>",
+		"no action":        "tag:complete",
+		"bad condition":    "complete skip",
+		"empty tag":        "tag: skip",
+		"bad interval":     "tag:complete interval=monthly",
+		"bad argument":     "tag:complete args=force",
+		"unknown action":   "tag:complete explode",
+		"bad column":       "#=yes skip",
+		"column no equals": "#column skip",
+	}
+	for name, input := range errorCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := rules.ParseRule(input)
+			assert.Error(t, err)
+		})
+	}
+	t.Run("defaults", func(t *testing.T) {
+		_, err := rules.ParseRules(rules.DefaultRules)
+		assert.NoError(t, err)
+	})
+}
+
+func TestEvaluate(t *testing.T) {
+	ruleSet, err := rules.ParseRules([]string{
+		"tag:noupdate skip",
+		"tag:complete interval=30d",
+		"tag:slow interval=1d args=--force",
+		"#update_overwrite=yes args=--force",
+		"#flag=true args=--update-cover",
+	})
+	require.NoError(t, err)
+
+	t.Run("no match", func(t *testing.T) {
+		decision := ruleSet.Evaluate(model.CalibreBook{Tags: []string{"other"}})
+		assert.Equal(t, rules.Decision{}, decision)
+	})
+	t.Run("skip", func(t *testing.T) {
+		decision := ruleSet.Evaluate(model.CalibreBook{Tags: []string{"NoUpdate"}})
+		assert.True(t, decision.Skip)
+		assert.Equal(t, []string{"tag:noupdate skip"}, decision.Matched)
+	})
+	t.Run("combined", func(t *testing.T) {
+		decision := ruleSet.Evaluate(model.CalibreBook{
+			Tags: []string{"complete", "slow"},
+			CustomColumns: map[string]model.CustomValue{
+				"update_overwrite": {Type: model.CustomText, Value: "Yes"},
+				"flag":             {Type: model.CustomBool, Value: true},
+			},
+		})
+		assert.False(t, decision.Skip)
+		assert.Equal(t, 30*24*time.Hour, decision.Interval)
+		assert.Equal(t, []string{"--force", "--update-cover"}, decision.Args)
+		assert.Len(t, decision.Matched, 4)
+	})
+	t.Run("bool column", func(t *testing.T) {
+		decision := ruleSet.Evaluate(model.CalibreBook{
+			CustomColumns: map[string]model.CustomValue{
+				"flag": {Type: model.CustomBool, Value: false},
+			},
+		})
+		assert.Empty(t, decision.Args)
+	})
+}
@@ -0,0 +1,199 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mook/fanficupdates/rules"
+)
+
+// Schedule determines when updates run.
+type Schedule interface {
+	// Next returns the first time strictly after the given time that the
+	// schedule fires, or the zero time if it never does.
+	Next(after time.Time) time.Time
+}
+
+// every is a schedule that fires at a fixed interval.
+type every time.Duration
+
+func (e every) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+// cron is a schedule using cron syntax.  Each field is a bit set of the
+// matching values.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	// Whether the day fields were given as other than "*".
+	domRestricted, dowRestricted bool
+	location                     *time.Location
+}
+
+// cronField describes one of the fields of a cron expression.
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField = cronField{name: "minute", min: 0, max: 59}
+	hourField   = cronField{name: "hour", min: 0, max: 23}
+	domField    = cronField{name: "day of month", min: 1, max: 31}
+	monthField  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// Day of week allows 7 for Sunday, which is folded into 0.
+	dowField = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// descriptors are the predefined schedules.
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// value parses a single value of the field.
+func (f cronField) value(input string) (int, error) {
+	if value, ok := f.names[strings.ToLower(input)]; ok {
+		return value, nil
+	}
+	value, err := strconv.Atoi(input)
+	if err != nil || value < f.min || value > f.max {
+		return 0, fmt.Errorf("invalid %s %q (expected %d-%d)", f.name, input, f.min, f.max)
+	}
+	return value, nil
+}
+
+// parse parses the field, which is a comma-separated list of "*", values or
+// ranges, each optionally followed by "/step".
+func (f cronField) parse(input string) (uint64, error) {
+	var result uint64
+	for _, part := range strings.Split(input, ",") {
+		rangeSpec, stepSpec, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepSpec)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q for %s", stepSpec, f.name)
+			}
+		}
+		low, high := f.min, f.max
+		if rangeSpec != "*" {
+			lowSpec, highSpec, isRange := strings.Cut(rangeSpec, "-")
+			var err error
+			if low, err = f.value(lowSpec); err != nil {
+				return 0, err
+			}
+			high = low
+			if isRange {
+				if high, err = f.value(highSpec); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				high = f.max
+			}
+			if high < low {
+				return 0, fmt.Errorf("invalid %s range %q", f.name, rangeSpec)
+			}
+		}
+		for value := low; value <= high; value += step {
+			result |= 1 << value
+		}
+	}
+	return result, nil
+}
+
+// Parse parses a schedule.  This is either a cron expression with five fields
+// (minute, hour, day of month, month, day of week), one of the descriptors
+// "@hourly", "@daily", "@weekly", "@monthly" or "@yearly", or "@every <interval>"
+// (such as "@every 6h").  Cron expressions are evaluated in the given location.
+func Parse(spec string, location *time.Location) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every") {
+		interval, err := rules.ParseInterval(strings.TrimSpace(strings.TrimPrefix(spec, "@every")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("invalid schedule %q: interval must be positive", spec)
+		}
+		return every(interval), nil
+	}
+	if expanded, ok := descriptors[strings.ToLower(spec)]; ok {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields (minute hour day-of-month month day-of-week), got %d", spec, len(fields))
+	}
+	if location == nil {
+		location = time.Local
+	}
+	result := &cron{location: location}
+	targets := []*uint64{&result.minute, &result.hour, &result.dom, &result.month, &result.dow}
+	for i, field := range []cronField{minuteField, hourField, domField, monthField, dowField} {
+		value, err := field.parse(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+		*targets[i] = value
+	}
+	if result.dow&(1<<7) != 0 {
+		result.dow = result.dow&^(1<<7) | 1
+	}
+	result.domRestricted = !strings.HasPrefix(fields[2], "*")
+	result.dowRestricted = !strings.HasPrefix(fields[4], "*")
+	return result, nil
+}
+
+// matchDay returns whether the schedule fires on the day of the given time.  As
+// with standard cron, if both the day of month and day of week are restricted,
+// either may match.
+func (c *cron) matchDay(t time.Time) bool {
+	domMatch := c.dom&(1<<t.Day()) != 0
+	dowMatch := c.dow&(1<<t.Weekday()) != 0
+	if c.domRestricted && c.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+func (c *cron) Next(after time.Time) time.Time {
+	t := after.In(c.location).Truncate(time.Minute).Add(time.Minute)
+	// Give up after five years, which can only happen for impossible dates
+	// such as 31 February.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<t.Month()) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.location)
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.location)
+			continue
+		}
+		if c.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.location)
+			continue
+		}
+		if c.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
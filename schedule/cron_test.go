@@ -0,0 +1,87 @@
+package schedule_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mook/fanficupdates/schedule"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	start := time.Date(2022, 6, 1, 10, 30, 15, 0, time.UTC) // A Wednesday
+	cases := []struct {
+		spec     string
+		expected []time.Time
+	}{
+		{"0 3 * * *", []time.Time{
+			time.Date(2022, 6, 2, 3, 0, 0, 0, time.UTC),
+			time.Date(2022, 6, 3, 3, 0, 0, 0, time.UTC),
+		}},
+		{"*/20 * * * *", []time.Time{
+			time.Date(2022, 6, 1, 10, 40, 0, 0, time.UTC),
+			time.Date(2022, 6, 1, 11, 0, 0, 0, time.UTC),
+		}},
+		{"0 1-7/6 * * *", []time.Time{
+			time.Date(2022, 6, 2, 1, 0, 0, 0, time.UTC),
+			time.Date(2022, 6, 2, 7, 0, 0, 0, time.UTC),
+			time.Date(2022, 6, 3, 1, 0, 0, 0, time.UTC),
+		}},
+		{"15 4 * * sat,7", []time.Time{
+			time.Date(2022, 6, 4, 4, 15, 0, 0, time.UTC),
+			time.Date(2022, 6, 5, 4, 15, 0, 0, time.UTC),
+			time.Date(2022, 6, 11, 4, 15, 0, 0, time.UTC),
+		}},
+		{"0 0 13 * 5", []time.Time{ // Friday or the 13th
+			time.Date(2022, 6, 3, 0, 0, 0, 0, time.UTC),
+			time.Date(2022, 6, 10, 0, 0, 0, 0, time.UTC),
+			time.Date(2022, 6, 13, 0, 0, 0, 0, time.UTC),
+		}},
+		{"@monthly", []time.Time{
+			time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC),
+		}},
+		{"0 0 29 feb *", []time.Time{
+			time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		}},
+		{"@every 6h", []time.Time{
+			time.Date(2022, 6, 1, 16, 30, 15, 0, time.UTC),
+			time.Date(2022, 6, 1, 22, 30, 15, 0, time.UTC),
+		}},
+		{"0 0 31 2 *", []time.Time{{}}},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.spec, func(t *testing.T) {
+			parsed, err := schedule.Parse(testCase.spec, time.UTC)
+			require.NoError(t, err)
+			actual := make([]time.Time, 0, len(testCase.expected))
+			next := start
+			for range testCase.expected {
+				next = parsed.Next(next)
+				actual = append(actual, next)
+			}
+			for i := range actual {
+				assert.True(t, testCase.expected[i].Equal(actual[i]), "expected %s, got %s", testCase.expected[i], actual[i])
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]string{
+		"too few fields": "0 3 * *",
+		"bad minute":     "60 * * * *",
+		"bad name":       "0 0 * * funday",
+		"bad range":      "0 5-1 * * *",
+		"bad step":       "*/0 * * * *",
+		"bad every":      "@every often",
+		"zero every":     "@every 0s",
+	}
+	for name, spec := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := schedule.Parse(spec, time.UTC)
+			assert.ErrorContains(t, err, spec)
+		})
+	}
+}
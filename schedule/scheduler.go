@@ -0,0 +1,252 @@
+package schedule
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/query"
+)
+
+// Window is a daily period of time, such as quiet hours.  The window may wrap
+// past midnight (e.g. 22:00-07:00).
+type Window struct {
+	Start, End time.Duration // Offset from midnight
+}
+
+// parseClock parses a time of day in the form "HH:MM".
+func parseClock(input string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(input))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q (expected HH:MM)", input)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// ParseWindow parses a window in the form "HH:MM-HH:MM".
+func ParseWindow(input string) (Window, error) {
+	start, end, ok := strings.Cut(input, "-")
+	if !ok {
+		return Window{}, fmt.Errorf("invalid time window %q (expected HH:MM-HH:MM)", input)
+	}
+	var result Window
+	var err error
+	if result.Start, err = parseClock(start); err != nil {
+		return Window{}, err
+	}
+	if result.End, err = parseClock(end); err != nil {
+		return Window{}, err
+	}
+	if result.Start == result.End {
+		return Window{}, fmt.Errorf("invalid time window %q: empty", input)
+	}
+	return result, nil
+}
+
+// end returns the end of the window containing the given time, or the zero
+// time if it is not within the window.
+func (w Window) end(t time.Time) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if w.Start < w.End {
+		if offset >= w.Start && offset < w.End {
+			return midnight.Add(w.End)
+		}
+		return time.Time{}
+	}
+	// The window wraps past midnight.
+	if offset >= w.Start {
+		return midnight.AddDate(0, 0, 1).Add(w.End)
+	}
+	if offset < w.End {
+		return midnight.Add(w.End)
+	}
+	return time.Time{}
+}
+
+// Plan is a schedule, adjusted to avoid quiet hours and with random jitter.
+type Plan struct {
+	Schedule Schedule
+	Quiet    []Window
+	Jitter   time.Duration // Maximum random delay added to each run
+	Location *time.Location
+
+	random func(n int64) int64 // For testing
+}
+
+// Next returns when the plan next fires after the given time.  The scheduled
+// time, which should be passed in for the following call, excludes the jitter
+// to avoid drift; the run time includes it.  If the scheduled time falls in
+// quiet hours, it is moved to the end of the quiet hours.
+func (p *Plan) Next(after time.Time) (scheduled, run time.Time) {
+	scheduled = p.Schedule.Next(after)
+	if scheduled.IsZero() {
+		return scheduled, scheduled
+	}
+	scheduled = p.avoidQuiet(scheduled)
+	run = scheduled
+	if p.Jitter > 0 {
+		random := rand.Int63n
+		if p.random != nil {
+			random = p.random
+		}
+		run = p.avoidQuiet(run.Add(time.Duration(random(int64(p.Jitter)))))
+	}
+	return scheduled, run
+}
+
+// equal returns whether the plans fire at the same times.
+func (p *Plan) equal(other *Plan) bool {
+	return p.Jitter == other.Jitter &&
+		sameLocation(p.Location, other.Location) &&
+		reflect.DeepEqual(p.Quiet, other.Quiet) &&
+		sameSchedule(p.Schedule, other.Schedule)
+}
+
+// sameLocation returns whether the locations are the same time zone; nil is
+// the local time zone.
+func sameLocation(a, b *time.Location) bool {
+	if a == nil {
+		a = time.Local
+	}
+	if b == nil {
+		b = time.Local
+	}
+	return a.String() == b.String()
+}
+
+// sameSchedule returns whether the schedules fire at the same times.
+func sameSchedule(a, b Schedule) bool {
+	aCron, aOk := a.(*cron)
+	bCron, bOk := b.(*cron)
+	if aOk && bOk {
+		aFields, bFields := *aCron, *bCron
+		aFields.location, bFields.location = nil, nil
+		return aFields == bFields && sameLocation(aCron.location, bCron.location)
+	}
+	return a == b
+}
+
+// avoidQuiet moves the time out of any quiet hours.
+func (p *Plan) avoidQuiet(t time.Time) time.Time {
+	location := p.Location
+	if location == nil {
+		location = time.Local
+	}
+	t = t.In(location)
+	// Windows may overlap, so repeat until the time is outside all of them.
+	for moved := true; moved; {
+		moved = false
+		for _, window := range p.Quiet {
+			if end := window.end(t); !end.IsZero() {
+				t = end
+				moved = true
+			}
+		}
+	}
+	return t
+}
+
+// Group is a set of books with its own plan.
+type Group struct {
+	Name   string
+	Filter query.Expr // Nil to match all books
+	Plan   *Plan
+
+	// MetadataOnly groups refresh the metadata of the matching books between
+	// their full updates; books are never assigned to them.
+	MetadataOnly bool
+
+	scheduled, run time.Time
+}
+
+// Scheduler tracks when each group of books is next due to be updated.
+type Scheduler struct {
+	lock   sync.Mutex // Protects the times of the groups
+	groups []*Group
+}
+
+// NewScheduler returns a scheduler for the groups, starting at the given time.
+// Books are assigned to the first group with a matching filter.
+func NewScheduler(groups []*Group, now time.Time) *Scheduler {
+	for _, group := range groups {
+		group.scheduled, group.run = group.Plan.Next(now)
+	}
+	return &Scheduler{groups: groups}
+}
+
+// Carry keeps the next run of each group whose name and plan are the same as
+// in the previous scheduler, so that reloading the configuration does not
+// postpone updates.
+func (s *Scheduler) Carry(previous *Scheduler) {
+	previous.lock.Lock()
+	defer previous.lock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, group := range s.groups {
+		for _, old := range previous.groups {
+			if old.Name == group.Name && old.Plan.equal(group.Plan) {
+				group.scheduled, group.run = old.scheduled, old.run
+				break
+			}
+		}
+	}
+}
+
+// Groups returns all the groups.
+func (s *Scheduler) Groups() []*Group {
+	return s.groups
+}
+
+// NextRun returns when the next group is due, or the zero time if none are
+// ever due.
+func (s *Scheduler) NextRun() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var result time.Time
+	for _, group := range s.groups {
+		if !group.run.IsZero() && (result.IsZero() || group.run.Before(result)) {
+			result = group.run
+		}
+	}
+	return result
+}
+
+// Due returns the groups that are due at the given time, and schedules their
+// next run.
+func (s *Scheduler) Due(now time.Time) []*Group {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var result []*Group
+	for _, group := range s.groups {
+		if group.run.IsZero() || group.run.After(now) {
+			continue
+		}
+		result = append(result, group)
+		group.scheduled, group.run = group.Plan.Next(group.scheduled)
+		for !group.run.IsZero() && !group.run.After(now) {
+			// Skip any runs that were missed, e.g. because the previous
+			// update took longer than the interval.
+			group.scheduled, group.run = group.Plan.Next(group.scheduled)
+		}
+	}
+	return result
+}
+
+// Assign returns the group the book belongs to for full updates, or nil if
+// none match.  Groups that are MetadataOnly are ignored.
+func (s *Scheduler) Assign(book model.CalibreBook) *Group {
+	for _, group := range s.groups {
+		if group.MetadataOnly {
+			continue
+		}
+		if group.Filter == nil || group.Filter.Match(book) {
+			return group
+		}
+	}
+	return nil
+}
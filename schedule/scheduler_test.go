@@ -0,0 +1,101 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWindow(t *testing.T) {
+	window, err := ParseWindow("22:00-07:30")
+	require.NoError(t, err)
+	assert.Equal(t, Window{Start: 22 * time.Hour, End: 7*time.Hour + 30*time.Minute}, window)
+	for _, input := range []string{"22:00", "25:00-07:00", "07:00-07:00"} {
+		_, err := ParseWindow(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	quiet, err := ParseWindow("22:00-07:00")
+	require.NoError(t, err)
+	plan := &Plan{
+		Schedule: every(4 * time.Hour),
+		Quiet:    []Window{quiet},
+		Jitter:   10 * time.Minute,
+		Location: time.UTC,
+		random:   func(n int64) int64 { return n / 2 },
+	}
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	scheduled, run := plan.Next(start)
+	assert.Equal(t, time.Date(2022, 6, 1, 16, 0, 0, 0, time.UTC), scheduled)
+	assert.Equal(t, time.Date(2022, 6, 1, 16, 5, 0, 0, time.UTC), run)
+
+	scheduled, run = plan.Next(scheduled)
+	assert.Equal(t, time.Date(2022, 6, 1, 20, 0, 0, 0, time.UTC), scheduled)
+	assert.Equal(t, time.Date(2022, 6, 1, 20, 5, 0, 0, time.UTC), run)
+
+	// 00:00 is in quiet hours, so it is moved to 07:00
+	scheduled, run = plan.Next(scheduled)
+	assert.Equal(t, time.Date(2022, 6, 2, 7, 0, 0, 0, time.UTC), scheduled)
+	assert.Equal(t, time.Date(2022, 6, 2, 7, 5, 0, 0, time.UTC), run)
+}
+
+func TestScheduler(t *testing.T) {
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	ao3 := &Group{Name: "ao3", Filter: query.MustParse("site:ao3"), Plan: &Plan{Schedule: every(time.Hour), Location: time.UTC}}
+	other := &Group{Name: "default", Plan: &Plan{Schedule: every(3 * time.Hour), Location: time.UTC}}
+	scheduler := NewScheduler([]*Group{ao3, other}, start)
+
+	assert.Equal(t, start.Add(time.Hour), scheduler.NextRun())
+	assert.Empty(t, scheduler.Due(start.Add(30*time.Minute)))
+	assert.Equal(t, []*Group{ao3}, scheduler.Due(start.Add(time.Hour)))
+	assert.Equal(t, start.Add(2*time.Hour), scheduler.NextRun())
+	// Missed runs are skipped
+	assert.Equal(t, []*Group{ao3, other}, scheduler.Due(start.Add(5*time.Hour+30*time.Minute)))
+	assert.Equal(t, start.Add(6*time.Hour), scheduler.NextRun())
+
+	book := model.CalibreBook{Identifiers: map[string]string{"url": "https://archiveofourown.org/works/1"}}
+	assert.Equal(t, ao3, scheduler.Assign(book))
+	assert.Equal(t, other, scheduler.Assign(model.CalibreBook{}))
+
+	refresh := &Group{Name: "refresh", MetadataOnly: true, Plan: &Plan{Schedule: every(time.Hour), Location: time.UTC}}
+	scheduler = NewScheduler([]*Group{refresh, ao3, other}, start)
+	assert.Equal(t, ao3, scheduler.Assign(book), "books should never be assigned to metadata-only groups")
+	assert.Equal(t, other, scheduler.Assign(model.CalibreBook{}))
+}
+
+func TestCarry(t *testing.T) {
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	makeScheduler := func(now time.Time, interval time.Duration) *Scheduler {
+		return NewScheduler([]*Group{
+			{Name: "ao3", Plan: &Plan{Schedule: every(time.Hour), Location: time.UTC}},
+			{Name: "default", Plan: &Plan{Schedule: every(interval), Location: time.UTC}},
+		}, now)
+	}
+	previous := makeScheduler(start, 3*time.Hour)
+	assert.Len(t, previous.Due(start.Add(time.Hour)), 1)
+
+	reloaded := makeScheduler(start.Add(90*time.Minute), 3*time.Hour)
+	reloaded.Carry(previous)
+	assert.Equal(t, start.Add(2*time.Hour), reloaded.NextRun(), "unchanged groups should keep their next run")
+	assert.Equal(t, []*Group{reloaded.Groups()[0]}, reloaded.Due(start.Add(2*time.Hour)))
+	assert.Equal(t, start.Add(3*time.Hour), reloaded.NextRun())
+
+	changed := makeScheduler(start.Add(90*time.Minute), 4*time.Hour)
+	changed.Carry(previous)
+	assert.Equal(t, []*Group{changed.Groups()[0]}, changed.Due(start.Add(3*time.Hour)), "changed groups should be rescheduled from the reload")
+	assert.Equal(t, changed.Groups(), changed.Due(start.Add(5*time.Hour+30*time.Minute)))
+
+	cronPlan := func(spec string) *Plan {
+		schedule, err := Parse(spec, time.UTC)
+		require.NoError(t, err)
+		return &Plan{Schedule: schedule, Quiet: []Window{{Start: time.Hour, End: 2 * time.Hour}}}
+	}
+	assert.True(t, cronPlan("0 3 * * *").equal(cronPlan("0 3 * * *")))
+	assert.False(t, cronPlan("0 3 * * *").equal(cronPlan("0 4 * * *")))
+}
@@ -0,0 +1,125 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/util"
+)
+
+// Book is the persisted state for a single book, for information that is not
+// stored in the Calibre library itself.
+type Book struct {
+	Chapters    []model.Chapter `json:"chapters,omitempty"`
+	LastChecked *model.Time3339 `json:"lastChecked,omitempty"`
+	// LastHeld is when an update was last held for review; unlike
+	// LastChecked, it doesn't delay the next check.
+	LastHeld *model.Time3339 `json:"lastHeld,omitempty"`
+
+	// Failures is the number of consecutive failed checks; the remaining
+	// fields describe the latest failure, and are cleared on success.
+	Failures    int              `json:"failures,omitempty"`
+	ErrorClass  model.ErrorClass `json:"errorClass,omitempty"`
+	LastError   string           `json:"lastError,omitempty"`
+	RetryAfter  *model.Time3339  `json:"retryAfter,omitempty"`  // The book is not checked before this time
+	Quarantined bool             `json:"quarantined,omitempty"` // Not checked until the quarantine tag is removed
+
+	// NotFound is the number of consecutive checks where the story was not
+	// found at its source; after enough of them, it is SourceRemoved.
+	NotFound      int  `json:"notFound,omitempty"`
+	SourceRemoved bool `json:"sourceRemoved,omitempty"` // Not checked until model.SourceRemovedTag is removed
+
+	// TagPending is set if the book is SourceRemoved or Quarantined, but the
+	// tag marking it could not be added; it is not checked until it is.
+	TagPending bool `json:"tagPending,omitempty"`
+}
+
+// Store is a collection of book states, saved as a JSON file.  It is safe for
+// concurrent use.
+type Store struct {
+	Path string // Path to the file backing the store; empty to keep in memory.
+
+	lock  sync.Mutex
+	books map[string]Book
+}
+
+// Open loads the store from the given path.  A missing file is treated as an
+// empty store.
+func Open(path string) (*Store, error) {
+	s := &Store{Path: path, books: make(map[string]Book)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read state file %s: %w", path, err)
+	}
+	if err = json.Unmarshal(data, &s.books); err != nil {
+		return nil, fmt.Errorf("could not parse state file %s: %w", path, err)
+	}
+	if s.books == nil {
+		s.books = make(map[string]Book)
+	}
+	return s, nil
+}
+
+// Get returns the state of the book with the given key.  If the book is not
+// known, the zero value is returned.
+func (s *Store) Get(key string) Book {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.books[key]
+}
+
+// Update modifies the state of the book with the given key, and saves the
+// store.
+func (s *Store) Update(key string, mutator func(book *Book)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.books == nil {
+		s.books = make(map[string]Book)
+	}
+	book := s.books[key]
+	mutator(&book)
+	s.books[key] = book
+	return s.save()
+}
+
+// Rename moves the state stored under one key to another, and saves the
+// store.  Nothing is moved if there is no state under the old key, or if there
+// already is state under the new one.
+func (s *Store) Rename(from, to string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	book, ok := s.books[from]
+	if !ok || from == to {
+		return nil
+	}
+	if _, exists := s.books[to]; exists {
+		return nil
+	}
+	s.books[to] = book
+	delete(s.books, from)
+	return s.save()
+}
+
+// save writes the store to disk; the caller must hold the lock.
+func (s *Store) save() error {
+	if s.Path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.books, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not serialize state: %w", err)
+	}
+	if err = util.ReplaceFile(s.Path, data); err != nil {
+		return fmt.Errorf("could not write state file %s: %w", s.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package state_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/state"
+	"github.com/mook/fanficupdates/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	t.Run("missing file", func(t *testing.T) {
+		store, err := state.Open(path.Join(t.TempDir(), "state.json"))
+		require.NoError(t, err)
+		assert.Empty(t, store.Get("book").Chapters)
+	})
+	t.Run("invalid file", func(t *testing.T) {
+		statePath := path.Join(t.TempDir(), "state.json")
+		require.NoError(t, os.WriteFile(statePath, []byte("pikachu"), 0o644))
+		_, err := state.Open(statePath)
+		assert.ErrorContains(t, err, "could not parse state file")
+	})
+	t.Run("round trip", func(t *testing.T) {
+		statePath := path.Join(t.TempDir(), "state.json")
+		store, err := state.Open(statePath)
+		require.NoError(t, err)
+		chapters := []model.Chapter{{Number: 1, Title: "one", URL: "http://x.test/1", Words: 10}}
+		require.NoError(t, store.Update("book", func(book *state.Book) {
+			book.Chapters = chapters
+		}))
+		assert.Equal(t, chapters, store.Get("book").Chapters)
+
+		reopened, err := state.Open(statePath)
+		require.NoError(t, err)
+		assert.Equal(t, chapters, reopened.Get("book").Chapters)
+		assert.Empty(t, reopened.Get("other").Chapters)
+	})
+	t.Run("in memory", func(t *testing.T) {
+		store, err := state.Open("")
+		require.NoError(t, err)
+		require.NoError(t, store.Update("book", func(book *state.Book) {
+			book.LastChecked = model.NewTime3339(util.RandomTime())
+		}))
+		assert.NotNil(t, store.Get("book").LastChecked)
+	})
+	t.Run("rename", func(t *testing.T) {
+		statePath := path.Join(t.TempDir(), "state.json")
+		store, err := state.Open(statePath)
+		require.NoError(t, err)
+		chapters := []model.Chapter{{Number: 1, Title: "one"}}
+		require.NoError(t, store.Update("old", func(book *state.Book) {
+			book.Chapters = chapters
+		}))
+		require.NoError(t, store.Update("taken", func(book *state.Book) {
+			book.Failures = 1
+		}))
+
+		require.NoError(t, store.Rename("missing", "new"))
+		assert.Equal(t, state.Book{}, store.Get("new"))
+		require.NoError(t, store.Rename("old", "taken"))
+		assert.Equal(t, chapters, store.Get("old").Chapters, "existing state should not be replaced")
+		require.NoError(t, store.Rename("old", "new"))
+		assert.Equal(t, chapters, store.Get("new").Chapters)
+		assert.Empty(t, store.Get("old").Chapters)
+
+		reopened, err := state.Open(statePath)
+		require.NoError(t, err)
+		assert.Equal(t, chapters, reopened.Get("new").Chapters)
+	})
+}
@@ -0,0 +1,181 @@
+// Package storyurl normalizes story URLs, so that a story is recognized
+// regardless of which of its pages, or which host name, a URL refers to.
+package storyurl
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/util"
+)
+
+// Story identifies a story at its source.
+type Story struct {
+	URL  string // The canonical URL of the story
+	Key  string // A stable key, such as "ao3:123"; "url:..." for unknown sites
+	Site string // The short site name used in the key, such as "ao3"
+}
+
+// site describes how to recognize stories on a known site.
+type site struct {
+	name      string         // Short name, as used by the query "site:" field
+	domains   []string       // Domains, which include their subdomains
+	path      *regexp.Regexp // Matches the path, capturing the story ID
+	canonical string         // Format of the canonical URL, given the ID
+}
+
+var sites = []site{
+	{"ao3", []string{"archiveofourown.org", "ao3.org"}, regexp.MustCompile(`^/(?:collections/[^/]+/)?works/(\d+)`), "https://archiveofourown.org/works/%s"},
+	{"ffnet", []string{"fanfiction.net"}, regexp.MustCompile(`^/s/(\d+)`), "https://www.fanfiction.net/s/%s/1/"},
+	{"fp", []string{"fictionpress.com"}, regexp.MustCompile(`^/s/(\d+)`), "https://www.fictionpress.com/s/%s/1/"},
+	{"sb", []string{"spacebattles.com"}, regexp.MustCompile(`^/threads/(?:[^/]*\.)?(\d+)`), "https://forums.spacebattles.com/threads/%s/"},
+	{"sv", []string{"sufficientvelocity.com"}, regexp.MustCompile(`^/threads/(?:[^/]*\.)?(\d+)`), "https://forums.sufficientvelocity.com/threads/%s/"},
+	{"qq", []string{"questionablequesting.com"}, regexp.MustCompile(`^/threads/(?:[^/]*\.)?(\d+)`), "https://forum.questionablequesting.com/threads/%s/"},
+	{"rr", []string{"royalroad.com"}, regexp.MustCompile(`^/fiction/(\d+)`), "https://www.royalroad.com/fiction/%s"},
+}
+
+// aliases are other short names for known sites, keyed by the alias.
+var aliases = map[string]string{
+	"ffn": "ffnet",
+}
+
+// SiteNames returns the short names of the known site at the given host, such
+// as "ao3", including aliases, sorted; nil if the host is not a known site.
+func SiteNames(host string) []string {
+	host = strings.ToLower(host)
+	var result []string
+	for _, s := range sites {
+		if !util.Any(s.domains, func(domain string) bool { return matchDomain(host, domain) }) {
+			continue
+		}
+		result = append(result, s.name)
+		for alias, name := range aliases {
+			if name == s.name {
+				result = append(result, alias)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// numberPattern matches the story ID in URLs of sites without built-in rules.
+var numberPattern = regexp.MustCompile(`\d+`)
+
+// matchDomain returns whether the host is the domain or one of its subdomains.
+func matchDomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// Parse normalizes the given story URL using the built-in rules for known
+// sites; other URLs are only cleaned up (the host is lowercased and the
+// fragment removed), and have keys based on the host and path.  Returns false
+// if the input is not an absolute URL.
+func Parse(raw string) (Story, bool) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return Story{}, false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, s := range sites {
+		for _, domain := range s.domains {
+			if !matchDomain(host, domain) {
+				continue
+			}
+			if match := s.path.FindStringSubmatch(u.EscapedPath()); match != nil {
+				return Story{
+					URL:  fmt.Sprintf(s.canonical, match[1]),
+					Key:  s.name + ":" + match[1],
+					Site: s.name,
+				}, true
+			}
+		}
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	u.RawFragment = ""
+	keyHost := strings.TrimPrefix(strings.TrimPrefix(host, "www."), "m.")
+	key := "url:" + keyHost + strings.TrimSuffix(u.EscapedPath(), "/")
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return Story{URL: u.String(), Key: key, Site: keyHost}, true
+}
+
+// ID returns the ID of the story at its source: the ID captured by the
+// built-in rule for known sites, or the first number in the path or query for
+// others.  It is empty if there is none.
+func (s Story) ID() string {
+	if isKnown(s) {
+		return strings.TrimPrefix(s.Key, s.Site+":")
+	}
+	return numberPattern.FindString(strings.TrimPrefix(s.Key, "url:"+s.Site))
+}
+
+// Book returns the normalized story for the book's url identifier, using the
+// built-in rules; see Parse().
+func Book(book model.CalibreBook) (Story, bool) {
+	raw, ok := book.Identifiers["url"]
+	if !ok {
+		return Story{}, false
+	}
+	return Parse(raw)
+}
+
+// Normalizer normalizes story URLs, using an external resolver (normally
+// FanFicFare) for sites without built-in rules.  Resolved URLs are cached.  It
+// is safe for concurrent use.
+type Normalizer struct {
+	// Resolve returns the canonical URL of the story at the given URL; if nil,
+	// only the built-in rules are used.
+	Resolve func(ctx context.Context, raw string) (string, error)
+
+	lock  sync.Mutex
+	cache map[string]string // Resolved URLs, keyed by the input
+}
+
+// Normalize returns the normalized story for the given URL.  URLs on known
+// sites are normalized with the built-in rules; others are first resolved, and
+// if that fails, they are normalized as if unknown.
+func (n *Normalizer) Normalize(ctx context.Context, raw string) (Story, bool) {
+	story, ok := Parse(raw)
+	if !ok || n == nil || n.Resolve == nil || isKnown(story) {
+		return story, ok
+	}
+	n.lock.Lock()
+	resolved, cached := n.cache[raw]
+	n.lock.Unlock()
+	if !cached {
+		var err error
+		if resolved, err = n.Resolve(ctx, raw); err != nil {
+			// Don't cache failures, which may be transient.
+			return story, ok
+		}
+		n.lock.Lock()
+		if n.cache == nil {
+			n.cache = make(map[string]string)
+		}
+		n.cache[raw] = resolved
+		n.lock.Unlock()
+	}
+	if normalized, ok := Parse(resolved); ok {
+		return normalized, true
+	}
+	return story, ok
+}
+
+// isKnown returns whether the story was normalized by a built-in rule.
+func isKnown(story Story) bool {
+	for _, s := range sites {
+		if story.Site == s.name {
+			return true
+		}
+	}
+	return false
+}
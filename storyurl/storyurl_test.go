@@ -0,0 +1,114 @@
+package storyurl
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		input string
+		story Story
+	}{
+		{"https://archiveofourown.org/works/123", Story{"https://archiveofourown.org/works/123", "ao3:123", "ao3"}},
+		{"http://www.archiveofourown.org/works/123/chapters/456#workskin", Story{"https://archiveofourown.org/works/123", "ao3:123", "ao3"}},
+		{"https://archiveofourown.org/collections/thing/works/123", Story{"https://archiveofourown.org/works/123", "ao3:123", "ao3"}},
+		{"https://m.fanfiction.net/s/456/3/Some-Title", Story{"https://www.fanfiction.net/s/456/1/", "ffnet:456", "ffnet"}},
+		{"https://www.fictionpress.com/s/789/1/", Story{"https://www.fictionpress.com/s/789/1/", "fp:789", "fp"}},
+		{"https://forums.spacebattles.com/threads/some-story.1234/page-5", Story{"https://forums.spacebattles.com/threads/1234/", "sb:1234", "sb"}},
+		{"https://forums.sufficientvelocity.com/threads/1234/", Story{"https://forums.sufficientvelocity.com/threads/1234/", "sv:1234", "sv"}},
+		{"https://forum.questionablequesting.com/threads/story.99/threadmarks", Story{"https://forum.questionablequesting.com/threads/99/", "qq:99", "qq"}},
+		{"https://www.royalroad.com/fiction/42/title/chapter/1", Story{"https://www.royalroad.com/fiction/42", "rr:42", "rr"}},
+		{"https://WWW.Example.com/story/1/#top", Story{"https://www.example.com/story/1/", "url:example.com/story/1", "example.com"}},
+		{"https://example.com/viewstory.php?sid=5", Story{"https://example.com/viewstory.php?sid=5", "url:example.com/viewstory.php?sid=5", "example.com"}},
+		{"https://archiveofourown.org/users/someone", Story{"https://archiveofourown.org/users/someone", "url:archiveofourown.org/users/someone", "archiveofourown.org"}},
+	}
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			story, ok := Parse(c.input)
+			assert.True(t, ok)
+			assert.Equal(t, c.story, story)
+		})
+	}
+	for _, input := range []string{"", "not a url", "/works/123"} {
+		_, ok := Parse(input)
+		assert.False(t, ok, "%q should not parse", input)
+	}
+
+	story, ok := Book(model.CalibreBook{Identifiers: map[string]string{"url": "https://archiveofourown.org/works/1"}})
+	assert.True(t, ok)
+	assert.Equal(t, "ao3:1", story.Key)
+	_, ok = Book(model.CalibreBook{})
+	assert.False(t, ok)
+}
+
+func TestNormalizer(t *testing.T) {
+	ctx := context.Background()
+	var calls []string
+	subject := &Normalizer{
+		Resolve: func(ctx context.Context, raw string) (string, error) {
+			calls = append(calls, raw)
+			switch raw {
+			case "https://example.com/chapter/2":
+				return "https://example.com/story/1", nil
+			case "https://mirror.example/works/5":
+				return "https://archiveofourown.org/works/5", nil
+			}
+			return "", errors.New("failed")
+		},
+	}
+
+	story, ok := subject.Normalize(ctx, "https://archiveofourown.org/works/1")
+	assert.True(t, ok)
+	assert.Equal(t, "ao3:1", story.Key)
+	assert.Empty(t, calls, "known sites should not be resolved")
+
+	for i := 0; i < 2; i++ {
+		story, ok = subject.Normalize(ctx, "https://example.com/chapter/2")
+		assert.True(t, ok)
+		assert.Equal(t, "url:example.com/story/1", story.Key)
+	}
+	assert.Equal(t, []string{"https://example.com/chapter/2"}, calls, "results should be cached")
+
+	story, _ = subject.Normalize(ctx, "https://mirror.example/works/5")
+	assert.Equal(t, "ao3:5", story.Key, "resolved URLs should use the built-in rules")
+
+	calls = nil
+	for i := 0; i < 2; i++ {
+		story, ok = subject.Normalize(ctx, "https://broken.example/story")
+		assert.True(t, ok)
+		assert.Equal(t, "url:broken.example/story", story.Key)
+	}
+	assert.Len(t, calls, 2, "failures should not be cached")
+
+	var nilNormalizer *Normalizer
+	story, ok = nilNormalizer.Normalize(ctx, "https://example.com/chapter/2")
+	assert.True(t, ok)
+	assert.Equal(t, "url:example.com/chapter/2", story.Key)
+}
+
+func TestStoryID(t *testing.T) {
+	cases := map[string]string{
+		"https://archiveofourown.org/works/123/chapters/456": "123",
+		"https://forums.spacebattles.com/threads/story.99/":  "99",
+		"https://www2.example.com/viewstory.php?sid=5":       "5",
+		"https://example.com/s/7/chapter/2":                  "7",
+		"https://example.com/about":                          "",
+	}
+	for input, expected := range cases {
+		story, ok := Parse(input)
+		require.True(t, ok)
+		assert.Equal(t, expected, story.ID(), input)
+	}
+}
+
+func TestSiteNames(t *testing.T) {
+	assert.Equal(t, []string{"ao3"}, SiteNames("archiveofourown.org"))
+	assert.Equal(t, []string{"ffn", "ffnet"}, SiteNames("M.FanFiction.net"))
+	assert.Nil(t, SiteNames("example.com"))
+}
@@ -0,0 +1,119 @@
+package updater
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/storyurl"
+)
+
+// SiteLimit restricts how often books from a single site are checked.
+type SiteLimit struct {
+	Delay     time.Duration // Minimum time between checks of books from the site
+	MaxPerRun int           // Maximum number of books checked per run; 0 for no limit
+}
+
+// SiteLimiter enforces the delay between checks of books from the same site.
+// It may be shared between multiple updaters (e.g. for different libraries),
+// in which case the delay applies across all of them.  A nil *SiteLimiter
+// imposes no limits.
+type SiteLimiter struct {
+	lock   sync.Mutex
+	limits map[string]SiteLimit // Keyed by host name
+	next   map[string]time.Time // Earliest time the next check may start
+
+	now   func() time.Time                                 // For testing
+	sleep func(ctx context.Context, d time.Duration) error // For testing
+}
+
+// NewSiteLimiter returns a limiter with the given limits, keyed by host name;
+// a key also applies to its subdomains.
+func NewSiteLimiter(limits map[string]SiteLimit) *SiteLimiter {
+	result := &SiteLimiter{next: make(map[string]time.Time)}
+	result.SetLimits(limits)
+	return result
+}
+
+// SetLimits replaces the limits, e.g. when the configuration is reloaded.
+func (l *SiteLimiter) SetLimits(limits map[string]SiteLimit) {
+	normalized := make(map[string]SiteLimit, len(limits))
+	for site, limit := range limits {
+		normalized[strings.ToLower(site)] = limit
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limits = normalized
+}
+
+func (l *SiteLimiter) currentTime() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// Site returns the site of the book for the purposes of limiting, and the
+// applicable limit.  The host of the canonical story URL is used, so that
+// mobile and desktop links share limits.
+func (l *SiteLimiter) Site(book model.CalibreBook) (string, SiteLimit) {
+	story, ok := storyurl.Book(book)
+	if !ok {
+		return "", SiteLimit{}
+	}
+	link, err := url.Parse(story.URL)
+	if err != nil {
+		return "", SiteLimit{}
+	}
+	host := strings.ToLower(link.Hostname())
+	if l == nil {
+		return host, SiteLimit{}
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for site, limit := range l.limits {
+		if host == site || strings.HasSuffix(host, "."+site) {
+			return site, limit
+		}
+	}
+	return host, SiteLimit{}
+}
+
+// Wait blocks until a book from the given site (as returned by Site) may be
+// checked, returning early with an error if the context is cancelled.
+func (l *SiteLimiter) Wait(ctx context.Context, site string) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	l.lock.Lock()
+	limit := l.limits[site]
+	now := l.currentTime()
+	start := now
+	if next, ok := l.next[site]; ok && next.After(now) {
+		start = next
+	}
+	// Reserve the slot before waiting, so that concurrent callers queue up.
+	if limit.Delay > 0 {
+		l.next[site] = start.Add(limit.Delay)
+	}
+	l.lock.Unlock()
+
+	remaining := start.Sub(now)
+	if remaining <= 0 {
+		return ctx.Err()
+	}
+	if l.sleep != nil {
+		return l.sleep(ctx, remaining)
+	}
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,227 @@
+package updater
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/state"
+)
+
+// QuarantineTag is added to books that are quarantined after repeated
+// failures; they are not checked again until the tag is removed.
+const QuarantineTag = "fanficupdates:error"
+
+// DefaultSourceRemovedAfter is the number of consecutive checks where a story
+// is not found before it is marked as removed from its source.
+const DefaultSourceRemovedAfter = 3
+
+// RetryPolicy determines when a book is checked again after it fails.
+type RetryPolicy struct {
+	Backoff    time.Duration // Delay after the first failure, doubled for each further one
+	MaxBackoff time.Duration // Maximum delay; 0 for no limit
+	Quarantine int           // Consecutive failures before quarantining; 0 to never quarantine
+}
+
+// DefaultRetryPolicies are used for classes of failures without a configured
+// policy.
+var DefaultRetryPolicies = map[model.ErrorClass]RetryPolicy{
+	model.ErrorNotFound:      {Backoff: 24 * time.Hour, MaxBackoff: 30 * 24 * time.Hour, Quarantine: 3},
+	model.ErrorLoginRequired: {Backoff: 24 * time.Hour, MaxBackoff: 7 * 24 * time.Hour, Quarantine: 5},
+	model.ErrorAdultCheck:    {Backoff: 24 * time.Hour, MaxBackoff: 7 * 24 * time.Hour, Quarantine: 5},
+	model.ErrorSiteDown:      {Backoff: time.Hour, MaxBackoff: 24 * time.Hour},
+	model.ErrorCloudflare:    {Backoff: 6 * time.Hour, MaxBackoff: 3 * 24 * time.Hour, Quarantine: 10},
+	model.ErrorParse:         {Backoff: 12 * time.Hour, MaxBackoff: 7 * 24 * time.Hour, Quarantine: 5},
+	model.ErrorCalibreWrite:  {Backoff: time.Hour, MaxBackoff: 24 * time.Hour, Quarantine: 5},
+	model.ErrorUnknown:       {Backoff: 6 * time.Hour, MaxBackoff: 7 * 24 * time.Hour, Quarantine: 10},
+}
+
+// Delay returns how long to wait before checking a book again after the given
+// number of consecutive failures.
+func (p RetryPolicy) Delay(failures int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < failures && delay > 0 && delay < math.MaxInt64/2; i++ {
+		delay *= 2
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+// retryPolicy returns the policy for the given class of failure.
+func (u *Updater) retryPolicy(class model.ErrorClass) RetryPolicy {
+	if policy, ok := u.RetryPolicies[class]; ok {
+		return policy
+	}
+	if policy, ok := DefaultRetryPolicies[class]; ok {
+		return policy
+	}
+	return DefaultRetryPolicies[model.ErrorUnknown]
+}
+
+// clearFailures resets the failure streak of a book, including any
+// quarantine or removal.
+func clearFailures(book *state.Book) {
+	book.Failures = 0
+	book.ErrorClass = ""
+	book.LastError = ""
+	book.RetryAfter = nil
+	book.Quarantined = false
+	book.NotFound = 0
+	book.SourceRemoved = false
+	book.TagPending = false
+}
+
+// retryDue returns whether a book that previously failed may be checked again.
+func (u *Updater) retryDue(ctx context.Context, book model.CalibreBook) bool {
+	if book.HasTag(model.SourceRemovedTag) {
+		u.logger().Debugf("Skipping %s: removed from its source", book.Title)
+		return false
+	}
+	if book.HasTag(QuarantineTag) {
+		u.logger().Debugf("Skipping %s: quarantined after repeated failures", book.Title)
+		return false
+	}
+	if u.Store == nil {
+		return true
+	}
+	key := u.key(book)
+	previous := u.Store.Get(key)
+	if previous.TagPending {
+		// The tag must be on the book before its removal can release it.
+		u.logger().Debugf("Skipping %s: removed from its source or quarantined", book.Title)
+		u.applyTag(ctx, key, book, previous)
+		return false
+	}
+	if previous.SourceRemoved || previous.Quarantined {
+		if u.Library == nil {
+			// Without the tag, this can't be undone by the user.
+			u.logger().Debugf("Skipping %s: removed from its source or quarantined", book.Title)
+			return false
+		}
+		u.logger().Infof("Tag was removed from %s, checking it again", book.Title)
+		if err := u.Store.Update(key, clearFailures); err != nil {
+			u.logger().Errorf("could not save state for %s: %v", book.Title, err)
+		}
+		return true
+	}
+	if previous.RetryAfter != nil && u.currentTime().Before(previous.RetryAfter.Time) {
+		u.logger().Debugf("Skipping %s until %s after %d failures (%s)",
+			book.Title, previous.RetryAfter, previous.Failures, previous.ErrorClass)
+		return false
+	}
+	return true
+}
+
+// recordResult tracks consecutive failures of the book, backing off before
+// checking it again and eventually quarantining it, or marking it as removed
+// from its source if it was repeatedly not found.
+func (u *Updater) recordResult(ctx context.Context, book model.CalibreBook, result model.UpdateResult, resultErr error) {
+	if u.Store == nil {
+		return
+	}
+	book = u.followURL(book, result.NewURL)
+	if u.MetadataOnly {
+		return
+	}
+	key := u.key(book)
+	switch result.Outcome {
+	case model.OutcomeUpdated, model.OutcomeUpToDate, model.OutcomeHeld:
+		if u.Store.Get(key).Failures > 0 {
+			if err := u.Store.Update(key, clearFailures); err != nil {
+				u.logger().Errorf("could not save state for %s: %v", book.Title, err)
+			}
+		}
+		return
+	case model.OutcomeFailed:
+	default:
+		return
+	}
+	policy := u.retryPolicy(result.ErrorClass)
+	removedAfter := u.SourceRemovedAfter
+	if removedAfter == 0 {
+		removedAfter = DefaultSourceRemovedAfter
+	}
+	removed, quarantine := false, false
+	var failures int
+	err := u.Store.Update(key, func(state *state.Book) {
+		state.Failures++
+		state.ErrorClass = result.ErrorClass
+		if resultErr != nil {
+			state.LastError = resultErr.Error()
+		}
+		state.RetryAfter = model.NewTime3339(u.currentTime().Add(policy.Delay(state.Failures)))
+		if result.ErrorClass == model.ErrorNotFound {
+			state.NotFound++
+		} else {
+			state.NotFound = 0
+		}
+		if state.SourceRemoved || state.Quarantined {
+			// Already handled
+		} else if removedAfter > 0 && state.NotFound >= removedAfter {
+			state.SourceRemoved = true
+			removed = true
+		} else if policy.Quarantine > 0 && state.Failures >= policy.Quarantine {
+			state.Quarantined = true
+			quarantine = true
+		}
+		failures = state.Failures
+	})
+	if err != nil {
+		u.logger().Errorf("could not save state for %s: %v", book.Title, err)
+	}
+	if removed {
+		u.logger().Warnf("Marking %s as removed from its source after %d checks; remove the %s tag to check it again",
+			book.Title, failures, model.SourceRemovedTag)
+	} else if quarantine {
+		u.logger().Warnf("Quarantining %s after %d consecutive failures (%s); remove the %s tag to check it again",
+			book.Title, failures, result.ErrorClass, QuarantineTag)
+	}
+	if removed || quarantine {
+		u.applyTag(ctx, key, book, u.Store.Get(key))
+	}
+}
+
+// applyTag adds the tag for the removed or quarantined state of the book, and
+// records in the state whether that is still pending.
+func (u *Updater) applyTag(ctx context.Context, key string, book model.CalibreBook, previous state.Book) {
+	tag := QuarantineTag
+	if previous.SourceRemoved {
+		tag = model.SourceRemovedTag
+	}
+	pending := !u.addTag(ctx, book, tag)
+	if pending == previous.TagPending {
+		return
+	}
+	err := u.Store.Update(key, func(state *state.Book) {
+		state.TagPending = pending
+	})
+	if err != nil {
+		u.logger().Errorf("could not save state for %s: %v", book.Title, err)
+	}
+}
+
+// addTag adds the tag to the book in the library, if there is one, returning
+// whether the book has the tag.
+func (u *Updater) addTag(ctx context.Context, book model.CalibreBook, tag string) bool {
+	if book.HasTag(tag) {
+		return true
+	}
+	if u.Library == nil {
+		return false
+	}
+	tags := append(append([]string(nil), book.Tags...), tag)
+	meta := calibre.UpdateMeta{Fields: map[string]string{"tags": strings.Join(tags, ",")}}
+	if err := u.Library.UpdateMetadata(ctx, book.Id, meta); err != nil {
+		u.logger().Errorf("could not tag %s as %s: %v", book.Title, tag, err)
+		return false
+	}
+	return true
+}
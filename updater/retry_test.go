@@ -0,0 +1,239 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/calibre/memory"
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/state"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{Backoff: time.Hour, MaxBackoff: 5 * time.Hour}
+	assert.Equal(t, time.Hour, policy.Delay(1))
+	assert.Equal(t, 2*time.Hour, policy.Delay(2))
+	assert.Equal(t, 4*time.Hour, policy.Delay(3))
+	assert.Equal(t, 5*time.Hour, policy.Delay(4))
+	assert.Equal(t, 5*time.Hour, policy.Delay(1000))
+	assert.Positive(t, RetryPolicy{Backoff: time.Hour}.Delay(1000))
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	library := memory.NewLibrary(model.CalibreBook{Id: 1, Uuid: "book", Title: "Broken", Tags: []string{"wip"}})
+	getBook := func() model.CalibreBook {
+		books, err := library.GetBooks(ctx)
+		require.NoError(t, err)
+		return books[0]
+	}
+	store, err := state.Open("")
+	require.NoError(t, err)
+	logger, _ := test.NewNullLogger()
+	processor := &fakeProcessor{result: fmt.Errorf("gone"), class: model.ErrorNotFound}
+	u := &Updater{
+		Processor: processor,
+		Store:     store,
+		Logger:    logger,
+		Library:   library,
+		RetryPolicies: map[model.ErrorClass]RetryPolicy{
+			model.ErrorNotFound: {Backoff: time.Hour, Quarantine: 2},
+		},
+		now: func() time.Time { return now },
+	}
+
+	u.Update(ctx, []model.CalibreBook{getBook()})
+	require.Len(t, processor.calls, 1)
+	assert.Equal(t, 1, store.Get("book").Failures)
+	assert.Equal(t, model.ErrorNotFound, store.Get("book").ErrorClass)
+	assert.Equal(t, "gone", store.Get("book").LastError)
+
+	// Backing off
+	now = now.Add(30 * time.Minute)
+	u.Update(ctx, []model.CalibreBook{getBook()})
+	assert.Len(t, processor.calls, 1)
+
+	// Second failure quarantines the book
+	now = now.Add(time.Hour)
+	u.Update(ctx, []model.CalibreBook{getBook()})
+	assert.Len(t, processor.calls, 2)
+	assert.True(t, store.Get("book").Quarantined)
+	assert.Equal(t, []string{"wip", QuarantineTag}, getBook().Tags)
+
+	// Quarantined books are not checked, even after the backoff
+	now = now.Add(30 * 24 * time.Hour)
+	u.Update(ctx, []model.CalibreBook{getBook()})
+	assert.Len(t, processor.calls, 2)
+
+	// Removing the tag releases the book, and success clears the failures
+	require.NoError(t, library.UpdateMetadata(ctx, 1, calibre.UpdateMeta{Fields: map[string]string{"tags": "wip"}}))
+	processor.result = nil
+	u.Update(ctx, []model.CalibreBook{getBook()})
+	assert.Len(t, processor.calls, 3)
+	assert.Equal(t, state.Book{}, store.Get("book"))
+}
+
+func TestSourceRemoved(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	library := memory.NewLibrary(model.CalibreBook{Id: 1, Uuid: "book", Title: "Gone"})
+	getBook := func() model.CalibreBook {
+		books, err := library.GetBooks(ctx)
+		require.NoError(t, err)
+		return books[0]
+	}
+	store, err := state.Open("")
+	require.NoError(t, err)
+	logger, _ := test.NewNullLogger()
+	processor := &fakeProcessor{result: fmt.Errorf("site down"), class: model.ErrorSiteDown}
+	u := &Updater{
+		Processor:          processor,
+		Store:              store,
+		Logger:             logger,
+		Library:            library,
+		SourceRemovedAfter: 2,
+		RetryPolicies: map[model.ErrorClass]RetryPolicy{
+			model.ErrorNotFound: {Backoff: time.Hour},
+			model.ErrorSiteDown: {Backoff: time.Hour},
+		},
+		now: func() time.Time { return now },
+	}
+	check := func(class model.ErrorClass) {
+		processor.class = class
+		now = now.Add(365 * 24 * time.Hour) // Past any backoff
+		u.Update(ctx, []model.CalibreBook{getBook()})
+	}
+
+	// Other failures interrupt the streak
+	check(model.ErrorNotFound)
+	check(model.ErrorSiteDown)
+	check(model.ErrorNotFound)
+	assert.Equal(t, 1, store.Get("book").NotFound)
+	assert.False(t, store.Get("book").SourceRemoved)
+
+	check(model.ErrorNotFound)
+	assert.True(t, store.Get("book").SourceRemoved)
+	assert.False(t, store.Get("book").Quarantined)
+	assert.Equal(t, []string{model.SourceRemovedTag}, getBook().Tags)
+	assert.Len(t, processor.calls, 4)
+
+	// Removed books are no longer checked
+	check(model.ErrorNotFound)
+	assert.Len(t, processor.calls, 4)
+}
+
+func TestMetadataOnlyResults(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	library := memory.NewLibrary(model.CalibreBook{Id: 1, Uuid: "book", Title: "Broken", Tags: []string{"wip"}})
+	getBook := func() model.CalibreBook {
+		books, err := library.GetBooks(ctx)
+		require.NoError(t, err)
+		return books[0]
+	}
+	store, err := state.Open("")
+	require.NoError(t, err)
+	logger, _ := test.NewNullLogger()
+	processor := &fakeProcessor{result: fmt.Errorf("broken"), class: model.ErrorParse}
+	u := &Updater{
+		Processor:    processor,
+		Store:        store,
+		Logger:       logger,
+		Library:      library,
+		MetadataOnly: true,
+		RetryPolicies: map[model.ErrorClass]RetryPolicy{
+			model.ErrorParse:    {Backoff: time.Hour, Quarantine: 1},
+			model.ErrorSiteDown: {Backoff: time.Hour},
+		},
+		now: func() time.Time { return now },
+	}
+
+	// Failed refreshes are not recorded
+	u.Update(ctx, []model.CalibreBook{getBook()})
+	u.Update(ctx, []model.CalibreBook{getBook()})
+	assert.Len(t, processor.calls, 2)
+	assert.Equal(t, state.Book{}, store.Get("book"))
+	assert.Equal(t, []string{"wip"}, getBook().Tags)
+
+	// Successful refreshes don't clear failures of full updates
+	u.MetadataOnly = false
+	processor.class = model.ErrorSiteDown
+	u.Update(ctx, []model.CalibreBook{getBook()})
+	require.Equal(t, 1, store.Get("book").Failures)
+	u.MetadataOnly = true
+	processor.result = nil
+	now = now.Add(30 * 24 * time.Hour)
+	u.Update(ctx, []model.CalibreBook{getBook()})
+	assert.Len(t, processor.calls, 4)
+	assert.Equal(t, 1, store.Get("book").Failures)
+}
+
+// readOnlyLibrary is a library whose metadata can't be updated while readOnly
+// is set.
+type readOnlyLibrary struct {
+	*memory.Library
+	readOnly bool
+}
+
+func (l *readOnlyLibrary) UpdateMetadata(ctx context.Context, id int, meta calibre.UpdateMeta) error {
+	if l.readOnly {
+		return fmt.Errorf("library is read-only")
+	}
+	return l.Library.UpdateMetadata(ctx, id, meta)
+}
+
+func TestQuarantineTagFailure(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	library := &readOnlyLibrary{Library: memory.NewLibrary(model.CalibreBook{Id: 1, Uuid: "book", Title: "Broken", Tags: []string{"wip"}}), readOnly: true}
+	getBook := func() model.CalibreBook {
+		books, err := library.GetBooks(ctx)
+		require.NoError(t, err)
+		return books[0]
+	}
+	store, err := state.Open("")
+	require.NoError(t, err)
+	logger, _ := test.NewNullLogger()
+	processor := &fakeProcessor{result: fmt.Errorf("broken"), class: model.ErrorParse}
+	u := &Updater{
+		Processor: processor,
+		Store:     store,
+		Logger:    logger,
+		Library:   library,
+		RetryPolicies: map[model.ErrorClass]RetryPolicy{
+			model.ErrorParse: {Backoff: time.Hour, Quarantine: 1},
+		},
+		now: func() time.Time { return now },
+	}
+
+	u.Update(ctx, []model.CalibreBook{getBook()})
+	require.Len(t, processor.calls, 1)
+	assert.True(t, store.Get("book").Quarantined)
+	assert.True(t, store.Get("book").TagPending)
+	assert.Equal(t, []string{"wip"}, getBook().Tags)
+
+	// The missing tag doesn't release the book, as it was never added
+	now = now.Add(30 * 24 * time.Hour)
+	u.Update(ctx, []model.CalibreBook{getBook()})
+	assert.Len(t, processor.calls, 1)
+	assert.True(t, store.Get("book").Quarantined)
+
+	// Once the tag can be added, removing it releases the book
+	library.readOnly = false
+	u.Update(ctx, []model.CalibreBook{getBook()})
+	assert.Len(t, processor.calls, 1)
+	assert.Equal(t, []string{"wip", QuarantineTag}, getBook().Tags)
+	assert.False(t, store.Get("book").TagPending)
+	require.NoError(t, library.UpdateMetadata(ctx, 1, calibre.UpdateMeta{Fields: map[string]string{"tags": "wip"}}))
+	processor.result = nil
+	u.Update(ctx, []model.CalibreBook{getBook()})
+	assert.Len(t, processor.calls, 2)
+	assert.Equal(t, state.Book{}, store.Get("book"))
+}
@@ -0,0 +1,194 @@
+package updater
+
+import (
+	"context"
+	"time"
+
+	"github.com/mook/fanficupdates/calibre"
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/rules"
+	"github.com/mook/fanficupdates/state"
+	"github.com/sirupsen/logrus"
+)
+
+// Processor updates a single book; this is normally *fanficfare.FanFicFare.
+type Processor interface {
+	Process(ctx context.Context, book model.CalibreBook, extraArgs ...string) (model.UpdateResult, error)
+}
+
+// Updater checks books for updates, applying the configured rules to decide
+// which books to check and how.
+type Updater struct {
+	Processor Processor
+	Rules     rules.Rules
+	Store     *state.Store // Used to find when a book was last checked
+	Logger    *logrus.Logger
+
+	// Limiter limits the checks of books from each site; it may be shared
+	// between updaters.
+	Limiter *SiteLimiter
+
+	// RetryPolicies determine when books are checked again after each class
+	// of failure; classes not listed use DefaultRetryPolicies.  Failures are
+	// only tracked if there is a Store.
+	RetryPolicies map[model.ErrorClass]RetryPolicy
+
+	// SourceRemovedAfter is the number of consecutive checks where the story
+	// is not found before it is marked as removed from its source; if 0,
+	// DefaultSourceRemovedAfter is used, and if negative, never.
+	SourceRemovedAfter int
+
+	// MetadataOnly is set if the processor only refreshes metadata; its
+	// results are then not recorded for retries, quarantine or removal from
+	// the source, which track full updates.
+	MetadataOnly bool
+
+	// Library, if set, is used to tag books with QuarantineTag or
+	// model.SourceRemovedTag.
+	Library calibre.Library
+
+	// OnResult, if set, is called with the result of each book checked by
+	// Update, including failures.
+	OnResult func(result model.UpdateResult)
+	// StateKey returns the key the processor uses to store the state of a
+	// book; if nil, the book UUID is used.
+	StateKey func(book model.CalibreBook) string
+
+	now func() time.Time // For testing
+}
+
+func (u *Updater) logger() *logrus.Logger {
+	if u.Logger == nil {
+		return logrus.StandardLogger()
+	}
+	return u.Logger
+}
+
+// key returns the key used to store the state of the book.
+func (u *Updater) key(book model.CalibreBook) string {
+	if u.StateKey != nil {
+		return u.StateKey(book)
+	}
+	return book.Uuid
+}
+
+// migrateState moves any state stored under the book UUID, as used before
+// state was keyed by story, to the current key.
+func (u *Updater) migrateState(book model.CalibreBook) {
+	if u.Store == nil || book.Uuid == "" {
+		return
+	}
+	if key := u.key(book); key != book.Uuid {
+		if err := u.Store.Rename(book.Uuid, key); err != nil {
+			u.logger().Errorf("could not move state of %s to %s: %v", book.Title, key, err)
+		}
+	}
+}
+
+// followURL moves the state of a book whose story URL was changed to the key
+// for the new URL, as keys are derived from the URL on sites without built-in
+// rules.  It returns the book with the new URL.
+func (u *Updater) followURL(book model.CalibreBook, newURL string) model.CalibreBook {
+	if newURL == "" || newURL == book.Identifiers["url"] {
+		return book
+	}
+	moved := book
+	moved.Identifiers = map[string]string{"url": newURL}
+	for key, value := range book.Identifiers {
+		if key != "url" {
+			moved.Identifiers[key] = value
+		}
+	}
+	if from, to := u.key(book), u.key(moved); from != to {
+		if err := u.Store.Rename(from, to); err != nil {
+			u.logger().Errorf("could not move state of %s to %s: %v", book.Title, to, err)
+		}
+	}
+	return moved
+}
+
+// lastChecked returns when the book was last checked, or the zero time if it
+// is unknown.
+func (u *Updater) lastChecked(book model.CalibreBook) time.Time {
+	if u.Store == nil {
+		return time.Time{}
+	}
+	if checked := u.Store.Get(u.key(book)).LastChecked; checked != nil {
+		return checked.Time
+	}
+	return time.Time{}
+}
+
+func (u *Updater) currentTime() time.Time {
+	if u.now != nil {
+		return u.now()
+	}
+	return time.Now()
+}
+
+// evaluate applies the rules to the book, returning the extra arguments for
+// the processor and whether the book should be checked.
+func (u *Updater) evaluate(ctx context.Context, book model.CalibreBook) ([]string, bool) {
+	u.migrateState(book)
+	if !u.retryDue(ctx, book) {
+		return nil, false
+	}
+	decision := u.Rules.Evaluate(book)
+	if decision.Skip {
+		u.logger().Debugf("Skipping %s due to rules %v", book.Title, decision.Matched)
+		return nil, false
+	}
+	if decision.Interval > 0 {
+		if next := u.lastChecked(book).Add(decision.Interval); u.currentTime().Before(next) {
+			u.logger().Debugf("Skipping %s until %s due to rules %v", book.Title, next, decision.Matched)
+			return nil, false
+		}
+	}
+	return decision.Args, true
+}
+
+// UpdateBook evaluates the rules for the book, and if appropriate, checks it
+// for updates.  If the rules skip the book, the outcome is
+// model.OutcomeSkipped.  Site limits are not applied.
+func (u *Updater) UpdateBook(ctx context.Context, book model.CalibreBook) (model.UpdateResult, error) {
+	args, ok := u.evaluate(ctx, book)
+	if !ok {
+		return model.UpdateResult{BookId: book.Id, Title: book.Title, Outcome: model.OutcomeSkipped}, nil
+	}
+	result, err := u.Processor.Process(ctx, book, args...)
+	u.recordResult(ctx, book, result, err)
+	return result, err
+}
+
+// Update checks each of the given books for updates, logging any errors.
+func (u *Updater) Update(ctx context.Context, books []model.CalibreBook) {
+	checked := make(map[string]int)
+	for _, book := range books {
+		if ctx.Err() != nil {
+			return
+		}
+		site, limit := u.Limiter.Site(book)
+		if limit.MaxPerRun > 0 && checked[site] >= limit.MaxPerRun {
+			u.logger().Debugf("Skipping %s: already checked %d books from %s", book.Title, checked[site], site)
+			continue
+		}
+		args, ok := u.evaluate(ctx, book)
+		if !ok {
+			continue
+		}
+		if err := u.Limiter.Wait(ctx, site); err != nil {
+			return
+		}
+		checked[site]++
+		result, err := u.Processor.Process(ctx, book, args...)
+		if err != nil {
+			u.logger().Errorf("error updating %s (%s): %v", book.Title, result.ErrorClass, err)
+		} else {
+			u.logger().Debugf("%s (%s)", result.Summary(), result.Duration)
+		}
+		u.recordResult(ctx, book, result, err)
+		if u.OnResult != nil {
+			u.OnResult(result)
+		}
+	}
+}
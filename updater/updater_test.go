@@ -0,0 +1,210 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mook/fanficupdates/model"
+	"github.com/mook/fanficupdates/rules"
+	"github.com/mook/fanficupdates/state"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type processCall struct {
+	book model.CalibreBook
+	args []string
+}
+
+type fakeProcessor struct {
+	calls  []processCall
+	result error
+	class  model.ErrorClass // The class of failure, if result is set
+	newURL string           // Reported as the new story URL, if set
+}
+
+func (p *fakeProcessor) Process(ctx context.Context, book model.CalibreBook, extraArgs ...string) (model.UpdateResult, error) {
+	p.calls = append(p.calls, processCall{book: book, args: extraArgs})
+	result := model.UpdateResult{Title: book.Title, Outcome: model.OutcomeUpdated, NewURL: p.newURL}
+	if p.result != nil {
+		result.Outcome = model.OutcomeFailed
+		result.ErrorClass = p.class
+	}
+	return result, p.result
+}
+
+func TestUpdateBook(t *testing.T) {
+	ruleSet, err := rules.ParseRules(rules.DefaultRules)
+	require.NoError(t, err)
+	store, err := state.Open("")
+	require.NoError(t, err)
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, store.Update("recent", func(book *state.Book) {
+		book.LastChecked = model.NewTime3339(now.Add(-24 * time.Hour))
+	}))
+	require.NoError(t, store.Update("old", func(book *state.Book) {
+		book.LastChecked = model.NewTime3339(now.Add(-60 * 24 * time.Hour))
+	}))
+
+	cases := []struct {
+		name    string
+		book    model.CalibreBook
+		process bool
+		args    []string
+	}{
+		{"plain", model.CalibreBook{Uuid: "recent"}, true, nil},
+		{"noupdate", model.CalibreBook{Uuid: "old", Tags: []string{"noupdate"}}, false, nil},
+		{"complete, recently checked", model.CalibreBook{Uuid: "recent", Tags: []string{"complete"}}, false, nil},
+		{"complete, checked long ago", model.CalibreBook{Uuid: "old", Tags: []string{"complete"}}, true, nil},
+		{"complete, never checked", model.CalibreBook{Uuid: "new", Tags: []string{"complete"}}, true, nil},
+		{
+			"overwrite",
+			model.CalibreBook{
+				Uuid: "recent",
+				CustomColumns: map[string]model.CustomValue{
+					"update_overwrite": {Type: model.CustomText, Value: "yes"},
+				},
+			},
+			true,
+			[]string{"--force"},
+		},
+	}
+	for _, testCase := range cases {
+		t.Run(testCase.name, func(t *testing.T) {
+			processor := &fakeProcessor{}
+			u := &Updater{Processor: processor, Rules: ruleSet, Store: store, now: func() time.Time { return now }}
+			result, err := u.UpdateBook(context.Background(), testCase.book)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.process, result.Updated())
+			if !testCase.process {
+				assert.Equal(t, model.OutcomeSkipped, result.Outcome)
+			}
+			if testCase.process {
+				if assert.Len(t, processor.calls, 1) {
+					assert.Equal(t, testCase.args, processor.calls[0].args)
+				}
+			} else {
+				assert.Empty(t, processor.calls)
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	processor := &fakeProcessor{result: fmt.Errorf("some error")}
+	var results []model.UpdateResult
+	u := &Updater{Processor: processor, Logger: logger}
+	u.OnResult = func(result model.UpdateResult) { results = append(results, result) }
+	books := []model.CalibreBook{{Title: "one"}, {Title: "two"}}
+	u.Update(context.Background(), books)
+	assert.Len(t, processor.calls, 2)
+	assert.Len(t, hook.AllEntries(), 2)
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, model.OutcomeFailed, results[1].Outcome)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	processor.calls = nil
+	u.Update(ctx, books)
+	assert.Empty(t, processor.calls)
+}
+
+func TestSiteLimits(t *testing.T) {
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	var sleeps []time.Duration
+	limiter := NewSiteLimiter(map[string]SiteLimit{
+		"ArchiveOfOurOwn.org": {Delay: time.Minute, MaxPerRun: 2},
+	})
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+	book := func(title, link string) model.CalibreBook {
+		return model.CalibreBook{Title: title, Identifiers: map[string]string{"url": link}}
+	}
+	books := []model.CalibreBook{
+		book("one", "https://archiveofourown.org/works/1"),
+		book("two", "https://www.fanfiction.net/s/2"),
+		book("three", "https://www.archiveofourown.org/works/3"),
+		book("four", "https://archiveofourown.org/works/4"),
+	}
+
+	processor := &fakeProcessor{}
+	u := &Updater{Processor: processor, Limiter: limiter}
+	u.Update(context.Background(), books)
+	titles := make([]string, 0, len(processor.calls))
+	for _, call := range processor.calls {
+		titles = append(titles, call.book.Title)
+	}
+	assert.Equal(t, []string{"one", "two", "three"}, titles)
+	assert.Equal(t, []time.Duration{time.Minute}, sleeps)
+
+	// A second updater sharing the limiter must wait for the first.
+	sleeps = nil
+	other := &Updater{Processor: &fakeProcessor{}, Limiter: limiter}
+	other.Update(context.Background(), books[:1])
+	assert.Equal(t, []time.Duration{2 * time.Minute}, sleeps)
+
+	mobile, _ := limiter.Site(book("mobile", "https://m.fanfiction.net/s/2/3/Title"))
+	desktop, _ := limiter.Site(book("desktop", "https://www.fanfiction.net/s/2"))
+	assert.Equal(t, desktop, mobile, "mirrors of a site should share limits")
+}
+
+func TestMigrateState(t *testing.T) {
+	store, err := state.Open("")
+	require.NoError(t, err)
+	checked := model.NewTime3339(time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, store.Update("uuid", func(book *state.Book) {
+		book.LastChecked = checked
+	}))
+	u := &Updater{
+		Processor: &fakeProcessor{},
+		Store:     store,
+		StateKey:  func(book model.CalibreBook) string { return "story:" + book.Title },
+	}
+	book := model.CalibreBook{Uuid: "uuid", Title: "one"}
+	_, err = u.UpdateBook(context.Background(), book)
+	require.NoError(t, err)
+	assert.Equal(t, checked, store.Get("story:one").LastChecked)
+	assert.Nil(t, store.Get("uuid").LastChecked)
+}
+
+func TestFollowURL(t *testing.T) {
+	store, err := state.Open("")
+	require.NoError(t, err)
+	checked := model.NewTime3339(time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, store.Update("http://story.test/old", func(book *state.Book) {
+		book.LastChecked = checked
+		book.Failures = 2
+	}))
+	u := &Updater{
+		Processor: &fakeProcessor{newURL: "http://story.test/new"},
+		Store:     store,
+		StateKey:  func(book model.CalibreBook) string { return book.Identifiers["url"] },
+		now:       func() time.Time { return checked.Add(time.Hour) },
+	}
+	book := model.CalibreBook{Title: "one", Identifiers: map[string]string{"url": "http://story.test/old", "isbn": "1"}}
+	_, err = u.UpdateBook(context.Background(), book)
+	require.NoError(t, err)
+	moved := store.Get("http://story.test/new")
+	assert.Equal(t, checked, moved.LastChecked, "state should follow the new URL")
+	assert.Zero(t, moved.Failures, "the successful check should clear the failures")
+	assert.Equal(t, state.Book{}, store.Get("http://story.test/old"))
+	assert.Equal(t, "http://story.test/old", book.Identifiers["url"], "the book should not be modified")
+}
+
+func TestNilSiteLimiter(t *testing.T) {
+	processor := &fakeProcessor{}
+	u := &Updater{Processor: processor}
+	u.Update(context.Background(), []model.CalibreBook{
+		{Title: "one", Identifiers: map[string]string{"url": "https://archiveofourown.org/works/1"}},
+		{Title: "two", Identifiers: map[string]string{"url": "https://archiveofourown.org/works/2"}},
+	})
+	assert.Len(t, processor.calls, 2)
+}